@@ -0,0 +1,253 @@
+// Package dn parses and checks X.509 distinguished names written in the
+// RFC 4514 string form, e.g. "CN=Issuing CA 1,OU=PKI,O=Example,C=VN".
+package dn
+
+import (
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+var (
+	oidCommonName         = asn1.ObjectIdentifier{2, 5, 4, 3}
+	oidSerialNumber       = asn1.ObjectIdentifier{2, 5, 4, 5}
+	oidCountry            = asn1.ObjectIdentifier{2, 5, 4, 6}
+	oidLocality           = asn1.ObjectIdentifier{2, 5, 4, 7}
+	oidProvince           = asn1.ObjectIdentifier{2, 5, 4, 8}
+	oidStreetAddress      = asn1.ObjectIdentifier{2, 5, 4, 9}
+	oidOrganization       = asn1.ObjectIdentifier{2, 5, 4, 10}
+	oidOrganizationalUnit = asn1.ObjectIdentifier{2, 5, 4, 11}
+	oidPostalCode         = asn1.ObjectIdentifier{2, 5, 4, 17}
+)
+
+// attributeTypes maps the attribute type names Parse accepts to their OIDs.
+var attributeTypes = map[string]asn1.ObjectIdentifier{
+	"CN":           oidCommonName,
+	"SERIALNUMBER": oidSerialNumber,
+	"C":            oidCountry,
+	"L":            oidLocality,
+	"ST":           oidProvince,
+	"STREET":       oidStreetAddress,
+	"O":            oidOrganization,
+	"OU":           oidOrganizationalUnit,
+	"POSTALCODE":   oidPostalCode,
+}
+
+// upperBounds are the maximum value lengths of RFC 5280, appendix A.1.
+var upperBounds = []struct {
+	oid  asn1.ObjectIdentifier
+	name string
+	max  int
+}{
+	{oidCommonName, "CN", 64},
+	{oidSerialNumber, "SERIALNUMBER", 64},
+	{oidLocality, "L", 128},
+	{oidProvince, "ST", 128},
+	{oidOrganization, "O", 64},
+	{oidOrganizationalUnit, "OU", 64},
+	{oidPostalCode, "POSTALCODE", 40},
+}
+
+// Parse parses a distinguished name. Attribute types are CN, SERIALNUMBER,
+// C, L, ST, STREET, O, OU and POSTALCODE in any case, or dotted OIDs. The
+// attributes keep the order of s, which RFC 4514 writes most specific
+// first, and the name is checked with Validate. Multi-valued RDNs and
+// hex-encoded values are not supported.
+func Parse(s string) (pkix.Name, error) {
+	if strings.TrimSpace(s) == "" {
+		return pkix.Name{}, errors.New("empty distinguished name")
+	}
+	attributes, err := split(s)
+	if err != nil {
+		return pkix.Name{}, err
+	}
+
+	var rdns pkix.RDNSequence
+	for i := len(attributes) - 1; i >= 0; i-- {
+		rdns = append(rdns, pkix.RelativeDistinguishedNameSET{attributes[i]})
+	}
+	var name pkix.Name
+	name.FillFromRDNSequence(&rdns)
+	// ExtraNames takes precedence over the fields when the name is
+	// marshaled, which keeps the order given.
+	name.ExtraNames = make([]pkix.AttributeTypeAndValue, 0, len(attributes))
+	for i := len(attributes) - 1; i >= 0; i-- {
+		name.ExtraNames = append(name.ExtraNames, attributes[i])
+	}
+	if err := Validate(name); err != nil {
+		return pkix.Name{}, err
+	}
+	return name, nil
+}
+
+// split returns the attributes of s in the order they are written.
+func split(s string) ([]pkix.AttributeTypeAndValue, error) {
+	var (
+		attributes []pkix.AttributeTypeAndValue
+		typ        string
+		value      []byte
+		inValue    bool
+		// trailing is the length of value up to its last escaped or
+		// non-space byte, so that unescaped trailing spaces are dropped.
+		trailing int
+	)
+	flush := func() error {
+		if !inValue {
+			return fmt.Errorf("missing '=' in %q", strings.TrimSpace(typ))
+		}
+		oid, err := attributeType(typ)
+		if err != nil {
+			return err
+		}
+		value = value[:trailing]
+		if !utf8.Valid(value) {
+			return fmt.Errorf("value of %s is not valid UTF-8", strings.TrimSpace(typ))
+		}
+		attributes = append(attributes, pkix.AttributeTypeAndValue{Type: oid, Value: string(value)})
+		typ, value, inValue, trailing = "", nil, false, 0
+		return nil
+	}
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case !inValue && c == '=':
+			inValue = true
+		case !inValue && c == ',':
+			// An empty RDN as in "CN=a,,O=b", or a type without a value
+			return nil, flush()
+		case !inValue:
+			typ += string(c)
+		case c == '\\':
+			if i+1 >= len(s) {
+				return nil, errors.New("distinguished name ends with an escape character")
+			}
+			if i+2 < len(s) && isHex(s[i+1]) && isHex(s[i+2]) {
+				b, _ := hex.DecodeString(s[i+1 : i+3])
+				value = append(value, b[0])
+				i += 2
+			} else if strings.IndexByte(`,+"\<>;= #`, s[i+1]) >= 0 {
+				value = append(value, s[i+1])
+				i++
+			} else {
+				return nil, fmt.Errorf("invalid escape sequence \\%c", s[i+1])
+			}
+			trailing = len(value)
+		case c == ',':
+			if err := flush(); err != nil {
+				return nil, err
+			}
+		case c == '+':
+			return nil, errors.New("multi-valued RDNs are not supported")
+		case c == ' ' && len(value) == 0:
+			// Leading spaces, as in "CN=a, O=b"
+		case c == '#' && len(value) == 0:
+			return nil, errors.New("hex-encoded attribute values are not supported")
+		default:
+			value = append(value, c)
+			if c != ' ' {
+				trailing = len(value)
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	return attributes, nil
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+// attributeType returns the OID of an attribute type name or dotted OID.
+func attributeType(typ string) (asn1.ObjectIdentifier, error) {
+	typ = strings.TrimSpace(typ)
+	if oid, ok := attributeTypes[strings.ToUpper(typ)]; ok {
+		return oid, nil
+	}
+	var oid asn1.ObjectIdentifier
+	for _, part := range strings.Split(typ, ".") {
+		var arc int
+		if _, err := fmt.Sscanf(part, "%d", &arc); err != nil || fmt.Sprint(arc) != part || arc < 0 {
+			return nil, fmt.Errorf("unsupported attribute type %q", typ)
+		}
+		oid = append(oid, arc)
+	}
+	if len(oid) < 2 {
+		return nil, fmt.Errorf("unsupported attribute type %q", typ)
+	}
+	return oid, nil
+}
+
+// Validate checks that a name has at most one CN, at most one C made of two
+// upper-case letters, no empty values and no value longer than RFC 5280
+// allows.
+func Validate(name pkix.Name) error {
+	counts := map[string]int{}
+	for _, rdn := range name.ToRDNSequence() {
+		for _, atv := range rdn {
+			value, ok := atv.Value.(string)
+			if !ok {
+				return fmt.Errorf("attribute %s is not a string", atv.Type)
+			}
+			if strings.TrimSpace(value) == "" {
+				return fmt.Errorf("attribute %s is empty", typeName(atv.Type))
+			}
+			for _, bound := range upperBounds {
+				if atv.Type.Equal(bound.oid) && utf8.RuneCountInString(value) > bound.max {
+					return fmt.Errorf("%s is longer than %d characters", bound.name, bound.max)
+				}
+			}
+			if atv.Type.Equal(oidCountry) && !isCountryCode(value) {
+				return fmt.Errorf("C must be a two-letter ISO 3166 country code, got %q", value)
+			}
+			counts[atv.Type.String()]++
+		}
+	}
+	if counts[oidCommonName.String()] > 1 {
+		return errors.New("at most one CN is allowed")
+	}
+	if counts[oidCountry.String()] > 1 {
+		return errors.New("at most one C is allowed")
+	}
+	return nil
+}
+
+func isCountryCode(s string) bool {
+	return len(s) == 2 && 'A' <= s[0] && s[0] <= 'Z' && 'A' <= s[1] && s[1] <= 'Z'
+}
+
+// typeName returns the short name of an attribute type, or its dotted OID.
+func typeName(oid asn1.ObjectIdentifier) string {
+	for name, known := range attributeTypes {
+		if known.Equal(oid) {
+			return name
+		}
+	}
+	return oid.String()
+}
+
+// WithCommonName returns name with its CN set to commonName, added as the
+// most specific attribute when name has none.
+func WithCommonName(name pkix.Name, commonName string) pkix.Name {
+	name.CommonName = commonName
+	extraNames := make([]pkix.AttributeTypeAndValue, 0, len(name.ExtraNames)+1)
+	found := false
+	for _, atv := range name.ExtraNames {
+		if atv.Type.Equal(oidCommonName) {
+			atv.Value = commonName
+			found = true
+		}
+		extraNames = append(extraNames, atv)
+	}
+	if !found && len(extraNames) > 0 {
+		extraNames = append(extraNames, pkix.AttributeTypeAndValue{Type: oidCommonName, Value: commonName})
+	}
+	name.ExtraNames = extraNames
+	return name
+}
@@ -0,0 +1,179 @@
+package dn
+
+import (
+	"bytes"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want []pkix.AttributeTypeAndValue // most specific first, as written
+	}{
+		{"CN=Issuing CA 1,OU=PKI,O=Example,C=VN", []pkix.AttributeTypeAndValue{
+			{Type: oidCommonName, Value: "Issuing CA 1"},
+			{Type: oidOrganizationalUnit, Value: "PKI"},
+			{Type: oidOrganization, Value: "Example"},
+			{Type: oidCountry, Value: "VN"},
+		}},
+		{`CN=Example\, Inc.`, []pkix.AttributeTypeAndValue{{Type: oidCommonName, Value: "Example, Inc."}}},
+		{`CN=Example\2C Inc.`, []pkix.AttributeTypeAndValue{{Type: oidCommonName, Value: "Example, Inc."}}},
+		{`CN=\"quoted\" \+ \; \<\> \= \\`, []pkix.AttributeTypeAndValue{{Type: oidCommonName, Value: `"quoted" + ; <> = \`}}},
+		{`CN=Vi\E1\BB\87t Nam`, []pkix.AttributeTypeAndValue{{Type: oidCommonName, Value: "Việt Nam"}}},
+		{"CN=a#b", []pkix.AttributeTypeAndValue{{Type: oidCommonName, Value: "a#b"}}},
+		// Spaces around types and values are dropped unless escaped
+		{"  CN =  Root CA  ,  O=Example  ", []pkix.AttributeTypeAndValue{
+			{Type: oidCommonName, Value: "Root CA"},
+			{Type: oidOrganization, Value: "Example"},
+		}},
+		{`CN=\ Root CA\ `, []pkix.AttributeTypeAndValue{{Type: oidCommonName, Value: " Root CA "}}},
+		{`CN=Root CA\20`, []pkix.AttributeTypeAndValue{{Type: oidCommonName, Value: "Root CA "}}},
+		{"cn=root,ou=pki,serialNumber=42,postalCode=100000", []pkix.AttributeTypeAndValue{
+			{Type: oidCommonName, Value: "root"},
+			{Type: oidOrganizationalUnit, Value: "pki"},
+			{Type: oidSerialNumber, Value: "42"},
+			{Type: oidPostalCode, Value: "100000"},
+		}},
+		{"2.5.4.3=Root,1.2.3.4=custom", []pkix.AttributeTypeAndValue{
+			{Type: oidCommonName, Value: "Root"},
+			{Type: asn1.ObjectIdentifier{1, 2, 3, 4}, Value: "custom"},
+		}},
+	} {
+		name, err := Parse(tc.in)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", tc.in, err)
+			continue
+		}
+		got := name.ExtraNames
+		if len(got) != len(tc.want) {
+			t.Errorf("Parse(%q) = %v, want %v", tc.in, got, tc.want)
+			continue
+		}
+		for i := range tc.want {
+			// ExtraNames runs from the least specific attribute.
+			atv := got[len(got)-1-i]
+			if !atv.Type.Equal(tc.want[i].Type) || atv.Value != tc.want[i].Value {
+				t.Errorf("Parse(%q) attribute %d = %s=%q, want %s=%q", tc.in, i, atv.Type, atv.Value, tc.want[i].Type, tc.want[i].Value)
+			}
+		}
+	}
+}
+
+func TestParseRejects(t *testing.T) {
+	for _, tc := range []struct{ in, err string }{
+		{"", "empty"},
+		{"   ", "empty"},
+		{"CN=a,,O=b", "missing '='"},
+		{"CN=a,", "missing '='"},
+		{",CN=a", "missing '='"},
+		{"CN", "missing '='"},
+		{"CN=a+O=b", "multi-valued"},
+		{"CN=#0403616263", "hex-encoded"},
+		{"CN= #0403616263", "hex-encoded"},
+		{`CN=a\`, "escape character"},
+		{`CN=a\x`, "invalid escape"},
+		{`CN=\FF`, "not valid UTF-8"},
+		{"XX=a", "unsupported attribute type"},
+		{"1=a", "unsupported attribute type"},
+		{"1.-2=a", "unsupported attribute type"},
+		{"1.02=a", "unsupported attribute type"},
+		{"CN=", "empty"},
+		{"CN=   ", "empty"},
+		{"CN=a,CN=b", "one CN"},
+		{"CN=a,2.5.4.3=b", "one CN"},
+		{"CN=a,C=VN,C=US", "one C"},
+		{"CN=a,C=vn", "country code"},
+		{"CN=a,C=VNM", "country code"},
+		{"CN=a,C=V", "country code"},
+		{"CN=a,C=1A", "country code"},
+	} {
+		_, err := Parse(tc.in)
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("Parse(%q): %v, want an error containing %q", tc.in, err, tc.err)
+		}
+	}
+}
+
+func TestParseUpperBounds(t *testing.T) {
+	for _, bound := range upperBounds {
+		for _, r := range []string{"a", "ệ"} {
+			value := strings.Repeat(r, bound.max)
+			if _, err := Parse("CN=x," + bound.name + "=" + value); bound.name != "CN" && err != nil {
+				t.Errorf("%s of %d characters: %v", bound.name, bound.max, err)
+			}
+			if _, err := Parse(bound.name + "=" + value); err != nil {
+				t.Errorf("%s of %d characters: %v", bound.name, bound.max, err)
+			}
+			_, err := Parse(bound.name + "=" + value + r)
+			if err == nil || !strings.Contains(err.Error(), "longer than") {
+				t.Errorf("%s of %d characters: %v, want it refused", bound.name, bound.max+1, err)
+			}
+		}
+	}
+}
+
+func TestParseKeepsOrder(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want pkix.RDNSequence // as encoded, least specific first
+	}{
+		{"CN=Issuing CA 1,OU=PKI,O=Example,C=VN", pkix.RDNSequence{
+			{{Type: oidCountry, Value: "VN"}},
+			{{Type: oidOrganization, Value: "Example"}},
+			{{Type: oidOrganizationalUnit, Value: "PKI"}},
+			{{Type: oidCommonName, Value: "Issuing CA 1"}},
+		}},
+		// Not the order crypto/x509 would pick for these fields
+		{"C=VN,O=Example,OU=PKI,CN=Issuing CA 1", pkix.RDNSequence{
+			{{Type: oidCommonName, Value: "Issuing CA 1"}},
+			{{Type: oidOrganizationalUnit, Value: "PKI"}},
+			{{Type: oidOrganization, Value: "Example"}},
+			{{Type: oidCountry, Value: "VN"}},
+		}},
+		{"OU=Second,OU=First,O=Example", pkix.RDNSequence{
+			{{Type: oidOrganization, Value: "Example"}},
+			{{Type: oidOrganizationalUnit, Value: "First"}},
+			{{Type: oidOrganizationalUnit, Value: "Second"}},
+		}},
+	} {
+		name, err := Parse(tc.in)
+		if err != nil {
+			t.Fatalf("Parse(%q): %v", tc.in, err)
+		}
+		got, err := asn1.Marshal(name.ToRDNSequence())
+		if err != nil {
+			t.Fatalf("marshal %q: %v", tc.in, err)
+		}
+		want, err := asn1.Marshal(tc.want)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("Parse(%q) encodes as %s", tc.in, name.ToRDNSequence())
+		}
+		if name.String() != tc.in {
+			t.Errorf("Parse(%q).String() = %q", tc.in, name.String())
+		}
+	}
+}
+
+func TestWithCommonName(t *testing.T) {
+	name, err := Parse("O=Example,C=VN")
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if got := WithCommonName(name, "Root CA").String(); got != "CN=Root CA,O=Example,C=VN" {
+		t.Errorf("added CN: %q", got)
+	}
+
+	name, err = Parse("C=VN,CN=Old,O=Example")
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if got := WithCommonName(name, "New").String(); got != "C=VN,CN=New,O=Example" {
+		t.Errorf("replaced CN: %q", got)
+	}
+}
@@ -6,10 +6,46 @@ type CA struct {
 	ID   int    `json:"id"`
 	Name string `json:"name"` // e.g., "RootCA"
 	Type CAType `json:"type"` // "ROOT" or "INTERMEDIATE"
-	// CryptoTokenID int       `json:"crypto_token_id"`
 	// CertID     int       `json:"cert_id"` // ID of the certificate in the database
 	ParentCAID *int      `json:"parent_ca_id,omitempty"`
 	CreateAt   time.Time `json:"created_at"`
-	Status     CAStatus  `json:"status"`   // "active" , "revoked", "expired", "unknown"
+	Status     CAStatus  `json:"status"`   // "active" , "pending", "hold", "revoked", "expired", "unknown"
 	CertPEM    string    `json:"cert_pem"` // PEM-encoded certificate
+	// SignatureAlgorithm used by this CA when signing, e.g. "SHA384WithRSA".
+	// Empty means the default for the CA key type.
+	SignatureAlgorithm string `json:"signature_algorithm,omitempty"`
+	// TokenID references the crypto_tokens row holding the CA key.
+	// Nil means the default token from keymanagement.softhsm.
+	TokenID   *int   `json:"token_id,omitempty"`
+	TokenName string `json:"token_name,omitempty"`
+	// KeyID references the crypto_keys row of the CA signing key.
+	KeyID *int `json:"key_id,omitempty"`
+	// SerialPrefix is the hex encoded prefix of the serial numbers of
+	// certificates issued by this CA, at most 3 bytes. Empty means none.
+	SerialPrefix string `json:"serial_prefix,omitempty"`
+	// CSRPEM is the certificate request of a CA created for an external
+	// issuer (see PendingCAStatus).
+	CSRPEM string `json:"csr_pem,omitempty"`
+	// ExternalChainPEM holds the certificates above a CA signed by an
+	// external issuer, up to its root; it is served after the CA's own chain.
+	ExternalChainPEM string `json:"external_chain_pem,omitempty"`
+	// Generation counts the renewals of the CA, starting at 1. CertPEM and
+	// KeyID are those of the current generation; see CAGeneration.
+	Generation int `json:"generation"`
+}
+
+// CAGeneration is a certificate of a CA with the key it certifies. Renewing
+// a CA starts a new generation, which issues from then on; earlier
+// generations keep signing CRLs and OCSP responses for the certificates
+// issued under them.
+type CAGeneration struct {
+	CAID       int    `json:"ca_id"`
+	Generation int    `json:"generation"`
+	CertPEM    string `json:"cert_pem"`
+	KeyID      *int   `json:"key_id,omitempty"`
+	// SignatureAlgorithm the generation signs with, see CA.SignatureAlgorithm
+	SignatureAlgorithm string    `json:"signature_algorithm,omitempty"`
+	NotBefore          time.Time `json:"not_before"`
+	NotAfter           time.Time `json:"not_after"`
+	Current            bool      `json:"current"`
 }
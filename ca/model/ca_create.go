@@ -0,0 +1,83 @@
+package model
+
+import keymodel "core-ca/keymanagement/model"
+
+// CACreate describes a CA whose key is generated on its token.
+type CACreate struct {
+	Name string
+	Type CAType
+	// ParentCAID is the issuing CA of a subordinate CA.
+	ParentCAID   *int
+	KeyAlgorithm keymodel.KeyAlgorithm
+	// SignatureAlgorithm defaults to the one of the key algorithm.
+	SignatureAlgorithm string
+	// TokenName is the registered token that will hold the key; empty for the default token.
+	TokenName string
+	// SerialPrefix is prepended to the serial numbers the CA issues, see CA.SerialPrefix.
+	SerialPrefix string
+	// Subject is the distinguished name of the CA in RFC 4514 form, e.g.
+	// "CN=Issuing CA 1,OU=PKI,O=Example,C=VN". Give either Subject or
+	// SubjectFields; without either the subject is ca.issuer from the
+	// configuration. The common name defaults to Name.
+	Subject       string
+	SubjectFields *SubjectName
+	// MaxPathLen limits the CAs below the new CA: nil for the default, no
+	// limit for a root and 0 for a subordinate; negative for no limit.
+	MaxPathLen *int
+	// NameConstraints restrict the names of certificates below the new CA.
+	NameConstraints *NameConstraints
+	// Policies are the certificate policy OIDs the CA asserts, in dotted form.
+	Policies []string
+}
+
+// NameConstraints are the permitted and excluded subtrees of a CA (RFC 5280,
+// section 4.2.1.10). DNS domains match the domain and its subdomains, or
+// only subdomains with a leading period. Email constraints are a mailbox, a
+// host, or a domain with a leading period; URI constraints a host or a
+// domain with a leading period. IP ranges are in CIDR form.
+type NameConstraints struct {
+	PermittedDNSDomains     []string `json:"permitted_dns_domains,omitempty"`
+	ExcludedDNSDomains      []string `json:"excluded_dns_domains,omitempty"`
+	PermittedIPRanges       []string `json:"permitted_ip_ranges,omitempty"`
+	ExcludedIPRanges        []string `json:"excluded_ip_ranges,omitempty"`
+	PermittedEmailAddresses []string `json:"permitted_email_addresses,omitempty"`
+	ExcludedEmailAddresses  []string `json:"excluded_email_addresses,omitempty"`
+	PermittedURIDomains     []string `json:"permitted_uri_domains,omitempty"`
+	ExcludedURIDomains      []string `json:"excluded_uri_domains,omitempty"`
+}
+
+// SubjectName is a CA subject given as separate attributes.
+type SubjectName struct {
+	CommonName         string   `json:"common_name,omitempty"`
+	Organization       []string `json:"organization,omitempty"`
+	OrganizationalUnit []string `json:"organizational_unit,omitempty"`
+	Country            string   `json:"country,omitempty"`
+	Province           string   `json:"province,omitempty"`
+	Locality           string   `json:"locality,omitempty"`
+	StreetAddress      string   `json:"street_address,omitempty"`
+	PostalCode         string   `json:"postal_code,omitempty"`
+	SerialNumber       string   `json:"serial_number,omitempty"`
+}
+
+// CARenew describes the renewal of a CA.
+type CARenew struct {
+	// ReKey generates a new key; otherwise the current key is certified again.
+	ReKey bool
+	// KeyAlgorithm of the new key; defaults to the algorithm of the current key.
+	KeyAlgorithm keymodel.KeyAlgorithm
+	// SignatureAlgorithm of the CA from the renewal on; defaults to the
+	// current one when it suits the key.
+	SignatureAlgorithm string
+}
+
+// CARenewal is what the renewal of a CA records, all at once.
+type CARenewal struct {
+	// CA with the certificate, key, signature algorithm and generation it is renewed to.
+	CA CA
+	// Certificate records the renewed certificate of a subordinate CA as
+	// issued by its parent; nil for a root.
+	Certificate *Certificate
+	// PreviousKeyID is the key a re-key supersedes, which loses certSign
+	// while the new key is linked to the CA; nil when the key is kept.
+	PreviousKeyID *int
+}
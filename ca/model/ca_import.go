@@ -0,0 +1,19 @@
+package model
+
+// CAImport is an existing CA key and certificate to adopt, given either as a
+// PKCS#12 file or as a PEM key and certificate.
+type CAImport struct {
+	// Name defaults to the common name of the certificate.
+	Name   string
+	PKCS12 []byte
+	KeyPEM string
+	// CertPEM holds the CA certificate, optionally followed by its chain.
+	CertPEM string
+	// Password of the PKCS#12 file or of an encrypted PKCS#8 key.
+	Password           string
+	SignatureAlgorithm string
+	// TokenName is the registered token that will hold the key; empty for the default token.
+	TokenName string
+	// SerialPrefix is prepended to the serial numbers the CA issues, see CA.SerialPrefix.
+	SerialPrefix string
+}
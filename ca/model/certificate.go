@@ -28,4 +28,6 @@ type Certificate struct {
 	NotAfter  time.Time         `json:"not_after"`
 	CertPEM   string            `json:"cert_pem"` // PEM-encoded cert
 	Status    CertificateStatus `json:"status"`   // active, expired, revoked
+	// CAGeneration is the generation of the CA that signed the certificate
+	CAGeneration int `json:"ca_generation"`
 }
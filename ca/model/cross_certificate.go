@@ -0,0 +1,33 @@
+package model
+
+import "time"
+
+// CrossCertificate is a certificate in which one CA certifies the subject and
+// current key of another CA, so that certificates below the subject also
+// chain to the root of the issuer.
+type CrossCertificate struct {
+	ID           int       `json:"id"`
+	IssuerCAID   int       `json:"issuer_ca_id"`
+	SubjectCAID  int       `json:"subject_ca_id"`
+	SerialNumber string    `json:"serial_number"`
+	CertPEM      string    `json:"cert_pem"`
+	NotBefore    time.Time `json:"not_before"`
+	NotAfter     time.Time `json:"not_after"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// CrossCertify describes a cross-certificate to issue.
+type CrossCertify struct {
+	IssuerCAID  int
+	SubjectCAID int
+	// ValidityDays defaults to the validity left on the subject's certificate.
+	// The certificate never outlives those of the issuer's chain.
+	ValidityDays int
+	// MaxPathLen limits the CAs below the subject on paths through the
+	// cross-certificate: nil for as many as the issuer allows, negative for
+	// no limit.
+	MaxPathLen *int
+	// NameConstraints and Policies as for CACreate
+	NameConstraints *NameConstraints
+	Policies        []string
+}
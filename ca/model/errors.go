@@ -0,0 +1,79 @@
+package model
+
+import "errors"
+
+// ErrKeyUsageNotAllowed is returned when a CA key is asked to sign something
+// its key_usages do not permit.
+var ErrKeyUsageNotAllowed = errors.New("key usage not allowed")
+
+// ErrKeyInUse is returned when destroying a key that an active CA still signs with.
+var ErrKeyInUse = errors.New("key is in use")
+
+// ErrInvalidCAImport is returned when a CA key and certificate cannot be imported as given.
+var ErrInvalidCAImport = errors.New("invalid CA import")
+
+// ErrCAExists is returned when importing a CA certificate that is already recorded.
+var ErrCAExists = errors.New("CA already exists")
+
+// ErrInvalidSerialPrefix is returned for a CA serial number prefix that is
+// not 1 to 3 bytes of hex with a non-zero first byte.
+var ErrInvalidSerialPrefix = errors.New("invalid serial number prefix")
+
+// ErrInvalidSubject is returned for a CA subject distinguished name that
+// cannot be parsed or is not a valid X.509 name.
+var ErrInvalidSubject = errors.New("invalid subject")
+
+// ErrInvalidCAConstraints is returned for a path length, name constraint or
+// certificate policy that is malformed or exceeds what the issuing CAs allow.
+var ErrInvalidCAConstraints = errors.New("invalid CA constraints")
+
+// ErrNameNotPermitted is returned for a certificate request whose names the
+// name constraints of the issuing CA or one of its parents do not permit.
+var ErrNameNotPermitted = errors.New("name not permitted")
+
+// ErrInvalidCSR is returned for a certificate request asking for an
+// extension the issuing CA controls, such as basic constraints.
+var ErrInvalidCSR = errors.New("invalid certificate request")
+
+// ErrInvalidCACertificate is returned for an externally signed certificate
+// that does not match a pending CA or does not chain to a trusted root.
+var ErrInvalidCACertificate = errors.New("invalid CA certificate")
+
+// ErrCANotPending is returned when activating a CA that is not waiting for
+// its certificate.
+var ErrCANotPending = errors.New("CA is not pending")
+
+// ErrInvalidCARenewal is returned for a CA renewal that cannot be carried out as requested.
+var ErrInvalidCARenewal = errors.New("invalid CA renewal")
+
+// ErrCAGenerationNotFound is returned for a generation a CA does not have.
+var ErrCAGenerationNotFound = errors.New("CA generation not found")
+
+// ErrInvalidCrossCertification is returned for a cross-certificate that
+// cannot be issued as requested.
+var ErrInvalidCrossCertification = errors.New("invalid cross-certification")
+
+// ErrAlreadyRevoked is returned when revoking a certificate that is already
+// revoked for good. A certificate on hold can still be revoked.
+var ErrAlreadyRevoked = errors.New("certificate already revoked")
+
+// ErrNotOnHold is returned when releasing a certificate or CA that is not on hold.
+var ErrNotOnHold = errors.New("not on hold")
+
+// ErrInvalidRevocation is returned for a revocation that cannot be carried out as requested.
+var ErrInvalidRevocation = errors.New("invalid revocation")
+
+// ErrCAExpired is returned when a CA whose certificate, or that of one of its
+// parents, has expired is asked to issue a certificate.
+var ErrCAExpired = errors.New("CA certificate expired")
+
+// ErrCAValidityExceeded is returned when a certificate would remain valid
+// after the certificate of its issuing CA, or of one of its parents, expires.
+var ErrCAValidityExceeded = errors.New("certificate would outlive its issuing CA")
+
+// ErrInvalidCAStatus is returned for a CA status that cannot be set directly.
+var ErrInvalidCAStatus = errors.New("invalid CA status")
+
+// ErrCAStatusChanged is returned when a CA no longer has the status a
+// transition starts from.
+var ErrCAStatusChanged = errors.New("CA status changed")
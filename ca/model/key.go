@@ -1,11 +1,18 @@
 package model
 
+import "time"
+
 type CryptoKey struct {
 	ID    int    `json:"id"`
-	Label string `json:"label"` // e.g., "rootKey"
+	Label string `json:"label"` // HSM label (CKA_LABEL/CKA_ID), e.g. "RootCA-3f2a9c1b7d4e6a08"
 	// Usage     []KeyUsage `json:"usage"` // "sign" or "encrypt"
-	TokenID   int    `json:"token_id"`
-	CaID      int    `json:"ca_id,omitempty"`
-	PublicKey string `json:"public_key"` // PEM-encoded
-	Status    string `json:"status"`     // "active" or "revoked"
+	// TokenID is nil for keys on the configured (default) token.
+	TokenID     *int            `json:"token_id,omitempty"`
+	TokenName   string          `json:"token_name,omitempty"`
+	CaID        *int            `json:"ca_id,omitempty"`
+	PublicKey   string          `json:"public_key"`  // PEM-encoded PKIX
+	Fingerprint string          `json:"fingerprint"` // hex SHA-256 of the SubjectPublicKeyInfo
+	Algorithm   string          `json:"algorithm"`   // e.g. "EC-P384"
+	Status      CryptoKeyStatus `json:"status"`      // "active" or "revoked"
+	CreatedAt   time.Time       `json:"created_at"`
 }
@@ -1,6 +1,21 @@
 package model
 
+import "fmt"
+
 type KeyUsageData struct {
 	KeyID int      `json:"key_id"`
 	Usage KeyUsage `json:"usage"` // "sign" or "encrypt"
 }
+
+// CAKeyUsages are granted to a CA key when it is created.
+var CAKeyUsages = []KeyUsage{KeyUsageCertSign, KeyUsageCRLSign, KeyUsageOCSPSign}
+
+// ParseKeyUsage validates a key usage name.
+func ParseKeyUsage(s string) (KeyUsage, error) {
+	usage := KeyUsage(s)
+	switch usage {
+	case KeyUsageCertSign, KeyUsageCRLSign, KeyUsageOCSPSign, KeyUsageEncrypt, KeyUsageSign:
+		return usage, nil
+	}
+	return "", fmt.Errorf("unsupported key usage: %s", s)
+}
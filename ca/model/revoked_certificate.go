@@ -7,4 +7,31 @@ type RevokedCertificate struct {
 	RevocationDate time.Time        `json:"revocation_date"`
 	Reason         RevocationReason `json:"reason,omitempty"`
 	IsCA           bool             `json:"is_ca"`
+	CAGeneration   int              `json:"ca_generation"`
+}
+
+// CARevocation describes how a CA is revoked.
+type CARevocation struct {
+	Reason RevocationReason
+	// Cascade also revokes every active CA below the CA, with caCompromise.
+	Cascade bool
+	// RevokeLeaves also revokes the end-entity certificates issued by the
+	// revoked CAs, with caCompromise.
+	RevokeLeaves bool
+}
+
+// CARevocationResult lists what a CA revocation revoked.
+type CARevocationResult struct {
+	RevokedCAs []int `json:"revoked_cas"`
+	// RevokedCertificates are the serial numbers revoked, CA certificates included.
+	RevokedCertificates []string `json:"revoked_certificates"`
+}
+
+// ReleasedCertificate is a certificate taken off hold, listed as
+// removeFromCRL in delta CRLs.
+type ReleasedCertificate struct {
+	SerialNumber string    `json:"serial_number"`
+	HoldDate     time.Time `json:"hold_date"`
+	ReleasedAt   time.Time `json:"released_at"`
+	CAGeneration int       `json:"ca_generation"`
 }
@@ -0,0 +1,27 @@
+package model
+
+import "time"
+
+// Entity types of status transitions.
+const (
+	TransitionEntityCA          = "ca"
+	TransitionEntityCertificate = "certificate"
+)
+
+// StatusTransition records a status change of a CA or a certificate.
+type StatusTransition struct {
+	ID         int    `json:"id"`
+	EntityType string `json:"entity_type"` // "ca" or "certificate"
+	// EntityID is the CA ID or the certificate serial number
+	EntityID   string    `json:"entity_id"`
+	FromStatus string    `json:"from_status"`
+	ToStatus   string    `json:"to_status"`
+	Reason     string    `json:"reason"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// ExpiryResult lists what an expiry check marked expired.
+type ExpiryResult struct {
+	ExpiredCAs          []int    `json:"expired_cas"`
+	ExpiredCertificates []string `json:"expired_certificates"`
+}
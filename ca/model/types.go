@@ -32,6 +32,8 @@ type CAStatus string
 
 const (
 	ActiveCAStatus  CAStatus = "active"
+	PendingCAStatus CAStatus = "pending" // key generated, waiting for a certificate from an external issuer
+	HoldCAStatus    CAStatus = "hold"    // certificates on hold, may be released
 	RevokedCaStatus CAStatus = "revoked"
 	ExpiredCaStatus CAStatus = "expired"
 	UnknownCaStatus CAStatus = "unknown"
@@ -44,6 +46,8 @@ const (
 	RevokedCryptoKeyStatus CryptoKeyStatus = "revoked"
 	ExpiredCryptoKeyStatus CryptoKeyStatus = "expired"
 	UnknownCryptoKeyStatus CryptoKeyStatus = "unknown"
+	// DestroyedCryptoKeyStatus marks keys removed from their token.
+	DestroyedCryptoKeyStatus CryptoKeyStatus = "destroyed"
 )
 
 type KeyUsage string
@@ -5,15 +5,36 @@ import (
 	"core-ca/ca/model"
 	"database/sql"
 	"fmt"
+	"strconv"
 )
 
 type CARepository interface {
 	SaveCA(ctx context.Context, ca model.CA) (int, error)
+	// FindCAByID returns an active CA, one that may issue certificates.
 	FindCAByID(ctx context.Context, id int) (model.CA, error)
+	// FindCAByIDAnyStatus returns a CA of any status but deleted, for
+	// publishing the revocation status of what it issued.
+	FindCAByIDAnyStatus(ctx context.Context, id int) (model.CA, error)
 	FindCABySerialNumber(ctx context.Context, serialNumber string) (model.CA, error)
 	GetCAChain(ctx context.Context, caID int) ([]model.CA, error)
 	GetAllCAs(ctx context.Context) ([]model.CA, error)
-	UpdateCAStatus(ctx context.Context, caID int, status string) error
+	// FindPendingCAByID returns a CA waiting for its certificate.
+	FindPendingCAByID(ctx context.Context, id int) (model.CA, error)
+	// FindHeldCAByID returns a CA whose certificates are on hold.
+	FindHeldCAByID(ctx context.Context, id int) (model.CA, error)
+	// ActivateCA records the certificate of a pending CA, makes it active and
+	// records the transition.
+	ActivateCA(ctx context.Context, ca model.CA) error
+	// RenewCA makes the certificate, key and generation of an active or
+	// expired CA current and keeps the generation they supersede in
+	// ca_generations. An expired CA becomes active again and the transition
+	// is recorded. The certificate recorded under the parent and a re-key are
+	// written in the same transaction.
+	RenewCA(ctx context.Context, renewal model.CARenewal) error
+	// GetCAGenerations returns the superseded generations of a CA, newest first.
+	GetCAGenerations(ctx context.Context, caID int) ([]model.CAGeneration, error)
+	// SetCAKey links a CA to its crypto_keys row.
+	SetCAKey(ctx context.Context, caID, keyID int) error
 	GetChildCAs(ctx context.Context, parentCAID int) ([]model.CA, error)
 	GetCertificatesByCAID(ctx context.Context, caID int) ([]model.Certificate, error)
 }
@@ -22,14 +43,45 @@ type caRepository struct {
 	db *sql.DB
 }
 
+// createCAGenerationsTable needs certificate_authorities and crypto_keys.
+const createCAGenerationsTable = `
+	CREATE TABLE IF NOT EXISTS ca_generations (
+		ca_id INTEGER NOT NULL,
+		generation INTEGER NOT NULL,
+		cert_pem TEXT NOT NULL,
+		key_id INTEGER,
+		signature_algorithm VARCHAR,
+		superseded_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY (ca_id, generation),
+		CONSTRAINT fk_ca_id FOREIGN KEY (ca_id) REFERENCES certificate_authorities(id),
+		CONSTRAINT fk_key_id FOREIGN KEY (key_id) REFERENCES crypto_keys(id)
+	);
+`
+
+// caColumns is the column list read by scanCA. Queries using it must select
+// FROM certificate_authorities without an alias.
+const caColumns = `id, name, type, parent_ca_id, cert_pem, status, created_at, COALESCE(signature_algorithm, ''),
+	token_id, COALESCE((SELECT t.name FROM crypto_tokens t WHERE t.id = certificate_authorities.token_id), ''), key_id,
+	COALESCE(serial_prefix, ''), COALESCE(csr_pem, ''), COALESCE(external_chain_pem, ''), generation`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanCA(row rowScanner) (model.CA, error) {
+	var ca model.CA
+	err := row.Scan(&ca.ID, &ca.Name, &ca.Type, &ca.ParentCAID, &ca.CertPEM, &ca.Status, &ca.CreateAt, &ca.SignatureAlgorithm, &ca.TokenID, &ca.TokenName, &ca.KeyID, &ca.SerialPrefix, &ca.CSRPEM, &ca.ExternalChainPEM, &ca.Generation)
+	return ca, err
+}
+
 func (r *caRepository) SaveCA(ctx context.Context, ca model.CA) (int, error) {
 	query := `
-		INSERT INTO certificate_authorities (name, type, parent_ca_id, cert_pem, status)
-		VALUES ($1, $2, $3, $4, $5)
+		INSERT INTO certificate_authorities (name, type, parent_ca_id, cert_pem, status, signature_algorithm, token_id, key_id, serial_prefix, csr_pem)
+		VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''), $7, $8, NULLIF($9, ''), NULLIF($10, ''))
 		RETURNING id
 	`
 	var id int
-	err := r.db.QueryRowContext(ctx, query, ca.Name, ca.Type, ca.ParentCAID, ca.CertPEM, ca.Status).Scan(&id)
+	err := r.db.QueryRowContext(ctx, query, ca.Name, ca.Type, ca.ParentCAID, ca.CertPEM, ca.Status, ca.SignatureAlgorithm, ca.TokenID, ca.KeyID, ca.SerialPrefix, ca.CSRPEM).Scan(&id)
 	if err != nil {
 		return 0, fmt.Errorf("SaveCA: failed to save CA: %w", err)
 	}
@@ -39,30 +91,39 @@ func (r *caRepository) SaveCA(ctx context.Context, ca model.CA) (int, error) {
 
 func (r *caRepository) FindCAByID(ctx context.Context, id int) (model.CA, error) {
 	query := `
-		SELECT id, name, type, parent_ca_id, cert_pem, status
+		SELECT ` + caColumns + `
 		FROM certificate_authorities
 		WHERE id = $1 AND status = 'active'
 		AND type IN ('root', 'sub')
 	`
-	var caData model.CA
-	row := r.db.QueryRowContext(ctx, query, id)
-	err := row.Scan(&caData.ID, &caData.Name, &caData.Type, &caData.ParentCAID, &caData.CertPEM, &caData.Status)
+	caData, err := scanCA(r.db.QueryRowContext(ctx, query, id))
 	if err != nil {
 		return model.CA{}, fmt.Errorf("FindCAByID: failed to find CA by ID %d: %w", id, err)
 	}
 	return caData, nil
 }
 
+func (r *caRepository) FindCAByIDAnyStatus(ctx context.Context, id int) (model.CA, error) {
+	query := `
+		SELECT ` + caColumns + `
+		FROM certificate_authorities
+		WHERE id = $1 AND status != 'deleted'
+		AND type IN ('root', 'sub')
+	`
+	caData, err := scanCA(r.db.QueryRowContext(ctx, query, id))
+	if err != nil {
+		return model.CA{}, fmt.Errorf("FindCAByIDAnyStatus: failed to find CA by ID %d: %w", id, err)
+	}
+	return caData, nil
+}
+
 func (r *caRepository) FindCABySerialNumber(ctx context.Context, serialNumber string) (model.CA, error) {
 	query := `
-		SELECT ca.id, ca.name, ca.type, ca.parent_ca_id, ca.cert_pem, ca.status, ca.created_at
-		FROM certificate_authorities ca
-		JOIN certificates c ON ca.id = c.ca_id
-		WHERE c.serial_number = $1 AND ca.status != 'deleted'
+		SELECT ` + caColumns + `
+		FROM certificate_authorities
+		WHERE id = (SELECT ca_id FROM certificates WHERE serial_number = $1) AND status != 'deleted'
 	`
-	var caData model.CA
-	row := r.db.QueryRowContext(ctx, query, serialNumber)
-	err := row.Scan(&caData.ID, &caData.Name, &caData.Type, &caData.ParentCAID, &caData.CertPEM, &caData.Status, &caData.CreateAt)
+	caData, err := scanCA(r.db.QueryRowContext(ctx, query, serialNumber))
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return model.CA{}, fmt.Errorf("FindCABySerialNumber: CA not found for certificate serial number %s", serialNumber)
@@ -75,47 +136,45 @@ func (r *caRepository) FindCABySerialNumber(ctx context.Context, serialNumber st
 func (r *caRepository) GetCAChain(ctx context.Context, caID int) ([]model.CA, error) {
 	var chain []model.CA
 	currentID := caID
-	
+
 	// Traverse từ CA hiện tại lên đến root CA
 	for currentID != 0 {
 		query := `
-			SELECT id, name, type, parent_ca_id, cert_pem, status, created_at
+			SELECT ` + caColumns + `
 			FROM certificate_authorities
 			WHERE id = $1 AND status != 'deleted'
 		`
-		var ca model.CA
-		row := r.db.QueryRowContext(ctx, query, currentID)
-		err := row.Scan(&ca.ID, &ca.Name, &ca.Type, &ca.ParentCAID, &ca.CertPEM, &ca.Status, &ca.CreateAt)
+		ca, err := scanCA(r.db.QueryRowContext(ctx, query, currentID))
 		if err != nil {
 			if err == sql.ErrNoRows {
 				return nil, fmt.Errorf("GetCAChain: CA with ID %d not found", currentID)
 			}
 			return nil, fmt.Errorf("GetCAChain: failed to get CA with ID %d: %w", currentID, err)
 		}
-		
+
 		// Thêm CA vào chain
 		chain = append(chain, ca)
-		
+
 		// Nếu đây là root CA (không có parent), dừng lại
 		if ca.ParentCAID == nil {
 			break
 		}
-		
+
 		// Chuyển sang parent CA
 		currentID = *ca.ParentCAID
-		
+
 		// Kiểm tra infinite loop (trong trường hợp có lỗi dữ liệu)
 		if len(chain) > 10 {
 			return nil, fmt.Errorf("GetCAChain: potential infinite loop detected, chain too long")
 		}
 	}
-	
+
 	return chain, nil
 }
 
 func (r *caRepository) GetAllCAs(ctx context.Context) ([]model.CA, error) {
 	query := `
-		SELECT id, name, type, parent_ca_id, cert_pem, status, created_at
+		SELECT ` + caColumns + `
 		FROM certificate_authorities
 		WHERE status != 'deleted'
 		ORDER BY created_at DESC
@@ -128,8 +187,7 @@ func (r *caRepository) GetAllCAs(ctx context.Context) ([]model.CA, error) {
 
 	var cas []model.CA
 	for rows.Next() {
-		var ca model.CA
-		err := rows.Scan(&ca.ID, &ca.Name, &ca.Type, &ca.ParentCAID, &ca.CertPEM, &ca.Status, &ca.CreateAt)
+		ca, err := scanCA(rows)
 		if err != nil {
 			return nil, fmt.Errorf("GetAllCAs: failed to scan CA: %w", err)
 		}
@@ -143,32 +201,201 @@ func (r *caRepository) GetAllCAs(ctx context.Context) ([]model.CA, error) {
 	return cas, nil
 }
 
-func (r *caRepository) UpdateCAStatus(ctx context.Context, caID int, status string) error {
+func (r *caRepository) FindPendingCAByID(ctx context.Context, id int) (model.CA, error) {
 	query := `
-		UPDATE certificate_authorities
-		SET status = $1
-		WHERE id = $2
+		SELECT ` + caColumns + `
+		FROM certificate_authorities
+		WHERE id = $1 AND status = 'pending'
+	`
+	caData, err := scanCA(r.db.QueryRowContext(ctx, query, id))
+	if err == sql.ErrNoRows {
+		return model.CA{}, fmt.Errorf("%w: no pending CA with ID %d", model.ErrCANotPending, id)
+	}
+	if err != nil {
+		return model.CA{}, fmt.Errorf("FindPendingCAByID: failed to find CA by ID %d: %w", id, err)
+	}
+	return caData, nil
+}
+
+func (r *caRepository) FindHeldCAByID(ctx context.Context, id int) (model.CA, error) {
+	query := `
+		SELECT ` + caColumns + `
+		FROM certificate_authorities
+		WHERE id = $1 AND status = 'hold'
 	`
-	result, err := r.db.ExecContext(ctx, query, status, caID)
+	caData, err := scanCA(r.db.QueryRowContext(ctx, query, id))
+	if err == sql.ErrNoRows {
+		return model.CA{}, fmt.Errorf("%w: no CA on hold with ID %d", model.ErrNotOnHold, id)
+	}
 	if err != nil {
-		return fmt.Errorf("UpdateCAStatus: failed to update CA status: %w", err)
+		return model.CA{}, fmt.Errorf("FindHeldCAByID: failed to find CA by ID %d: %w", id, err)
 	}
+	return caData, nil
+}
 
-	rowsAffected, err := result.RowsAffected()
+func (r *caRepository) ActivateCA(ctx context.Context, ca model.CA) error {
+	tx, err := r.db.BeginTx(ctx, nil)
 	if err != nil {
-		return fmt.Errorf("UpdateCAStatus: failed to get rows affected: %w", err)
+		return fmt.Errorf("ActivateCA: failed to begin transaction: %w", err)
 	}
+	defer tx.Rollback()
 
+	result, err := tx.ExecContext(ctx, `
+		UPDATE certificate_authorities
+		SET cert_pem = $1, parent_ca_id = $2, external_chain_pem = NULLIF($3, ''), status = 'active'
+		WHERE id = $4 AND status = 'pending'
+	`, ca.CertPEM, ca.ParentCAID, ca.ExternalChainPEM, ca.ID)
+	if err != nil {
+		return fmt.Errorf("ActivateCA: failed to activate CA: %w", err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("ActivateCA: failed to get rows affected: %w", err)
+	}
 	if rowsAffected == 0 {
-		return fmt.Errorf("UpdateCAStatus: CA with ID %d not found", caID)
+		return fmt.Errorf("%w: CA with ID %d", model.ErrCANotPending, ca.ID)
+	}
+	err = recordTransition(ctx, tx, model.TransitionEntityCA, strconv.Itoa(ca.ID),
+		string(model.PendingCAStatus), string(model.ActiveCAStatus), "certificate imported")
+	if err != nil {
+		return fmt.Errorf("ActivateCA: %w", err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("ActivateCA: failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+func (r *caRepository) RenewCA(ctx context.Context, renewal model.CARenewal) error {
+	ca := renewal.CA
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("RenewCA: failed to begin transaction: %w", err)
 	}
+	defer tx.Rollback()
 
+	// The generation being superseded must still be the current one
+	var status model.CAStatus
+	err = tx.QueryRowContext(ctx, `
+		SELECT status
+		FROM certificate_authorities
+		WHERE id = $1 AND generation = $2 AND status IN ('active', 'expired')
+		FOR UPDATE
+	`, ca.ID, ca.Generation-1).Scan(&status)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("%w: CA with ID %d is not active or expired at generation %d", model.ErrCAStatusChanged, ca.ID, ca.Generation-1)
+	}
+	if err != nil {
+		return fmt.Errorf("RenewCA: failed to lock CA: %w", err)
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO ca_generations (ca_id, generation, cert_pem, key_id, signature_algorithm)
+		SELECT id, generation, cert_pem, key_id, signature_algorithm
+		FROM certificate_authorities
+		WHERE id = $1
+	`, ca.ID)
+	if err != nil {
+		return fmt.Errorf("RenewCA: failed to keep the superseded generation: %w", err)
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		UPDATE certificate_authorities
+		SET cert_pem = $1, key_id = $2, signature_algorithm = NULLIF($3, ''), generation = $4, status = 'active'
+		WHERE id = $5
+	`, ca.CertPEM, ca.KeyID, ca.SignatureAlgorithm, ca.Generation, ca.ID)
+	if err != nil {
+		return fmt.Errorf("RenewCA: failed to update CA: %w", err)
+	}
+	if status != model.ActiveCAStatus {
+		err = recordTransition(ctx, tx, model.TransitionEntityCA, strconv.Itoa(ca.ID),
+			string(status), string(model.ActiveCAStatus), fmt.Sprintf("renewed to generation %d", ca.Generation))
+		if err != nil {
+			return fmt.Errorf("RenewCA: %w", err)
+		}
+	}
+
+	if cert := renewal.Certificate; cert != nil {
+		_, err = tx.ExecContext(ctx, `
+			INSERT INTO certificates (serial_number, subject, not_before, not_after, cert_pem, ca_id, status, ca_generation)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+			ON CONFLICT (serial_number) DO NOTHING
+		`, cert.SerialNumber, cert.Subject, cert.NotBefore, cert.NotAfter, cert.CertPEM, cert.CAID, string(cert.Status), cert.CAGeneration)
+		if err != nil {
+			return fmt.Errorf("RenewCA: failed to record the renewed certificate: %w", err)
+		}
+	}
+
+	if renewal.PreviousKeyID != nil {
+		result, err := tx.ExecContext(ctx, `UPDATE crypto_keys SET ca_id = $1 WHERE id = $2`, ca.ID, ca.KeyID)
+		if err != nil {
+			return fmt.Errorf("RenewCA: failed to link key to CA: %w", err)
+		}
+		rowsAffected, err := result.RowsAffected()
+		if err != nil {
+			return fmt.Errorf("RenewCA: failed to get rows affected: %w", err)
+		}
+		if rowsAffected == 0 {
+			return fmt.Errorf("RenewCA: key with ID %d not found", *ca.KeyID)
+		}
+		// The previous key only signs CRLs and OCSP responses from now on
+		_, err = tx.ExecContext(ctx, `DELETE FROM key_usages WHERE key_id = $1 AND usage = $2`, *renewal.PreviousKeyID, model.KeyUsageCertSign)
+		if err != nil {
+			return fmt.Errorf("RenewCA: failed to remove certSign from key %d: %w", *renewal.PreviousKeyID, err)
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("RenewCA: failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+func (r *caRepository) GetCAGenerations(ctx context.Context, caID int) ([]model.CAGeneration, error) {
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT ca_id, generation, cert_pem, key_id, COALESCE(signature_algorithm, '')
+		FROM ca_generations
+		WHERE ca_id = $1
+		ORDER BY generation DESC
+	`, caID)
+	if err != nil {
+		return nil, fmt.Errorf("GetCAGenerations: failed to query generations: %w", err)
+	}
+	defer rows.Close()
+
+	var generations []model.CAGeneration
+	for rows.Next() {
+		var generation model.CAGeneration
+		if err := rows.Scan(&generation.CAID, &generation.Generation, &generation.CertPEM, &generation.KeyID, &generation.SignatureAlgorithm); err != nil {
+			return nil, fmt.Errorf("GetCAGenerations: failed to scan generation: %w", err)
+		}
+		generations = append(generations, generation)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("GetCAGenerations: rows error: %w", err)
+	}
+	return generations, nil
+}
+
+func (r *caRepository) SetCAKey(ctx context.Context, caID, keyID int) error {
+	result, err := r.db.ExecContext(ctx, `UPDATE certificate_authorities SET key_id = $1 WHERE id = $2`, keyID, caID)
+	if err != nil {
+		return fmt.Errorf("SetCAKey: failed to update CA key: %w", err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("SetCAKey: failed to get rows affected: %w", err)
+	}
+	if rowsAffected == 0 {
+		return fmt.Errorf("SetCAKey: CA with ID %d not found", caID)
+	}
 	return nil
 }
 
 func (r *caRepository) GetChildCAs(ctx context.Context, parentCAID int) ([]model.CA, error) {
 	query := `
-		SELECT id, name, type, parent_ca_id, cert_pem, status, created_at
+		SELECT ` + caColumns + `
 		FROM certificate_authorities
 		WHERE parent_ca_id = $1 AND status != 'deleted'
 	`
@@ -180,8 +407,7 @@ func (r *caRepository) GetChildCAs(ctx context.Context, parentCAID int) ([]model
 
 	var cas []model.CA
 	for rows.Next() {
-		var ca model.CA
-		err := rows.Scan(&ca.ID, &ca.Name, &ca.Type, &ca.ParentCAID, &ca.CertPEM, &ca.Status, &ca.CreateAt)
+		ca, err := scanCA(rows)
 		if err != nil {
 			return nil, fmt.Errorf("GetChildCAs: failed to scan CA: %w", err)
 		}
@@ -210,7 +436,7 @@ func (r *caRepository) GetCertificatesByCAID(ctx context.Context, caID int) ([]m
 	var certificates []model.Certificate
 	for rows.Next() {
 		var cert model.Certificate
-		err := rows.Scan(&cert.SerialNumber, &cert.Subject, &cert.NotBefore, &cert.NotAfter, 
+		err := rows.Scan(&cert.SerialNumber, &cert.Subject, &cert.NotBefore, &cert.NotAfter,
 			&cert.CertPEM, &cert.CAID, &cert.Status)
 		if err != nil {
 			return nil, fmt.Errorf("GetCertificatesByCAID: failed to scan certificate: %w", err)
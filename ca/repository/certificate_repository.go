@@ -12,6 +12,8 @@ type CertificateRepository interface {
 	FindBySerialNumber(ctx context.Context, serialNumber string) (model.Certificate, error)
 	FindCertByCAID(ctx context.Context, id int) (model.Certificate, error)
 	GetAllCertificates(ctx context.Context) ([]model.Certificate, error)
+	// SerialNumberExists reports whether a certificate with the serial number is recorded.
+	SerialNumberExists(ctx context.Context, serialNumber string) (bool, error)
 }
 
 type certificateRepository struct {
@@ -20,21 +22,21 @@ type certificateRepository struct {
 
 func (r *certificateRepository) SaveCert(ctx context.Context, certData model.Certificate) error {
 	_, err := r.db.ExecContext(ctx, `
-		INSERT INTO certificates (serial_number, subject, not_before, not_after, cert_pem, ca_id, status)
-		VALUES ($1, $2, $3, $4, $5, $6, $7)
-	`, certData.SerialNumber, certData.Subject, certData.NotBefore, certData.NotAfter, string(certData.CertPEM), certData.CAID, string(certData.Status))
+		INSERT INTO certificates (serial_number, subject, not_before, not_after, cert_pem, ca_id, status, ca_generation)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+	`, certData.SerialNumber, certData.Subject, certData.NotBefore, certData.NotAfter, string(certData.CertPEM), certData.CAID, string(certData.Status), certData.CAGeneration)
 	return err
 }
 
 func (r *certificateRepository) FindBySerialNumber(ctx context.Context, serialNumber string) (model.Certificate, error) {
 	var certData model.Certificate
 	row := r.db.QueryRowContext(ctx, `
-		SELECT serial_number, subject, not_before, not_after, cert_pem, ca_id, status
+		SELECT serial_number, subject, not_before, not_after, cert_pem, ca_id, status, ca_generation
 		FROM certificates
 		WHERE serial_number = $1
 	`, serialNumber)
 
-	err := row.Scan(&certData.SerialNumber, &certData.Subject, &certData.NotBefore, &certData.NotAfter, &certData.CertPEM, &certData.CAID, &certData.Status)
+	err := row.Scan(&certData.SerialNumber, &certData.Subject, &certData.NotBefore, &certData.NotAfter, &certData.CertPEM, &certData.CAID, &certData.Status, &certData.CAGeneration)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return model.Certificate{}, nil // No certificate found
@@ -64,7 +66,7 @@ func (r *certificateRepository) FindCertByCAID(ctx context.Context, caID int) (m
 
 func (r *certificateRepository) GetAllCertificates(ctx context.Context) ([]model.Certificate, error) {
 	query := `
-		SELECT serial_number, subject, not_before, not_after, cert_pem, ca_id, status
+		SELECT serial_number, subject, not_before, not_after, cert_pem, ca_id, status, ca_generation
 		FROM certificates
 		ORDER BY not_before DESC
 	`
@@ -78,7 +80,7 @@ func (r *certificateRepository) GetAllCertificates(ctx context.Context) ([]model
 	for rows.Next() {
 		var cert model.Certificate
 		err := rows.Scan(&cert.SerialNumber, &cert.Subject, &cert.NotBefore, &cert.NotAfter, 
-			&cert.CertPEM, &cert.CAID, &cert.Status)
+			&cert.CertPEM, &cert.CAID, &cert.Status, &cert.CAGeneration)
 		if err != nil {
 			return nil, fmt.Errorf("GetAllCertificates: failed to scan certificate: %w", err)
 		}
@@ -91,3 +93,14 @@ func (r *certificateRepository) GetAllCertificates(ctx context.Context) ([]model
 
 	return certificates, nil
 }
+
+func (r *certificateRepository) SerialNumberExists(ctx context.Context, serialNumber string) (bool, error) {
+	var exists bool
+	err := r.db.QueryRowContext(ctx, `
+		SELECT EXISTS (SELECT 1 FROM certificates WHERE serial_number = $1)
+	`, serialNumber).Scan(&exists)
+	if err != nil {
+		return false, fmt.Errorf("SerialNumberExists: %w", err)
+	}
+	return exists, nil
+}
@@ -0,0 +1,73 @@
+package repository
+
+import (
+	"context"
+	"core-ca/ca/model"
+	"database/sql"
+	"fmt"
+)
+
+type CrossCertificateRepository interface {
+	SaveCrossCertificate(ctx context.Context, cert model.CrossCertificate) (int, error)
+	// GetCrossCertificates returns the cross-certificates a CA issued or is the subject of.
+	GetCrossCertificates(ctx context.Context, caID int) ([]model.CrossCertificate, error)
+}
+
+type crossCertificateRepository struct {
+	db *sql.DB
+}
+
+// createCrossCertificatesTable needs certificate_authorities.
+const createCrossCertificatesTable = `
+	CREATE TABLE IF NOT EXISTS cross_certificates (
+		id SERIAL PRIMARY KEY,
+		issuer_ca_id INTEGER NOT NULL,
+		subject_ca_id INTEGER NOT NULL,
+		serial_number VARCHAR NOT NULL UNIQUE,
+		cert_pem TEXT NOT NULL,
+		not_before TIMESTAMP NOT NULL,
+		not_after TIMESTAMP NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		CONSTRAINT fk_issuer_ca_id FOREIGN KEY (issuer_ca_id) REFERENCES certificate_authorities(id),
+		CONSTRAINT fk_subject_ca_id FOREIGN KEY (subject_ca_id) REFERENCES certificate_authorities(id)
+	);
+`
+
+func (r *crossCertificateRepository) SaveCrossCertificate(ctx context.Context, cert model.CrossCertificate) (int, error) {
+	var id int
+	err := r.db.QueryRowContext(ctx, `
+		INSERT INTO cross_certificates (issuer_ca_id, subject_ca_id, serial_number, cert_pem, not_before, not_after)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id
+	`, cert.IssuerCAID, cert.SubjectCAID, cert.SerialNumber, cert.CertPEM, cert.NotBefore, cert.NotAfter).Scan(&id)
+	if err != nil {
+		return 0, fmt.Errorf("SaveCrossCertificate: failed to save cross-certificate: %w", err)
+	}
+	return id, nil
+}
+
+func (r *crossCertificateRepository) GetCrossCertificates(ctx context.Context, caID int) ([]model.CrossCertificate, error) {
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT id, issuer_ca_id, subject_ca_id, serial_number, cert_pem, not_before, not_after, created_at
+		FROM cross_certificates
+		WHERE issuer_ca_id = $1 OR subject_ca_id = $1
+		ORDER BY created_at DESC
+	`, caID)
+	if err != nil {
+		return nil, fmt.Errorf("GetCrossCertificates: failed to query cross-certificates: %w", err)
+	}
+	defer rows.Close()
+
+	var certs []model.CrossCertificate
+	for rows.Next() {
+		var cert model.CrossCertificate
+		if err := rows.Scan(&cert.ID, &cert.IssuerCAID, &cert.SubjectCAID, &cert.SerialNumber, &cert.CertPEM, &cert.NotBefore, &cert.NotAfter, &cert.CreatedAt); err != nil {
+			return nil, fmt.Errorf("GetCrossCertificates: failed to scan cross-certificate: %w", err)
+		}
+		certs = append(certs, cert)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("GetCrossCertificates: rows error: %w", err)
+	}
+	return certs, nil
+}
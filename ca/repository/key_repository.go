@@ -9,30 +9,49 @@ import (
 
 type KeyRepository interface {
 	SaveKey(ctx context.Context, key model.CryptoKey) (int, error)
-	FindKeyByLabelAndTokenID(ctx context.Context, label string, tokenID int) (model.CryptoKey, error)
+	FindKeyByID(ctx context.Context, id int) (model.CryptoKey, error)
+	// FindKeyByLabelAndTokenID looks a key up by label; a nil tokenID means the default token.
+	FindKeyByLabelAndTokenID(ctx context.Context, label string, tokenID *int) (model.CryptoKey, error)
+	// SetKeyCA records the CA that owns a key.
+	SetKeyCA(ctx context.Context, keyID, caID int) error
+	UpdateKeyStatus(ctx context.Context, keyID int, status model.CryptoKeyStatus) error
 }
 
 type keyRepository struct {
 	db *sql.DB
 }
 
-func NewKeyRepository(db *sql.DB) (KeyRepository, error) {
-	if db == nil {
-		return nil, fmt.Errorf("NewKeyRepository: database connection is nil")
-	}
-
-	_, err := db.Exec(`
+// createCryptoKeysTable needs crypto_tokens. A NULL token_id means the
+// configured token; the unique index treats all such keys as one token.
+const createCryptoKeysTable = `
 	CREATE TABLE IF NOT EXISTS crypto_keys (
 		id SERIAL PRIMARY KEY,
 		label VARCHAR NOT NULL,
-		token_id INTEGER NOT NULL,
+		token_id INTEGER,
 		ca_id INTEGER,
 		public_key TEXT NOT NULL,
-		status VARCHAR NOT NULL DEFAULT 'active' CHECK (status IN ('active', 'revoked')),
-		CONSTRAINT fk_token_id FOREIGN KEY (token_id) REFERENCES crypto_tokens(id),
-		CONSTRAINT unique_label_token UNIQUE (label, token_id)
+		fingerprint VARCHAR NOT NULL,
+		algorithm VARCHAR NOT NULL,
+		status VARCHAR NOT NULL DEFAULT 'active',
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		CONSTRAINT fk_token_id FOREIGN KEY (token_id) REFERENCES crypto_tokens(id)
 	);
-	`)
+	CREATE UNIQUE INDEX IF NOT EXISTS unique_label_token ON crypto_keys (label, COALESCE(token_id, 0));
+	ALTER TABLE crypto_keys DROP CONSTRAINT IF EXISTS crypto_keys_status_check;
+	ALTER TABLE crypto_keys ADD CONSTRAINT crypto_keys_status_check CHECK (status IN ('active', 'revoked', 'destroyed'));
+`
+
+// keyColumns is the column list read by scanKey. Queries using it must select
+// FROM crypto_keys without an alias.
+const keyColumns = `id, label, token_id, COALESCE((SELECT t.name FROM crypto_tokens t WHERE t.id = crypto_keys.token_id), ''),
+	ca_id, public_key, fingerprint, algorithm, status, created_at`
+
+func NewKeyRepository(db *sql.DB) (KeyRepository, error) {
+	if db == nil {
+		return nil, fmt.Errorf("NewKeyRepository: database connection is nil")
+	}
+
+	_, err := db.Exec(createCryptoKeysTable)
 	if err != nil {
 		return nil, fmt.Errorf("NewKeyRepository: failed to create crypto_keys table: %w", err)
 	}
@@ -40,9 +59,74 @@ func NewKeyRepository(db *sql.DB) (KeyRepository, error) {
 	return &keyRepository{db: db}, nil
 }
 
+func scanKey(row rowScanner) (model.CryptoKey, error) {
+	var key model.CryptoKey
+	err := row.Scan(&key.ID, &key.Label, &key.TokenID, &key.TokenName, &key.CaID, &key.PublicKey,
+		&key.Fingerprint, &key.Algorithm, &key.Status, &key.CreatedAt)
+	return key, err
+}
+
 func (r *keyRepository) SaveKey(ctx context.Context, key model.CryptoKey) (int, error) {
-	return 0, nil
+	query := `
+		INSERT INTO crypto_keys (label, token_id, ca_id, public_key, fingerprint, algorithm, status)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id
+	`
+	var id int
+	err := r.db.QueryRowContext(ctx, query, key.Label, key.TokenID, key.CaID, key.PublicKey,
+		key.Fingerprint, key.Algorithm, key.Status).Scan(&id)
+	if err != nil {
+		return 0, fmt.Errorf("SaveKey: failed to save key %s: %w", key.Label, err)
+	}
+	return id, nil
 }
-func (r *keyRepository) FindKeyByLabelAndTokenID(ctx context.Context, label string, tokenID int) (model.CryptoKey, error) {
-	return model.CryptoKey{}, nil
+
+func (r *keyRepository) FindKeyByID(ctx context.Context, id int) (model.CryptoKey, error) {
+	query := `SELECT ` + keyColumns + ` FROM crypto_keys WHERE id = $1`
+
+	key, err := scanKey(r.db.QueryRowContext(ctx, query, id))
+	if err != nil {
+		return model.CryptoKey{}, fmt.Errorf("FindKeyByID: failed to find key %d: %w", id, err)
+	}
+	return key, nil
+}
+
+func (r *keyRepository) FindKeyByLabelAndTokenID(ctx context.Context, label string, tokenID *int) (model.CryptoKey, error) {
+	query := `SELECT ` + keyColumns + ` FROM crypto_keys WHERE label = $1 AND token_id IS NOT DISTINCT FROM $2`
+
+	key, err := scanKey(r.db.QueryRowContext(ctx, query, label, tokenID))
+	if err != nil {
+		return model.CryptoKey{}, fmt.Errorf("FindKeyByLabelAndTokenID: failed to find key %s: %w", label, err)
+	}
+	return key, nil
+}
+
+func (r *keyRepository) SetKeyCA(ctx context.Context, keyID, caID int) error {
+	result, err := r.db.ExecContext(ctx, `UPDATE crypto_keys SET ca_id = $1 WHERE id = $2`, caID, keyID)
+	if err != nil {
+		return fmt.Errorf("SetKeyCA: failed to update key: %w", err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("SetKeyCA: failed to get rows affected: %w", err)
+	}
+	if rowsAffected == 0 {
+		return fmt.Errorf("SetKeyCA: key with ID %d not found", keyID)
+	}
+	return nil
+}
+
+func (r *keyRepository) UpdateKeyStatus(ctx context.Context, keyID int, status model.CryptoKeyStatus) error {
+	result, err := r.db.ExecContext(ctx, `UPDATE crypto_keys SET status = $1 WHERE id = $2`, status, keyID)
+	if err != nil {
+		return fmt.Errorf("UpdateKeyStatus: failed to update key status: %w", err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("UpdateKeyStatus: failed to get rows affected: %w", err)
+	}
+	if rowsAffected == 0 {
+		return fmt.Errorf("UpdateKeyStatus: key with ID %d not found", keyID)
+	}
+	return nil
 }
@@ -13,36 +13,74 @@ type KeyUsageRepository interface {
 	// RemoveUsage removes a usage type from a key.
 	RemoveUsage(ctx context.Context, keyID int, usage model.KeyUsage) error
 	// GetUsages retrieves all usage types for a key.
+	GetUsages(ctx context.Context, keyID int) ([]model.KeyUsage, error)
 }
 
 type keyUsageRepository struct {
 	db *sql.DB
 }
 
-func NewKeyUsageRepository(db *sql.DB) (KeyUsageRepository, error) {
-	if db == nil {
-		return nil, fmt.Errorf("NewKeyUsageRepository: database connection is nil")
-	}
-
-	_, err := db.Exec(`
+// createKeyUsagesTable needs crypto_keys.
+const createKeyUsagesTable = `
 	CREATE TABLE IF NOT EXISTS key_usages (
 		key_id INTEGER NOT NULL,
 		usage VARCHAR NOT NULL CHECK (usage IN ('certSign', 'crlSign', 'ocspSign', 'encrypt', 'sign')),
 		PRIMARY KEY (key_id, usage),
 		CONSTRAINT fk_key_id FOREIGN KEY (key_id) REFERENCES crypto_keys(id)
 	);
-	`)
+`
+
+func NewKeyUsageRepository(db *sql.DB) (KeyUsageRepository, error) {
+	if db == nil {
+		return nil, fmt.Errorf("NewKeyUsageRepository: database connection is nil")
+	}
+
+	_, err := db.Exec(createKeyUsagesTable)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("NewKeyUsageRepository: failed to create key_usages table: %w", err)
 	}
 
 	return &keyUsageRepository{db: db}, nil
 }
 
 func (r *keyUsageRepository) AddUsage(ctx context.Context, keyID int, usage model.KeyUsage) error {
+	query := `
+		INSERT INTO key_usages (key_id, usage)
+		VALUES ($1, $2)
+		ON CONFLICT (key_id, usage) DO NOTHING
+	`
+	if _, err := r.db.ExecContext(ctx, query, keyID, usage); err != nil {
+		return fmt.Errorf("AddUsage: failed to add usage %s to key %d: %w", usage, keyID, err)
+	}
 	return nil
 }
 
 func (r *keyUsageRepository) RemoveUsage(ctx context.Context, keyID int, usage model.KeyUsage) error {
+	query := `DELETE FROM key_usages WHERE key_id = $1 AND usage = $2`
+	if _, err := r.db.ExecContext(ctx, query, keyID, usage); err != nil {
+		return fmt.Errorf("RemoveUsage: failed to remove usage %s from key %d: %w", usage, keyID, err)
+	}
 	return nil
 }
+
+func (r *keyUsageRepository) GetUsages(ctx context.Context, keyID int) ([]model.KeyUsage, error) {
+	query := `SELECT usage FROM key_usages WHERE key_id = $1 ORDER BY usage`
+	rows, err := r.db.QueryContext(ctx, query, keyID)
+	if err != nil {
+		return nil, fmt.Errorf("GetUsages: failed to query usages of key %d: %w", keyID, err)
+	}
+	defer rows.Close()
+
+	var usages []model.KeyUsage
+	for rows.Next() {
+		var usage model.KeyUsage
+		if err := rows.Scan(&usage); err != nil {
+			return nil, fmt.Errorf("GetUsages: failed to scan usage: %w", err)
+		}
+		usages = append(usages, usage)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("GetUsages: error iterating usages: %w", err)
+	}
+	return usages, nil
+}
@@ -11,15 +11,21 @@ type Repository interface {
 	CertificateRepository
 	TokenRepository
 	KeyRepository
+	KeyUsageRepository
 	CARepository
+	CrossCertificateRepository
+	StatusTransitionRepository
 }
 
 type repository struct {
 	*tokenRepository
 	*keyRepository
+	*keyUsageRepository
 	*caRepository
 	*certificateRepository
 	*revocationRepository
+	*crossCertificateRepository
+	*statusTransitionRepository
 }
 
 func NewRepository(db *sql.DB) (Repository, error) {
@@ -27,23 +33,79 @@ func NewRepository(db *sql.DB) (Repository, error) {
 		return nil, errors.New("database is nil")
 	}
 
+	// Create crypto_tokens table, referenced by certificate_authorities
+	_, err := db.Exec(createCryptoTokensTable)
+	if err != nil {
+		return nil, fmt.Errorf("NewRepository: failed to create crypto_tokens table: %w", err)
+	}
+
+	// Create crypto_keys table, referenced by certificate_authorities
+	_, err = db.Exec(createCryptoKeysTable)
+	if err != nil {
+		return nil, fmt.Errorf("NewRepository: failed to create crypto_keys table: %w", err)
+	}
+
+	// Create key_usages table
+	_, err = db.Exec(createKeyUsagesTable)
+	if err != nil {
+		return nil, fmt.Errorf("NewRepository: failed to create key_usages table: %w", err)
+	}
+
 	// Create certificate_authorities table
-	_, err := db.Exec(`
+	_, err = db.Exec(`
 		CREATE TABLE IF NOT EXISTS certificate_authorities (
 			id SERIAL PRIMARY KEY,
 			name VARCHAR NOT NULL UNIQUE,
 			type VARCHAR NOT NULL CHECK (type IN ('root', 'sub')),
 			parent_ca_id INTEGER,
 			cert_pem TEXT NOT NULL,
-			status VARCHAR NOT NULL DEFAULT 'active' CHECK (status IN ('active', 'revoked', 'expired', 'unknown')),
+			status VARCHAR NOT NULL DEFAULT 'active' CONSTRAINT certificate_authorities_status_check CHECK (status IN ('active', 'pending', 'hold', 'revoked', 'expired', 'unknown', 'deleted')),
 			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-			CONSTRAINT fk_parent_ca_id FOREIGN KEY (parent_ca_id) REFERENCES certificate_authorities(id)
+			signature_algorithm VARCHAR,
+			token_id INTEGER,
+			key_id INTEGER,
+			serial_prefix VARCHAR,
+			csr_pem TEXT,
+			external_chain_pem TEXT,
+			generation INTEGER NOT NULL DEFAULT 1,
+			CONSTRAINT fk_parent_ca_id FOREIGN KEY (parent_ca_id) REFERENCES certificate_authorities(id),
+			CONSTRAINT fk_token_id FOREIGN KEY (token_id) REFERENCES crypto_tokens(id),
+			CONSTRAINT fk_key_id FOREIGN KEY (key_id) REFERENCES crypto_keys(id)
 		);
 	`)
 	if err != nil {
 		return nil, fmt.Errorf("NewRepository: failed to create certificate_authorities table: %w", err)
 	}
 
+	// Add columns introduced after the initial schema
+	_, err = db.Exec(`
+		ALTER TABLE certificate_authorities ADD COLUMN IF NOT EXISTS signature_algorithm VARCHAR;
+		ALTER TABLE certificate_authorities ADD COLUMN IF NOT EXISTS token_id INTEGER REFERENCES crypto_tokens(id);
+		ALTER TABLE certificate_authorities ADD COLUMN IF NOT EXISTS key_id INTEGER REFERENCES crypto_keys(id);
+		ALTER TABLE certificate_authorities ADD COLUMN IF NOT EXISTS serial_prefix VARCHAR;
+		ALTER TABLE certificate_authorities ADD COLUMN IF NOT EXISTS csr_pem TEXT;
+		ALTER TABLE certificate_authorities ADD COLUMN IF NOT EXISTS external_chain_pem TEXT;
+		ALTER TABLE certificate_authorities ADD COLUMN IF NOT EXISTS generation INTEGER NOT NULL DEFAULT 1;
+		ALTER TABLE certificate_authorities DROP CONSTRAINT IF EXISTS certificate_authorities_status_check;
+		ALTER TABLE certificate_authorities ADD CONSTRAINT certificate_authorities_status_check
+			CHECK (status IN ('active', 'pending', 'hold', 'revoked', 'expired', 'unknown', 'deleted'));
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("NewRepository: failed to migrate certificate_authorities table: %w", err)
+	}
+
+	// Create ca_generations table
+	_, err = db.Exec(createCAGenerationsTable)
+	if err != nil {
+		return nil, fmt.Errorf("NewRepository: failed to create ca_generations table: %w", err)
+	}
+
+	// Create cross_certificates table
+	_, err = db.Exec(createCrossCertificatesTable)
+	if err != nil {
+		return nil, fmt.Errorf("NewRepository: failed to create cross_certificates table: %w", err)
+	}
+
 	// Create certificates table
 	_, err = db.Exec(`
 		CREATE TABLE IF NOT EXISTS certificates (
@@ -55,12 +117,19 @@ func NewRepository(db *sql.DB) (Repository, error) {
 			ca_id INTEGER,
 			status VARCHAR NOT NULL DEFAULT 'valid' CHECK (status IN ('valid', 'revoked', 'expired', 'unknown')),
 			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+			ca_generation INTEGER NOT NULL DEFAULT 1,
 			CONSTRAINT fk_ca_id FOREIGN KEY (ca_id) REFERENCES certificate_authorities(id)
 		);
 	`)
 	if err != nil {
 		return nil, fmt.Errorf("NewRepository: failed to create certificates table: %w", err)
 	}
+	_, err = db.Exec(`
+		ALTER TABLE certificates ADD COLUMN IF NOT EXISTS ca_generation INTEGER NOT NULL DEFAULT 1;
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("NewRepository: failed to migrate certificates table: %w", err)
+	}
 
 	_, err = db.Exec(`
 		CREATE TABLE IF NOT EXISTS revoked_certificates(
@@ -68,6 +137,7 @@ func NewRepository(db *sql.DB) (Repository, error) {
 			revocation_date TIMESTAMP NOT NULL,
 			reason VARCHAR,
 			is_ca BOOLEAN NOT NULL DEFAULT FALSE,
+			updated_at TIMESTAMP,
 			FOREIGN KEY (serial_number) REFERENCES certificates(serial_number)
 		)
 	`)
@@ -75,12 +145,33 @@ func NewRepository(db *sql.DB) (Repository, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to create revoked_certificates table: %w", err)
 	}
+	_, err = db.Exec(`
+		ALTER TABLE revoked_certificates ADD COLUMN IF NOT EXISTS updated_at TIMESTAMP;
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("NewRepository: failed to migrate revoked_certificates table: %w", err)
+	}
+
+	// Create released_certificates table
+	_, err = db.Exec(createReleasedCertificatesTable)
+	if err != nil {
+		return nil, fmt.Errorf("NewRepository: failed to create released_certificates table: %w", err)
+	}
+
+	// Create status_transitions table
+	_, err = db.Exec(createStatusTransitionsTable)
+	if err != nil {
+		return nil, fmt.Errorf("NewRepository: failed to create status_transitions table: %w", err)
+	}
 
 	return &repository{
-		tokenRepository:       &tokenRepository{db},
-		keyRepository:         &keyRepository{db},
-		caRepository:          &caRepository{db},
-		certificateRepository: &certificateRepository{db},
-		revocationRepository:  &revocationRepository{db},
+		tokenRepository:            &tokenRepository{db},
+		keyRepository:              &keyRepository{db},
+		keyUsageRepository:         &keyUsageRepository{db},
+		caRepository:               &caRepository{db},
+		certificateRepository:      &certificateRepository{db},
+		revocationRepository:       &revocationRepository{db},
+		crossCertificateRepository: &crossCertificateRepository{db},
+		statusTransitionRepository: &statusTransitionRepository{db},
 	}, nil
 }
@@ -5,12 +5,23 @@ import (
 	"core-ca/ca/model"
 	"database/sql"
 	"errors"
+	"fmt"
 	"time"
 )
 
 type RevocationRepository interface {
+	// Revoke records the revocation of a certificate. A certificate on hold
+	// can be revoked again with another reason, which replaces the hold.
 	Revoke(ctx context.Context, serialNumber, reason string, isCA bool) error
+	// Release takes a certificate off hold and records the release for delta CRLs.
+	Release(ctx context.Context, serialNumber string) error
 	GetRevokedCertificates(ctx context.Context, caID int) ([]model.RevokedCertificate, error)
+	// GetRevokedCertificatesSince returns the revocations of certificates
+	// issued by a CA that were made or changed at or after since.
+	GetRevokedCertificatesSince(ctx context.Context, caID int, since time.Time) ([]model.RevokedCertificate, error)
+	// GetReleasedCertificates returns the certificates issued by a CA and
+	// taken off hold at or after since.
+	GetReleasedCertificates(ctx context.Context, caID int, since time.Time) ([]model.ReleasedCertificate, error)
 	IsRevoked(ctx context.Context, serialNumber string) (model.RevokedCertificate, bool, error)
 }
 
@@ -18,6 +29,17 @@ type revocationRepository struct {
 	db *sql.DB
 }
 
+// createReleasedCertificatesTable needs certificates.
+const createReleasedCertificatesTable = `
+	CREATE TABLE IF NOT EXISTS released_certificates (
+		id SERIAL PRIMARY KEY,
+		serial_number VARCHAR NOT NULL,
+		hold_date TIMESTAMP NOT NULL,
+		released_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+		FOREIGN KEY (serial_number) REFERENCES certificates(serial_number)
+	);
+`
+
 func (r *revocationRepository) Revoke(ctx context.Context, serialNumber string, reason string, isCA bool) error {
 	// Start transaction
 	tx, err := r.db.BeginTx(ctx, nil)
@@ -26,13 +48,29 @@ func (r *revocationRepository) Revoke(ctx context.Context, serialNumber string,
 	}
 	defer tx.Rollback()
 
-	// Insert into revoked_certificates table
-	query1 := `INSERT INTO revoked_certificates (serial_number, revocation_date, reason, is_ca)
-				VALUES ($1, $2, $3, $4)`
-	_, err = tx.ExecContext(ctx, query1, serialNumber, time.Now(), reason, isCA)
+	// Lock the certificate and keep its status for the transition history
+	var fromStatus string
+	err = tx.QueryRowContext(ctx, `SELECT status FROM certificates WHERE serial_number = $1 FOR UPDATE`, serialNumber).Scan(&fromStatus)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("certificate %s not found", serialNumber)
+	}
+	if err != nil {
+		return errors.New("failed to get certificate status: " + err.Error())
+	}
+
+	// Insert into revoked_certificates table. A hold keeps its date when it
+	// becomes a permanent revocation.
+	query1 := `INSERT INTO revoked_certificates (serial_number, revocation_date, reason, is_ca, updated_at)
+				VALUES ($1, $2, $3, $4, $2)
+				ON CONFLICT (serial_number) DO UPDATE SET reason = EXCLUDED.reason, updated_at = EXCLUDED.updated_at
+				WHERE revoked_certificates.reason = 'certificateHold' AND EXCLUDED.reason != 'certificateHold'`
+	result, err := tx.ExecContext(ctx, query1, serialNumber, time.Now(), reason, isCA)
 	if err != nil {
 		return errors.New("failed to insert into revoked_certificates: " + err.Error())
 	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return fmt.Errorf("%w: %s", model.ErrAlreadyRevoked, serialNumber)
+	}
 
 	// Update certificate status to 'revoked'
 	query2 := `UPDATE certificates SET status = 'revoked' WHERE serial_number = $1`
@@ -40,6 +78,10 @@ func (r *revocationRepository) Revoke(ctx context.Context, serialNumber string,
 	if err != nil {
 		return errors.New("failed to update certificate status: " + err.Error())
 	}
+	err = recordTransition(ctx, tx, model.TransitionEntityCertificate, serialNumber, fromStatus, string(model.StatusRevoked), "revoked: "+reason)
+	if err != nil {
+		return err
+	}
 
 	// Commit transaction
 	if err = tx.Commit(); err != nil {
@@ -49,12 +91,68 @@ func (r *revocationRepository) Revoke(ctx context.Context, serialNumber string,
 	return nil
 }
 
+func (r *revocationRepository) Release(ctx context.Context, serialNumber string) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.New("failed to begin transaction: " + err.Error())
+	}
+	defer tx.Rollback()
+
+	var holdDate time.Time
+	err = tx.QueryRowContext(ctx, `DELETE FROM revoked_certificates
+				WHERE serial_number = $1 AND reason = 'certificateHold'
+				RETURNING revocation_date`, serialNumber).Scan(&holdDate)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("%w: certificate %s", model.ErrNotOnHold, serialNumber)
+	}
+	if err != nil {
+		return errors.New("failed to delete from revoked_certificates: " + err.Error())
+	}
+
+	_, err = tx.ExecContext(ctx, `INSERT INTO released_certificates (serial_number, hold_date, released_at)
+				VALUES ($1, $2, $3)`, serialNumber, holdDate, time.Now())
+	if err != nil {
+		return errors.New("failed to insert into released_certificates: " + err.Error())
+	}
+
+	var fromStatus string
+	err = tx.QueryRowContext(ctx, `SELECT status FROM certificates WHERE serial_number = $1 FOR UPDATE`, serialNumber).Scan(&fromStatus)
+	if err != nil {
+		return errors.New("failed to get certificate status: " + err.Error())
+	}
+	_, err = tx.ExecContext(ctx, `UPDATE certificates SET status = 'valid' WHERE serial_number = $1`, serialNumber)
+	if err != nil {
+		return errors.New("failed to update certificate status: " + err.Error())
+	}
+	err = recordTransition(ctx, tx, model.TransitionEntityCertificate, serialNumber, fromStatus, string(model.StatusValid), "released")
+	if err != nil {
+		return err
+	}
+
+	if err = tx.Commit(); err != nil {
+		return errors.New("failed to commit transaction: " + err.Error())
+	}
+	return nil
+}
+
 func (r *revocationRepository) GetRevokedCertificates(ctx context.Context, caID int) ([]model.RevokedCertificate, error) {
-	query := `SELECT rc.serial_number, rc.revocation_date, rc.reason, rc.is_ca 
+	query := `SELECT rc.serial_number, rc.revocation_date, rc.reason, rc.is_ca, c.ca_generation
 			  FROM revoked_certificates rc
 			  INNER JOIN certificates c ON rc.serial_number = c.serial_number
 			  WHERE c.ca_id = $1`
-	rows, err := r.db.QueryContext(ctx, query, caID)
+	return r.queryRevoked(ctx, query, caID)
+}
+
+func (r *revocationRepository) GetRevokedCertificatesSince(ctx context.Context, caID int, since time.Time) ([]model.RevokedCertificate, error) {
+	query := `SELECT rc.serial_number, rc.revocation_date, rc.reason, rc.is_ca, c.ca_generation
+			  FROM revoked_certificates rc
+			  INNER JOIN certificates c ON rc.serial_number = c.serial_number
+			  WHERE c.ca_id = $1 AND COALESCE(rc.updated_at, rc.revocation_date) >= $2`
+	return r.queryRevoked(ctx, query, caID, since)
+}
+
+func (r *revocationRepository) queryRevoked(ctx context.Context, query string, args ...any) ([]model.RevokedCertificate, error) {
+	rows, err := r.db.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, errors.New("failed to query revoked certificates: " + err.Error())
 	}
@@ -63,7 +161,7 @@ func (r *revocationRepository) GetRevokedCertificates(ctx context.Context, caID
 	for rows.Next() {
 		var cert model.RevokedCertificate
 		var reason sql.NullString
-		if err := rows.Scan(&cert.SerialNumber, &cert.RevocationDate, &reason, &cert.IsCA); err != nil {
+		if err := rows.Scan(&cert.SerialNumber, &cert.RevocationDate, &reason, &cert.IsCA, &cert.CAGeneration); err != nil {
 			return nil, errors.New("failed to scan revoked certificate: " + err.Error())
 		}
 		if reason.Valid {
@@ -74,6 +172,28 @@ func (r *revocationRepository) GetRevokedCertificates(ctx context.Context, caID
 	return revokedCerts, nil
 }
 
+func (r *revocationRepository) GetReleasedCertificates(ctx context.Context, caID int, since time.Time) ([]model.ReleasedCertificate, error) {
+	query := `SELECT rl.serial_number, rl.hold_date, rl.released_at, c.ca_generation
+			  FROM released_certificates rl
+			  INNER JOIN certificates c ON rl.serial_number = c.serial_number
+			  WHERE c.ca_id = $1 AND rl.released_at >= $2
+			  ORDER BY rl.released_at`
+	rows, err := r.db.QueryContext(ctx, query, caID, since)
+	if err != nil {
+		return nil, errors.New("failed to query released certificates: " + err.Error())
+	}
+	defer rows.Close()
+	var released []model.ReleasedCertificate
+	for rows.Next() {
+		var cert model.ReleasedCertificate
+		if err := rows.Scan(&cert.SerialNumber, &cert.HoldDate, &cert.ReleasedAt, &cert.CAGeneration); err != nil {
+			return nil, errors.New("failed to scan released certificate: " + err.Error())
+		}
+		released = append(released, cert)
+	}
+	return released, nil
+}
+
 func (r *revocationRepository) IsRevoked(ctx context.Context, serialNumber string) (model.RevokedCertificate, bool, error) {
 	query := `SELECT serial_number, revocation_date, reason, is_ca FROM revoked_certificates
 	WHERE revoked_certificates.serial_number = $1
@@ -0,0 +1,145 @@
+package repository
+
+import (
+	"context"
+	"core-ca/ca/model"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+type StatusTransitionRepository interface {
+	// TransitionCAStatus changes the status of a CA from one status to
+	// another and records the transition. It fails with ErrCAStatusChanged
+	// when the CA does not have the from status.
+	TransitionCAStatus(ctx context.Context, caID int, from, to model.CAStatus, reason string) error
+	// ExpireCertificates marks the valid certificates whose not_after is not
+	// after now expired, records the transitions and returns their serial numbers.
+	ExpireCertificates(ctx context.Context, now time.Time) ([]string, error)
+	// GetStatusTransitions returns the status transitions of a CA or
+	// certificate, the oldest first.
+	GetStatusTransitions(ctx context.Context, entityType, entityID string) ([]model.StatusTransition, error)
+}
+
+type statusTransitionRepository struct {
+	db *sql.DB
+}
+
+const createStatusTransitionsTable = `
+	CREATE TABLE IF NOT EXISTS status_transitions (
+		id SERIAL PRIMARY KEY,
+		entity_type VARCHAR NOT NULL CHECK (entity_type IN ('ca', 'certificate')),
+		entity_id VARCHAR NOT NULL,
+		from_status VARCHAR NOT NULL,
+		to_status VARCHAR NOT NULL,
+		reason VARCHAR,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+	);
+	CREATE INDEX IF NOT EXISTS idx_status_transitions_entity ON status_transitions (entity_type, entity_id);
+`
+
+func (r *statusTransitionRepository) TransitionCAStatus(ctx context.Context, caID int, from, to model.CAStatus, reason string) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("TransitionCAStatus: failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, `
+		UPDATE certificate_authorities
+		SET status = $1
+		WHERE id = $2 AND status = $3
+	`, to, caID, from)
+	if err != nil {
+		return fmt.Errorf("TransitionCAStatus: failed to update CA status: %w", err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("TransitionCAStatus: failed to get rows affected: %w", err)
+	}
+	if rowsAffected == 0 {
+		return fmt.Errorf("%w: CA with ID %d is not %s", model.ErrCAStatusChanged, caID, from)
+	}
+
+	err = recordTransition(ctx, tx, model.TransitionEntityCA, strconv.Itoa(caID), string(from), string(to), reason)
+	if err != nil {
+		return fmt.Errorf("TransitionCAStatus: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("TransitionCAStatus: failed to commit transaction: %w", err)
+	}
+	return nil
+}
+
+// recordTransition records a status transition within tx, so that it is
+// kept exactly when the status change made in tx is.
+func recordTransition(ctx context.Context, tx *sql.Tx, entityType, entityID, from, to, reason string) error {
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO status_transitions (entity_type, entity_id, from_status, to_status, reason)
+		VALUES ($1, $2, $3, $4, $5)
+	`, entityType, entityID, from, to, reason)
+	if err != nil {
+		return fmt.Errorf("failed to record transition: %w", err)
+	}
+	return nil
+}
+
+func (r *statusTransitionRepository) ExpireCertificates(ctx context.Context, now time.Time) ([]string, error) {
+	rows, err := r.db.QueryContext(ctx, `
+		WITH expired AS (
+			UPDATE certificates
+			SET status = 'expired'
+			WHERE status = 'valid' AND not_after <= $1
+			RETURNING serial_number
+		)
+		INSERT INTO status_transitions (entity_type, entity_id, from_status, to_status, reason, created_at)
+		SELECT 'certificate', serial_number, 'valid', 'expired', 'not_after passed', $1
+		FROM expired
+		RETURNING entity_id
+	`, now)
+	if err != nil {
+		return nil, fmt.Errorf("ExpireCertificates: failed to expire certificates: %w", err)
+	}
+	defer rows.Close()
+
+	var serials []string
+	for rows.Next() {
+		var serial string
+		if err := rows.Scan(&serial); err != nil {
+			return nil, fmt.Errorf("ExpireCertificates: failed to scan serial number: %w", err)
+		}
+		serials = append(serials, serial)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("ExpireCertificates: rows error: %w", err)
+	}
+	return serials, nil
+}
+
+func (r *statusTransitionRepository) GetStatusTransitions(ctx context.Context, entityType, entityID string) ([]model.StatusTransition, error) {
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT id, entity_type, entity_id, from_status, to_status, COALESCE(reason, ''), created_at
+		FROM status_transitions
+		WHERE entity_type = $1 AND entity_id = $2
+		ORDER BY created_at, id
+	`, entityType, entityID)
+	if err != nil {
+		return nil, fmt.Errorf("GetStatusTransitions: failed to query status transitions: %w", err)
+	}
+	defer rows.Close()
+
+	var transitions []model.StatusTransition
+	for rows.Next() {
+		var t model.StatusTransition
+		if err := rows.Scan(&t.ID, &t.EntityType, &t.EntityID, &t.FromStatus, &t.ToStatus, &t.Reason, &t.CreatedAt); err != nil {
+			return nil, fmt.Errorf("GetStatusTransitions: failed to scan status transition: %w", err)
+		}
+		transitions = append(transitions, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("GetStatusTransitions: rows error: %w", err)
+	}
+	return transitions, nil
+}
@@ -9,29 +9,33 @@ import (
 
 type TokenRepository interface {
 	SaveToken(ctx context.Context, token model.CryptoToken) (int, error)
-	FindTokenById(ctx context.Context, id string) (model.CryptoToken, error)
+	FindTokenById(ctx context.Context, id int) (model.CryptoToken, error)
+	FindTokenByName(ctx context.Context, name string) (model.CryptoToken, error)
+	GetAllTokens(ctx context.Context) ([]model.CryptoToken, error)
 }
 
 type tokenRepository struct {
 	db *sql.DB
 }
 
-// Implement SaveToken, FindTokenByID here
+const createCryptoTokensTable = `
+	CREATE TABLE IF NOT EXISTS crypto_tokens (
+		id SERIAL PRIMARY KEY,
+		name VARCHAR NOT NULL UNIQUE,
+		backend VARCHAR NOT NULL,
+		slot_id INTEGER NOT NULL,
+		pin_ref VARCHAR NOT NULL,
+		CONSTRAINT unique_backend_slot UNIQUE (backend, slot_id)
+	);
+`
+
+const tokenColumns = "id, name, backend, slot_id, pin_ref"
+
 func NewTokenRepository(db *sql.DB) (TokenRepository, error) {
 	if db == nil {
 		return nil, fmt.Errorf("NewTokenRepository: database connection is nil")
 	}
-	_, err := db.Exec(`
-		CREATE TABLE IF NOT EXIST crypto_tokens (
-			id SERIAL PRIMARY KEY ,
-			name VARCHAR NOT NULL UNIQUE,
-			backend VARCHAR NOT NULL ,
-			slot_id INTERGER NOT NULL,
-			pin_ref VARCHAR NOT NULL,
-			CONSTRAINT unique_backend_slot UNIQUE (backend, slot_id),
-		);
-	`)
-
+	_, err := db.Exec(createCryptoTokensTable)
 	if err != nil {
 		return nil, fmt.Errorf("NewTokenRepository: failed to create crypto_tokens table: %w", err)
 	}
@@ -39,35 +43,74 @@ func NewTokenRepository(db *sql.DB) (TokenRepository, error) {
 }
 
 func (r *tokenRepository) SaveToken(ctx context.Context, token model.CryptoToken) (int, error) {
-	query := `INSERT INTO crypto_tokens (name, backend, slot_id, pin_ref) 
-			VALUEs  $1, $2, $3, $4
+	query := `INSERT INTO crypto_tokens (name, backend, slot_id, pin_ref)
+			VALUES ($1, $2, $3, $4)
 			RETURNING id
 	`
 	var id int
 
 	err := r.db.QueryRowContext(ctx, query, token.Name, token.Backend, token.SlotID, token.PinRef).Scan(&id)
 	if err != nil {
-		return 0, fmt.Errorf("SaveToken: failed to save token, %w", err)
+		return 0, fmt.Errorf("SaveToken: failed to save token: %w", err)
 	}
 
 	return id, nil
 }
-func (r *tokenRepository) FindTokenById(ctx context.Context, id string) (model.CryptoToken, error) {
-	query := `
-	SELECT id, name, backend, slot_id, pin_ref 
-	FROM crypto_tokens
-	WHERE crypto_tokens.id = $1
-	`
 
-	var token model.CryptoToken
+func (r *tokenRepository) FindTokenById(ctx context.Context, id int) (model.CryptoToken, error) {
+	query := `SELECT ` + tokenColumns + ` FROM crypto_tokens WHERE id = $1`
+
+	token, err := scanToken(r.db.QueryRowContext(ctx, query, id))
+	if err == sql.ErrNoRows {
+		return model.CryptoToken{}, fmt.Errorf("FindTokenById: token not found: %w", err)
+	}
+	if err != nil {
+		return model.CryptoToken{}, fmt.Errorf("FindTokenById: failed to find token: %w", err)
+	}
+
+	return token, nil
+}
 
-	err := r.db.QueryRowContext(ctx, query, id).Scan(&token.ID, &token.Name, &token.Backend, &token.SlotID, &token.PinRef)
+func (r *tokenRepository) FindTokenByName(ctx context.Context, name string) (model.CryptoToken, error) {
+	query := `SELECT ` + tokenColumns + ` FROM crypto_tokens WHERE name = $1`
+
+	token, err := scanToken(r.db.QueryRowContext(ctx, query, name))
 	if err == sql.ErrNoRows {
-		return model.CryptoToken{}, fmt.Errorf("FindTokenById: token not found, %w", err)
+		return model.CryptoToken{}, fmt.Errorf("FindTokenByName: token %s not found: %w", name, err)
 	}
 	if err != nil {
-		return model.CryptoToken{}, fmt.Errorf("FindTokenById: failed to find token")
+		return model.CryptoToken{}, fmt.Errorf("FindTokenByName: failed to find token: %w", err)
 	}
 
 	return token, nil
 }
+
+func (r *tokenRepository) GetAllTokens(ctx context.Context) ([]model.CryptoToken, error) {
+	query := `SELECT ` + tokenColumns + ` FROM crypto_tokens ORDER BY id`
+
+	rows, err := r.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("GetAllTokens: failed to query tokens: %w", err)
+	}
+	defer rows.Close()
+
+	var tokens []model.CryptoToken
+	for rows.Next() {
+		token, err := scanToken(rows)
+		if err != nil {
+			return nil, fmt.Errorf("GetAllTokens: failed to scan token: %w", err)
+		}
+		tokens = append(tokens, token)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("GetAllTokens: error iterating tokens: %w", err)
+	}
+
+	return tokens, nil
+}
+
+func scanToken(row rowScanner) (model.CryptoToken, error) {
+	var token model.CryptoToken
+	err := row.Scan(&token.ID, &token.Name, &token.Backend, &token.SlotID, &token.PinRef)
+	return token, err
+}
@@ -0,0 +1,260 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"core-ca/ca/model"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"slices"
+	"time"
+)
+
+// CrossCertify has one CA certify the subject and current key of another, so
+// that clients trusting only the root of the issuer can validate the
+// certificates below the subject, e.g. while migrating from a legacy
+// hierarchy. The cross-certificate carries its own path length, name
+// constraints and policies, checked against the issuer's chain like those of
+// a new subordinate CA, and by default lasts as long as the subject's current
+// certificate, never longer than any certificate of the issuer's chain.
+func (s *caService) CrossCertify(ctx context.Context, req model.CrossCertify) (model.CrossCertificate, error) {
+	if req.IssuerCAID == req.SubjectCAID {
+		return model.CrossCertificate{}, fmt.Errorf("%w: a CA cannot cross-certify itself", model.ErrInvalidCrossCertification)
+	}
+	if req.ValidityDays < 0 {
+		return model.CrossCertificate{}, fmt.Errorf("%w: validity_days must not be negative", model.ErrInvalidCrossCertification)
+	}
+	issuer, err := s.repo.FindCAByID(ctx, req.IssuerCAID)
+	if err != nil {
+		return model.CrossCertificate{}, fmt.Errorf("failed to find issuer CA: %w", err)
+	}
+	subject, err := s.repo.FindCAByID(ctx, req.SubjectCAID)
+	if err != nil {
+		return model.CrossCertificate{}, fmt.Errorf("failed to find subject CA: %w", err)
+	}
+	subjectCert, err := parseCertificatePEM(subject.CertPEM)
+	if err != nil {
+		return model.CrossCertificate{}, fmt.Errorf("failed to parse certificate of CA %s: %w", subject.Name, err)
+	}
+
+	// Paths through the cross-certificate must not loop back to the subject
+	issuerChain, err := s.repo.GetCAChain(ctx, issuer.ID)
+	if err != nil {
+		return model.CrossCertificate{}, fmt.Errorf("failed to get CA chain: %w", err)
+	}
+	if slices.ContainsFunc(issuerChain, func(ca model.CA) bool { return ca.ID == subject.ID }) {
+		return model.CrossCertificate{}, fmt.Errorf("%w: CA %s is certified by CA %s", model.ErrInvalidCrossCertification, issuer.Name, subject.Name)
+	}
+	issuers, err := s.caChainCertificates(ctx, issuer.ID)
+	if err != nil {
+		return model.CrossCertificate{}, err
+	}
+	issuerCert := issuers[0]
+
+	// By default the subject keeps its own path length, within what the issuers allow
+	maxPathLen := req.MaxPathLen
+	if maxPathLen == nil {
+		n := subjectCert.MaxPathLen
+		if n == 0 && !subjectCert.MaxPathLenZero {
+			n = -1
+		}
+		if allowance := pathLenAllowance(issuers); allowance >= 0 && (n < 0 || n > allowance) {
+			n = allowance
+		}
+		maxPathLen = &n
+	}
+	constraints, err := parseCAConstraints(model.CACreate{
+		Type:            model.SubordinateCAType,
+		MaxPathLen:      maxPathLen,
+		NameConstraints: req.NameConstraints,
+		Policies:        req.Policies,
+	})
+	if err != nil {
+		return model.CrossCertificate{}, err
+	}
+	if err := checkCAConstraints(constraints, issuers); err != nil {
+		return model.CrossCertificate{}, err
+	}
+
+	notBefore := time.Now()
+	notAfter := subjectCert.NotAfter
+	if req.ValidityDays > 0 {
+		notAfter = notBefore.Add(time.Duration(req.ValidityDays) * 24 * time.Hour)
+	}
+	for _, cert := range issuers {
+		if notAfter.After(cert.NotAfter) {
+			notAfter = cert.NotAfter
+		}
+	}
+	if err := checkIssuerValidity(notAfter, issuers); err != nil {
+		return model.CrossCertificate{}, err
+	}
+	if !notAfter.After(notBefore) {
+		return model.CrossCertificate{}, fmt.Errorf("%w: the certificate of CA %s or %s has expired", model.ErrInvalidCrossCertification, subject.Name, issuer.Name)
+	}
+
+	signer, err := s.signerForCA(ctx, issuer, model.KeyUsageCertSign)
+	if err != nil {
+		return model.CrossCertificate{}, fmt.Errorf("failed to get signer for issuer CA key: %w", err)
+	}
+	sigAlg, err := parseSignatureAlgorithm(issuer.SignatureAlgorithm, signer.Public())
+	if err != nil {
+		return model.CrossCertificate{}, err
+	}
+	serialNumber, err := s.newSerialNumber(ctx, issuer)
+	if err != nil {
+		return model.CrossCertificate{}, err
+	}
+	subjectKeyID := subjectCert.SubjectKeyId
+	if len(subjectKeyID) == 0 {
+		sum := sha1.Sum(subjectCert.RawSubjectPublicKeyInfo)
+		subjectKeyID = sum[:]
+	}
+	keyUsage := subjectCert.KeyUsage
+	if keyUsage == 0 {
+		keyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+	}
+	template := x509.Certificate{
+		RawSubject:            subjectCert.RawSubject,
+		SerialNumber:          serialNumber,
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		SubjectKeyId:          subjectKeyID,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              keyUsage,
+		ExtKeyUsage:           subjectCert.ExtKeyUsage,
+		SignatureAlgorithm:    sigAlg,
+	}
+	applyCAConstraints(&template, constraints)
+	s.setIssuerURLs(&template, issuer)
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, issuerCert, subjectCert.PublicKey, signer)
+	if err != nil {
+		return model.CrossCertificate{}, fmt.Errorf("failed to create cross-certificate: %w", err)
+	}
+	cross := model.CrossCertificate{
+		IssuerCAID:   issuer.ID,
+		SubjectCAID:  subject.ID,
+		SerialNumber: serialNumber.String(),
+		CertPEM:      string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+		CreatedAt:    notBefore,
+	}
+	cross.ID, err = s.repo.SaveCrossCertificate(ctx, cross)
+	if err != nil {
+		return model.CrossCertificate{}, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return model.CrossCertificate{}, fmt.Errorf("failed to parse cross-certificate: %w", err)
+	}
+	if err := s.recordCACertificate(ctx, issuer, issuer.Generation, cert); err != nil {
+		return model.CrossCertificate{}, err
+	}
+	log.Printf("CA %s (id %d) cross-certified CA %s (id %d), serial %s", issuer.Name, issuer.ID, subject.Name, subject.ID, cross.SerialNumber)
+	return cross, nil
+}
+
+// pathLenAllowance returns how many CAs the issuers, from the parent up to
+// the root, allow below a new CA, or -1 for no limit.
+func pathLenAllowance(issuers []*x509.Certificate) int {
+	allowance := -1
+	for i, issuer := range issuers {
+		if issuer.MaxPathLen < 0 || issuer.MaxPathLen == 0 && !issuer.MaxPathLenZero {
+			continue
+		}
+		remaining := max(issuer.MaxPathLen-i-1, 0)
+		if allowance < 0 || remaining < allowance {
+			allowance = remaining
+		}
+	}
+	return allowance
+}
+
+// GetCrossCertificates returns the cross-certificates a CA issued or is the subject of.
+func (s *caService) GetCrossCertificates(ctx context.Context, caID int) ([]model.CrossCertificate, error) {
+	if _, err := s.repo.FindCAByID(ctx, caID); err != nil {
+		return nil, fmt.Errorf("failed to find CA: %w", err)
+	}
+	return s.repo.GetCrossCertificates(ctx, caID)
+}
+
+// GetAlternateChains returns the certification paths of a CA through
+// cross-certificates, each from the CA's certificate up to another root, in
+// PEM. For every CA on the CA's own chain cross-certified by a CA outside
+// it, a path continues from that CA with the cross-certificate and the
+// issuer's chain.
+func (s *caService) GetAlternateChains(ctx context.Context, caID int) ([]string, error) {
+	paths, err := s.alternateChains(ctx, caID)
+	if err != nil {
+		return nil, err
+	}
+	chains := make([]string, 0, len(paths))
+	for _, path := range paths {
+		var chain bytes.Buffer
+		for _, cert := range path {
+			chain.Write(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))
+		}
+		chains = append(chains, chain.String())
+	}
+	return chains, nil
+}
+
+func (s *caService) alternateChains(ctx context.Context, caID int) ([][]*x509.Certificate, error) {
+	chain, err := s.repo.GetCAChain(ctx, caID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get CA chain: %w", err)
+	}
+	certs, err := s.caChainCertificates(ctx, caID)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	var paths [][]*x509.Certificate
+	for i, ca := range chain {
+		crosses, err := s.repo.GetCrossCertificates(ctx, ca.ID)
+		if err != nil {
+			return nil, err
+		}
+		for _, cc := range crosses {
+			if cc.SubjectCAID != ca.ID || now.Before(cc.NotBefore) || now.After(cc.NotAfter) {
+				continue
+			}
+			cross, err := parseCertificatePEM(cc.CertPEM)
+			if err != nil {
+				log.Printf("failed to parse cross-certificate %s: %v", cc.SerialNumber, err)
+				continue
+			}
+			// The CA may have been re-keyed since it was cross-certified
+			if !bytes.Equal(cross.RawSubjectPublicKeyInfo, certs[i].RawSubjectPublicKeyInfo) {
+				continue
+			}
+			issuer, err := s.repo.FindCAByID(ctx, cc.IssuerCAID)
+			if err != nil {
+				// Only active issuers make a path
+				continue
+			}
+			issuers, err := s.caChainCertificates(ctx, issuer.ID)
+			if err != nil {
+				return nil, err
+			}
+			issuers[0] = s.issuingGeneration(ctx, issuer, issuers[0], cross)
+			// Skip paths that would pass a CA twice
+			if slices.ContainsFunc(issuers, func(c *x509.Certificate) bool {
+				return slices.ContainsFunc(certs[:i+1], func(p *x509.Certificate) bool { return bytes.Equal(c.RawSubject, p.RawSubject) })
+			}) {
+				continue
+			}
+			path := append(slices.Clone(certs[:i]), cross)
+			paths = append(paths, append(path, issuers...))
+		}
+	}
+	return paths, nil
+}
@@ -0,0 +1,79 @@
+package service
+
+import (
+	"context"
+	"core-ca/ca/model"
+	keymodel "core-ca/keymanagement/model"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// reissueRoot replaces the certificate of a root CA with one signed by the
+// same key and valid from notBefore to notAfter.
+func reissueRoot(t *testing.T, s *caService, repo *memoryRepository, root model.CA, notBefore, notAfter time.Time) {
+	t.Helper()
+	cert := parsePEMCertificate(t, root.CertPEM)
+	signer, err := s.signerForCA(context.Background(), root, model.KeyUsageCertSign)
+	if err != nil {
+		t.Fatalf("signerForCA: %v", err)
+	}
+	template := *cert
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore, template.NotAfter = notBefore, notAfter
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, signer.Public(), signer)
+	if err != nil {
+		t.Fatalf("CreateCertificate: %v", err)
+	}
+	root.CertPEM = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	repo.cas[root.ID] = root
+}
+
+func TestCrossCertifyWithinIssuerChain(t *testing.T) {
+	s, repo := newTestCAService(t)
+	ctx := context.Background()
+
+	root, err := s.CreateCA(ctx, model.CACreate{Name: "Test Root", Type: model.RootCAType, KeyAlgorithm: keymodel.KeyAlgorithmECP256})
+	if err != nil {
+		t.Fatalf("CreateCA: %v", err)
+	}
+	sub, err := s.CreateCA(ctx, model.CACreate{Name: "Test Sub", Type: model.SubordinateCAType, ParentCAID: &root.ID, KeyAlgorithm: keymodel.KeyAlgorithmECP256, MaxPathLen: pathLen(1)})
+	if err != nil {
+		t.Fatalf("CreateCA: %v", err)
+	}
+	legacy, err := s.CreateCA(ctx, model.CACreate{Name: "Legacy Root", Type: model.RootCAType, KeyAlgorithm: keymodel.KeyAlgorithmECP256})
+	if err != nil {
+		t.Fatalf("CreateCA: %v", err)
+	}
+	subCert := parsePEMCertificate(t, sub.CertPEM)
+
+	// The root now expires before the sub CA it certified
+	rootNotAfter := time.Now().Add(30 * 24 * time.Hour).Truncate(time.Second)
+	reissueRoot(t, s, repo, root, time.Now().Add(-time.Hour), rootNotAfter)
+	if !subCert.NotAfter.After(rootNotAfter) {
+		t.Fatalf("sub CA expires on %s, before its parent", subCert.NotAfter)
+	}
+	for _, validityDays := range []int{0, 365} {
+		cross, err := s.CrossCertify(ctx, model.CrossCertify{IssuerCAID: sub.ID, SubjectCAID: legacy.ID, ValidityDays: validityDays})
+		if err != nil {
+			t.Fatalf("CrossCertify for %d days: %v", validityDays, err)
+		}
+		cert := parsePEMCertificate(t, cross.CertPEM)
+		if !cert.NotAfter.Equal(rootNotAfter) || !cross.NotAfter.Equal(rootNotAfter) {
+			t.Errorf("cross-certificate for %d days expires on %s, want the root's %s", validityDays, cert.NotAfter, rootNotAfter)
+		}
+		if err := cert.CheckSignatureFrom(subCert); err != nil {
+			t.Errorf("cross-certificate not signed by the sub CA: %v", err)
+		}
+	}
+
+	// An expired parent refuses, as for issuing
+	reissueRoot(t, s, repo, root, time.Now().Add(-48*time.Hour), time.Now().Add(-time.Hour))
+	if _, err := s.CrossCertify(ctx, model.CrossCertify{IssuerCAID: sub.ID, SubjectCAID: legacy.ID}); !errors.Is(err, model.ErrCAExpired) {
+		t.Fatalf("CrossCertify under an expired root: %v, want ErrCAExpired", err)
+	}
+}
@@ -0,0 +1,148 @@
+package service
+
+import (
+	"context"
+	"core-ca/ca/model"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// DefaultExpiryCheckInterval is how often MonitorExpiry looks for expired
+// CAs and certificates when no interval is configured.
+const DefaultExpiryCheckInterval = time.Hour
+
+// checkIssuerValidity refuses to issue a certificate valid until notAfter
+// under issuers, the issuing CA first, when one of them has expired or
+// expires first.
+func checkIssuerValidity(notAfter time.Time, issuers []*x509.Certificate) error {
+	now := time.Now()
+	for _, issuer := range issuers {
+		if now.After(issuer.NotAfter) {
+			return fmt.Errorf("%w: %s expired on %s; renew that CA with POST /ca/{id}/renew first", model.ErrCAExpired, issuer.Subject, issuer.NotAfter.Format(time.RFC3339))
+		}
+		if notAfter.After(issuer.NotAfter) {
+			return fmt.Errorf("%w: %s expires on %s, before %s; renew that CA with POST /ca/{id}/renew first", model.ErrCAValidityExceeded,
+				issuer.Subject, issuer.NotAfter.Format(time.RFC3339), notAfter.Format(time.RFC3339))
+		}
+	}
+	return nil
+}
+
+// MonitorExpiry runs ExpireCertificates now and then every interval
+// (DefaultExpiryCheckInterval when zero, never when negative) until ctx is done.
+func (s *caService) MonitorExpiry(ctx context.Context, interval time.Duration) {
+	if interval < 0 {
+		return
+	}
+	if interval == 0 {
+		interval = DefaultExpiryCheckInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := s.ExpireCertificates(ctx); err != nil {
+			log.Printf("ca: expiry check failed: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ExpireCertificates marks the active or held CAs whose current certificate
+// has expired, and the valid certificates past their not_after, expired.
+// Each transition is recorded.
+func (s *caService) ExpireCertificates(ctx context.Context) (model.ExpiryResult, error) {
+	now := time.Now()
+	result := model.ExpiryResult{}
+
+	cas, err := s.repo.GetAllCAs(ctx)
+	if err != nil {
+		return result, fmt.Errorf("failed to list CAs: %w", err)
+	}
+	for _, ca := range cas {
+		if ca.Status != model.ActiveCAStatus && ca.Status != model.HoldCAStatus {
+			continue
+		}
+		cert, err := parseCertificatePEM(ca.CertPEM)
+		if err != nil {
+			log.Printf("ca: failed to parse certificate of CA %s (id %d): %v", ca.Name, ca.ID, err)
+			continue
+		}
+		if !now.After(cert.NotAfter) {
+			continue
+		}
+		reason := "certificate expired on " + cert.NotAfter.Format(time.RFC3339)
+		err = s.repo.TransitionCAStatus(ctx, ca.ID, ca.Status, model.ExpiredCaStatus, reason)
+		if errors.Is(err, model.ErrCAStatusChanged) {
+			// Revoked or released in the meantime; the next check sees the new status
+			continue
+		}
+		if err != nil {
+			return result, err
+		}
+		log.Printf("ca: CA %s (id %d) %s, marked expired", ca.Name, ca.ID, reason)
+		result.ExpiredCAs = append(result.ExpiredCAs, ca.ID)
+	}
+
+	serials, err := s.repo.ExpireCertificates(ctx, now)
+	if err != nil {
+		return result, err
+	}
+	if len(serials) > 0 {
+		log.Printf("ca: marked %d certificate(s) expired", len(serials))
+	}
+	result.ExpiredCertificates = serials
+	return result, nil
+}
+
+// UpdateCAStatus sets the status of an active, expired or unknown CA to one
+// of these and records the transition. Other statuses are set by the
+// operations that publish them (revoke, release, activate, delete), and a
+// CA whose certificate has expired is made active again by renewing it.
+func (s *caService) UpdateCAStatus(ctx context.Context, caID int, status model.CAStatus) error {
+	settable := []model.CAStatus{model.ActiveCAStatus, model.ExpiredCaStatus, model.UnknownCaStatus}
+	if !slices.Contains(settable, status) {
+		return fmt.Errorf("%w: %q, valid statuses are active, expired and unknown; revoke or hold a CA with /ca/{id}/revoke", model.ErrInvalidCAStatus, status)
+	}
+	chain, err := s.repo.GetCAChain(ctx, caID)
+	if err != nil {
+		return fmt.Errorf("failed to find CA: %w", err)
+	}
+	ca := chain[0]
+	if !slices.Contains(settable, ca.Status) {
+		return fmt.Errorf("%w: CA %s is %s", model.ErrInvalidCAStatus, ca.Name, ca.Status)
+	}
+	if ca.Status == status {
+		return nil
+	}
+	if status == model.ActiveCAStatus {
+		cert, err := parseCertificatePEM(ca.CertPEM)
+		if err != nil {
+			return fmt.Errorf("failed to parse certificate of CA %s: %w", ca.Name, err)
+		}
+		if time.Now().After(cert.NotAfter) {
+			return fmt.Errorf("%w: CA %s expired on %s; renewing it with POST /ca/%d/renew makes it active again", model.ErrCAExpired, ca.Name, cert.NotAfter.Format(time.RFC3339), ca.ID)
+		}
+	}
+	return s.repo.TransitionCAStatus(ctx, caID, ca.Status, status, "status update")
+}
+
+// GetCAStatusTransitions returns the status transitions of a CA, the oldest first.
+func (s *caService) GetCAStatusTransitions(ctx context.Context, caID int) ([]model.StatusTransition, error) {
+	return s.repo.GetStatusTransitions(ctx, model.TransitionEntityCA, strconv.Itoa(caID))
+}
+
+// GetCertificateStatusTransitions returns the status transitions of a
+// certificate, the oldest first.
+func (s *caService) GetCertificateStatusTransitions(ctx context.Context, serialNumber string) ([]model.StatusTransition, error) {
+	return s.repo.GetStatusTransitions(ctx, model.TransitionEntityCertificate, serialNumber)
+}
@@ -0,0 +1,71 @@
+package service
+
+import (
+	"context"
+	"core-ca/ca/model"
+	"errors"
+	"fmt"
+	"log"
+)
+
+// ReleaseCertificate takes a certificate off hold: it leaves the full CRL,
+// is listed as removeFromCRL in the next delta CRL and is good again in OCSP.
+func (s *caService) ReleaseCertificate(ctx context.Context, serialNumber string) error {
+	certData, err := s.repo.FindBySerialNumber(ctx, serialNumber)
+	if err != nil || certData.SerialNumber == "" {
+		return errors.New("certificate not found")
+	}
+	return s.repo.Release(ctx, serialNumber)
+}
+
+// ReleaseCA takes a CA on hold off hold, releasing the certificates that
+// were held with it, and makes it active again.
+func (s *caService) ReleaseCA(ctx context.Context, caID int) (model.CA, error) {
+	ca, err := s.repo.FindHeldCAByID(ctx, caID)
+	if err != nil {
+		return model.CA{}, fmt.Errorf("failed to find CA: %w", err)
+	}
+	var parent *model.CA
+	if ca.ParentCAID != nil {
+		chain, err := s.repo.GetCAChain(ctx, ca.ID)
+		if err != nil || len(chain) < 2 {
+			return model.CA{}, fmt.Errorf("failed to get parent of CA %s: %v", ca.Name, err)
+		}
+		parent = &chain[1]
+	}
+	serials, err := s.caCertificateSerials(ctx, ca, parent)
+	if err != nil {
+		return model.CA{}, err
+	}
+	released := 0
+	for _, serial := range serials {
+		revoked, isRevoked, err := s.repo.IsRevoked(ctx, serial)
+		if err != nil {
+			return model.CA{}, err
+		}
+		// Certificates revoked for good since the hold stay revoked
+		if !isRevoked || revoked.Reason != model.ReasonCertificateHold {
+			continue
+		}
+		if err := s.repo.Release(ctx, serial); err != nil {
+			return model.CA{}, fmt.Errorf("failed to release certificate %s of CA %s: %w", serial, ca.Name, err)
+		}
+		released++
+	}
+	if err := s.repo.TransitionCAStatus(ctx, ca.ID, model.HoldCAStatus, model.ActiveCAStatus, "released"); err != nil {
+		return model.CA{}, fmt.Errorf("failed to update CA status: %w", err)
+	}
+	ca.Status = model.ActiveCAStatus
+	log.Printf("released CA %s (id %d): %d certificate(s)", ca.Name, ca.ID, released)
+	return ca, nil
+}
+
+// GetDeltaCRL returns the delta CRL of a CA: the revocations and releases
+// since the oldest full CRL still valid.
+func (s *caService) GetDeltaCRL(ctx context.Context, caID int) ([]byte, error) {
+	ca, err := s.repo.FindCAByIDAnyStatus(ctx, caID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find CA: %w", err)
+	}
+	return s.generationCRL(ctx, ca, ca.Generation, deltaCRL)
+}
@@ -0,0 +1,253 @@
+package service
+
+import (
+	"context"
+	"core-ca/ca/model"
+	keymodel "core-ca/keymanagement/model"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// parseCRL decodes a PEM CRL and checks that issuer signed it.
+func parseCRL(t *testing.T, crlPEM []byte, issuer *x509.Certificate) *x509.RevocationList {
+	t.Helper()
+	block, _ := pem.Decode(crlPEM)
+	if block == nil {
+		t.Fatal("CRL is not PEM")
+	}
+	crl, err := x509.ParseRevocationList(block.Bytes)
+	if err != nil {
+		t.Fatalf("ParseRevocationList: %v", err)
+	}
+	if err := crl.CheckSignatureFrom(issuer); err != nil {
+		t.Fatalf("CRL signature: %v", err)
+	}
+	return crl
+}
+
+// crlReasons maps the serial numbers a CRL lists to their reason codes.
+func crlReasons(crl *x509.RevocationList) map[string]int {
+	reasons := make(map[string]int)
+	for _, entry := range crl.RevokedCertificateEntries {
+		reasons[entry.SerialNumber.String()] = entry.ReasonCode
+	}
+	return reasons
+}
+
+func isDeltaCRL(crl *x509.RevocationList) bool {
+	for _, ext := range crl.Extensions {
+		if ext.Id.Equal(oidDeltaCRLIndicator) {
+			return ext.Critical
+		}
+	}
+	return false
+}
+
+func TestHoldReleaseAndDeltaCRL(t *testing.T) {
+	s, repo := newTestCAService(t)
+	ctx := context.Background()
+
+	root, err := s.CreateCA(ctx, model.CACreate{Name: "Test Root", Type: model.RootCAType, KeyAlgorithm: keymodel.KeyAlgorithmECP256})
+	if err != nil {
+		t.Fatalf("CreateCA: %v", err)
+	}
+	rootCert := parsePEMCertificate(t, root.CertPEM)
+	issue := func(cn string) (model.Certificate, *x509.Certificate) {
+		issued, err := s.IssueCertificate(ctx, newCSR(t, cn), root.ID)
+		if err != nil {
+			t.Fatalf("IssueCertificate: %v", err)
+		}
+		return issued, parsePEMCertificate(t, issued.CertPEM)
+	}
+	released, releasedCert := issue("released.example.com")
+	revoked, revokedCert := issue("revoked.example.com")
+	old, _ := issue("old.example.com")
+
+	// A revocation older than the oldest full CRL still valid is not in the delta
+	if err := s.RevokeCertificate(ctx, old.SerialNumber, model.ReasonSuperseded); err != nil {
+		t.Fatalf("RevokeCertificate: %v", err)
+	}
+	repo.updated[old.SerialNumber] = time.Now().Add(-crlValidity - time.Hour)
+
+	for _, serial := range []string{released.SerialNumber, revoked.SerialNumber} {
+		if err := s.RevokeCertificate(ctx, serial, model.ReasonCertificateHold); err != nil {
+			t.Fatalf("hold: %v", err)
+		}
+	}
+	if err := s.RevokeCertificate(ctx, released.SerialNumber, model.ReasonCertificateHold); !errors.Is(err, model.ErrAlreadyRevoked) {
+		t.Fatalf("second hold: %v, want ErrAlreadyRevoked", err)
+	}
+	for _, cert := range []*x509.Certificate{releasedCert, revokedCert} {
+		response := ocspStatus(t, s, root.ID, cert, rootCert)
+		if response.Status != ocsp.Revoked || response.RevocationReason != ocsp.CertificateHold {
+			t.Fatalf("OCSP status on hold = %d (reason %d), want revoked for certificateHold", response.Status, response.RevocationReason)
+		}
+	}
+	holdDate := repo.revoked[revoked.SerialNumber].RevocationDate
+
+	// Taking a certificate off hold makes it good again
+	if err := s.ReleaseCertificate(ctx, released.SerialNumber); err != nil {
+		t.Fatalf("ReleaseCertificate: %v", err)
+	}
+	if err := s.ReleaseCertificate(ctx, released.SerialNumber); !errors.Is(err, model.ErrNotOnHold) {
+		t.Fatalf("second ReleaseCertificate: %v, want ErrNotOnHold", err)
+	}
+	if response := ocspStatus(t, s, root.ID, releasedCert, rootCert); response.Status != ocsp.Good {
+		t.Fatalf("OCSP status after release = %d, want good", response.Status)
+	}
+	if repo.certs[released.SerialNumber].Status != model.StatusValid {
+		t.Fatalf("status after release = %s, want valid", repo.certs[released.SerialNumber].Status)
+	}
+
+	// A hold becomes a permanent revocation and can no longer be released
+	if err := s.RevokeCertificate(ctx, revoked.SerialNumber, model.ReasonKeyCompromise); err != nil {
+		t.Fatalf("revoke on hold: %v", err)
+	}
+	if err := s.ReleaseCertificate(ctx, revoked.SerialNumber); !errors.Is(err, model.ErrNotOnHold) {
+		t.Fatalf("ReleaseCertificate of a revoked certificate: %v, want ErrNotOnHold", err)
+	}
+	response := ocspStatus(t, s, root.ID, revokedCert, rootCert)
+	if response.Status != ocsp.Revoked || response.RevocationReason != ocsp.KeyCompromise {
+		t.Fatalf("OCSP status after revocation = %d (reason %d), want revoked for keyCompromise", response.Status, response.RevocationReason)
+	}
+	if !response.RevokedAt.Equal(holdDate.UTC().Truncate(time.Second)) {
+		t.Errorf("revoked at %s, want the hold date %s", response.RevokedAt, holdDate)
+	}
+
+	crlPEM, err := s.GetCRL(ctx, root.ID)
+	if err != nil {
+		t.Fatalf("GetCRL: %v", err)
+	}
+	crl := parseCRL(t, crlPEM, rootCert)
+	if isDeltaCRL(crl) {
+		t.Error("the full CRL has a delta CRL indicator")
+	}
+	if got := crlReasons(crl); len(got) != 2 || got[revoked.SerialNumber] != ocsp.KeyCompromise || got[old.SerialNumber] != ocsp.Superseded {
+		t.Fatalf("full CRL reasons %v, want the revoked and old certificates only", got)
+	}
+
+	deltaPEM, err := s.GetDeltaCRL(ctx, root.ID)
+	if err != nil {
+		t.Fatalf("GetDeltaCRL: %v", err)
+	}
+	delta := parseCRL(t, deltaPEM, rootCert)
+	if !isDeltaCRL(delta) {
+		t.Fatal("the delta CRL has no critical delta CRL indicator")
+	}
+	if delta.Number.Cmp(crl.Number) < 0 {
+		t.Errorf("delta CRL number %d is lower than the full CRL number %d", delta.Number, crl.Number)
+	}
+	want := map[string]int{
+		released.SerialNumber: ocsp.RemoveFromCRL,
+		revoked.SerialNumber:  ocsp.KeyCompromise,
+	}
+	got := crlReasons(delta)
+	if len(got) != len(want) {
+		t.Fatalf("delta CRL reasons %v, want %v", got, want)
+	}
+	for serial, reason := range want {
+		if got[serial] != reason {
+			t.Errorf("delta CRL reason of %s = %d, want %d", serial, got[serial], reason)
+		}
+	}
+
+	// A release followed by a new hold is listed as the hold
+	if err := s.RevokeCertificate(ctx, released.SerialNumber, model.ReasonCertificateHold); err != nil {
+		t.Fatalf("hold after release: %v", err)
+	}
+	deltaPEM, err = s.GetDeltaCRL(ctx, root.ID)
+	if err != nil {
+		t.Fatalf("GetDeltaCRL: %v", err)
+	}
+	if got := crlReasons(parseCRL(t, deltaPEM, rootCert)); len(got) != 2 || got[released.SerialNumber] != ocsp.CertificateHold {
+		t.Fatalf("delta CRL reasons after a new hold %v, want certificateHold", got)
+	}
+}
+
+func TestHoldAndReleaseCA(t *testing.T) {
+	s, repo := newTestCAService(t)
+	ctx := context.Background()
+
+	root, err := s.CreateCA(ctx, model.CACreate{Name: "Test Root", Type: model.RootCAType, KeyAlgorithm: keymodel.KeyAlgorithmECP256})
+	if err != nil {
+		t.Fatalf("CreateCA: %v", err)
+	}
+	rootCert := parsePEMCertificate(t, root.CertPEM)
+	sub, err := s.CreateCA(ctx, model.CACreate{Name: "Test Sub", Type: model.SubordinateCAType, ParentCAID: &root.ID, KeyAlgorithm: keymodel.KeyAlgorithmECP256})
+	if err != nil {
+		t.Fatalf("CreateCA: %v", err)
+	}
+	subCert := parsePEMCertificate(t, sub.CertPEM)
+
+	if _, err := s.RevokeCA(ctx, sub.ID, model.CARevocation{Reason: model.ReasonCertificateHold, RevokeLeaves: true}); !errors.Is(err, model.ErrInvalidRevocation) {
+		t.Fatalf("hold with RevokeLeaves: %v, want ErrInvalidRevocation", err)
+	}
+	if _, err := s.ReleaseCA(ctx, sub.ID); !errors.Is(err, model.ErrNotOnHold) {
+		t.Fatalf("ReleaseCA of an active CA: %v, want ErrNotOnHold", err)
+	}
+	if _, err := s.RevokeCA(ctx, sub.ID, model.CARevocation{Reason: model.ReasonCertificateHold}); err != nil {
+		t.Fatalf("hold: %v", err)
+	}
+	if repo.cas[sub.ID].Status != model.HoldCAStatus {
+		t.Fatalf("CA status = %s, want hold", repo.cas[sub.ID].Status)
+	}
+	if _, err := s.IssueCertificate(ctx, newCSR(t, "www.example.com"), sub.ID); err == nil {
+		t.Fatal("a CA on hold issued a certificate")
+	}
+	response := ocspStatus(t, s, root.ID, subCert, rootCert)
+	if response.Status != ocsp.Revoked || response.RevocationReason != ocsp.CertificateHold {
+		t.Fatalf("OCSP status on hold = %d (reason %d), want revoked for certificateHold", response.Status, response.RevocationReason)
+	}
+
+	released, err := s.ReleaseCA(ctx, sub.ID)
+	if err != nil {
+		t.Fatalf("ReleaseCA: %v", err)
+	}
+	if released.Status != model.ActiveCAStatus || repo.cas[sub.ID].Status != model.ActiveCAStatus {
+		t.Fatalf("CA status after release = %s, want active", repo.cas[sub.ID].Status)
+	}
+	if response := ocspStatus(t, s, root.ID, subCert, rootCert); response.Status != ocsp.Good {
+		t.Fatalf("OCSP status after release = %d, want good", response.Status)
+	}
+	if _, err := s.IssueCertificate(ctx, newCSR(t, "www.example.com"), sub.ID); err != nil {
+		t.Fatalf("IssueCertificate after release: %v", err)
+	}
+
+	deltaPEM, err := s.GetDeltaCRL(ctx, root.ID)
+	if err != nil {
+		t.Fatalf("GetDeltaCRL: %v", err)
+	}
+	got := crlReasons(parseCRL(t, deltaPEM, rootCert))
+	if serial := subCert.SerialNumber.String(); len(got) != 1 || got[serial] != ocsp.RemoveFromCRL {
+		t.Fatalf("delta CRL reasons %v, want %s as removeFromCRL", got, serial)
+	}
+
+	// A CA on hold can be revoked for good, and then stays revoked
+	if _, err := s.RevokeCA(ctx, sub.ID, model.CARevocation{Reason: model.ReasonCertificateHold}); err != nil {
+		t.Fatalf("second hold: %v", err)
+	}
+	if _, err := s.RevokeCA(ctx, sub.ID, model.CARevocation{Reason: model.ReasonKeyCompromise}); err != nil {
+		t.Fatalf("revoke on hold: %v", err)
+	}
+	if _, err := s.ReleaseCA(ctx, sub.ID); !errors.Is(err, model.ErrNotOnHold) {
+		t.Fatalf("ReleaseCA of a revoked CA: %v, want ErrNotOnHold", err)
+	}
+	response = ocspStatus(t, s, root.ID, subCert, rootCert)
+	if response.Status != ocsp.Revoked || response.RevocationReason != ocsp.KeyCompromise {
+		t.Fatalf("OCSP status after revocation = %d (reason %d), want revoked for keyCompromise", response.Status, response.RevocationReason)
+	}
+	arlPEM, err := s.GetARL(ctx, root.ID)
+	if err != nil {
+		t.Fatalf("GetARL: %v", err)
+	}
+	arl := parseCRL(t, arlPEM, rootCert)
+	if len(arl.RevokedCertificateEntries) != 1 || arl.RevokedCertificateEntries[0].SerialNumber.Cmp(subCert.SerialNumber) != 0 ||
+		arl.RevokedCertificateEntries[0].ReasonCode != ocsp.KeyCompromise {
+		t.Fatalf("ARL entries %+v, want the CA certificate for keyCompromise", arl.RevokedCertificateEntries)
+	}
+}
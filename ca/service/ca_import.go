@@ -0,0 +1,201 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"core-ca/ca/model"
+	"core-ca/keymanagement/keyfile"
+	keymodel "core-ca/keymanagement/model"
+	"core-ca/keymanagement/repository"
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"time"
+)
+
+// ImportCA adopts a CA whose key was generated elsewhere. The key must match
+// the CA certificate; a self-signed certificate becomes a root CA, any other
+// a subordinate of the recorded CA whose key signed it.
+func (s *caService) ImportCA(ctx context.Context, req model.CAImport) (model.CA, error) {
+	signer, certs, err := parseCAImport(req)
+	if err != nil {
+		return model.CA{}, err
+	}
+
+	var caCert *x509.Certificate
+	for _, cert := range certs {
+		if k, ok := cert.PublicKey.(interface{ Equal(crypto.PublicKey) bool }); ok && k.Equal(signer.Public()) {
+			caCert = cert
+			break
+		}
+	}
+	if caCert == nil {
+		return model.CA{}, fmt.Errorf("%w: no certificate matches the private key", model.ErrInvalidCAImport)
+	}
+	if !caCert.BasicConstraintsValid || !caCert.IsCA {
+		return model.CA{}, fmt.Errorf("%w: certificate %s is not a CA certificate", model.ErrInvalidCAImport, caCert.Subject)
+	}
+	if caCert.KeyUsage != 0 && caCert.KeyUsage&x509.KeyUsageCertSign == 0 {
+		return model.CA{}, fmt.Errorf("%w: certificate %s does not allow certificate signing", model.ErrInvalidCAImport, caCert.Subject)
+	}
+	if time.Now().After(caCert.NotAfter) {
+		return model.CA{}, fmt.Errorf("%w: certificate %s expired on %s", model.ErrInvalidCAImport, caCert.Subject, caCert.NotAfter.Format(time.RFC3339))
+	}
+	keyAlgorithm, err := repository.KeyAlgorithmOf(signer.Public())
+	if err != nil {
+		return model.CA{}, fmt.Errorf("%w: %v", model.ErrInvalidCAImport, err)
+	}
+	if err := validateSignatureAlgorithm(req.SignatureAlgorithm, keyAlgorithm); err != nil {
+		return model.CA{}, err
+	}
+	if _, err := parseSerialPrefix(req.SerialPrefix); err != nil {
+		return model.CA{}, err
+	}
+
+	caType, parent, err := s.importedCAParent(ctx, caCert)
+	if err != nil {
+		return model.CA{}, err
+	}
+	tokenID, tokenName, err := s.resolveToken(ctx, req.TokenName)
+	if err != nil {
+		return model.CA{}, err
+	}
+	name := req.Name
+	if name == "" {
+		name = caCert.Subject.CommonName
+	}
+	if name == "" {
+		return model.CA{}, fmt.Errorf("%w: name is required for a certificate without a common name", model.ErrInvalidCAImport)
+	}
+
+	// Write the key to the token under a label no other key uses
+	keyLabel, err := newKeyLabel(name)
+	if err != nil {
+		return model.CA{}, err
+	}
+	keyPair, err := s.keyService.ImportKeyPair(tokenName, keyLabel, signer, keymodel.KeyPurposeCA)
+	if err != nil {
+		return model.CA{}, err
+	}
+	key, err := newCryptoKey(keyLabel, tokenID, keyPair.PublicKey, keyPair.Algorithm)
+	if err != nil {
+		return model.CA{}, err
+	}
+	keyID, err := s.repo.SaveKey(ctx, key)
+	if err != nil {
+		return model.CA{}, fmt.Errorf("failed to save CA key: %w", err)
+	}
+	if err := s.addKeyUsages(ctx, keyID, model.CAKeyUsages); err != nil {
+		return model.CA{}, fmt.Errorf("failed to save CA key usages: %w", err)
+	}
+
+	ca := model.CA{
+		Name:     name,
+		Type:     caType,
+		CertPEM:  string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caCert.Raw})),
+		Status:   model.ActiveCAStatus,
+		CreateAt: time.Now(),
+
+		SignatureAlgorithm: req.SignatureAlgorithm,
+		TokenID:            tokenID,
+		TokenName:          tokenName,
+		KeyID:              &keyID,
+		SerialPrefix:       req.SerialPrefix,
+		Generation:         1,
+	}
+	if parent != nil {
+		ca.ParentCAID = &parent.ID
+	}
+	ca.ID, err = s.repo.SaveCA(ctx, ca)
+	if err != nil {
+		return model.CA{}, fmt.Errorf("failed to save CA: %w", err)
+	}
+	if err := s.repo.SetKeyCA(ctx, keyID, ca.ID); err != nil {
+		return model.CA{}, fmt.Errorf("failed to link key to CA: %w", err)
+	}
+
+	if parent != nil {
+		if err := s.recordCACertificate(ctx, *parent, s.signingGeneration(ctx, *parent, caCert), caCert); err != nil {
+			return model.CA{}, err
+		}
+		log.Printf("imported %s CA %s (id %d) issued by %s (id %d) with key %s", caType, name, ca.ID, parent.Name, parent.ID, keyLabel)
+	} else {
+		log.Printf("imported %s CA %s (id %d) with key %s", caType, name, ca.ID, keyLabel)
+	}
+	return ca, nil
+}
+
+// parseCAImport decodes the private key and certificates of an import request.
+func parseCAImport(req model.CAImport) (crypto.Signer, []*x509.Certificate, error) {
+	var (
+		key   crypto.PrivateKey
+		certs []*x509.Certificate
+		err   error
+	)
+	switch {
+	case len(req.PKCS12) > 0 && (req.KeyPEM != "" || req.CertPEM != ""):
+		return nil, nil, fmt.Errorf("%w: give either a PKCS#12 file or a PEM key and certificate", model.ErrInvalidCAImport)
+	case len(req.PKCS12) > 0:
+		key, certs, err = keyfile.ParsePKCS12(req.PKCS12, req.Password)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: %v", model.ErrInvalidCAImport, err)
+		}
+	case req.KeyPEM != "" && req.CertPEM != "":
+		key, err = keyfile.ParsePrivateKeyPEM([]byte(req.KeyPEM), req.Password)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: %v", model.ErrInvalidCAImport, err)
+		}
+		certs, err = keyfile.ParseCertificatesPEM([]byte(req.CertPEM))
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: %v", model.ErrInvalidCAImport, err)
+		}
+	default:
+		return nil, nil, fmt.Errorf("%w: a PKCS#12 file or a PEM key and certificate is required", model.ErrInvalidCAImport)
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: unsupported private key type %T", model.ErrInvalidCAImport, key)
+	}
+	if len(certs) == 0 {
+		return nil, nil, fmt.Errorf("%w: no certificate given", model.ErrInvalidCAImport)
+	}
+	return signer, certs, nil
+}
+
+// importedCAParent returns the type of an imported CA and, for a subordinate,
+// the recorded CA that issued it. The certificate must not be recorded yet.
+func (s *caService) importedCAParent(ctx context.Context, caCert *x509.Certificate) (model.CAType, *model.CA, error) {
+	cas, err := s.repo.GetAllCAs(ctx)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to get CAs: %w", err)
+	}
+
+	selfSigned := bytes.Equal(caCert.RawIssuer, caCert.RawSubject) && caCert.CheckSignatureFrom(caCert) == nil
+	var parent *model.CA
+	for i, ca := range cas {
+		cert, err := parseCertificatePEM(ca.CertPEM)
+		if err != nil {
+			continue
+		}
+		if bytes.Equal(cert.Raw, caCert.Raw) {
+			return "", nil, fmt.Errorf("%w: certificate is already recorded as CA %s (id %d)", model.ErrCAExists, ca.Name, ca.ID)
+		}
+		if selfSigned || parent != nil && parent.Status == model.ActiveCAStatus {
+			continue
+		}
+		if bytes.Equal(caCert.RawIssuer, cert.RawSubject) && caCert.CheckSignatureFrom(cert) == nil {
+			parent = &cas[i]
+		}
+	}
+
+	if selfSigned {
+		return model.RootCAType, nil, nil
+	}
+	if parent == nil {
+		return "", nil, fmt.Errorf("%w: issuer %s of %s is not a recorded CA, import it first", model.ErrInvalidCAImport, caCert.Issuer, caCert.Subject)
+	}
+	return model.SubordinateCAType, parent, nil
+}
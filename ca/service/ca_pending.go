@@ -0,0 +1,289 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"core-ca/ca/model"
+	"core-ca/keymanagement/keyfile"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"math/big"
+	"slices"
+	"strings"
+	"time"
+)
+
+// requestedExtensions are the extensions of a CA certificate that a pending
+// CA asks its external issuer for.
+var requestedExtensions = []asn1.ObjectIdentifier{
+	{2, 5, 29, 15}, // key usage
+	{2, 5, 29, 19}, // basic constraints
+	{2, 5, 29, 30}, // name constraints
+	{2, 5, 29, 32}, // certificate policies
+}
+
+// CreatePendingCA generates the key of a subordinate CA that an external
+// issuer, e.g. an offline root, will sign. The CA is recorded as pending with
+// a PKCS#10 request signed by the new key, asking for the requested path
+// length, name constraints and policies. ActivateCA completes it.
+func (s *caService) CreatePendingCA(ctx context.Context, req model.CACreate) (model.CA, error) {
+	req.Type = model.SubordinateCAType
+	req.ParentCAID = nil
+
+	// Validate the request before touching the HSM
+	if err := validateSignatureAlgorithm(req.SignatureAlgorithm, req.KeyAlgorithm); err != nil {
+		return model.CA{}, err
+	}
+	if _, err := parseSerialPrefix(req.SerialPrefix); err != nil {
+		return model.CA{}, err
+	}
+	subject, err := s.caSubject(req)
+	if err != nil {
+		return model.CA{}, err
+	}
+	constraints, err := parseCAConstraints(req)
+	if err != nil {
+		return model.CA{}, err
+	}
+	extensions, err := caRequestExtensions(constraints)
+	if err != nil {
+		return model.CA{}, err
+	}
+
+	caKey, err := s.generateCAKey(ctx, req)
+	if err != nil {
+		return model.CA{}, err
+	}
+	signer, err := s.keyService.GetSigner(caKey.tokenName, caKey.label)
+	if err != nil {
+		return model.CA{}, fmt.Errorf("failed to get signer for CA key: %w", err)
+	}
+	signer = randomSigner{Signer: signer, random: s.randomSource(caKey.tokenName)}
+	sigAlg, err := parseSignatureAlgorithm(req.SignatureAlgorithm, signer.Public())
+	if err != nil {
+		return model.CA{}, err
+	}
+	csrDER, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:            subject,
+		SignatureAlgorithm: sigAlg,
+		ExtraExtensions:    extensions,
+	}, signer)
+	if err != nil {
+		return model.CA{}, fmt.Errorf("failed to create CA certificate request: %w", err)
+	}
+
+	ca := model.CA{
+		Name:     req.Name,
+		Type:     model.SubordinateCAType,
+		Status:   model.PendingCAStatus,
+		CreateAt: time.Now(),
+		CSRPEM:   string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csrDER})),
+
+		SignatureAlgorithm: req.SignatureAlgorithm,
+		TokenID:            caKey.tokenID,
+		TokenName:          caKey.tokenName,
+		KeyID:              &caKey.id,
+		SerialPrefix:       req.SerialPrefix,
+		Generation:         1,
+	}
+	ca.ID, err = s.repo.SaveCA(ctx, ca)
+	if err != nil {
+		return model.CA{}, fmt.Errorf("failed to save CA: %w", err)
+	}
+	if err := s.repo.SetKeyCA(ctx, caKey.id, ca.ID); err != nil {
+		return model.CA{}, fmt.Errorf("failed to link key to CA: %w", err)
+	}
+	log.Printf("created pending CA %s (id %d) with key %s, waiting for its certificate", ca.Name, ca.ID, caKey.label)
+	return ca, nil
+}
+
+// caRequestExtensions returns the CA extensions requested in the certificate
+// request of a pending CA. x509 only encodes them in certificates, so they
+// are taken from a throwaway certificate signed with an ephemeral key.
+func caRequestExtensions(constraints *x509.Certificate) ([]pkix.Extension, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+	}
+	applyCAConstraints(template, constraints)
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", model.ErrInvalidCAConstraints, err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	var extensions []pkix.Extension
+	for _, ext := range cert.Extensions {
+		if slices.ContainsFunc(requestedExtensions, ext.Id.Equal) {
+			extensions = append(extensions, ext)
+		}
+	}
+	return extensions, nil
+}
+
+// ActivateCA completes a pending CA with the certificate its external issuer
+// signed. The certificate must be a CA certificate for the CA's key and the
+// subject of its certificate request, byte for byte, and, with the chain
+// given, chain to a root: a self-signed certificate in the chain, a recorded
+// CA, or the system roots when the chain has no root. A CA signed by a
+// recorded CA becomes its subordinate; otherwise the chain is kept and served
+// after the CA certificate.
+func (s *caService) ActivateCA(ctx context.Context, caID int, certPEM, chainPEM string) (model.CA, error) {
+	ca, err := s.repo.FindPendingCAByID(ctx, caID)
+	if err != nil {
+		return model.CA{}, err
+	}
+
+	certs, err := keyfile.ParseCertificatesPEM([]byte(certPEM))
+	if err != nil {
+		return model.CA{}, fmt.Errorf("%w: %v", model.ErrInvalidCACertificate, err)
+	}
+	if len(certs) == 0 {
+		return model.CA{}, fmt.Errorf("%w: no certificate given", model.ErrInvalidCACertificate)
+	}
+	caCert, chain := certs[0], certs[1:]
+	if strings.TrimSpace(chainPEM) != "" {
+		more, err := keyfile.ParseCertificatesPEM([]byte(chainPEM))
+		if err != nil {
+			return model.CA{}, fmt.Errorf("%w: chain: %v", model.ErrInvalidCACertificate, err)
+		}
+		chain = append(chain, more...)
+	}
+
+	block, _ := pem.Decode([]byte(ca.CSRPEM))
+	if block == nil {
+		return model.CA{}, fmt.Errorf("pending CA %s has no certificate request", ca.Name)
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return model.CA{}, fmt.Errorf("failed to parse certificate request of CA %s: %w", ca.Name, err)
+	}
+	if k, ok := caCert.PublicKey.(interface{ Equal(crypto.PublicKey) bool }); !ok || !k.Equal(csr.PublicKey) {
+		return model.CA{}, fmt.Errorf("%w: certificate %s is not for the key of CA %s", model.ErrInvalidCACertificate, caCert.Subject, ca.Name)
+	}
+	// The issuer must not have rewritten the subject the CA was created with
+	if !bytes.Equal(caCert.RawSubject, csr.RawSubject) {
+		return model.CA{}, fmt.Errorf("%w: certificate subject %s is not the subject %s requested for CA %s", model.ErrInvalidCACertificate, caCert.Subject, csr.Subject, ca.Name)
+	}
+	if !caCert.BasicConstraintsValid || !caCert.IsCA {
+		return model.CA{}, fmt.Errorf("%w: certificate %s is not a CA certificate", model.ErrInvalidCACertificate, caCert.Subject)
+	}
+	if caCert.KeyUsage != 0 && caCert.KeyUsage&x509.KeyUsageCertSign == 0 {
+		return model.CA{}, fmt.Errorf("%w: certificate %s does not allow certificate signing", model.ErrInvalidCACertificate, caCert.Subject)
+	}
+	if bytes.Equal(caCert.RawIssuer, caCert.RawSubject) && caCert.CheckSignatureFrom(caCert) == nil {
+		return model.CA{}, fmt.Errorf("%w: certificate %s is self-signed", model.ErrInvalidCACertificate, caCert.Subject)
+	}
+
+	// Build the path to a root, through a recorded CA when one signed the certificate
+	parent, err := s.recordedIssuer(ctx, caCert)
+	if err != nil {
+		return model.CA{}, err
+	}
+	if parent != nil {
+		issuers, err := s.caChainCertificates(ctx, parent.ID)
+		if err != nil {
+			return model.CA{}, err
+		}
+		chain = append(issuers, chain...)
+	}
+	roots, intermediates := x509.NewCertPool(), x509.NewCertPool()
+	hasRoot := false
+	for _, cert := range chain {
+		if bytes.Equal(cert.RawIssuer, cert.RawSubject) && cert.CheckSignatureFrom(cert) == nil {
+			roots.AddCert(cert)
+			hasRoot = true
+		} else {
+			intermediates.AddCert(cert)
+		}
+	}
+	if !hasRoot {
+		if roots, err = x509.SystemCertPool(); err != nil {
+			return model.CA{}, fmt.Errorf("%w: no root certificate given and no system roots: %v", model.ErrInvalidCACertificate, err)
+		}
+	}
+	paths, err := caCert.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return model.CA{}, fmt.Errorf("%w: %v", model.ErrInvalidCACertificate, err)
+	}
+
+	ca.CertPEM = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caCert.Raw}))
+	if parent != nil {
+		ca.ParentCAID = &parent.ID
+	} else {
+		var external strings.Builder
+		for _, cert := range paths[0][1:] {
+			external.Write(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))
+		}
+		ca.ExternalChainPEM = external.String()
+	}
+
+	// Make sure the token key signs for the certificate before using it
+	ca.Status = model.ActiveCAStatus
+	if _, err := s.signerForCA(ctx, ca, model.KeyUsageCertSign); err != nil {
+		return model.CA{}, err
+	}
+	if err := s.repo.ActivateCA(ctx, ca); err != nil {
+		return model.CA{}, err
+	}
+
+	if parent != nil {
+		if err := s.recordCACertificate(ctx, *parent, s.signingGeneration(ctx, *parent, caCert), caCert); err != nil {
+			return model.CA{}, err
+		}
+		log.Printf("activated CA %s (id %d) issued by %s (id %d)", ca.Name, ca.ID, parent.Name, parent.ID)
+	} else {
+		log.Printf("activated CA %s (id %d) issued by external CA %s", ca.Name, ca.ID, caCert.Issuer)
+	}
+	return ca, nil
+}
+
+// recordedIssuer returns the active recorded CA that signed cert, or nil.
+func (s *caService) recordedIssuer(ctx context.Context, cert *x509.Certificate) (*model.CA, error) {
+	cas, err := s.repo.GetAllCAs(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get CAs: %w", err)
+	}
+	for i, ca := range cas {
+		if ca.Status != model.ActiveCAStatus {
+			continue
+		}
+		issuer, err := parseCertificatePEM(ca.CertPEM)
+		if err != nil {
+			continue
+		}
+		if bytes.Equal(cert.RawIssuer, issuer.RawSubject) && cert.CheckSignatureFrom(issuer) == nil {
+			return &cas[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// GetCACSR returns the certificate request of a pending CA.
+func (s *caService) GetCACSR(ctx context.Context, caID int) (string, error) {
+	ca, err := s.repo.FindPendingCAByID(ctx, caID)
+	if err != nil {
+		return "", err
+	}
+	return ca.CSRPEM, nil
+}
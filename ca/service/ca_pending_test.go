@@ -0,0 +1,102 @@
+package service
+
+import (
+	"context"
+	"core-ca/ca/model"
+	keymodel "core-ca/keymanagement/model"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"slices"
+	"testing"
+	"time"
+)
+
+func parsePEMCertificateRequest(t *testing.T, csrPEM string) *x509.CertificateRequest {
+	t.Helper()
+	block, _ := pem.Decode([]byte(csrPEM))
+	if block == nil {
+		t.Fatal("certificate request is not PEM")
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		t.Fatalf("ParseCertificateRequest: %v", err)
+	}
+	return csr
+}
+
+// signPendingCA has root certify the key of a pending CA under rawSubject.
+func signPendingCA(t *testing.T, s *caService, root model.CA, pending model.CA, rawSubject []byte) string {
+	t.Helper()
+	csr := parsePEMCertificateRequest(t, pending.CSRPEM)
+	signer, err := s.signerForCA(context.Background(), root, model.KeyUsageCertSign)
+	if err != nil {
+		t.Fatalf("signerForCA: %v", err)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		RawSubject:            rawSubject,
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(365 * 24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		MaxPathLenZero:        true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}, parsePEMCertificate(t, root.CertPEM), csr.PublicKey, signer)
+	if err != nil {
+		t.Fatalf("CreateCertificate: %v", err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
+
+func TestActivateCAChecksSubject(t *testing.T) {
+	s, repo := newTestCAService(t)
+	ctx := context.Background()
+
+	root, err := s.CreateCA(ctx, model.CACreate{Name: "Offline Root", Type: model.RootCAType, KeyAlgorithm: keymodel.KeyAlgorithmECP256})
+	if err != nil {
+		t.Fatalf("CreateCA: %v", err)
+	}
+	pending, err := s.CreatePendingCA(ctx, model.CACreate{Name: "Issuing CA 1", KeyAlgorithm: keymodel.KeyAlgorithmECP256, Subject: "CN=Issuing CA 1,OU=PKI,O=Example"})
+	if err != nil {
+		t.Fatalf("CreatePendingCA: %v", err)
+	}
+	requested := parsePEMCertificateRequest(t, pending.CSRPEM).RawSubject
+
+	var rdns pkix.RDNSequence
+	if _, err := asn1.Unmarshal(requested, &rdns); err != nil {
+		t.Fatal(err)
+	}
+	slices.Reverse(rdns)
+	reordered, err := asn1.Marshal(rdns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := asn1.Marshal(pkix.Name{CommonName: "Other CA", Organization: []string{"Example"}}.ToRDNSequence())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The same attributes in another order are another name to relying parties
+	for name, rawSubject := range map[string][]byte{"reordered": reordered, "other": other} {
+		_, err := s.ActivateCA(ctx, pending.ID, signPendingCA(t, s, root, pending, rawSubject), "")
+		if !errors.Is(err, model.ErrInvalidCACertificate) {
+			t.Errorf("ActivateCA with the %s subject: %v, want ErrInvalidCACertificate", name, err)
+		}
+	}
+	if repo.cas[pending.ID].Status != model.PendingCAStatus {
+		t.Fatalf("CA status = %s after refused activations, want pending", repo.cas[pending.ID].Status)
+	}
+
+	activated, err := s.ActivateCA(ctx, pending.ID, signPendingCA(t, s, root, pending, requested), "")
+	if err != nil {
+		t.Fatalf("ActivateCA: %v", err)
+	}
+	if activated.Status != model.ActiveCAStatus || activated.ParentCAID == nil || *activated.ParentCAID != root.ID {
+		t.Fatalf("activated CA %+v, want an active subordinate of the root", activated)
+	}
+}
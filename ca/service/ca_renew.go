@@ -0,0 +1,319 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"core-ca/ca/model"
+	keymodel "core-ca/keymanagement/model"
+	"crypto"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// RenewCA issues a new certificate for a CA, for its current key or, with
+// ReKey, for a new key on the same token, and makes it the current
+// generation: certificates are issued under it from then on, while earlier
+// generations keep signing CRLs and OCSP responses for the certificates
+// issued under them. The new certificate keeps the subject and CA extensions
+// of the current one and is valid from now on, overlapping the previous
+// generation until that expires. An expired CA can be renewed too and
+// becomes active again.
+func (s *caService) RenewCA(ctx context.Context, caID int, req model.CARenew) (model.CA, error) {
+	ca, err := s.repo.FindCAByIDAnyStatus(ctx, caID)
+	if err != nil {
+		return model.CA{}, fmt.Errorf("failed to find CA: %w", err)
+	}
+	if ca.Status != model.ActiveCAStatus && ca.Status != model.ExpiredCaStatus {
+		return model.CA{}, fmt.Errorf("%w: CA %s is %s, only active or expired CAs can be renewed", model.ErrInvalidCARenewal, ca.Name, ca.Status)
+	}
+	if ca.Type != model.RootCAType && ca.ParentCAID == nil {
+		return model.CA{}, fmt.Errorf("%w: CA %s is signed by an external issuer, which must certify its key again", model.ErrInvalidCARenewal, ca.Name)
+	}
+	current, err := parseCertificatePEM(ca.CertPEM)
+	if err != nil {
+		return model.CA{}, fmt.Errorf("failed to parse certificate of CA %s: %w", ca.Name, err)
+	}
+	currentKey, err := s.caKey(ctx, ca, current)
+	if err != nil {
+		return model.CA{}, err
+	}
+
+	// Validate the request before touching the HSM
+	keyAlgorithm := req.KeyAlgorithm
+	if keyAlgorithm == "" {
+		if keyAlgorithm, err = keymodel.ParseKeyAlgorithm(currentKey.Algorithm); err != nil {
+			return model.CA{}, fmt.Errorf("%w: unknown algorithm of key %s, give the key algorithm", model.ErrInvalidCARenewal, currentKey.Label)
+		}
+	} else if !req.ReKey {
+		return model.CA{}, fmt.Errorf("%w: a key algorithm needs a new key", model.ErrInvalidCARenewal)
+	}
+	renewed := ca
+	renewed.Generation = ca.Generation + 1
+	renewed.Status = model.ActiveCAStatus
+	renewed.SignatureAlgorithm = req.SignatureAlgorithm
+	if renewed.SignatureAlgorithm == "" && validateSignatureAlgorithm(ca.SignatureAlgorithm, keyAlgorithm) == nil {
+		renewed.SignatureAlgorithm = ca.SignatureAlgorithm
+	}
+	if err := validateSignatureAlgorithm(renewed.SignatureAlgorithm, keyAlgorithm); err != nil {
+		return model.CA{}, err
+	}
+
+	// A subordinate CA is certified again by the current generation of its parent
+	var parent model.CA
+	var parentCert *x509.Certificate
+	var parentSigner crypto.Signer
+	if ca.Type != model.RootCAType {
+		parent, err = s.repo.FindCAByID(ctx, *ca.ParentCAID)
+		if err != nil {
+			return model.CA{}, fmt.Errorf("failed to get parent CA: %w", err)
+		}
+		if parentCert, err = parseCertificatePEM(parent.CertPEM); err != nil {
+			return model.CA{}, fmt.Errorf("failed to parse certificate of CA %s: %w", parent.Name, err)
+		}
+		issuers, err := s.caChainCertificates(ctx, parent.ID)
+		if err != nil {
+			return model.CA{}, err
+		}
+		if err := checkIssuerValidity(time.Now().Add(parentCert.NotAfter.Sub(parentCert.NotBefore)/2), issuers); err != nil {
+			return model.CA{}, err
+		}
+		if parentSigner, err = s.signerForCA(ctx, parent, model.KeyUsageCertSign); err != nil {
+			return model.CA{}, fmt.Errorf("failed to get signer for parent CA key: %w", err)
+		}
+	}
+
+	var publicKey crypto.PublicKey
+	var signer crypto.Signer
+	if req.ReKey {
+		newKey, err := s.generateCAKey(ctx, model.CACreate{Name: ca.Name, KeyAlgorithm: keyAlgorithm, TokenName: ca.TokenName})
+		if err != nil {
+			return model.CA{}, err
+		}
+		renewed.KeyID = &newKey.id
+		publicKey = newKey.PublicKey
+		if signer, err = s.keyService.GetSigner(newKey.tokenName, newKey.label); err != nil {
+			return model.CA{}, fmt.Errorf("failed to get signer for CA key: %w", err)
+		}
+		signer = randomSigner{Signer: signer, random: s.randomSource(newKey.tokenName)}
+	} else {
+		renewed.KeyID = &currentKey.ID
+		publicKey = current.PublicKey
+		if signer, err = s.signerForCA(ctx, ca, model.KeyUsageCertSign); err != nil {
+			return model.CA{}, err
+		}
+	}
+
+	pubKeyBytes, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return model.CA{}, fmt.Errorf("failed to marshal CA public key: %w", err)
+	}
+	subjectKeyID := sha1.Sum(pubKeyBytes)
+	notBefore := time.Now()
+	template := x509.Certificate{
+		RawSubject:            current.RawSubject,
+		NotBefore:             notBefore,
+		SubjectKeyId:          subjectKeyID[:],
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		MaxPathLen:            current.MaxPathLen,
+		MaxPathLenZero:        current.MaxPathLenZero,
+		KeyUsage:              current.KeyUsage,
+		ExtKeyUsage:           current.ExtKeyUsage,
+
+		PermittedDNSDomainsCritical: current.PermittedDNSDomainsCritical,
+		PermittedDNSDomains:         current.PermittedDNSDomains,
+		ExcludedDNSDomains:          current.ExcludedDNSDomains,
+		PermittedIPRanges:           current.PermittedIPRanges,
+		ExcludedIPRanges:            current.ExcludedIPRanges,
+		PermittedEmailAddresses:     current.PermittedEmailAddresses,
+		ExcludedEmailAddresses:      current.ExcludedEmailAddresses,
+		PermittedURIDomains:         current.PermittedURIDomains,
+		ExcludedURIDomains:          current.ExcludedURIDomains,
+		Policies:                    current.Policies,
+	}
+
+	var signedCert []byte
+	if ca.Type == model.RootCAType {
+		template.NotAfter = notBefore.Add(time.Duration(s.cfg.CA.ValidityDays) * 24 * time.Hour)
+		if template.SignatureAlgorithm, err = parseSignatureAlgorithm(renewed.SignatureAlgorithm, publicKey); err != nil {
+			return model.CA{}, err
+		}
+		if template.SerialNumber, err = s.newSerialNumber(ctx, ca); err != nil {
+			return model.CA{}, err
+		}
+		signedCert, err = x509.CreateCertificate(rand.Reader, &template, &template, publicKey, signer)
+	} else {
+		// Same validity as a new subordinate: half of the parent's lifetime
+		template.NotAfter = notBefore.Add(parentCert.NotAfter.Sub(parentCert.NotBefore) / 2)
+		if template.SignatureAlgorithm, err = parseSignatureAlgorithm(parent.SignatureAlgorithm, parentSigner.Public()); err != nil {
+			return model.CA{}, err
+		}
+		if template.SerialNumber, err = s.newSerialNumber(ctx, parent); err != nil {
+			return model.CA{}, err
+		}
+		s.setIssuerURLs(&template, parent)
+		signedCert, err = x509.CreateCertificate(rand.Reader, &template, parentCert, publicKey, parentSigner)
+	}
+	if err != nil {
+		return model.CA{}, fmt.Errorf("failed to create renewed CA certificate: %w", err)
+	}
+	renewed.CertPEM = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: signedCert}))
+
+	// Make sure the new generation can sign before switching to it
+	if _, err := s.signerForCA(ctx, renewed, model.KeyUsageCertSign); err != nil {
+		return model.CA{}, err
+	}
+	renewal := model.CARenewal{CA: renewed}
+	if ca.Type != model.RootCAType {
+		cert, err := x509.ParseCertificate(signedCert)
+		if err != nil {
+			return model.CA{}, fmt.Errorf("failed to parse renewed CA certificate: %w", err)
+		}
+		record := caCertificateRecord(parent, parent.Generation, cert)
+		renewal.Certificate = &record
+	}
+	if req.ReKey {
+		renewal.PreviousKeyID = &currentKey.ID
+	}
+	if err := s.repo.RenewCA(ctx, renewal); err != nil {
+		return model.CA{}, err
+	}
+	if req.ReKey {
+		log.Printf("renewed CA %s (id %d) to generation %d with a new key", ca.Name, ca.ID, renewed.Generation)
+	} else {
+		log.Printf("renewed CA %s (id %d) to generation %d with key %s", ca.Name, ca.ID, renewed.Generation, currentKey.Label)
+	}
+	return renewed, nil
+}
+
+// GetCAGenerations returns the generations of a CA, the current one first.
+func (s *caService) GetCAGenerations(ctx context.Context, caID int) ([]model.CAGeneration, error) {
+	ca, err := s.repo.FindCAByID(ctx, caID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find CA: %w", err)
+	}
+	return s.caGenerations(ctx, ca)
+}
+
+func (s *caService) caGenerations(ctx context.Context, ca model.CA) ([]model.CAGeneration, error) {
+	previous, err := s.repo.GetCAGenerations(ctx, ca.ID)
+	if err != nil {
+		return nil, err
+	}
+	generations := append([]model.CAGeneration{{
+		CAID:               ca.ID,
+		Generation:         ca.Generation,
+		CertPEM:            ca.CertPEM,
+		KeyID:              ca.KeyID,
+		SignatureAlgorithm: ca.SignatureAlgorithm,
+		Current:            true,
+	}}, previous...)
+	for i := range generations {
+		cert, err := parseCertificatePEM(generations[i].CertPEM)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse certificate of CA %s generation %d: %w", ca.Name, generations[i].Generation, err)
+		}
+		generations[i].NotBefore, generations[i].NotAfter = cert.NotBefore, cert.NotAfter
+	}
+	return generations, nil
+}
+
+// findGeneration returns generation n of the CA's generations.
+func findGeneration(ca model.CA, generations []model.CAGeneration, n int) (model.CAGeneration, error) {
+	for _, generation := range generations {
+		if generation.Generation == n {
+			return generation, nil
+		}
+	}
+	return model.CAGeneration{}, fmt.Errorf("%w: CA %s has no generation %d", model.ErrCAGenerationNotFound, ca.Name, n)
+}
+
+// atGeneration returns the CA as it was at generation, to sign with the key
+// and certificate of that generation.
+func atGeneration(ca model.CA, generation model.CAGeneration) model.CA {
+	ca.CertPEM = generation.CertPEM
+	ca.KeyID = generation.KeyID
+	ca.SignatureAlgorithm = generation.SignatureAlgorithm
+	ca.Generation = generation.Generation
+	return ca
+}
+
+// sameKey reports whether two generations certify the same recorded key.
+func sameKey(a, b model.CAGeneration) bool {
+	if a.KeyID == nil || b.KeyID == nil {
+		return a.KeyID == nil && b.KeyID == nil
+	}
+	return *a.KeyID == *b.KeyID
+}
+
+// issuingGeneration returns the certificate of the generation of ca that
+// signed cert, which is the current one unless ca was renewed with a new
+// key after cert was issued.
+func (s *caService) issuingGeneration(ctx context.Context, ca model.CA, current, cert *x509.Certificate) *x509.Certificate {
+	if cert.CheckSignatureFrom(current) == nil {
+		return current
+	}
+	previous, err := s.repo.GetCAGenerations(ctx, ca.ID)
+	if err != nil {
+		log.Printf("failed to get generations of CA %s: %v", ca.Name, err)
+		return current
+	}
+	for _, generation := range previous {
+		issuer, err := parseCertificatePEM(generation.CertPEM)
+		if err == nil && cert.CheckSignatureFrom(issuer) == nil {
+			return issuer
+		}
+	}
+	return current
+}
+
+// issuerKeyHash returns the hash of the public key of an issuer as used in
+// OCSP requests (RFC 6960, section 4.1.1).
+func issuerKeyHash(issuer *x509.Certificate, hash crypto.Hash) ([]byte, error) {
+	var spki struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(issuer.RawSubjectPublicKeyInfo, &spki); err != nil {
+		return nil, err
+	}
+	if !hash.Available() {
+		return nil, fmt.Errorf("unsupported hash algorithm %v", hash)
+	}
+	h := hash.New()
+	h.Write(spki.PublicKey.RightAlign())
+	return h.Sum(nil), nil
+}
+
+// ocspGeneration returns the CA at the newest generation whose key is the
+// issuer key named in an OCSP request, or at its current generation when
+// none matches.
+func (s *caService) ocspGeneration(ctx context.Context, ca model.CA, req *ocsp.Request) (model.CA, error) {
+	generations, err := s.caGenerations(ctx, ca)
+	if err != nil {
+		return model.CA{}, err
+	}
+	for _, generation := range generations {
+		cert, err := parseCertificatePEM(generation.CertPEM)
+		if err != nil {
+			return model.CA{}, err
+		}
+		keyHash, err := issuerKeyHash(cert, req.HashAlgorithm)
+		if err != nil {
+			break
+		}
+		if bytes.Equal(keyHash, req.IssuerKeyHash) {
+			return atGeneration(ca, generation), nil
+		}
+	}
+	return ca, nil
+}
@@ -0,0 +1,251 @@
+package service
+
+import (
+	"context"
+	"core-ca/ca/model"
+	"crypto/x509"
+	"database/sql"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+)
+
+// RevokeCA revokes a CA: every certificate recorded for it under its parent,
+// one per generation, and the cross-certificates certifying it, which then
+// appear in the CRL, ARL and OCSP responses of their issuers. A root or a CA
+// signed outside this system has no recorded issuer to publish its revocation
+// and is only marked revoked. With Cascade the active or held CAs below it are
+// revoked the same way with caCompromise; with RevokeLeaves so are the
+// end-entity certificates the revoked CAs issued. A certificateHold revocation
+// puts the CA on hold until ReleaseCA and cannot cascade; a CA on hold can be
+// revoked for good.
+func (s *caService) RevokeCA(ctx context.Context, caID int, req model.CARevocation) (model.CARevocationResult, error) {
+	hold := req.Reason == model.ReasonCertificateHold
+	if hold && (req.Cascade || req.RevokeLeaves) {
+		return model.CARevocationResult{}, fmt.Errorf("%w: a hold only applies to the CA itself", model.ErrInvalidRevocation)
+	}
+	ca, err := s.repo.FindCAByID(ctx, caID)
+	if errors.Is(err, sql.ErrNoRows) && !hold {
+		if held, heldErr := s.repo.FindHeldCAByID(ctx, caID); heldErr == nil {
+			ca, err = held, nil
+		}
+	}
+	if err != nil {
+		return model.CARevocationResult{}, fmt.Errorf("failed to find CA: %w", err)
+	}
+
+	var parent *model.CA
+	if ca.ParentCAID != nil {
+		chain, err := s.repo.GetCAChain(ctx, ca.ID)
+		if err != nil {
+			return model.CARevocationResult{}, fmt.Errorf("failed to get CA chain: %w", err)
+		}
+		parent = &chain[1]
+	}
+
+	var result model.CARevocationResult
+	revoked := []model.CA{ca}
+	if err := s.revokeCA(ctx, ca, parent, req.Reason, &result); err != nil {
+		return result, err
+	}
+	if req.Cascade {
+		for i := 0; i < len(revoked); i++ {
+			children, err := s.repo.GetChildCAs(ctx, revoked[i].ID)
+			if err != nil {
+				return result, fmt.Errorf("failed to get CAs below CA %s: %w", revoked[i].Name, err)
+			}
+			for _, child := range children {
+				if child.Status != model.ActiveCAStatus && child.Status != model.HoldCAStatus {
+					continue
+				}
+				if err := s.revokeCA(ctx, child, &revoked[i], model.ReasonCACompromise, &result); err != nil {
+					return result, err
+				}
+				revoked = append(revoked, child)
+			}
+		}
+	}
+	if req.RevokeLeaves {
+		for _, ca := range revoked {
+			if err := s.revokeLeaves(ctx, ca, &result); err != nil {
+				return result, err
+			}
+		}
+	}
+	if hold {
+		log.Printf("put CA %s (id %d) on hold: %d certificate(s)", ca.Name, ca.ID, len(result.RevokedCertificates))
+	} else {
+		log.Printf("revoked CA %s (id %d): %d CA(s), %d certificate(s)", ca.Name, ca.ID, len(result.RevokedCAs), len(result.RevokedCertificates))
+	}
+	return result, nil
+}
+
+// revokeCA revokes the certificates of a single CA, signed by parent unless
+// it is nil, and marks it revoked, or on hold.
+func (s *caService) revokeCA(ctx context.Context, ca model.CA, parent *model.CA, reason model.RevocationReason, result *model.CARevocationResult) error {
+	serials, err := s.caCertificateSerials(ctx, ca, parent)
+	if err != nil {
+		return err
+	}
+	for _, serial := range serials {
+		if err := s.revokeOnce(ctx, serial, reason, true, result); err != nil {
+			return fmt.Errorf("failed to revoke certificate %s of CA %s: %w", serial, ca.Name, err)
+		}
+	}
+	status := model.RevokedCaStatus
+	if reason == model.ReasonCertificateHold {
+		status = model.HoldCAStatus
+	}
+	if err := s.repo.TransitionCAStatus(ctx, ca.ID, ca.Status, status, "revoked: "+string(reason)); err != nil {
+		return fmt.Errorf("failed to update CA status: %w", err)
+	}
+	result.RevokedCAs = append(result.RevokedCAs, ca.ID)
+	return nil
+}
+
+// caCertificateSerials returns the serial numbers of the certificates
+// recorded for a CA: one per generation under parent, unless it is nil, and
+// the cross-certificates of active issuers certifying it.
+func (s *caService) caCertificateSerials(ctx context.Context, ca model.CA, parent *model.CA) ([]string, error) {
+	var serials []string
+	if parent != nil {
+		generations, err := s.caGenerations(ctx, ca)
+		if err != nil {
+			return nil, err
+		}
+		for _, generation := range generations {
+			cert, err := parseCertificatePEM(generation.CertPEM)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse certificate of CA %s: %w", ca.Name, err)
+			}
+			// CAs created before their certificates were recorded are recorded now
+			if err := s.recordCACertificate(ctx, *parent, s.signingGeneration(ctx, *parent, cert), cert); err != nil {
+				return nil, err
+			}
+			serials = append(serials, cert.SerialNumber.String())
+		}
+	}
+	crosses, err := s.repo.GetCrossCertificates(ctx, ca.ID)
+	if err != nil {
+		return nil, err
+	}
+	for _, cc := range crosses {
+		if cc.SubjectCAID != ca.ID {
+			continue
+		}
+		issuer, err := s.repo.FindCAByID(ctx, cc.IssuerCAID)
+		if err != nil {
+			// An inactive issuer publishes no revocation information
+			continue
+		}
+		cert, err := parseCertificatePEM(cc.CertPEM)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse cross-certificate %s: %w", cc.SerialNumber, err)
+		}
+		if err := s.recordCACertificate(ctx, issuer, s.signingGeneration(ctx, issuer, cert), cert); err != nil {
+			return nil, err
+		}
+		serials = append(serials, cc.SerialNumber)
+	}
+	return serials, nil
+}
+
+// revokeLeaves revokes the end-entity certificates a CA issued with caCompromise.
+func (s *caService) revokeLeaves(ctx context.Context, ca model.CA, result *model.CARevocationResult) error {
+	certs, err := s.repo.GetCertificatesByCAID(ctx, ca.ID)
+	if err != nil {
+		return err
+	}
+	for _, c := range certs {
+		cert, err := parseCertificatePEM(c.CertPEM)
+		if err != nil {
+			return fmt.Errorf("failed to parse certificate %s: %w", c.SerialNumber, err)
+		}
+		// CA certificates are revoked with the CA they certify
+		if cert.IsCA {
+			continue
+		}
+		if err := s.revokeOnce(ctx, c.SerialNumber, model.ReasonCACompromise, false, result); err != nil {
+			return fmt.Errorf("failed to revoke certificate %s issued by CA %s: %w", c.SerialNumber, ca.Name, err)
+		}
+	}
+	return nil
+}
+
+// revokeOnce revokes a certificate unless it is already revoked. A
+// certificate on hold is revoked for good unless reason is a hold again.
+func (s *caService) revokeOnce(ctx context.Context, serial string, reason model.RevocationReason, isCA bool, result *model.CARevocationResult) error {
+	current, revoked, err := s.repo.IsRevoked(ctx, serial)
+	if err != nil {
+		return err
+	}
+	if revoked && (current.Reason != model.ReasonCertificateHold || reason == model.ReasonCertificateHold) {
+		return nil
+	}
+	if err := s.repo.Revoke(ctx, serial, string(reason), isCA); err != nil {
+		return err
+	}
+	result.RevokedCertificates = append(result.RevokedCertificates, serial)
+	return nil
+}
+
+// recordCACertificate records a CA certificate among the certificates its
+// issuer signed, under the issuer's generation, so that it can be revoked and
+// listed like any other. A certificate already recorded is left as it is.
+func (s *caService) recordCACertificate(ctx context.Context, issuer model.CA, generation int, cert *x509.Certificate) error {
+	serial := cert.SerialNumber.String()
+	exists, err := s.repo.SerialNumberExists(ctx, serial)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+	if err := s.repo.SaveCert(ctx, caCertificateRecord(issuer, generation, cert)); err != nil {
+		return fmt.Errorf("failed to record certificate of CA %s: %w", cert.Subject, err)
+	}
+	return nil
+}
+
+// caCertificateRecord returns the record of a CA certificate issued by the
+// given generation of issuer.
+func caCertificateRecord(issuer model.CA, generation int, cert *x509.Certificate) model.Certificate {
+	return model.Certificate{
+		SerialNumber: cert.SerialNumber.String(),
+		CAID:         issuer.ID,
+		Subject:      cert.Subject.CommonName,
+		NotBefore:    cert.NotBefore,
+		NotAfter:     cert.NotAfter,
+		CertPEM:      string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})),
+		Status:       model.StatusValid,
+		CAGeneration: generation,
+	}
+}
+
+// signingGeneration returns the generation of ca whose key signed cert,
+// defaulting to the current one.
+func (s *caService) signingGeneration(ctx context.Context, ca model.CA, cert *x509.Certificate) int {
+	generations, err := s.caGenerations(ctx, ca)
+	if err != nil {
+		log.Printf("failed to get generations of CA %s: %v", ca.Name, err)
+		return ca.Generation
+	}
+	for _, generation := range generations {
+		issuer, err := parseCertificatePEM(generation.CertPEM)
+		if err == nil && cert.CheckSignatureFrom(issuer) == nil {
+			return generation.Generation
+		}
+	}
+	return ca.Generation
+}
+
+// GetARL returns the authority revocation list of a CA: its CRL restricted
+// to the CA certificates it issued, signed by its current generation.
+func (s *caService) GetARL(ctx context.Context, caID int) ([]byte, error) {
+	ca, err := s.repo.FindCAByIDAnyStatus(ctx, caID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find CA: %w", err)
+	}
+	return s.generationCRL(ctx, ca, ca.Generation, authorityCRL)
+}
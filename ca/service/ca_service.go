@@ -6,12 +6,19 @@ import (
 	"core-ca/ca/model"
 	"core-ca/ca/repository"
 	"core-ca/config"
+	keymodel "core-ca/keymanagement/model"
 	"core-ca/keymanagement/service"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/rsa"
 	"crypto/sha1"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"database/sql"
 	"log"
+	"slices"
 	"strings"
 
 	"encoding/asn1"
@@ -26,19 +33,78 @@ import (
 )
 
 type CaService interface {
-	CreateCA(ctx context.Context, name string, caType model.CAType, parentCAID *int) (model.CA, error)
+	CreateCA(ctx context.Context, req model.CACreate) (model.CA, error)
 	GetCA(ctx context.Context, id int) (model.CA, error)
 	GetAllCAs(ctx context.Context) ([]model.CA, error)
 	GetCAChain(ctx context.Context, caID int) ([]model.CA, error)
-	UpdateCAStatus(ctx context.Context, caID int, status string) error
-	RevokeCA(ctx context.Context, caID int, reason model.RevocationReason) error
+	// UpdateCAStatus sets a CA active, expired or unknown and records the transition.
+	UpdateCAStatus(ctx context.Context, caID int, status model.CAStatus) error
+	// GetCAStatusTransitions returns the recorded status changes of a CA.
+	GetCAStatusTransitions(ctx context.Context, caID int) ([]model.StatusTransition, error)
+	// GetCertificateStatusTransitions returns the recorded status changes of a certificate.
+	GetCertificateStatusTransitions(ctx context.Context, serialNumber string) ([]model.StatusTransition, error)
+	// ExpireCertificates marks the CAs and certificates past their not_after expired.
+	ExpireCertificates(ctx context.Context) (model.ExpiryResult, error)
+	// MonitorExpiry runs ExpireCertificates periodically until ctx is done.
+	MonitorExpiry(ctx context.Context, interval time.Duration)
+	// RevokeCA revokes the certificates of a CA and, with Cascade, of the CAs below it.
+	RevokeCA(ctx context.Context, caID int, req model.CARevocation) (model.CARevocationResult, error)
+	// ReleaseCA takes a CA on hold, and the certificates held with it, off hold.
+	ReleaseCA(ctx context.Context, caID int) (model.CA, error)
 	DeleteCA(ctx context.Context, caID int) error
 
 	IssueCertificate(ctx context.Context, csrPEM string, issuerID int) (model.Certificate, error)
 	RevokeCertificate(ctx context.Context, serialNumber string, reason model.RevocationReason) error
 	GetCRL(ctx context.Context, caID int) ([]byte, error)
+	// GetARL returns the CRL of a CA restricted to the CA certificates it issued.
+	GetARL(ctx context.Context, caID int) ([]byte, error)
+	// GetDeltaCRL returns the revocations and releases of a CA since the
+	// oldest full CRL still valid.
+	GetDeltaCRL(ctx context.Context, caID int) ([]byte, error)
+	// ReleaseCertificate takes a certificate off hold.
+	ReleaseCertificate(ctx context.Context, serialNumber string) error
 	HandleOCSPRequest(ctx context.Context, requestData []byte, caID int) ([]byte, error)
 	GetAllCertificates(ctx context.Context) ([]model.Certificate, error)
+
+	// RegisterToken opens the token and records it in crypto_tokens.
+	RegisterToken(ctx context.Context, token model.CryptoToken) (model.CryptoToken, error)
+	GetAllTokens(ctx context.Context) ([]model.CryptoToken, error)
+	// LoadTokens opens every registered token. Tokens that fail to open are
+	// logged and skipped so that CAs on other tokens keep working.
+	LoadTokens(ctx context.Context) error
+
+	// Key usages recorded in key_usages and checked before every CA signature.
+	GetKeyUsages(ctx context.Context, keyID int) ([]model.KeyUsage, error)
+	AddKeyUsage(ctx context.Context, keyID int, usage model.KeyUsage) error
+	RemoveKeyUsage(ctx context.Context, keyID int, usage model.KeyUsage) error
+	// DestroyKey removes a key pair from its token unless an active CA still uses it.
+	DestroyKey(ctx context.Context, tokenName, keyLabel string) error
+	// AttestCAKey returns a signed report of how the CA key is protected on its token.
+	AttestCAKey(ctx context.Context, caID int) (keymodel.KeyAttestation, error)
+	// ImportCA adopts an existing CA: the key is written to the token and the
+	// certificate recorded as a root or as a subordinate of the CA that issued it.
+	ImportCA(ctx context.Context, req model.CAImport) (model.CA, error)
+	// CreatePendingCA generates the key of a subordinate CA signed outside this
+	// system and returns the CA, pending, with its certificate request.
+	CreatePendingCA(ctx context.Context, req model.CACreate) (model.CA, error)
+	// GetCACSR returns the certificate request of a pending CA.
+	GetCACSR(ctx context.Context, caID int) (string, error)
+	// ActivateCA installs the externally signed certificate of a pending CA.
+	ActivateCA(ctx context.Context, caID int, certPEM, chainPEM string) (model.CA, error)
+	// RenewCA certifies the CA key again, or a new key, as the CA's next generation.
+	RenewCA(ctx context.Context, caID int, req model.CARenew) (model.CA, error)
+	// GetCAGenerations returns the generations of a CA, the current one first.
+	GetCAGenerations(ctx context.Context, caID int) ([]model.CAGeneration, error)
+	// GetGenerationCRL returns the CRL signed by a generation of a CA, which
+	// covers the certificates issued under that generation's key.
+	GetGenerationCRL(ctx context.Context, caID, generation int) ([]byte, error)
+	// CrossCertify has one CA certify the subject and current key of another.
+	CrossCertify(ctx context.Context, req model.CrossCertify) (model.CrossCertificate, error)
+	// GetCrossCertificates returns the cross-certificates a CA issued or is the subject of.
+	GetCrossCertificates(ctx context.Context, caID int) ([]model.CrossCertificate, error)
+	// GetAlternateChains returns the chains of a CA, in PEM, that reach
+	// another root through cross-certificates.
+	GetAlternateChains(ctx context.Context, caID int) ([]string, error)
 }
 
 type caService struct {
@@ -76,14 +142,30 @@ func (s *caService) IssueCertificate(ctx context.Context, csrPEM string, caID in
 		return model.Certificate{}, fmt.Errorf("failed to find issuer CA: %w", err)
 	}
 
+	// Refuse names the issuing CA or its parents do not permit
+	issuers, err := s.caChainCertificates(ctx, ca.ID)
+	if err != nil {
+		return model.Certificate{}, err
+	}
+	if err := checkCSRExtensions(csr); err != nil {
+		return model.Certificate{}, err
+	}
+	if err := checkNamesPermitted(csr, issuers); err != nil {
+		return model.Certificate{}, err
+	}
+
 	// Get signer.
-	signer, err := s.keyService.GetSigner(ca.Name + "-Key")
+	signer, err := s.signerForCA(ctx, ca, model.KeyUsageCertSign)
+	if err != nil {
+		return model.Certificate{}, err
+	}
+	sigAlg, err := parseSignatureAlgorithm(ca.SignatureAlgorithm, signer.Public())
 	if err != nil {
 		return model.Certificate{}, err
 	}
 
 	// Generate serial number
-	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	serialNumber, err := s.newSerialNumber(ctx, ca)
 	if err != nil {
 		return model.Certificate{}, err
 	}
@@ -104,6 +186,9 @@ func (s *caService) IssueCertificate(ctx context.Context, csrPEM string, caID in
 	// Create certificate template for the subject (end entity).
 	notBefore := time.Now()
 	notAfter := notBefore.Add(halfLifetime)
+	if err := checkIssuerValidity(notAfter, issuers); err != nil {
+		return model.Certificate{}, err
+	}
 
 	subjectTemplate := &x509.Certificate{
 		Version:               csr.Version,
@@ -123,22 +208,22 @@ func (s *caService) IssueCertificate(ctx context.Context, csrPEM string, caID in
 			sum := sha1.Sum(pubKeyBytes)
 			return sum[:]
 		}(),
-		SignatureAlgorithm:    x509.SHA256WithRSA,
-		PublicKey:             csr.PublicKey,
-		PublicKeyAlgorithm:    csr.PublicKeyAlgorithm,
-		ExtraExtensions:       csr.Extensions,
-		AuthorityKeyId:        caCert.SubjectKeyId,
-		CRLDistributionPoints: caCert.CRLDistributionPoints,
-		OCSPServer:            caCert.OCSPServer,
-		DNSNames:              csr.DNSNames,
-		EmailAddresses:        csr.EmailAddresses,
-		IPAddresses:           csr.IPAddresses,
-	}
+		SignatureAlgorithm: sigAlg,
+		PublicKey:          csr.PublicKey,
+		PublicKeyAlgorithm: csr.PublicKeyAlgorithm,
+		AuthorityKeyId:     caCert.SubjectKeyId,
+		DNSNames:           csr.DNSNames,
+		EmailAddresses:     csr.EmailAddresses,
+		IPAddresses:        csr.IPAddresses,
+		URIs:               csr.URIs,
+	}
+	// Relying parties check the leaf against its issuing CA's own endpoints
+	s.setIssuerURLs(subjectTemplate, ca)
 
 	// Create certificate.
 	cert, err := x509.CreateCertificate(rand.Reader, subjectTemplate, caCert, csr.PublicKey, signer)
 	if err != nil {
-		return model.Certificate{}, fmt.Errorf("x509.CreateCertificate failed: %v", err)
+		return model.Certificate{}, fmt.Errorf("x509.CreateCertificate failed: %w", err)
 	}
 
 	certPEM := pem.EncodeToMemory(&pem.Block{
@@ -155,6 +240,7 @@ func (s *caService) IssueCertificate(ctx context.Context, csrPEM string, caID in
 		NotAfter:     notAfter,
 		CertPEM:      string(certPEM),
 		Status:       model.StatusValid,
+		CAGeneration: ca.Generation,
 	}
 
 	if err := s.repo.SaveCert(ctx, certData); err != nil {
@@ -163,12 +249,8 @@ func (s *caService) IssueCertificate(ctx context.Context, csrPEM string, caID in
 
 	var certChain strings.Builder
 	certChain.WriteString(string(certPEM))
-	caChain, err := s.repo.GetCAChain(ctx, ca.ID)
-	if err != nil {
-		return model.Certificate{}, err
-	}
-	for _, ca := range caChain {
-		certChain.WriteString(ca.CertPEM)
+	for _, issuer := range issuers {
+		certChain.Write(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: issuer.Raw}))
 	}
 	certData.CertPEM = certChain.String()
 
@@ -177,20 +259,81 @@ func (s *caService) IssueCertificate(ctx context.Context, csrPEM string, caID in
 
 func (s *caService) RevokeCertificate(ctx context.Context, serialNumber string, reason model.RevocationReason) error {
 	// Validate certificate exists.
-	_, err := s.repo.FindBySerialNumber(ctx, serialNumber)
+	certData, err := s.repo.FindBySerialNumber(ctx, serialNumber)
 	if err != nil {
 		return errors.New("certificate not found")
 	}
+	// CA certificates also go on the issuer's ARL
+	isCA := false
+	if cert, err := parseCertificatePEM(certData.CertPEM); err == nil {
+		isCA = cert.IsCA
+	}
 	// Revoke certificate.
-	return s.repo.Revoke(ctx, serialNumber, string(reason), false)
+	return s.repo.Revoke(ctx, serialNumber, string(reason), isCA)
 }
 
 func (s *caService) GetCRL(ctx context.Context, caID int) ([]byte, error) {
 
-	ca, err := s.repo.FindCAByID(ctx, caID)
+	ca, err := s.repo.FindCAByIDAnyStatus(ctx, caID)
 	if err != nil {
 		return nil, fmt.Errorf("failed to find CA: %w", err)
 	}
+	return s.generationCRL(ctx, ca, ca.Generation, fullCRL)
+}
+
+func (s *caService) GetGenerationCRL(ctx context.Context, caID, generation int) ([]byte, error) {
+	ca, err := s.repo.FindCAByIDAnyStatus(ctx, caID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find CA: %w", err)
+	}
+	return s.generationCRL(ctx, ca, generation, fullCRL)
+}
+
+// crlScope selects the entries of a CRL.
+type crlScope int
+
+const (
+	fullCRL      crlScope = iota // every revoked certificate
+	authorityCRL                 // revoked CA certificates only (ARL)
+	deltaCRL                     // changes since the oldest full CRL still valid
+)
+
+const (
+	// crlValidity is how long a full CRL or ARL is valid; a delta CRL lists
+	// the changes made during that time, so that it applies to every full
+	// CRL a relying party may still hold.
+	crlValidity      = 7 * 24 * time.Hour
+	deltaCRLValidity = time.Hour
+)
+
+// crlNumber numbers the CRLs a CA issues at t, full and delta alike, in
+// increasing order (RFC 5280, section 5.2.3).
+func crlNumber(t time.Time) *big.Int {
+	return big.NewInt(t.UnixMilli())
+}
+
+// generationCRL signs the CRL of generation n of a CA with the key and
+// certificate of that generation. It lists the revoked certificates issued
+// under every generation of the same key, which relying parties check it with.
+// An authority revocation list only lists CA certificates and says so in its
+// issuing distribution point. A delta CRL lists the revocations made or
+// changed since its base, and the certificates taken off hold as removeFromCRL.
+func (s *caService) generationCRL(ctx context.Context, ca model.CA, n int, scope crlScope) ([]byte, error) {
+	generations, err := s.caGenerations(ctx, ca)
+	if err != nil {
+		return nil, err
+	}
+	generation, err := findGeneration(ca, generations, n)
+	if err != nil {
+		return nil, err
+	}
+	covered := make(map[int]bool)
+	for _, g := range generations {
+		if sameKey(g, generation) {
+			covered[g.Generation] = true
+		}
+	}
+	ca = atGeneration(ca, generation)
 
 	// Parse CA certificate
 	block, _ := pem.Decode([]byte(ca.CertPEM))
@@ -203,18 +346,35 @@ func (s *caService) GetCRL(ctx context.Context, caID int) ([]byte, error) {
 	}
 
 	// Get signer.
-	signer, err := s.keyService.GetSigner(ca.Name + "-Key")
+	signer, err := s.signerForCA(ctx, ca, model.KeyUsageCRLSign)
 	if err != nil {
 		return nil, err
 	}
-
-	revokedCerts, err := s.repo.GetRevokedCertificates(ctx, caID)
+	sigAlg, err := parseSignatureAlgorithm(ca.SignatureAlgorithm, signer.Public())
 	if err != nil {
 		return nil, err
 	}
 
+	now := time.Now()
+	base := now.Add(-crlValidity)
+	var revokedCerts []model.RevokedCertificate
+	var releasedCerts []model.ReleasedCertificate
+	if scope == deltaCRL {
+		if revokedCerts, err = s.repo.GetRevokedCertificatesSince(ctx, ca.ID, base); err != nil {
+			return nil, err
+		}
+		if releasedCerts, err = s.repo.GetReleasedCertificates(ctx, ca.ID, base); err != nil {
+			return nil, err
+		}
+	} else if revokedCerts, err = s.repo.GetRevokedCertificates(ctx, ca.ID); err != nil {
+		return nil, err
+	}
+
 	var revokedList []x509.RevocationListEntry
 	for _, cert := range revokedCerts {
+		if !covered[cert.CAGeneration] || scope == authorityCRL && !cert.IsCA {
+			continue
+		}
 		serialNumber, ok := new(big.Int).SetString(cert.SerialNumber, 10)
 		if !ok {
 			return nil, errors.New("invalid serial number")
@@ -247,14 +407,47 @@ func (s *caService) GetCRL(ctx context.Context, caID int) ([]byte, error) {
 		})
 	}
 
+	// Certificates taken off hold, unless held or revoked again since
+	for _, cert := range releasedCerts {
+		if !covered[cert.CAGeneration] || slices.ContainsFunc(revokedList, func(e x509.RevocationListEntry) bool {
+			return e.SerialNumber.String() == cert.SerialNumber
+		}) {
+			continue
+		}
+		serialNumber, ok := new(big.Int).SetString(cert.SerialNumber, 10)
+		if !ok {
+			return nil, errors.New("invalid serial number")
+		}
+		revokedList = append(revokedList, x509.RevocationListEntry{
+			SerialNumber:   serialNumber,
+			RevocationTime: cert.HoldDate,
+			ReasonCode:     8, // removeFromCRL
+		})
+	}
+
 	// Create CRL using the CA certificate as issuer
 	crlTemplate := x509.RevocationList{
 		Issuer:                    caCert.Subject,
-		SignatureAlgorithm:        x509.SHA256WithRSA,
+		SignatureAlgorithm:        sigAlg,
 		RevokedCertificateEntries: revokedList,
-		ThisUpdate:                time.Now(),
-		NextUpdate:                time.Now().Add(7 * 24 * time.Hour),
-		Number:                    big.NewInt(1),
+		ThisUpdate:                now,
+		NextUpdate:                now.Add(crlValidity),
+		Number:                    crlNumber(now),
+	}
+	switch scope {
+	case authorityCRL:
+		idp, err := asn1.Marshal(issuingDistributionPoint{OnlyContainsCACerts: true})
+		if err != nil {
+			return nil, err
+		}
+		crlTemplate.ExtraExtensions = []pkix.Extension{{Id: oidIssuingDistributionPoint, Critical: true, Value: idp}}
+	case deltaCRL:
+		baseNumber, err := asn1.Marshal(crlNumber(base))
+		if err != nil {
+			return nil, err
+		}
+		crlTemplate.NextUpdate = now.Add(deltaCRLValidity)
+		crlTemplate.ExtraExtensions = []pkix.Extension{{Id: oidDeltaCRLIndicator, Critical: true, Value: baseNumber}}
 	}
 
 	crlDER, err := x509.CreateRevocationList(rand.Reader, &crlTemplate, caCert, signer)
@@ -274,71 +467,67 @@ func (s *caService) GetCRL(ctx context.Context, caID int) ([]byte, error) {
 	return pemBuf.Bytes(), nil
 }
 
+// oidIssuingDistributionPoint identifies the issuing distribution point CRL
+// extension (RFC 5280, section 5.2.5).
+var oidIssuingDistributionPoint = asn1.ObjectIdentifier{2, 5, 29, 28}
+
+// oidDeltaCRLIndicator identifies the delta CRL indicator extension, which
+// holds the number of the base CRL (RFC 5280, section 5.2.4).
+var oidDeltaCRLIndicator = asn1.ObjectIdentifier{2, 5, 29, 27}
+
+// issuingDistributionPoint is the part of the extension an ARL sets.
+type issuingDistributionPoint struct {
+	OnlyContainsCACerts bool `asn1:"optional,tag:2"`
+}
+
 // tao mot ca moi can tao moi token va key
-func (s *caService) CreateCA(ctx context.Context, name string, caType model.CAType, parentCAID *int) (model.CA, error) {
-
-	// create token for new CA
-	// token := model.CryptoToken{
-	// 	Name:    name + "-Token",
-	// 	Backend: "pkcs11",
-	// 	SlotID: func() int {
-	// 		slot, _ := strconv.ParseInt(s.cfg.KeyManagement.SoftHSM.Slot, 10, 32)
-	// 		return int(slot)
-	// 	}(),
-	// 	PinRef: "keymanagement/softhsm/pin-subca",
-	// }
-
-	//save token metadata
-	// tokenID, err := s.repo.SaveToken(ctx, token)
-	// if err != nil {
-	// 	return model.CA{}, err
-	// }
-
-	// Generate key pair for the CA
-	keyLabel := name + "-Key"
-	keyPair, err := s.keyService.GenerateKeyPair(keyLabel)
+func (s *caService) CreateCA(ctx context.Context, req model.CACreate) (model.CA, error) {
+
+	// Validate the requested signature algorithm, serial prefix and subject before touching the HSM
+	if err := validateSignatureAlgorithm(req.SignatureAlgorithm, req.KeyAlgorithm); err != nil {
+		return model.CA{}, err
+	}
+	if _, err := parseSerialPrefix(req.SerialPrefix); err != nil {
+		return model.CA{}, err
+	}
+	subject, err := s.caSubject(req)
 	if err != nil {
 		return model.CA{}, err
 	}
+	constraints, err := parseCAConstraints(req)
+	if err != nil {
+		return model.CA{}, err
+	}
+	if req.Type != model.RootCAType {
+		if req.ParentCAID == nil {
+			return model.CA{}, errors.New("parent_ca_id is required for a subordinate CA")
+		}
+		issuers, err := s.caChainCertificates(ctx, *req.ParentCAID)
+		if err != nil {
+			return model.CA{}, err
+		}
+		if err := checkCAConstraints(constraints, issuers); err != nil {
+			return model.CA{}, err
+		}
+		// Valid for half of the parent's lifetime, see below
+		if err := checkIssuerValidity(time.Now().Add(issuers[0].NotAfter.Sub(issuers[0].NotBefore)/2), issuers); err != nil {
+			return model.CA{}, err
+		}
+	}
 
-	//save key pair metadata
-	// publicKeyPEM := pem.EncodeToMemory(&pem.Block{
-	// 	Type:  "RSA Public Key",
-	// 	Bytes: x509.MarshalPKCS1PublicKey(keyPair.PublicKey),
-	// })
-
-	// key := model.CryptoKey{
-	// 	Label:     keyLabel,
-	// 	TokenID:   tokenID,
-	// 	CaID:      1,
-	// 	PublicKey: string(publicKeyPEM),
-	// 	Status:    "active",
-	// }
-
-	// keyID, err := s.repo.SaveKey(ctx, key)
-	// if err != nil {
-	//     return model.CA{}, nil
-	// }
-
-	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	caKey, err := s.generateCAKey(ctx, req)
 	if err != nil {
 		return model.CA{}, err
 	}
+	tokenName, keyLabel, keyID, keyPair := caKey.tokenName, caKey.label, caKey.id, caKey.KeyPair
 
 	notBefore := time.Now()
 
 	//certificate template for new CA
 	CAcertTemplate := x509.Certificate{
-		SignatureAlgorithm: x509.SHA256WithRSA,
-		PublicKeyAlgorithm: x509.RSA,
-		PublicKey:          keyPair.PublicKey,
-		Version:            2,
-		SerialNumber:       serialNumber,
-		Subject: pkix.Name{
-			Country:      []string{"VN"},
-			Organization: []string{"Viettel"},
-			CommonName:   name, // eg: "viettel-rootCA",
-		},
+		PublicKey: keyPair.PublicKey,
+		Version:   2,
+		Subject:   subject,
 		NotBefore: notBefore,
 		// KeyUsage:              x509.KeyUsageCRLSign | x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
 		IsCA:                  true,
@@ -352,41 +541,61 @@ func (s *caService) CreateCA(ctx context.Context, name string, caType model.CATy
 			return sum[:]
 		}(),
 		// ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
-		CRLDistributionPoints: []string{"http://localhost:8080/crl.pem"},
-		OCSPServer:            []string{"http://localhost:8080/ocsp"},
 	}
+	applyCAConstraints(&CAcertTemplate, constraints)
 	var signedCert []byte
 
 	var parentCAIDValue *int
+	var issuer model.CA // parent of a subordinate CA
 	//if caType is root CA, create self-signed certificate
 	// else create intermediate CA signed by parent CA
-	if caType == model.RootCAType {
+	if req.Type == model.RootCAType {
 		parentCAIDValue = nil // root CA has no parent
 		//validity 8 years
 		notAfter := notBefore.Add(time.Duration(s.cfg.CA.ValidityDays) * 24 * time.Hour)
 		CAcertTemplate.NotAfter = notAfter
 		CAcertTemplate.KeyUsage = x509.KeyUsageCRLSign | x509.KeyUsageCertSign
 
-		signer, err := s.keyService.GetSigner(keyLabel)
+		signer, err := s.keyService.GetSigner(tokenName, keyLabel)
 		if err != nil {
-			return model.CA{}, fmt.Errorf("failed to get signer for CA key: %v", err)
+			return model.CA{}, fmt.Errorf("failed to get signer for CA key: %w", err)
+		}
+		signer = randomSigner{Signer: signer, random: s.randomSource(tokenName)}
+		CAcertTemplate.SignatureAlgorithm, err = parseSignatureAlgorithm(req.SignatureAlgorithm, signer.Public())
+		if err != nil {
+			return model.CA{}, err
+		}
+		// The root CA issues its own certificate
+		CAcertTemplate.SerialNumber, err = s.newSerialNumber(ctx, model.CA{Name: req.Name, TokenName: tokenName, SerialPrefix: req.SerialPrefix})
+		if err != nil {
+			return model.CA{}, err
 		}
 		// Create self-signed certificate for root CA
 		signedCert, err = x509.CreateCertificate(rand.Reader, &CAcertTemplate, &CAcertTemplate, keyPair.PublicKey, signer)
 		if err != nil {
-			return model.CA{}, fmt.Errorf("failed to create self-signed certificate: %v", err)
+			return model.CA{}, fmt.Errorf("failed to create self-signed certificate: %w", err)
 		}
 	} else { // Create intermediate CA signed by parent CA
-		parentCAIDValue = parentCAID
-		parentCA, err := s.repo.FindCAByID(ctx, *parentCAID)
+		parentCAIDValue = req.ParentCAID
+		parentCA, err := s.repo.FindCAByID(ctx, *req.ParentCAID)
 		if err != nil {
 			return model.CA{}, fmt.Errorf("failed to get parent CA: %v", err)
 		}
+		issuer = parentCA
 
-		signer, err := s.keyService.GetSigner(parentCA.Name + "-Key")
+		signer, err := s.signerForCA(ctx, parentCA, model.KeyUsageCertSign)
 		if err != nil {
 			return model.CA{}, fmt.Errorf("failed to get signer for parent CA key: %w", err)
 		}
+		// The subordinate certificate is signed with the parent's algorithm
+		CAcertTemplate.SignatureAlgorithm, err = parseSignatureAlgorithm(parentCA.SignatureAlgorithm, signer.Public())
+		if err != nil {
+			return model.CA{}, err
+		}
+		CAcertTemplate.SerialNumber, err = s.newSerialNumber(ctx, parentCA)
+		if err != nil {
+			return model.CA{}, err
+		}
 
 		block, _ := pem.Decode([]byte(parentCA.CertPEM))
 		if block == nil || block.Type != "CERTIFICATE" {
@@ -402,25 +611,33 @@ func (s *caService) CreateCA(ctx context.Context, name string, caType model.CATy
 		halfLifetime := caLifetime / 2
 		CAcertTemplate.NotAfter = notBefore.Add(halfLifetime)
 
-		CAcertTemplate.MaxPathLen = 0
 		CAcertTemplate.KeyUsage = x509.KeyUsageCRLSign | x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment
 		CAcertTemplate.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageOCSPSigning}
+		// A root has no revocation or issuer endpoints; a subordinate is checked against its parent's
+		s.setIssuerURLs(&CAcertTemplate, parentCA)
 
 		signedCert, err = x509.CreateCertificate(rand.Reader, &CAcertTemplate, parentCert, keyPair.PublicKey, signer)
 		if err != nil {
-			return model.CA{}, fmt.Errorf("failed to create intermediate CA certificate: %v", err)
+			return model.CA{}, fmt.Errorf("failed to create intermediate CA certificate: %w", err)
 		}
 	}
 
 	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: signedCert})
 	// Save CA
 	ca := model.CA{
-		Name:       name,
-		Type:       caType,
+		Name:       req.Name,
+		Type:       req.Type,
 		ParentCAID: parentCAIDValue,
 		CertPEM:    string(certPEM),
 		Status:     "active",
 		CreateAt:   notBefore,
+
+		SignatureAlgorithm: req.SignatureAlgorithm,
+		TokenID:            caKey.tokenID,
+		TokenName:          tokenName,
+		KeyID:              &keyID,
+		SerialPrefix:       req.SerialPrefix,
+		Generation:         1,
 	}
 
 	caID, err := s.repo.SaveCA(ctx, ca)
@@ -430,15 +647,84 @@ func (s *caService) CreateCA(ctx context.Context, name string, caType model.CATy
 	// fmt.Println(ca.CertPEM)
 
 	// Update key with ca_id
-	// key.CAID = &caID
-	// _, err = s.repo.SaveKey(ctx, key)
-	// if err != nil {
-	//     return model.CA{}, err
-	// }
+	if err := s.repo.SetKeyCA(ctx, keyID, caID); err != nil {
+		return model.CA{}, fmt.Errorf("failed to link key to CA: %w", err)
+	}
 	ca.ID = caID
+	if ca.ParentCAID != nil {
+		cert, err := x509.ParseCertificate(signedCert)
+		if err != nil {
+			return model.CA{}, fmt.Errorf("failed to parse CA certificate: %w", err)
+		}
+		if err := s.recordCACertificate(ctx, issuer, issuer.Generation, cert); err != nil {
+			return model.CA{}, err
+		}
+	}
 	return ca, nil
 }
 
+// caKeyPair is the key of a new CA, generated on its token and recorded in crypto_keys.
+type caKeyPair struct {
+	keymodel.KeyPair
+	tokenID   *int
+	tokenName string
+	label     string
+	id        int
+}
+
+// generateCAKey generates the key pair of a new CA on its token, under a
+// label no other key on the token uses, and records it with the CA key usages.
+func (s *caService) generateCAKey(ctx context.Context, req model.CACreate) (caKeyPair, error) {
+	var (
+		key caKeyPair
+		err error
+	)
+	// Resolve the token that will hold the CA key
+	key.tokenID, key.tokenName, err = s.resolveToken(ctx, req.TokenName)
+	if err != nil {
+		return caKeyPair{}, err
+	}
+
+	key.label, err = newKeyLabel(req.Name)
+	if err != nil {
+		return caKeyPair{}, err
+	}
+	key.KeyPair, err = s.keyService.GenerateKeyPair(key.tokenName, key.label, req.KeyAlgorithm, keymodel.KeyPurposeCA)
+	if err != nil {
+		return caKeyPair{}, err
+	}
+
+	// Save key pair metadata
+	cryptoKey, err := newCryptoKey(key.label, key.tokenID, key.PublicKey, key.Algorithm)
+	if err != nil {
+		return caKeyPair{}, err
+	}
+	key.id, err = s.repo.SaveKey(ctx, cryptoKey)
+	if err != nil {
+		return caKeyPair{}, fmt.Errorf("failed to save CA key: %w", err)
+	}
+	if err := s.addKeyUsages(ctx, key.id, model.CAKeyUsages); err != nil {
+		return caKeyPair{}, fmt.Errorf("failed to save CA key usages: %w", err)
+	}
+	return key, nil
+}
+
+// resolveToken returns the crypto_tokens ID and the key service name of a
+// token. The default token has no crypto_tokens row and an empty name.
+func (s *caService) resolveToken(ctx context.Context, tokenName string) (*int, string, error) {
+	if tokenName == "" || tokenName == keymodel.DefaultToken {
+		return nil, "", nil
+	}
+	token, err := s.repo.FindTokenByName(ctx, tokenName)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, "", fmt.Errorf("%w: %s", keymodel.ErrTokenNotFound, tokenName)
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to find token: %w", err)
+	}
+	return &token.ID, tokenName, nil
+}
+
 func (s *caService) HandleOCSPRequest(ctx context.Context, requestData []byte, caID int) ([]byte, error) {
 
 	// Parse OCSP request
@@ -448,10 +734,15 @@ func (s *caService) HandleOCSPRequest(ctx context.Context, requestData []byte, c
 	}
 
 	// Get CA certificate and key
-	ca, err := s.repo.FindCAByID(ctx, caID)
+	ca, err := s.repo.FindCAByIDAnyStatus(ctx, caID)
 	if err != nil {
 		return nil, fmt.Errorf("failed to find CA: %w", err)
 	}
+	// Answer with the generation whose key issued the certificate in question
+	ca, err = s.ocspGeneration(ctx, ca, ocspReq)
+	if err != nil {
+		return nil, err
+	}
 
 	// Parse CA certificate
 	block, _ := pem.Decode([]byte(ca.CertPEM))
@@ -464,10 +755,16 @@ func (s *caService) HandleOCSPRequest(ctx context.Context, requestData []byte, c
 	}
 
 	// Get signer for OCSP response
-	signer, err := s.keyService.GetSigner(ca.Name + "-Key")
+	signer, err := s.signerForCA(ctx, ca, model.KeyUsageOCSPSign)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get CA signer: %w", err)
 	}
+	sigAlg, err := parseSignatureAlgorithm(ca.SignatureAlgorithm, signer.Public())
+	if err != nil {
+		return nil, err
+	}
+	// golang.org/x/crypto/ocsp cannot produce RSA-PSS signatures
+	sigAlg = ocspSignatureAlgorithm(sigAlg)
 
 	// Convert serial number to string for database lookup
 	serialNumber := ocspReq.SerialNumber.String()
@@ -481,6 +778,8 @@ func (s *caService) HandleOCSPRequest(ctx context.Context, requestData []byte, c
 			SerialNumber: ocspReq.SerialNumber,
 			ThisUpdate:   time.Now(),
 			NextUpdate:   time.Now().Add(24 * time.Hour),
+
+			SignatureAlgorithm: sigAlg,
 		}
 		return ocsp.CreateResponse(caCert, caCert, response, signer)
 	}
@@ -524,6 +823,7 @@ func (s *caService) HandleOCSPRequest(ctx context.Context, requestData []byte, c
 	}
 
 	// Create and sign OCSP response
+	response.SignatureAlgorithm = sigAlg
 	return ocsp.CreateResponse(caCert, caCert, response, signer)
 }
 
@@ -545,69 +845,111 @@ func getOCSPReasonCode(reason model.RevocationReason) int {
 	return ocsp.Unspecified
 }
 
-func (s *caService) GetCA(ctx context.Context, id int) (model.CA, error) {
-	return s.repo.FindCAByID(ctx, id)
-}
-
-func (s *caService) GetAllCAs(ctx context.Context) ([]model.CA, error) {
-	return s.repo.GetAllCAs(ctx)
+// signatureAlgorithms lists the signature algorithms a CA can be configured with.
+var signatureAlgorithms = map[string]x509.SignatureAlgorithm{
+	"SHA256WithRSA":    x509.SHA256WithRSA,
+	"SHA384WithRSA":    x509.SHA384WithRSA,
+	"SHA512WithRSA":    x509.SHA512WithRSA,
+	"SHA256WithRSAPSS": x509.SHA256WithRSAPSS,
+	"SHA384WithRSAPSS": x509.SHA384WithRSAPSS,
+	"SHA512WithRSAPSS": x509.SHA512WithRSAPSS,
+	"ECDSAWithSHA256":  x509.ECDSAWithSHA256,
+	"ECDSAWithSHA384":  x509.ECDSAWithSHA384,
+	"ECDSAWithSHA512":  x509.ECDSAWithSHA512,
 }
 
-func (s *caService) GetCAChain(ctx context.Context, caID int) ([]model.CA, error) {
-	return s.repo.GetCAChain(ctx, caID)
+// isRSASignatureAlgorithm reports whether alg is a PKCS#1 v1.5 or PSS algorithm.
+func isRSASignatureAlgorithm(alg x509.SignatureAlgorithm) bool {
+	switch alg {
+	case x509.SHA256WithRSA, x509.SHA384WithRSA, x509.SHA512WithRSA,
+		x509.SHA256WithRSAPSS, x509.SHA384WithRSAPSS, x509.SHA512WithRSAPSS:
+		return true
+	}
+	return false
 }
 
-func (s *caService) UpdateCAStatus(ctx context.Context, caID int, status string) error {
-	// Validate status
-	validStatuses := []string{"active", "revoked", "expired", "unknown"}
-	isValid := false
-	for _, validStatus := range validStatuses {
-		if status == validStatus {
-			isValid = true
-			break
-		}
+// validateSignatureAlgorithm checks that a configured signature algorithm name
+// is known and can be used with keys of the given algorithm.
+func validateSignatureAlgorithm(name string, keyAlgorithm keymodel.KeyAlgorithm) error {
+	if name == "" {
+		return nil
 	}
-
-	if !isValid {
-		return fmt.Errorf("invalid status: %s. Valid statuses are: active, revoked, expired, unknown", status)
+	alg, ok := signatureAlgorithms[name]
+	if !ok {
+		return fmt.Errorf("unsupported signature algorithm: %s", name)
 	}
-
-	return s.repo.UpdateCAStatus(ctx, caID, status)
+	if isRSASignatureAlgorithm(alg) != keyAlgorithm.IsRSA() {
+		return fmt.Errorf("signature algorithm %s cannot be used with %s keys", name, keyAlgorithm)
+	}
+	return nil
 }
 
-func (s *caService) RevokeCA(ctx context.Context, caID int, reason model.RevocationReason) error {
-	// Get CA certificate
-	ca, err := s.repo.FindCAByID(ctx, caID)
-	if err != nil {
-		return fmt.Errorf("failed to find CA: %w", err)
+// parseSignatureAlgorithm resolves a CA's configured signature algorithm against
+// its signing key. An empty name selects the default for the key type.
+func parseSignatureAlgorithm(name string, pub crypto.PublicKey) (x509.SignatureAlgorithm, error) {
+	if name == "" {
+		return signatureAlgorithmFor(pub), nil
 	}
-
-	// Parse CA certificate to get serial number
-	block, _ := pem.Decode([]byte(ca.CertPEM))
-	if block == nil || block.Type != "CERTIFICATE" {
-		return fmt.Errorf("failed to decode CA certificate PEM block")
+	alg, ok := signatureAlgorithms[name]
+	if !ok {
+		return x509.UnknownSignatureAlgorithm, fmt.Errorf("unsupported signature algorithm: %s", name)
 	}
-	caCert, err := x509.ParseCertificate(block.Bytes)
-	if err != nil {
-		return fmt.Errorf("failed to parse CA certificate: %v", err)
+	_, isRSAKey := pub.(*rsa.PublicKey)
+	if isRSASignatureAlgorithm(alg) != isRSAKey {
+		return x509.UnknownSignatureAlgorithm, fmt.Errorf("signature algorithm %s does not match the CA key type", name)
 	}
+	return alg, nil
+}
 
-	// Revoke the CA certificate
-	err = s.repo.Revoke(ctx, caCert.SerialNumber.String(), string(reason), true)
-	if err != nil {
-		return fmt.Errorf("failed to revoke CA certificate: %w", err)
-	}
+// ocspSignatureAlgorithm maps RSA-PSS algorithms to PKCS#1 v1.5 with the same
+// hash, since OCSP responses are signed through golang.org/x/crypto/ocsp.
+func ocspSignatureAlgorithm(alg x509.SignatureAlgorithm) x509.SignatureAlgorithm {
+	switch alg {
+	case x509.SHA256WithRSAPSS:
+		return x509.SHA256WithRSA
+	case x509.SHA384WithRSAPSS:
+		return x509.SHA384WithRSA
+	case x509.SHA512WithRSAPSS:
+		return x509.SHA512WithRSA
+	}
+	return alg
+}
 
-	// Update CA status to revoked
-	err = s.repo.UpdateCAStatus(ctx, caID, "revoked")
-	if err != nil {
-		return fmt.Errorf("failed to update CA status: %w", err)
+// signatureAlgorithmFor picks the default x509 signature algorithm matching the signing key.
+func signatureAlgorithmFor(pub crypto.PublicKey) x509.SignatureAlgorithm {
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		return x509.SHA256WithRSA
+	case *ecdsa.PublicKey:
+		if k.Curve == elliptic.P384() {
+			return x509.ECDSAWithSHA384
+		}
+		return x509.ECDSAWithSHA256
 	}
+	return x509.UnknownSignatureAlgorithm
+}
 
-	return nil
+func (s *caService) GetCA(ctx context.Context, id int) (model.CA, error) {
+	return s.repo.FindCAByID(ctx, id)
+}
+
+func (s *caService) GetAllCAs(ctx context.Context) ([]model.CA, error) {
+	return s.repo.GetAllCAs(ctx)
+}
+
+func (s *caService) GetCAChain(ctx context.Context, caID int) ([]model.CA, error) {
+	return s.repo.GetCAChain(ctx, caID)
 }
 
 func (s *caService) DeleteCA(ctx context.Context, caID int) error {
+	ca, err := s.repo.FindCAByIDAnyStatus(ctx, caID)
+	if err != nil {
+		return fmt.Errorf("failed to find CA: %w", err)
+	}
+	if ca.Status == model.RevokedCaStatus {
+		return fmt.Errorf("%w: CA %s is already %s", model.ErrInvalidCAStatus, ca.Name, ca.Status)
+	}
+
 	// Check if CA has any child CAs
 	childCAs, err := s.repo.GetChildCAs(ctx, caID)
 	if err != nil {
@@ -628,8 +970,8 @@ func (s *caService) DeleteCA(ctx context.Context, caID int) error {
 		return fmt.Errorf("cannot delete CA: it has issued %d certificate(s). Revoke all certificates first", len(certificates))
 	}
 
-	// Soft delete CA (update status to 'deleted')
-	return s.repo.UpdateCAStatus(ctx, caID, string(model.RevokedCaStatus))
+	// Soft delete CA (update status to 'revoked')
+	return s.repo.TransitionCAStatus(ctx, caID, ca.Status, model.RevokedCaStatus, "deleted")
 }
 
 func (s *caService) GetAllCertificates(ctx context.Context) ([]model.Certificate, error) {
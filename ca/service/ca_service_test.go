@@ -0,0 +1,484 @@
+package service
+
+import (
+	"context"
+	"core-ca/ca/model"
+	"core-ca/ca/repository"
+	"core-ca/config"
+	keymodel "core-ca/keymanagement/model"
+	keyrepo "core-ca/keymanagement/repository"
+	keyservice "core-ca/keymanagement/service"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"database/sql"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// memoryRepository keeps CAs, keys and certificates in maps, for the
+// repository methods that issuing and revoking use. Other methods panic
+// through the nil embedded Repository.
+type memoryRepository struct {
+	repository.Repository
+	cas     map[int]model.CA
+	keys    map[int]model.CryptoKey
+	usages  map[int][]model.KeyUsage
+	certs   map[string]model.Certificate
+	revoked map[string]model.RevokedCertificate
+	// updated is when each revocation was made or last changed, for delta CRLs
+	updated     map[string]time.Time
+	released    []model.ReleasedCertificate
+	crosses     []model.CrossCertificate
+	transitions []model.StatusTransition
+}
+
+func newMemoryRepository() *memoryRepository {
+	return &memoryRepository{
+		cas:     map[int]model.CA{},
+		keys:    map[int]model.CryptoKey{},
+		usages:  map[int][]model.KeyUsage{},
+		certs:   map[string]model.Certificate{},
+		revoked: map[string]model.RevokedCertificate{},
+		updated: map[string]time.Time{},
+	}
+}
+
+func (r *memoryRepository) SaveCA(ctx context.Context, ca model.CA) (int, error) {
+	ca.ID = len(r.cas) + 1
+	if ca.Status == "" {
+		ca.Status = model.ActiveCAStatus
+	}
+	r.cas[ca.ID] = ca
+	return ca.ID, nil
+}
+
+func (r *memoryRepository) FindCAByID(ctx context.Context, id int) (model.CA, error) {
+	ca, ok := r.cas[id]
+	if !ok || ca.Status != model.ActiveCAStatus {
+		return model.CA{}, sql.ErrNoRows
+	}
+	return ca, nil
+}
+
+func (r *memoryRepository) FindCAByIDAnyStatus(ctx context.Context, id int) (model.CA, error) {
+	ca, ok := r.cas[id]
+	if !ok {
+		return model.CA{}, sql.ErrNoRows
+	}
+	return ca, nil
+}
+
+func (r *memoryRepository) GetCAChain(ctx context.Context, id int) ([]model.CA, error) {
+	var chain []model.CA
+	for {
+		ca, ok := r.cas[id]
+		if !ok {
+			return nil, fmt.Errorf("CA with ID %d not found", id)
+		}
+		chain = append(chain, ca)
+		if ca.ParentCAID == nil {
+			return chain, nil
+		}
+		id = *ca.ParentCAID
+	}
+}
+
+func (r *memoryRepository) GetAllCAs(ctx context.Context) ([]model.CA, error) {
+	cas := make([]model.CA, 0, len(r.cas))
+	for id := 1; id <= len(r.cas); id++ {
+		cas = append(cas, r.cas[id])
+	}
+	return cas, nil
+}
+
+func (r *memoryRepository) FindPendingCAByID(ctx context.Context, id int) (model.CA, error) {
+	ca, ok := r.cas[id]
+	if !ok || ca.Status != model.PendingCAStatus {
+		return model.CA{}, fmt.Errorf("%w: no pending CA with ID %d", model.ErrCANotPending, id)
+	}
+	return ca, nil
+}
+
+func (r *memoryRepository) ActivateCA(ctx context.Context, ca model.CA) error {
+	if _, err := r.FindPendingCAByID(ctx, ca.ID); err != nil {
+		return err
+	}
+	ca.Status = model.ActiveCAStatus
+	r.cas[ca.ID] = ca
+	r.record(model.TransitionEntityCA, strconv.Itoa(ca.ID), string(model.PendingCAStatus), string(model.ActiveCAStatus), "certificate imported")
+	return nil
+}
+
+func (r *memoryRepository) FindHeldCAByID(ctx context.Context, id int) (model.CA, error) {
+	ca, ok := r.cas[id]
+	if !ok || ca.Status != model.HoldCAStatus {
+		return model.CA{}, fmt.Errorf("%w: no CA on hold with ID %d", model.ErrNotOnHold, id)
+	}
+	return ca, nil
+}
+
+func (r *memoryRepository) GetCAGenerations(ctx context.Context, id int) ([]model.CAGeneration, error) {
+	return nil, nil
+}
+
+func (r *memoryRepository) TransitionCAStatus(ctx context.Context, id int, from, to model.CAStatus, reason string) error {
+	ca, ok := r.cas[id]
+	if !ok || ca.Status != from {
+		return fmt.Errorf("%w: CA with ID %d is not %s", model.ErrCAStatusChanged, id, from)
+	}
+	ca.Status = to
+	r.cas[id] = ca
+	r.record(model.TransitionEntityCA, strconv.Itoa(id), string(from), string(to), reason)
+	return nil
+}
+
+func (r *memoryRepository) GetStatusTransitions(ctx context.Context, entityType, entityID string) ([]model.StatusTransition, error) {
+	var transitions []model.StatusTransition
+	for _, t := range r.transitions {
+		if t.EntityType == entityType && t.EntityID == entityID {
+			transitions = append(transitions, t)
+		}
+	}
+	return transitions, nil
+}
+
+func (r *memoryRepository) record(entityType, entityID, from, to, reason string) {
+	r.transitions = append(r.transitions, model.StatusTransition{
+		ID: len(r.transitions) + 1, EntityType: entityType, EntityID: entityID,
+		FromStatus: from, ToStatus: to, Reason: reason, CreatedAt: time.Now(),
+	})
+}
+
+func (r *memoryRepository) SaveKey(ctx context.Context, key model.CryptoKey) (int, error) {
+	key.ID = len(r.keys) + 1
+	key.Status = model.ActiveCryptoKeyStatus
+	r.keys[key.ID] = key
+	return key.ID, nil
+}
+
+func (r *memoryRepository) FindKeyByID(ctx context.Context, id int) (model.CryptoKey, error) {
+	key, ok := r.keys[id]
+	if !ok {
+		return model.CryptoKey{}, sql.ErrNoRows
+	}
+	return key, nil
+}
+
+func (r *memoryRepository) SetKeyCA(ctx context.Context, keyID, caID int) error {
+	key := r.keys[keyID]
+	key.CaID = &caID
+	r.keys[keyID] = key
+	return nil
+}
+
+func (r *memoryRepository) AddUsage(ctx context.Context, keyID int, usage model.KeyUsage) error {
+	r.usages[keyID] = append(r.usages[keyID], usage)
+	return nil
+}
+
+func (r *memoryRepository) GetUsages(ctx context.Context, keyID int) ([]model.KeyUsage, error) {
+	return r.usages[keyID], nil
+}
+
+func (r *memoryRepository) SerialNumberExists(ctx context.Context, serial string) (bool, error) {
+	_, ok := r.certs[serial]
+	return ok, nil
+}
+
+func (r *memoryRepository) SaveCert(ctx context.Context, cert model.Certificate) error {
+	if _, ok := r.certs[cert.SerialNumber]; ok {
+		return fmt.Errorf("duplicate serial number %s", cert.SerialNumber)
+	}
+	r.certs[cert.SerialNumber] = cert
+	return nil
+}
+
+func (r *memoryRepository) FindBySerialNumber(ctx context.Context, serial string) (model.Certificate, error) {
+	return r.certs[serial], nil
+}
+
+func (r *memoryRepository) Revoke(ctx context.Context, serial, reason string, isCA bool) error {
+	cert, ok := r.certs[serial]
+	if !ok {
+		return fmt.Errorf("certificate %s not found", serial)
+	}
+	now := time.Now()
+	date := now
+	// A hold keeps its date when it becomes a permanent revocation
+	if previous, ok := r.revoked[serial]; ok {
+		if previous.Reason != model.ReasonCertificateHold || reason == string(model.ReasonCertificateHold) {
+			return fmt.Errorf("%w: %s", model.ErrAlreadyRevoked, serial)
+		}
+		date = previous.RevocationDate
+	}
+	r.revoked[serial] = model.RevokedCertificate{
+		SerialNumber: serial, RevocationDate: date, Reason: model.RevocationReason(reason),
+		IsCA: isCA, CAGeneration: cert.CAGeneration,
+	}
+	r.updated[serial] = now
+	r.record(model.TransitionEntityCertificate, serial, string(cert.Status), string(model.StatusRevoked), "revoked: "+reason)
+	cert.Status = model.StatusRevoked
+	r.certs[serial] = cert
+	return nil
+}
+
+func (r *memoryRepository) Release(ctx context.Context, serial string) error {
+	held, ok := r.revoked[serial]
+	if !ok || held.Reason != model.ReasonCertificateHold {
+		return fmt.Errorf("%w: certificate %s", model.ErrNotOnHold, serial)
+	}
+	delete(r.revoked, serial)
+	delete(r.updated, serial)
+	cert := r.certs[serial]
+	r.released = append(r.released, model.ReleasedCertificate{
+		SerialNumber: serial, HoldDate: held.RevocationDate, ReleasedAt: time.Now(), CAGeneration: cert.CAGeneration,
+	})
+	r.record(model.TransitionEntityCertificate, serial, string(cert.Status), string(model.StatusValid), "released")
+	cert.Status = model.StatusValid
+	r.certs[serial] = cert
+	return nil
+}
+
+func (r *memoryRepository) GetCertificatesByCAID(ctx context.Context, caID int) ([]model.Certificate, error) {
+	var certs []model.Certificate
+	for _, cert := range r.certs {
+		if cert.CAID == caID {
+			certs = append(certs, cert)
+		}
+	}
+	return certs, nil
+}
+
+func (r *memoryRepository) SaveCrossCertificate(ctx context.Context, cross model.CrossCertificate) (int, error) {
+	cross.ID = len(r.crosses) + 1
+	r.crosses = append(r.crosses, cross)
+	return cross.ID, nil
+}
+
+func (r *memoryRepository) GetCrossCertificates(ctx context.Context, caID int) ([]model.CrossCertificate, error) {
+	var crosses []model.CrossCertificate
+	for _, cc := range r.crosses {
+		if cc.IssuerCAID == caID || cc.SubjectCAID == caID {
+			crosses = append(crosses, cc)
+		}
+	}
+	return crosses, nil
+}
+
+func (r *memoryRepository) IsRevoked(ctx context.Context, serial string) (model.RevokedCertificate, bool, error) {
+	revoked, ok := r.revoked[serial]
+	return revoked, ok, nil
+}
+
+func (r *memoryRepository) GetRevokedCertificates(ctx context.Context, caID int) ([]model.RevokedCertificate, error) {
+	var revoked []model.RevokedCertificate
+	for serial, rc := range r.revoked {
+		if r.certs[serial].CAID == caID {
+			revoked = append(revoked, rc)
+		}
+	}
+	return revoked, nil
+}
+
+func (r *memoryRepository) GetRevokedCertificatesSince(ctx context.Context, caID int, since time.Time) ([]model.RevokedCertificate, error) {
+	var revoked []model.RevokedCertificate
+	for serial, rc := range r.revoked {
+		if r.certs[serial].CAID == caID && !r.updated[serial].Before(since) {
+			revoked = append(revoked, rc)
+		}
+	}
+	return revoked, nil
+}
+
+func (r *memoryRepository) GetReleasedCertificates(ctx context.Context, caID int, since time.Time) ([]model.ReleasedCertificate, error) {
+	var released []model.ReleasedCertificate
+	for _, rc := range r.released {
+		if r.certs[rc.SerialNumber].CAID == caID && !rc.ReleasedAt.Before(since) {
+			released = append(released, rc)
+		}
+	}
+	return released, nil
+}
+
+func newTestCAService(t *testing.T) (*caService, *memoryRepository) {
+	t.Helper()
+	keyService, err := keyservice.NewKeyManagementService(keymodel.Token{Backend: keymodel.BackendMemory},
+		keyrepo.NewMemoryKeyPairRepository(), nil, nil, 0)
+	if err != nil {
+		t.Fatalf("NewKeyManagementService: %v", err)
+	}
+	t.Cleanup(keyService.Close)
+	cfg := &config.AppConfig{}
+	cfg.CA.ValidityDays = 3650
+	cfg.KeyManagement.RandomSource = config.RandomSourceOS
+	repo := newMemoryRepository()
+	return NewCaService(repo, keyService, cfg).(*caService), repo
+}
+
+func newCSR(t *testing.T, cn string) string {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: cn},
+		DNSNames: []string{cn},
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}))
+}
+
+func parsePEMCertificate(t *testing.T, certPEM string) *x509.Certificate {
+	t.Helper()
+	cert, err := parseCertificatePEM(certPEM)
+	if err != nil {
+		t.Fatalf("parse certificate: %v", err)
+	}
+	return cert
+}
+
+// ocspStatus asks the CA for the OCSP status of cert and checks the
+// response signature.
+func ocspStatus(t *testing.T, s *caService, caID int, cert, issuer *x509.Certificate) *ocsp.Response {
+	t.Helper()
+	request, err := ocsp.CreateRequest(cert, issuer, &ocsp.RequestOptions{Hash: crypto.SHA256})
+	if err != nil {
+		t.Fatalf("CreateRequest: %v", err)
+	}
+	der, err := s.HandleOCSPRequest(context.Background(), request, caID)
+	if err != nil {
+		t.Fatalf("HandleOCSPRequest: %v", err)
+	}
+	response, err := ocsp.ParseResponseForCert(der, cert, issuer)
+	if err != nil {
+		t.Fatalf("ParseResponseForCert: %v", err)
+	}
+	return response
+}
+
+func TestIssueRevokeCRLAndOCSP(t *testing.T) {
+	s, repo := newTestCAService(t)
+	ctx := context.Background()
+
+	for _, algorithm := range []keymodel.KeyAlgorithm{keymodel.KeyAlgorithmECP256, keymodel.KeyAlgorithmRSA2048} {
+		t.Run(string(algorithm), func(t *testing.T) {
+			root, err := s.CreateCA(ctx, model.CACreate{Name: "Test Root " + string(algorithm), Type: model.RootCAType, KeyAlgorithm: algorithm})
+			if err != nil {
+				t.Fatalf("CreateCA: %v", err)
+			}
+			rootCert := parsePEMCertificate(t, root.CertPEM)
+			if !rootCert.IsCA || rootCert.CheckSignatureFrom(rootCert) != nil {
+				t.Fatal("root certificate is not a self-signed CA certificate")
+			}
+
+			issued, err := s.IssueCertificate(ctx, newCSR(t, "www.example.com"), root.ID)
+			if err != nil {
+				t.Fatalf("IssueCertificate: %v", err)
+			}
+			leaf := parsePEMCertificate(t, issued.CertPEM)
+			if err := leaf.CheckSignatureFrom(rootCert); err != nil {
+				t.Fatalf("leaf not signed by the root: %v", err)
+			}
+			if leaf.IsCA || leaf.Subject.CommonName != "www.example.com" || leaf.SerialNumber.String() != issued.SerialNumber {
+				t.Fatalf("unexpected leaf %s, serial %s", leaf.Subject, leaf.SerialNumber)
+			}
+			if response := ocspStatus(t, s, root.ID, leaf, rootCert); response.Status != ocsp.Good {
+				t.Fatalf("OCSP status before revocation = %d, want good", response.Status)
+			}
+
+			if err := s.RevokeCertificate(ctx, issued.SerialNumber, model.ReasonKeyCompromise); err != nil {
+				t.Fatalf("RevokeCertificate: %v", err)
+			}
+			if err := s.RevokeCertificate(ctx, issued.SerialNumber, model.ReasonKeyCompromise); !errors.Is(err, model.ErrAlreadyRevoked) {
+				t.Fatalf("second RevokeCertificate: %v, want ErrAlreadyRevoked", err)
+			}
+
+			crlPEM, err := s.GetCRL(ctx, root.ID)
+			if err != nil {
+				t.Fatalf("GetCRL: %v", err)
+			}
+			block, _ := pem.Decode(crlPEM)
+			if block == nil {
+				t.Fatal("CRL is not PEM")
+			}
+			crl, err := x509.ParseRevocationList(block.Bytes)
+			if err != nil {
+				t.Fatalf("ParseRevocationList: %v", err)
+			}
+			if err := crl.CheckSignatureFrom(rootCert); err != nil {
+				t.Fatalf("CRL signature: %v", err)
+			}
+			if len(crl.RevokedCertificateEntries) != 1 || crl.RevokedCertificateEntries[0].SerialNumber.Cmp(leaf.SerialNumber) != 0 {
+				t.Fatalf("CRL entries %+v, want the revoked leaf only", crl.RevokedCertificateEntries)
+			}
+			if crl.RevokedCertificateEntries[0].ReasonCode != ocsp.KeyCompromise {
+				t.Errorf("CRL reason = %d, want keyCompromise", crl.RevokedCertificateEntries[0].ReasonCode)
+			}
+
+			response := ocspStatus(t, s, root.ID, leaf, rootCert)
+			if response.Status != ocsp.Revoked || response.RevocationReason != ocsp.KeyCompromise {
+				t.Fatalf("OCSP status after revocation = %d (reason %d), want revoked for keyCompromise", response.Status, response.RevocationReason)
+			}
+
+			transitions, err := s.GetCertificateStatusTransitions(ctx, issued.SerialNumber)
+			if err != nil {
+				t.Fatalf("GetCertificateStatusTransitions: %v", err)
+			}
+			if len(transitions) != 1 || transitions[0].FromStatus != string(model.StatusValid) || transitions[0].ToStatus != string(model.StatusRevoked) {
+				t.Fatalf("transitions %+v, want valid to revoked", transitions)
+			}
+		})
+	}
+
+	// An unknown serial number is not answered as good
+	root := repo.cas[1]
+	rootCert := parsePEMCertificate(t, root.CertPEM)
+	unknown := *rootCert
+	unknown.SerialNumber = big.NewInt(42)
+	if response := ocspStatus(t, s, root.ID, &unknown, rootCert); response.Status == ocsp.Good {
+		t.Error("OCSP answered good for a serial number the CA never issued")
+	}
+}
+
+func TestRevokedCAKeepsPublishingRevocations(t *testing.T) {
+	s, _ := newTestCAService(t)
+	ctx := context.Background()
+
+	root, err := s.CreateCA(ctx, model.CACreate{Name: "Test Root", Type: model.RootCAType, KeyAlgorithm: keymodel.KeyAlgorithmECP256})
+	if err != nil {
+		t.Fatalf("CreateCA: %v", err)
+	}
+	rootCert := parsePEMCertificate(t, root.CertPEM)
+	issued, err := s.IssueCertificate(ctx, newCSR(t, "www.example.com"), root.ID)
+	if err != nil {
+		t.Fatalf("IssueCertificate: %v", err)
+	}
+	leaf := parsePEMCertificate(t, issued.CertPEM)
+
+	if _, err := s.RevokeCA(ctx, root.ID, model.CARevocation{Reason: model.ReasonCessationOfOperation, RevokeLeaves: true}); err != nil {
+		t.Fatalf("RevokeCA: %v", err)
+	}
+	if _, err := s.IssueCertificate(ctx, newCSR(t, "late.example.com"), root.ID); err == nil {
+		t.Fatal("a revoked CA issued a certificate")
+	}
+	if _, err := s.GetCRL(ctx, root.ID); err != nil {
+		t.Fatalf("GetCRL of a revoked CA: %v", err)
+	}
+	if response := ocspStatus(t, s, root.ID, leaf, rootCert); response.Status != ocsp.Revoked {
+		t.Fatalf("OCSP status of a leaf of a revoked CA = %d, want revoked", response.Status)
+	}
+}
@@ -0,0 +1,406 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"core-ca/ca/model"
+	"core-ca/keymanagement/keyfile"
+	"crypto/x509"
+	"encoding/asn1"
+	"fmt"
+	"net"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// anyPolicy is the special policy OID that stands for every policy (RFC 5280, section 4.2.1.4).
+var anyPolicy = mustParseOID("2.5.29.32.0")
+
+func mustParseOID(s string) x509.OID {
+	oid, err := x509.ParseOID(s)
+	if err != nil {
+		panic(err)
+	}
+	return oid
+}
+
+// parseCAConstraints returns a certificate holding only the path length,
+// name constraints and policies requested for a new CA.
+func parseCAConstraints(req model.CACreate) (*x509.Certificate, error) {
+	c := &x509.Certificate{MaxPathLen: -1}
+	switch {
+	case req.MaxPathLen != nil && *req.MaxPathLen >= 0:
+		c.MaxPathLen = *req.MaxPathLen
+		c.MaxPathLenZero = *req.MaxPathLen == 0
+	case req.MaxPathLen == nil && req.Type == model.SubordinateCAType:
+		c.MaxPathLen = 0
+		c.MaxPathLenZero = true
+	}
+
+	if nc := req.NameConstraints; nc != nil {
+		var err error
+		if c.PermittedDNSDomains, err = parseDomainConstraints("permitted DNS domain", nc.PermittedDNSDomains); err != nil {
+			return nil, err
+		}
+		if c.ExcludedDNSDomains, err = parseDomainConstraints("excluded DNS domain", nc.ExcludedDNSDomains); err != nil {
+			return nil, err
+		}
+		if c.PermittedIPRanges, err = parseIPConstraints("permitted IP range", nc.PermittedIPRanges); err != nil {
+			return nil, err
+		}
+		if c.ExcludedIPRanges, err = parseIPConstraints("excluded IP range", nc.ExcludedIPRanges); err != nil {
+			return nil, err
+		}
+		if c.PermittedEmailAddresses, err = parseEmailConstraints("permitted email address", nc.PermittedEmailAddresses); err != nil {
+			return nil, err
+		}
+		if c.ExcludedEmailAddresses, err = parseEmailConstraints("excluded email address", nc.ExcludedEmailAddresses); err != nil {
+			return nil, err
+		}
+		if c.PermittedURIDomains, err = parseDomainConstraints("permitted URI domain", nc.PermittedURIDomains); err != nil {
+			return nil, err
+		}
+		if c.ExcludedURIDomains, err = parseDomainConstraints("excluded URI domain", nc.ExcludedURIDomains); err != nil {
+			return nil, err
+		}
+		// Conforming CAs mark name constraints critical (RFC 5280, section 4.2.1.10)
+		c.PermittedDNSDomainsCritical = true
+	}
+
+	for _, s := range req.Policies {
+		oid, err := x509.ParseOID(s)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid policy OID %q", model.ErrInvalidCAConstraints, s)
+		}
+		if slices.ContainsFunc(c.Policies, oid.Equal) {
+			return nil, fmt.Errorf("%w: duplicate policy OID %s", model.ErrInvalidCAConstraints, s)
+		}
+		c.Policies = append(c.Policies, oid)
+	}
+	return c, nil
+}
+
+// applyCAConstraints copies the constraints parsed by parseCAConstraints into
+// a CA certificate template.
+func applyCAConstraints(template, c *x509.Certificate) {
+	template.MaxPathLen = c.MaxPathLen
+	template.MaxPathLenZero = c.MaxPathLenZero
+	template.PermittedDNSDomainsCritical = c.PermittedDNSDomainsCritical
+	template.PermittedDNSDomains = c.PermittedDNSDomains
+	template.ExcludedDNSDomains = c.ExcludedDNSDomains
+	template.PermittedIPRanges = c.PermittedIPRanges
+	template.ExcludedIPRanges = c.ExcludedIPRanges
+	template.PermittedEmailAddresses = c.PermittedEmailAddresses
+	template.ExcludedEmailAddresses = c.ExcludedEmailAddresses
+	template.PermittedURIDomains = c.PermittedURIDomains
+	template.ExcludedURIDomains = c.ExcludedURIDomains
+	template.Policies = c.Policies
+}
+
+// parseDomainConstraints checks DNS or URI domain constraints: a host name,
+// or a domain with a leading period.
+func parseDomainConstraints(kind string, values []string) ([]string, error) {
+	var domains []string
+	for _, value := range values {
+		domain := strings.ToLower(value)
+		if !validDomain(strings.TrimPrefix(domain, ".")) {
+			return nil, fmt.Errorf("%w: invalid %s %q", model.ErrInvalidCAConstraints, kind, value)
+		}
+		domains = append(domains, domain)
+	}
+	return domains, nil
+}
+
+// parseEmailConstraints checks email constraints: a mailbox, a host, or a
+// domain with a leading period.
+func parseEmailConstraints(kind string, values []string) ([]string, error) {
+	var constraints []string
+	for _, value := range values {
+		constraint := strings.ToLower(value)
+		host := strings.TrimPrefix(constraint, ".")
+		if local, domain, ok := strings.Cut(constraint, "@"); ok {
+			if local == "" {
+				host = ""
+			} else {
+				host = domain
+			}
+		}
+		if !validDomain(host) {
+			return nil, fmt.Errorf("%w: invalid %s %q", model.ErrInvalidCAConstraints, kind, value)
+		}
+		constraints = append(constraints, constraint)
+	}
+	return constraints, nil
+}
+
+// parseIPConstraints parses CIDR ranges given by their network address.
+func parseIPConstraints(kind string, values []string) ([]*net.IPNet, error) {
+	var ranges []*net.IPNet
+	for _, value := range values {
+		ip, ipNet, err := net.ParseCIDR(value)
+		if err != nil || !ip.Equal(ipNet.IP) {
+			return nil, fmt.Errorf("%w: invalid %s %q, want a network in CIDR form", model.ErrInvalidCAConstraints, kind, value)
+		}
+		ranges = append(ranges, ipNet)
+	}
+	return ranges, nil
+}
+
+// validDomain reports whether s is a lower-case host name without wildcards.
+func validDomain(s string) bool {
+	if s == "" || len(s) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(s, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !('a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// checkCAConstraints checks the constraints of a new subordinate CA against
+// its issuers, from the parent up to the root: the issuers must allow one
+// more CA below them, and the new CA may not permit names or assert policies
+// its issuers do not.
+func checkCAConstraints(c *x509.Certificate, issuers []*x509.Certificate) error {
+	for i, issuer := range issuers {
+		if issuer.MaxPathLen < 0 || issuer.MaxPathLen == 0 && !issuer.MaxPathLenZero {
+			continue
+		}
+		// i CAs already stand between the issuer and the new CA
+		remaining := issuer.MaxPathLen - i - 1
+		if remaining < 0 {
+			return fmt.Errorf("%w: CA %s does not allow another CA below it (path length %d)", model.ErrInvalidCAConstraints, issuer.Subject, issuer.MaxPathLen)
+		}
+		if c.MaxPathLen < 0 || c.MaxPathLen > remaining {
+			return fmt.Errorf("%w: max_path_len must be at most %d below CA %s", model.ErrInvalidCAConstraints, remaining, issuer.Subject)
+		}
+	}
+
+	for _, issuer := range issuers {
+		if err := checkSubtreesWithin("DNS domain", c.PermittedDNSDomains, issuer.PermittedDNSDomains, issuer.ExcludedDNSDomains, issuer, dnsSubtreeWithin); err != nil {
+			return err
+		}
+		if err := checkSubtreesWithin("email address", c.PermittedEmailAddresses, issuer.PermittedEmailAddresses, issuer.ExcludedEmailAddresses, issuer, emailSubtreeWithin); err != nil {
+			return err
+		}
+		if err := checkSubtreesWithin("URI domain", c.PermittedURIDomains, issuer.PermittedURIDomains, issuer.ExcludedURIDomains, issuer, hostSubtreeWithin); err != nil {
+			return err
+		}
+		for _, ipNet := range c.PermittedIPRanges {
+			if len(issuer.PermittedIPRanges) > 0 && !slices.ContainsFunc(issuer.PermittedIPRanges, func(p *net.IPNet) bool { return ipRangeWithin(ipNet, p) }) {
+				return fmt.Errorf("%w: permitted IP range %s is outside the permitted ranges of CA %s", model.ErrInvalidCAConstraints, ipNet, issuer.Subject)
+			}
+			if slices.ContainsFunc(issuer.ExcludedIPRanges, func(e *net.IPNet) bool { return ipRangeWithin(ipNet, e) }) {
+				return fmt.Errorf("%w: permitted IP range %s is excluded by CA %s", model.ErrInvalidCAConstraints, ipNet, issuer.Subject)
+			}
+		}
+	}
+
+	if len(c.Policies) == 0 {
+		return nil
+	}
+	for _, issuer := range issuers {
+		// The trust anchor's policies are not processed
+		if bytes.Equal(issuer.RawIssuer, issuer.RawSubject) {
+			continue
+		}
+		if len(issuer.Policies) == 0 {
+			return fmt.Errorf("%w: CA %s asserts no certificate policies", model.ErrInvalidCAConstraints, issuer.Subject)
+		}
+		if slices.ContainsFunc(issuer.Policies, anyPolicy.Equal) {
+			continue
+		}
+		for _, policy := range c.Policies {
+			if !slices.ContainsFunc(issuer.Policies, policy.Equal) {
+				return fmt.Errorf("%w: policy %s is not asserted by CA %s", model.ErrInvalidCAConstraints, policy, issuer.Subject)
+			}
+		}
+	}
+	return nil
+}
+
+// checkSubtreesWithin checks that the permitted subtrees of a new CA lie in
+// the permitted subtrees of an issuer, if it has any, and not in its
+// excluded subtrees.
+func checkSubtreesWithin(kind string, subtrees, permitted, excluded []string, issuer *x509.Certificate, within func(c, p string) bool) error {
+	for _, subtree := range subtrees {
+		if len(permitted) > 0 && !slices.ContainsFunc(permitted, func(p string) bool { return within(subtree, p) }) {
+			return fmt.Errorf("%w: permitted %s %s is outside the permitted subtrees of CA %s", model.ErrInvalidCAConstraints, kind, subtree, issuer.Subject)
+		}
+		if slices.ContainsFunc(excluded, func(e string) bool { return within(subtree, e) }) {
+			return fmt.Errorf("%w: permitted %s %s is excluded by CA %s", model.ErrInvalidCAConstraints, kind, subtree, issuer.Subject)
+		}
+	}
+	return nil
+}
+
+// dnsMatch reports whether a DNS name lies in a DNS domain constraint: the
+// domain and its subdomains, or only the subdomains with a leading period.
+func dnsMatch(name, constraint string) bool {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if strings.HasPrefix(constraint, ".") {
+		return strings.HasSuffix(name, constraint)
+	}
+	return name == constraint || strings.HasSuffix(name, "."+constraint)
+}
+
+// dnsSubtreeWithin reports whether every name in DNS constraint c lies in p.
+func dnsSubtreeWithin(c, p string) bool {
+	domain := strings.TrimPrefix(c, ".")
+	if strings.HasPrefix(p, ".") {
+		return strings.HasSuffix(domain, p) || strings.HasPrefix(c, ".") && "."+domain == p
+	}
+	return dnsMatch(domain, p)
+}
+
+// hostMatch reports whether a host lies in an email host or URI constraint:
+// exactly the host, or the subdomains of a domain with a leading period.
+func hostMatch(host, constraint string) bool {
+	host = strings.ToLower(host)
+	if strings.HasPrefix(constraint, ".") {
+		return strings.HasSuffix(host, constraint)
+	}
+	return host == constraint
+}
+
+// hostSubtreeWithin reports whether every host in constraint c lies in p.
+func hostSubtreeWithin(c, p string) bool {
+	if strings.HasPrefix(c, ".") {
+		return strings.HasPrefix(p, ".") && strings.HasSuffix(c, p)
+	}
+	return hostMatch(c, p)
+}
+
+// emailMatch reports whether an email address lies in an email constraint.
+func emailMatch(email, constraint string) bool {
+	if strings.Contains(constraint, "@") {
+		return strings.EqualFold(email, constraint)
+	}
+	_, host, ok := strings.Cut(email, "@")
+	return ok && hostMatch(host, constraint)
+}
+
+// emailSubtreeWithin reports whether every address in email constraint c lies in p.
+func emailSubtreeWithin(c, p string) bool {
+	if strings.Contains(c, "@") {
+		return emailMatch(c, p)
+	}
+	return !strings.Contains(p, "@") && hostSubtreeWithin(c, p)
+}
+
+// ipRangeWithin reports whether range c lies in range p.
+func ipRangeWithin(c, p *net.IPNet) bool {
+	cOnes, cBits := c.Mask.Size()
+	pOnes, pBits := p.Mask.Size()
+	return cBits == pBits && pOnes <= cOnes && p.Contains(c.IP)
+}
+
+// caControlledExtensions are the extensions a certificate request must not
+// ask for: their values are set by the CA, and path length, name constraints
+// and policies are enforced along the issuing chain.
+var caControlledExtensions = map[string]asn1.ObjectIdentifier{
+	"key usage":            {2, 5, 29, 15},
+	"basic constraints":    {2, 5, 29, 19},
+	"name constraints":     {2, 5, 29, 30},
+	"certificate policies": {2, 5, 29, 32},
+	"policy mappings":      {2, 5, 29, 33},
+	"policy constraints":   {2, 5, 29, 36},
+	"inhibit anyPolicy":    {2, 5, 29, 54},
+}
+
+// checkCSRExtensions refuses a certificate request asking for an extension
+// the CA controls. Other requested extensions are not copied into the
+// certificate; its names come from the parsed subject alternative names.
+func checkCSRExtensions(csr *x509.CertificateRequest) error {
+	for _, ext := range csr.Extensions {
+		for name, oid := range caControlledExtensions {
+			if ext.Id.Equal(oid) {
+				return fmt.Errorf("%w: the request asks for %s (%s)", model.ErrInvalidCSR, name, ext.Id)
+			}
+		}
+	}
+	return nil
+}
+
+// checkNamesPermitted checks the subject alternative names of a certificate
+// request against the name constraints of the issuing CA and its parents.
+func checkNamesPermitted(csr *x509.CertificateRequest, chain []*x509.Certificate) error {
+	for _, ca := range chain {
+		for _, name := range csr.DNSNames {
+			if err := checkName("DNS name", name, ca.PermittedDNSDomains, ca.ExcludedDNSDomains, ca, dnsMatch); err != nil {
+				return err
+			}
+		}
+		for _, email := range csr.EmailAddresses {
+			if err := checkName("email address", email, ca.PermittedEmailAddresses, ca.ExcludedEmailAddresses, ca, emailMatch); err != nil {
+				return err
+			}
+		}
+		for _, uri := range csr.URIs {
+			if err := checkName("URI", uri.String(), ca.PermittedURIDomains, ca.ExcludedURIDomains, ca, uriMatch); err != nil {
+				return err
+			}
+		}
+		for _, ip := range csr.IPAddresses {
+			contains := func(r *net.IPNet) bool { return r.Contains(ip) }
+			if len(ca.PermittedIPRanges) > 0 && !slices.ContainsFunc(ca.PermittedIPRanges, contains) || slices.ContainsFunc(ca.ExcludedIPRanges, contains) {
+				return fmt.Errorf("%w by CA %s: IP address %s", model.ErrNameNotPermitted, ca.Subject, ip)
+			}
+		}
+	}
+	return nil
+}
+
+func checkName(kind, name string, permitted, excluded []string, ca *x509.Certificate, match func(name, constraint string) bool) error {
+	if len(permitted) > 0 && !slices.ContainsFunc(permitted, func(p string) bool { return match(name, p) }) ||
+		slices.ContainsFunc(excluded, func(e string) bool { return match(name, e) }) {
+		return fmt.Errorf("%w by CA %s: %s %s", model.ErrNameNotPermitted, ca.Subject, kind, name)
+	}
+	return nil
+}
+
+// uriMatch reports whether the host of a URI lies in a URI constraint.
+func uriMatch(uri, constraint string) bool {
+	u, err := url.Parse(uri)
+	if err != nil || u.Hostname() == "" {
+		return false
+	}
+	return hostMatch(u.Hostname(), constraint)
+}
+
+// caChainCertificates returns the certificates of a CA and its parents, up to the root.
+func (s *caService) caChainCertificates(ctx context.Context, caID int) ([]*x509.Certificate, error) {
+	chain, err := s.repo.GetCAChain(ctx, caID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get CA chain: %w", err)
+	}
+	certs := make([]*x509.Certificate, 0, len(chain))
+	for i, ca := range chain {
+		cert, err := parseCertificatePEM(ca.CertPEM)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse certificate of CA %s: %w", ca.Name, err)
+		}
+		if i > 0 {
+			// The CA below may have been certified by an earlier key of this one
+			cert = s.issuingGeneration(ctx, ca, cert, certs[i-1])
+		}
+		certs = append(certs, cert)
+	}
+	// A CA signed outside this system continues with the chain it was activated with
+	if top := chain[len(chain)-1]; top.ExternalChainPEM != "" {
+		external, err := keyfile.ParseCertificatesPEM([]byte(top.ExternalChainPEM))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse external chain of CA %s: %w", top.Name, err)
+		}
+		certs = append(certs, external...)
+	}
+	return certs, nil
+}
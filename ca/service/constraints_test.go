@@ -0,0 +1,337 @@
+package service
+
+import (
+	"core-ca/ca/model"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"net"
+	"net/url"
+	"testing"
+)
+
+func TestDNSSubtreeWithin(t *testing.T) {
+	for _, tc := range []struct {
+		c, p string
+		want bool
+	}{
+		{"example.com", "example.com", true},
+		{"sub.example.com", "example.com", true},
+		{".example.com", "example.com", true},
+		{".sub.example.com", "example.com", true},
+		// A bare domain is not among the subdomains a leading period stands for
+		{"example.com", ".example.com", false},
+		{".example.com", ".example.com", true},
+		{"sub.example.com", ".example.com", true},
+		{".sub.example.com", ".example.com", true},
+		{"badexample.com", "example.com", false},
+		{".badexample.com", ".example.com", false},
+		{"example.com.evil", "example.com", false},
+		{"example.com", "sub.example.com", false},
+		{".example.com", "sub.example.com", false},
+	} {
+		if got := dnsSubtreeWithin(tc.c, tc.p); got != tc.want {
+			t.Errorf("dnsSubtreeWithin(%q, %q) = %v, want %v", tc.c, tc.p, got, tc.want)
+		}
+	}
+}
+
+func TestHostSubtreeWithin(t *testing.T) {
+	for _, tc := range []struct {
+		c, p string
+		want bool
+	}{
+		// Without a leading period a host constraint is that host only
+		{"example.com", "example.com", true},
+		{"sub.example.com", "example.com", false},
+		{".example.com", "example.com", false},
+		{"sub.example.com", ".example.com", true},
+		{".sub.example.com", ".example.com", true},
+		{".example.com", ".example.com", true},
+		{"example.com", ".example.com", false},
+		{".badexample.com", ".example.com", false},
+	} {
+		if got := hostSubtreeWithin(tc.c, tc.p); got != tc.want {
+			t.Errorf("hostSubtreeWithin(%q, %q) = %v, want %v", tc.c, tc.p, got, tc.want)
+		}
+	}
+}
+
+func TestEmailSubtreeWithin(t *testing.T) {
+	for _, tc := range []struct {
+		c, p string
+		want bool
+	}{
+		{"alice@example.com", "alice@example.com", true},
+		{"bob@example.com", "alice@example.com", false},
+		{"alice@example.com", "example.com", true},
+		{"alice@sub.example.com", "example.com", false},
+		{"alice@sub.example.com", ".example.com", true},
+		{"alice@example.com", ".example.com", false},
+		// A host or domain holds more than one mailbox
+		{"example.com", "alice@example.com", false},
+		{".example.com", "alice@sub.example.com", false},
+		{"example.com", "example.com", true},
+		{"sub.example.com", "example.com", false},
+		{"sub.example.com", ".example.com", true},
+		{".sub.example.com", ".example.com", true},
+		{".example.com", "example.com", false},
+		{"example.com", ".example.com", false},
+	} {
+		if got := emailSubtreeWithin(tc.c, tc.p); got != tc.want {
+			t.Errorf("emailSubtreeWithin(%q, %q) = %v, want %v", tc.c, tc.p, got, tc.want)
+		}
+	}
+}
+
+func TestIPRangeWithin(t *testing.T) {
+	for _, tc := range []struct {
+		c, p string
+		want bool
+	}{
+		{"10.1.0.0/16", "10.0.0.0/8", true},
+		{"10.0.0.0/8", "10.0.0.0/8", true},
+		{"10.0.0.0/8", "10.1.0.0/16", false},
+		{"11.0.0.0/16", "10.0.0.0/8", false},
+		{"2001:db8:1::/48", "2001:db8::/32", true},
+		{"2001:db8::/32", "2001:db8:1::/48", false},
+		// IPv4 and IPv6 ranges are different address families (RFC 5280,
+		// section 4.2.1.10), even for IPv4-mapped addresses
+		{"10.0.0.0/8", "::/0", false},
+		{"10.0.0.0/8", "::ffff:0:0/96", false},
+		{"::ffff:10.0.0.0/104", "10.0.0.0/8", false},
+		{"::/0", "0.0.0.0/0", false},
+	} {
+		_, c, err := net.ParseCIDR(tc.c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, p, err := net.ParseCIDR(tc.p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := ipRangeWithin(c, p); got != tc.want {
+			t.Errorf("ipRangeWithin(%s, %s) = %v, want %v", tc.c, tc.p, got, tc.want)
+		}
+	}
+}
+
+func pathLen(n int) *int { return &n }
+
+// constrainedCA returns a CA certificate carrying the constraints of req.
+// Its issuer differs from its subject unless it is a root.
+func constrainedCA(t *testing.T, name string, req model.CACreate) *x509.Certificate {
+	t.Helper()
+	c, err := parseCAConstraints(req)
+	if err != nil {
+		t.Fatalf("parseCAConstraints %s: %v", name, err)
+	}
+	c.Subject = pkix.Name{CommonName: name}
+	c.RawSubject = []byte(name)
+	c.RawIssuer = []byte(name)
+	if req.Type != model.RootCAType {
+		c.RawIssuer = []byte("issuer of " + name)
+	}
+	return c
+}
+
+func TestCheckCAConstraintsPathLength(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		issuers []*int // path lengths from the parent up to the root; nil for none
+		want    *int   // path length of the new CA
+		ok      bool
+	}{
+		{"unconstrained", []*int{nil, nil}, nil, true},
+		{"root 1 allows no CA below its child", []*int{nil, pathLen(1)}, pathLen(0), false},
+		{"root 2 allows a CA with path length 0 below its child", []*int{nil, pathLen(2)}, pathLen(0), true},
+		{"root 2 refuses path length 1 below its child", []*int{nil, pathLen(2)}, pathLen(1), false},
+		{"root 2 refuses an unconstrained CA below its child", []*int{nil, pathLen(2)}, nil, false},
+		{"the parent limits more than the root", []*int{pathLen(0), pathLen(5)}, pathLen(0), false},
+		{"the root limits more than the parent", []*int{pathLen(3), pathLen(2)}, pathLen(1), false},
+		{"three issuers", []*int{pathLen(5), nil, pathLen(3)}, pathLen(0), true},
+		{"three issuers, root exhausted", []*int{pathLen(5), nil, pathLen(2)}, pathLen(0), false},
+		{"three issuers, too long below the root", []*int{pathLen(5), pathLen(5), pathLen(4)}, pathLen(2), false},
+	} {
+		var issuers []*x509.Certificate
+		for i, maxPathLen := range tc.issuers {
+			caType := model.SubordinateCAType
+			if i == len(tc.issuers)-1 {
+				caType = model.RootCAType
+			}
+			if maxPathLen == nil {
+				// Only a root is unconstrained by default
+				maxPathLen = pathLen(-1)
+			}
+			issuers = append(issuers, constrainedCA(t, string(rune('A'+i)), model.CACreate{Type: caType, MaxPathLen: maxPathLen}))
+		}
+		want := tc.want
+		if want == nil {
+			want = pathLen(-1)
+		}
+		c := constrainedCA(t, "new", model.CACreate{Type: model.SubordinateCAType, MaxPathLen: want})
+
+		err := checkCAConstraints(c, issuers)
+		if tc.ok && err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+		}
+		if !tc.ok && !errors.Is(err, model.ErrInvalidCAConstraints) {
+			t.Errorf("%s: %v, want ErrInvalidCAConstraints", tc.name, err)
+		}
+	}
+}
+
+func TestCheckCAConstraintsNames(t *testing.T) {
+	parent := constrainedCA(t, "parent", model.CACreate{Type: model.SubordinateCAType, MaxPathLen: pathLen(1), NameConstraints: &model.NameConstraints{
+		PermittedDNSDomains:     []string{"example.com", ".example.org"},
+		ExcludedDNSDomains:      []string{"secret.example.com"},
+		PermittedIPRanges:       []string{"10.0.0.0/8", "2001:db8::/32"},
+		ExcludedIPRanges:        []string{"10.99.0.0/16"},
+		PermittedEmailAddresses: []string{"example.com", ".example.org"},
+		PermittedURIDomains:     []string{".example.com"},
+	}})
+	root := constrainedCA(t, "root", model.CACreate{Type: model.RootCAType, NameConstraints: &model.NameConstraints{
+		ExcludedDNSDomains: []string{".internal.example.com"},
+	}})
+	issuers := []*x509.Certificate{parent, root}
+
+	for _, tc := range []struct {
+		name string
+		nc   model.NameConstraints
+		ok   bool
+	}{
+		{"DNS subdomain", model.NameConstraints{PermittedDNSDomains: []string{"pki.example.com"}}, true},
+		{"DNS subdomains of a bare domain", model.NameConstraints{PermittedDNSDomains: []string{".example.com"}}, true},
+		{"bare domain of subdomains only", model.NameConstraints{PermittedDNSDomains: []string{"example.org"}}, false},
+		{"DNS outside", model.NameConstraints{PermittedDNSDomains: []string{"example.net"}}, false},
+		{"DNS excluded by the parent", model.NameConstraints{PermittedDNSDomains: []string{"a.secret.example.com"}}, false},
+		{"DNS excluded by the root", model.NameConstraints{PermittedDNSDomains: []string{"host.internal.example.com"}}, false},
+		{"IPv4 range", model.NameConstraints{PermittedIPRanges: []string{"10.1.0.0/16"}}, true},
+		{"IPv6 range", model.NameConstraints{PermittedIPRanges: []string{"2001:db8:1::/48"}}, true},
+		{"IPv4-mapped range", model.NameConstraints{PermittedIPRanges: []string{"::ffff:10.1.0.0/112"}}, false},
+		{"IP range excluded", model.NameConstraints{PermittedIPRanges: []string{"10.99.1.0/24"}}, false},
+		{"IP range wider", model.NameConstraints{PermittedIPRanges: []string{"10.0.0.0/7"}}, false},
+		{"mailbox", model.NameConstraints{PermittedEmailAddresses: []string{"alice@example.com"}}, true},
+		{"mailbox in a subdomain", model.NameConstraints{PermittedEmailAddresses: []string{"alice@sub.example.org"}}, true},
+		{"mailbox of another host", model.NameConstraints{PermittedEmailAddresses: []string{"alice@sub.example.com"}}, false},
+		{"email host", model.NameConstraints{PermittedEmailAddresses: []string{"mail.example.org"}}, true},
+		{"email domain", model.NameConstraints{PermittedEmailAddresses: []string{".example.com"}}, false},
+		{"URI host", model.NameConstraints{PermittedURIDomains: []string{"www.example.com"}}, true},
+		{"URI host of the bare domain", model.NameConstraints{PermittedURIDomains: []string{"example.com"}}, false},
+		// The new CA may exclude what it likes
+		{"exclusions only", model.NameConstraints{ExcludedDNSDomains: []string{"example.net"}, ExcludedIPRanges: []string{"192.168.0.0/16"}}, true},
+	} {
+		c := constrainedCA(t, "new", model.CACreate{Type: model.SubordinateCAType, NameConstraints: &tc.nc})
+		err := checkCAConstraints(c, issuers)
+		if tc.ok && err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+		}
+		if !tc.ok && !errors.Is(err, model.ErrInvalidCAConstraints) {
+			t.Errorf("%s: %v, want ErrInvalidCAConstraints", tc.name, err)
+		}
+	}
+}
+
+func TestCheckCAConstraintsPolicies(t *testing.T) {
+	const (
+		policyA = "1.3.6.1.4.1.99999.1"
+		policyB = "1.3.6.1.4.1.99999.2"
+	)
+	rootWithoutPolicies := constrainedCA(t, "root", model.CACreate{Type: model.RootCAType})
+	rootWithPolicyA := constrainedCA(t, "root", model.CACreate{Type: model.RootCAType, Policies: []string{policyA}})
+	parentA := constrainedCA(t, "parent", model.CACreate{Type: model.SubordinateCAType, MaxPathLen: pathLen(1), Policies: []string{policyA}})
+	parentAny := constrainedCA(t, "parent", model.CACreate{Type: model.SubordinateCAType, MaxPathLen: pathLen(1), Policies: []string{"2.5.29.32.0"}})
+	parentNone := constrainedCA(t, "parent", model.CACreate{Type: model.SubordinateCAType, MaxPathLen: pathLen(1)})
+
+	for _, tc := range []struct {
+		name     string
+		issuers  []*x509.Certificate
+		policies []string
+		ok       bool
+	}{
+		// The trust anchor's policies are not processed
+		{"below a root without policies", []*x509.Certificate{rootWithoutPolicies}, []string{policyB}, true},
+		{"below a root asserting another policy", []*x509.Certificate{rootWithPolicyA}, []string{policyB}, true},
+		{"asserted by the parent", []*x509.Certificate{parentA, rootWithoutPolicies}, []string{policyA}, true},
+		{"not asserted by the parent", []*x509.Certificate{parentA, rootWithoutPolicies}, []string{policyA, policyB}, false},
+		{"parent asserts anyPolicy", []*x509.Certificate{parentAny, rootWithoutPolicies}, []string{policyB}, true},
+		{"parent asserts no policies", []*x509.Certificate{parentNone, rootWithPolicyA}, []string{policyA}, false},
+		{"no policies requested", []*x509.Certificate{parentNone, rootWithoutPolicies}, nil, true},
+	} {
+		c := constrainedCA(t, "new", model.CACreate{Type: model.SubordinateCAType, Policies: tc.policies})
+		err := checkCAConstraints(c, tc.issuers)
+		if tc.ok && err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+		}
+		if !tc.ok && !errors.Is(err, model.ErrInvalidCAConstraints) {
+			t.Errorf("%s: %v, want ErrInvalidCAConstraints", tc.name, err)
+		}
+	}
+}
+
+func TestParseCAConstraintsRejects(t *testing.T) {
+	for _, nc := range []model.NameConstraints{
+		{PermittedDNSDomains: []string{"*.example.com"}},
+		{PermittedDNSDomains: []string{"example..com"}},
+		{PermittedDNSDomains: []string{"-example.com"}},
+		{PermittedIPRanges: []string{"10.0.0.1/8"}},
+		{PermittedIPRanges: []string{"10.0.0.0"}},
+		{PermittedEmailAddresses: []string{"@example.com"}},
+		{PermittedEmailAddresses: []string{"alice@"}},
+		{PermittedURIDomains: []string{"https://example.com"}},
+	} {
+		if _, err := parseCAConstraints(model.CACreate{Type: model.SubordinateCAType, NameConstraints: &nc}); !errors.Is(err, model.ErrInvalidCAConstraints) {
+			t.Errorf("%+v: %v, want ErrInvalidCAConstraints", nc, err)
+		}
+	}
+	if _, err := parseCAConstraints(model.CACreate{Policies: []string{"1.2.3", "1.2.3"}}); !errors.Is(err, model.ErrInvalidCAConstraints) {
+		t.Errorf("duplicate policy: %v, want ErrInvalidCAConstraints", err)
+	}
+}
+
+func TestCheckNamesPermitted(t *testing.T) {
+	parent := constrainedCA(t, "parent", model.CACreate{Type: model.SubordinateCAType, NameConstraints: &model.NameConstraints{
+		PermittedDNSDomains:     []string{"example.com"},
+		PermittedIPRanges:       []string{"10.0.0.0/8"},
+		PermittedEmailAddresses: []string{".example.com"},
+		PermittedURIDomains:     []string{"www.example.com"},
+	}})
+	root := constrainedCA(t, "root", model.CACreate{Type: model.RootCAType, NameConstraints: &model.NameConstraints{
+		ExcludedDNSDomains: []string{".internal.example.com"},
+		ExcludedIPRanges:   []string{"10.99.0.0/16"},
+	}})
+	chain := []*x509.Certificate{parent, root}
+
+	uri := func(s string) *url.URL {
+		u, err := url.Parse(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return u
+	}
+	for _, tc := range []struct {
+		name string
+		csr  x509.CertificateRequest
+		ok   bool
+	}{
+		{"DNS name", x509.CertificateRequest{DNSNames: []string{"example.com", "WWW.Example.com."}}, true},
+		{"DNS name outside", x509.CertificateRequest{DNSNames: []string{"example.com", "example.net"}}, false},
+		{"DNS name excluded by the root", x509.CertificateRequest{DNSNames: []string{"db.internal.example.com"}}, false},
+		{"IP address", x509.CertificateRequest{IPAddresses: []net.IP{net.ParseIP("10.1.2.3")}}, true},
+		{"IP address excluded by the root", x509.CertificateRequest{IPAddresses: []net.IP{net.ParseIP("10.99.2.3")}}, false},
+		{"IPv6 address", x509.CertificateRequest{IPAddresses: []net.IP{net.ParseIP("2001:db8::1")}}, false},
+		{"email address", x509.CertificateRequest{EmailAddresses: []string{"alice@mail.example.com"}}, true},
+		{"email address of the bare domain", x509.CertificateRequest{EmailAddresses: []string{"alice@example.com"}}, false},
+		{"URI", x509.CertificateRequest{URIs: []*url.URL{uri("https://www.example.com/path")}}, true},
+		{"URI of another host", x509.CertificateRequest{URIs: []*url.URL{uri("https://example.com/")}}, false},
+		{"URI without a host", x509.CertificateRequest{URIs: []*url.URL{uri("urn:example:1")}}, false},
+	} {
+		err := checkNamesPermitted(&tc.csr, chain)
+		if tc.ok && err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+		}
+		if !tc.ok && !errors.Is(err, model.ErrNameNotPermitted) {
+			t.Errorf("%s: %v, want ErrNameNotPermitted", tc.name, err)
+		}
+	}
+}
@@ -0,0 +1,310 @@
+package service
+
+import (
+	"context"
+	"core-ca/ca/model"
+	keymodel "core-ca/keymanagement/model"
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"database/sql"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"time"
+)
+
+// signerForCA returns the signer of the CA key recorded in crypto_keys after
+// checking that the key may be used for usage and that the token still holds
+// the key certified for the CA. CAs created before keys were recorded are
+// resolved once through the old "<name>-Key" label and linked to a new
+// crypto_keys row. The signer draws on the random source of the CA's token.
+func (s *caService) signerForCA(ctx context.Context, ca model.CA, usage model.KeyUsage) (crypto.Signer, error) {
+	caCert, err := parseCertificatePEM(ca.CertPEM)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse certificate of CA %s: %w", ca.Name, err)
+	}
+
+	key, err := s.caKey(ctx, ca, caCert)
+	if err != nil {
+		return nil, err
+	}
+	if key.Status != model.ActiveCryptoKeyStatus {
+		return nil, fmt.Errorf("key %s of CA %s is %s", key.Label, ca.Name, key.Status)
+	}
+	if err := s.checkKeyUsage(ctx, key, usage); err != nil {
+		return nil, fmt.Errorf("CA %s: %w", ca.Name, err)
+	}
+
+	signer, err := s.keyService.GetSigner(key.TokenName, key.Label)
+	if errors.Is(err, keymodel.ErrTokenNotFound) {
+		// A registered token that could not be opened at startup
+		return nil, &keymodel.HSMUnavailableError{Err: err}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyCAKey(signer.Public(), key, caCert); err != nil {
+		return nil, fmt.Errorf("refusing to sign for CA %s: %w", ca.Name, err)
+	}
+	return randomSigner{Signer: signer, random: s.randomSource(key.TokenName)}, nil
+}
+
+// caKey returns the crypto_keys row of the CA key.
+func (s *caService) caKey(ctx context.Context, ca model.CA, caCert *x509.Certificate) (model.CryptoKey, error) {
+	var key model.CryptoKey
+	var err error
+	if ca.KeyID == nil {
+		key, err = s.adoptLegacyKey(ctx, ca, caCert)
+	} else {
+		key, err = s.repo.FindKeyByID(ctx, *ca.KeyID)
+	}
+	if err != nil {
+		return model.CryptoKey{}, fmt.Errorf("failed to find key of CA %s: %w", ca.Name, err)
+	}
+	return key, nil
+}
+
+// AttestCAKey returns the signed attestation of a CA key after checking that
+// the attested key is the one recorded for the CA.
+func (s *caService) AttestCAKey(ctx context.Context, caID int) (keymodel.KeyAttestation, error) {
+	ca, err := s.repo.FindCAByID(ctx, caID)
+	if err != nil {
+		return keymodel.KeyAttestation{}, err
+	}
+	caCert, err := parseCertificatePEM(ca.CertPEM)
+	if err != nil {
+		return keymodel.KeyAttestation{}, fmt.Errorf("failed to parse certificate of CA %s: %w", ca.Name, err)
+	}
+	key, err := s.caKey(ctx, ca, caCert)
+	if err != nil {
+		return keymodel.KeyAttestation{}, err
+	}
+
+	attestation, err := s.keyService.AttestKey(key.TokenName, key.Label)
+	if err != nil {
+		return keymodel.KeyAttestation{}, err
+	}
+	if attestation.Report.PublicKeySHA256 != key.Fingerprint {
+		return keymodel.KeyAttestation{}, fmt.Errorf("public key of %s on the token does not match the recorded fingerprint %s", key.Label, key.Fingerprint)
+	}
+	return attestation, nil
+}
+
+// adoptLegacyKey records the "<name>-Key" key of a CA created without a
+// crypto_keys row and links it to the CA.
+func (s *caService) adoptLegacyKey(ctx context.Context, ca model.CA, caCert *x509.Certificate) (model.CryptoKey, error) {
+	label := ca.Name + "-Key"
+	key, err := s.repo.FindKeyByLabelAndTokenID(ctx, label, ca.TokenID)
+	if err == nil {
+		if key.CaID == nil || *key.CaID != ca.ID {
+			return model.CryptoKey{}, fmt.Errorf("key %s belongs to another CA", label)
+		}
+	} else if errors.Is(err, sql.ErrNoRows) {
+		keyPair, err := s.keyService.GetKeyPair(ca.TokenName, label)
+		if err != nil {
+			return model.CryptoKey{}, err
+		}
+		key, err = newCryptoKey(label, ca.TokenID, keyPair.PublicKey, keyPair.Algorithm)
+		if err != nil {
+			return model.CryptoKey{}, err
+		}
+		if err := verifyCAKey(keyPair.PublicKey, key, caCert); err != nil {
+			return model.CryptoKey{}, err
+		}
+		key.CaID = &ca.ID
+		key.ID, err = s.repo.SaveKey(ctx, key)
+		if err != nil {
+			return model.CryptoKey{}, err
+		}
+		if err := s.addKeyUsages(ctx, key.ID, model.CAKeyUsages); err != nil {
+			return model.CryptoKey{}, err
+		}
+	} else {
+		return model.CryptoKey{}, err
+	}
+
+	if err := s.repo.SetCAKey(ctx, ca.ID, key.ID); err != nil {
+		return model.CryptoKey{}, err
+	}
+	log.Printf("linked CA %s to key %s (id %d)", ca.Name, label, key.ID)
+	return key, nil
+}
+
+// checkKeyUsage returns an error matching model.ErrKeyUsageNotAllowed unless
+// key_usages grants usage to key.
+func (s *caService) checkKeyUsage(ctx context.Context, key model.CryptoKey, usage model.KeyUsage) error {
+	usages, err := s.repo.GetUsages(ctx, key.ID)
+	if err != nil {
+		return fmt.Errorf("failed to get usages of key %s: %w", key.Label, err)
+	}
+	if !slices.Contains(usages, usage) {
+		return fmt.Errorf("%w: key %s may not be used for %s", model.ErrKeyUsageNotAllowed, key.Label, usage)
+	}
+	return nil
+}
+
+func (s *caService) addKeyUsages(ctx context.Context, keyID int, usages []model.KeyUsage) error {
+	for _, usage := range usages {
+		if err := s.repo.AddUsage(ctx, keyID, usage); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *caService) GetKeyUsages(ctx context.Context, keyID int) ([]model.KeyUsage, error) {
+	if _, err := s.repo.FindKeyByID(ctx, keyID); err != nil {
+		return nil, err
+	}
+	return s.repo.GetUsages(ctx, keyID)
+}
+
+func (s *caService) AddKeyUsage(ctx context.Context, keyID int, usage model.KeyUsage) error {
+	if _, err := s.repo.FindKeyByID(ctx, keyID); err != nil {
+		return err
+	}
+	return s.repo.AddUsage(ctx, keyID, usage)
+}
+
+func (s *caService) RemoveKeyUsage(ctx context.Context, keyID int, usage model.KeyUsage) error {
+	if _, err := s.repo.FindKeyByID(ctx, keyID); err != nil {
+		return err
+	}
+	return s.repo.RemoveUsage(ctx, keyID, usage)
+}
+
+func (s *caService) DestroyKey(ctx context.Context, tokenName, keyLabel string) error {
+	var tokenID *int
+	if tokenName == keymodel.DefaultToken {
+		tokenName = ""
+	}
+	if tokenName != "" {
+		token, err := s.repo.FindTokenByName(ctx, tokenName)
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("%w: %s", keymodel.ErrTokenNotFound, tokenName)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to find token: %w", err)
+		}
+		tokenID = &token.ID
+	}
+
+	key, err := s.repo.FindKeyByLabelAndTokenID(ctx, keyLabel, tokenID)
+	recorded := err == nil
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("failed to find key: %w", err)
+	}
+
+	// Refuse while an active CA signs with the key, or a CA on hold or
+	// pending will sign with it once released or activated, whether it is
+	// linked by key_id or still found through the old "<name>-Key" label.
+	cas, err := s.repo.GetAllCAs(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to check CAs using the key: %w", err)
+	}
+	for _, ca := range cas {
+		if ca.Status != model.ActiveCAStatus && ca.Status != model.HoldCAStatus && ca.Status != model.PendingCAStatus {
+			continue
+		}
+		linked := recorded && ca.KeyID != nil && *ca.KeyID == key.ID
+		legacy := ca.KeyID == nil && ca.TokenName == tokenName && ca.Name+"-Key" == keyLabel
+		if linked || legacy {
+			return fmt.Errorf("%w: %s CA %s (id %d) signs with %s", model.ErrKeyInUse, ca.Status, ca.Name, ca.ID, keyLabel)
+		}
+		if !recorded {
+			continue
+		}
+		// Earlier generations sign CRLs and OCSP responses while their certificate is valid
+		previous, err := s.repo.GetCAGenerations(ctx, ca.ID)
+		if err != nil {
+			return fmt.Errorf("failed to check CAs using the key: %w", err)
+		}
+		for _, generation := range previous {
+			if generation.KeyID == nil || *generation.KeyID != key.ID {
+				continue
+			}
+			cert, err := parseCertificatePEM(generation.CertPEM)
+			if err == nil && time.Now().Before(cert.NotAfter) {
+				return fmt.Errorf("%w: generation %d of CA %s (id %d) signs with %s until %s", model.ErrKeyInUse, generation.Generation, ca.Name, ca.ID, keyLabel, cert.NotAfter.Format(time.RFC3339))
+			}
+		}
+	}
+
+	if err := s.keyService.DestroyKeyPair(tokenName, keyLabel); err != nil {
+		return err
+	}
+	if recorded {
+		if err := s.repo.UpdateKeyStatus(ctx, key.ID, model.DestroyedCryptoKeyStatus); err != nil {
+			return fmt.Errorf("key destroyed but its status could not be recorded: %w", err)
+		}
+	}
+	return nil
+}
+
+// verifyCAKey checks that pub is the recorded key and the key in the CA certificate.
+func verifyCAKey(pub crypto.PublicKey, key model.CryptoKey, caCert *x509.Certificate) error {
+	fingerprint, err := publicKeyFingerprint(pub)
+	if err != nil {
+		return err
+	}
+	if fingerprint != key.Fingerprint {
+		return fmt.Errorf("public key of %s on the token does not match the recorded fingerprint %s", key.Label, key.Fingerprint)
+	}
+	if k, ok := pub.(interface{ Equal(crypto.PublicKey) bool }); !ok || !k.Equal(caCert.PublicKey) {
+		return fmt.Errorf("public key of %s does not match the CA certificate", key.Label)
+	}
+	return nil
+}
+
+// newKeyLabel returns a fresh HSM label for a key of the named CA. The random
+// suffix keeps a recreated CA with the same name from picking up an old key.
+func newKeyLabel(caName string) (string, error) {
+	suffix := make([]byte, 8)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", fmt.Errorf("failed to generate key label: %w", err)
+	}
+	return caName + "-" + hex.EncodeToString(suffix), nil
+}
+
+// newCryptoKey builds the crypto_keys row for a key generated on a token.
+func newCryptoKey(label string, tokenID *int, pub crypto.PublicKey, algorithm keymodel.KeyAlgorithm) (model.CryptoKey, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return model.CryptoKey{}, fmt.Errorf("failed to marshal public key: %w", err)
+	}
+	fingerprint, err := publicKeyFingerprint(pub)
+	if err != nil {
+		return model.CryptoKey{}, err
+	}
+	return model.CryptoKey{
+		Label:       label,
+		TokenID:     tokenID,
+		PublicKey:   string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})),
+		Fingerprint: fingerprint,
+		Algorithm:   string(algorithm),
+		Status:      model.ActiveCryptoKeyStatus,
+	}, nil
+}
+
+// publicKeyFingerprint returns the hex SHA-256 of the SubjectPublicKeyInfo.
+func publicKeyFingerprint(pub crypto.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal public key: %w", err)
+	}
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func parseCertificatePEM(certPEM string) (*x509.Certificate, error) {
+	block, _ := pem.Decode([]byte(certPEM))
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.New("failed to decode PEM block containing certificate")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
@@ -0,0 +1,180 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"core-ca/ca/model"
+	"core-ca/config"
+	keyservice "core-ca/keymanagement/service"
+	"encoding/asn1"
+	"errors"
+	"io"
+	"math/big"
+	"strings"
+	"testing"
+)
+
+// scriptedRandom returns its blocks in turn, repeating the last one, and
+// counts the reads.
+type scriptedRandom struct {
+	blocks [][]byte
+	reads  int
+}
+
+func (r *scriptedRandom) Read(p []byte) (int, error) {
+	block := r.blocks[min(r.reads, len(r.blocks)-1)]
+	r.reads++
+	return copy(p, bytes.Repeat(block, len(p)/len(block)+1)), nil
+}
+
+// randomKeys serves Random from a fixed reader.
+type randomKeys struct {
+	keyservice.KeyManagementService
+	random io.Reader
+}
+
+func (k randomKeys) Random(string) io.Reader { return k.random }
+
+// withRandom makes the token random source of s read random.
+func withRandom(s *caService, random io.Reader) {
+	s.cfg.KeyManagement.RandomSource = config.RandomSourceHSM
+	s.keyService = randomKeys{KeyManagementService: s.keyService, random: random}
+}
+
+func TestParseSerialPrefix(t *testing.T) {
+	for prefix, want := range map[string][]byte{
+		"":       nil,
+		"01":     {0x01},
+		"ff":     {0xff},
+		"ABCDEF": {0xab, 0xcd, 0xef},
+	} {
+		got, err := parseSerialPrefix(prefix)
+		if err != nil || !bytes.Equal(got, want) {
+			t.Errorf("parseSerialPrefix(%q) = %x, %v, want %x", prefix, got, err, want)
+		}
+	}
+	for _, prefix := range []string{"00", "0001", "1", "xyz", "01020304", "0x01"} {
+		if _, err := parseSerialPrefix(prefix); !errors.Is(err, model.ErrInvalidSerialPrefix) {
+			t.Errorf("parseSerialPrefix(%q): %v, want ErrInvalidSerialPrefix", prefix, err)
+		}
+	}
+}
+
+func TestNewSerialNumberIsPositive(t *testing.T) {
+	s, _ := newTestCAService(t)
+	ctx := context.Background()
+
+	for _, prefix := range []string{"", "7f", "ffffff"} {
+		for range 200 {
+			serial, err := s.newSerialNumber(ctx, model.CA{Name: "Test CA", SerialPrefix: prefix})
+			if err != nil {
+				t.Fatalf("newSerialNumber: %v", err)
+			}
+			if serial.Sign() <= 0 {
+				t.Fatalf("serial number %d is not positive", serial)
+			}
+		}
+	}
+
+	// The largest serial number fits the 20 octets of RFC 5280
+	withRandom(s, &scriptedRandom{blocks: [][]byte{{0xff}}})
+	serial, err := s.newSerialNumber(ctx, model.CA{Name: "Test CA", SerialPrefix: "ffffff"})
+	if err != nil {
+		t.Fatalf("newSerialNumber: %v", err)
+	}
+	der, err := asn1.Marshal(serial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if length := len(der) - 2; serial.Sign() <= 0 || length > 20 {
+		t.Fatalf("serial number %x is %d octets", serial, length)
+	}
+
+	// A zero serial number is drawn again
+	random := &scriptedRandom{blocks: [][]byte{{0}, {0x01}}}
+	withRandom(s, random)
+	serial, err = s.newSerialNumber(ctx, model.CA{Name: "Test CA"})
+	if err != nil {
+		t.Fatalf("newSerialNumber: %v", err)
+	}
+	if serial.Sign() <= 0 || random.reads != 2 {
+		t.Fatalf("serial number %x after %d reads", serial, random.reads)
+	}
+}
+
+func TestNewSerialNumberKeepsRandomBits(t *testing.T) {
+	s, _ := newTestCAService(t)
+	ctx := context.Background()
+	prefix := []byte{0xab, 0xcd, 0xef}
+
+	// The prefix comes first and the full random part follows it
+	random := make([]byte, serialRandomBytes)
+	for i := range random {
+		random[i] = byte(i + 1)
+	}
+	withRandom(s, &scriptedRandom{blocks: [][]byte{random}})
+	serial, err := s.newSerialNumber(ctx, model.CA{Name: "Test CA", SerialPrefix: "abcdef"})
+	if err != nil {
+		t.Fatalf("newSerialNumber: %v", err)
+	}
+	if want := new(big.Int).SetBytes(append(bytes.Clone(prefix), random...)); serial.Cmp(want) != 0 {
+		t.Fatalf("serial number %x, want %x", serial, want)
+	}
+
+	// At least 64 bits follow the longest prefix, and every one of them varies
+	if 8*serialRandomBytes < 64 {
+		t.Fatalf("%d random bits, want at least 64", 8*serialRandomBytes)
+	}
+	s, _ = newTestCAService(t)
+	var set, unset big.Int
+	for range 256 {
+		serial, err := s.newSerialNumber(ctx, model.CA{Name: "Test CA", SerialPrefix: "abcdef"})
+		if err != nil {
+			t.Fatalf("newSerialNumber: %v", err)
+		}
+		b := serial.Bytes()
+		if len(b) != len(prefix)+serialRandomBytes || !bytes.Equal(b[:len(prefix)], prefix) {
+			t.Fatalf("serial number %x does not start with the prefix", serial)
+		}
+		randomPart := new(big.Int).SetBytes(b[len(prefix):])
+		set.Or(&set, randomPart)
+		unset.Or(&unset, new(big.Int).Not(randomPart))
+	}
+	mask := new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 8*serialRandomBytes), big.NewInt(1))
+	unset.And(&unset, mask)
+	if set.Cmp(mask) != 0 || unset.Cmp(mask) != 0 {
+		t.Fatalf("random bits never set %x, never cleared %x", new(big.Int).Xor(&set, mask), new(big.Int).Xor(&unset, mask))
+	}
+}
+
+func TestNewSerialNumberRetriesCollisions(t *testing.T) {
+	s, repo := newTestCAService(t)
+	ctx := context.Background()
+
+	used := bytes.Repeat([]byte{0x42}, serialRandomBytes)
+	fresh := bytes.Repeat([]byte{0x43}, serialRandomBytes)
+	usedSerial := new(big.Int).SetBytes(used)
+	repo.certs[usedSerial.String()] = model.Certificate{SerialNumber: usedSerial.String()}
+
+	// A serial number in use is drawn again
+	random := &scriptedRandom{blocks: [][]byte{used, used, fresh}}
+	withRandom(s, random)
+	serial, err := s.newSerialNumber(ctx, model.CA{Name: "Test CA"})
+	if err != nil {
+		t.Fatalf("newSerialNumber: %v", err)
+	}
+	if serial.Cmp(new(big.Int).SetBytes(fresh)) != 0 || random.reads != 3 {
+		t.Fatalf("serial number %x after %d reads", serial, random.reads)
+	}
+
+	// A generator that keeps repeating a used serial number is given up on
+	random = &scriptedRandom{blocks: [][]byte{used}}
+	withRandom(s, random)
+	_, err = s.newSerialNumber(ctx, model.CA{Name: "Test CA"})
+	if err == nil || !strings.Contains(err.Error(), "after 5 attempts") {
+		t.Fatalf("newSerialNumber with a stuck generator: %v", err)
+	}
+	if random.reads != serialAttempts {
+		t.Fatalf("drew %d serial numbers, want %d", random.reads, serialAttempts)
+	}
+}
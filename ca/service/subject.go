@@ -0,0 +1,66 @@
+package service
+
+import (
+	"core-ca/ca/dn"
+	"core-ca/ca/model"
+	"crypto/x509/pkix"
+	"fmt"
+)
+
+// caSubject returns the subject of a new CA: the requested distinguished
+// name or attributes, or ca.issuer from the configuration with its common
+// name replaced by the CA name. A requested subject without a common name
+// gets the CA name.
+func (s *caService) caSubject(req model.CACreate) (pkix.Name, error) {
+	var (
+		name pkix.Name
+		err  error
+	)
+	switch {
+	case req.Subject != "" && req.SubjectFields != nil:
+		return pkix.Name{}, fmt.Errorf("%w: give either subject or subject_fields", model.ErrInvalidSubject)
+	case req.Subject != "":
+		name, err = dn.Parse(req.Subject)
+		if err != nil {
+			return pkix.Name{}, fmt.Errorf("%w: %v", model.ErrInvalidSubject, err)
+		}
+	case req.SubjectFields != nil:
+		name = subjectFromFields(*req.SubjectFields)
+	case s.cfg.CA.Issuer != "":
+		name, err = dn.Parse(s.cfg.CA.Issuer)
+		if err != nil {
+			return pkix.Name{}, fmt.Errorf("invalid ca.issuer: %w", err)
+		}
+		name = dn.WithCommonName(name, req.Name)
+	}
+
+	if name.CommonName == "" {
+		name = dn.WithCommonName(name, req.Name)
+	}
+	if err := dn.Validate(name); err != nil {
+		return pkix.Name{}, fmt.Errorf("%w: %v", model.ErrInvalidSubject, err)
+	}
+	return name, nil
+}
+
+// subjectFromFields converts structured subject attributes. They are encoded
+// in the usual order, from country down to common name.
+func subjectFromFields(fields model.SubjectName) pkix.Name {
+	single := func(value string) []string {
+		if value == "" {
+			return nil
+		}
+		return []string{value}
+	}
+	return pkix.Name{
+		CommonName:         fields.CommonName,
+		SerialNumber:       fields.SerialNumber,
+		Organization:       fields.Organization,
+		OrganizationalUnit: fields.OrganizationalUnit,
+		Country:            single(fields.Country),
+		Province:           single(fields.Province),
+		Locality:           single(fields.Locality),
+		StreetAddress:      single(fields.StreetAddress),
+		PostalCode:         single(fields.PostalCode),
+	}
+}
@@ -0,0 +1,81 @@
+package service
+
+import (
+	"context"
+	"core-ca/ca/model"
+	keymodel "core-ca/keymanagement/model"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+func (s *caService) RegisterToken(ctx context.Context, token model.CryptoToken) (model.CryptoToken, error) {
+	if token.Name == "" {
+		return model.CryptoToken{}, errors.New("token name is required")
+	}
+	if token.Name == keymodel.DefaultToken {
+		return model.CryptoToken{}, fmt.Errorf("token name %q is reserved for the configured token", keymodel.DefaultToken)
+	}
+	if token.Backend == "" {
+		token.Backend = keymodel.BackendPKCS11
+	}
+	if token.Backend != keymodel.BackendPKCS11 {
+		// A registered token is a numbered slot; keystore directories and
+		// signer URLs only come from the configuration of the default token.
+		return model.CryptoToken{}, fmt.Errorf("unsupported token backend %q: only pkcs11 slots can be registered, the %s backend serves the configured token only", token.Backend, token.Backend)
+	}
+	if token.SlotID < 0 {
+		return model.CryptoToken{}, fmt.Errorf("invalid slot id: %d", token.SlotID)
+	}
+	if token.PinRef == "" {
+		return model.CryptoToken{}, errors.New("pin_ref is required")
+	}
+	if strings.HasPrefix(token.PinRef, "stdin:") {
+		// Nobody is at the console to answer a prompt while the server is running
+		return model.CryptoToken{}, errors.New("stdin PIN references can only be used for the configured token")
+	}
+
+	// Log in before recording the token so that a wrong slot or PIN is rejected
+	if err := s.keyService.OpenToken(keyToken(token)); err != nil {
+		return model.CryptoToken{}, err
+	}
+
+	id, err := s.repo.SaveToken(ctx, token)
+	if err != nil {
+		if closeErr := s.keyService.CloseToken(token.Name); closeErr != nil {
+			log.Printf("failed to close token %s: %v", token.Name, closeErr)
+		}
+		return model.CryptoToken{}, fmt.Errorf("failed to save token: %w", err)
+	}
+	token.ID = id
+	return token, nil
+}
+
+func (s *caService) GetAllTokens(ctx context.Context) ([]model.CryptoToken, error) {
+	return s.repo.GetAllTokens(ctx)
+}
+
+func (s *caService) LoadTokens(ctx context.Context) error {
+	tokens, err := s.repo.GetAllTokens(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to load tokens: %w", err)
+	}
+	for _, token := range tokens {
+		if err := s.keyService.OpenToken(keyToken(token)); err != nil {
+			log.Printf("failed to open token %s: %v", token.Name, err)
+		}
+	}
+	return nil
+}
+
+// keyToken converts a crypto_tokens row to the key management token description.
+func keyToken(token model.CryptoToken) keymodel.Token {
+	return keymodel.Token{
+		Name:    token.Name,
+		Backend: token.Backend,
+		Slot:    strconv.Itoa(token.SlotID),
+		PinRef:  token.PinRef,
+	}
+}
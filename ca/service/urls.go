@@ -0,0 +1,22 @@
+package service
+
+import (
+	"core-ca/ca/model"
+	"crypto/x509"
+)
+
+// setIssuerURLs points the CRL distribution point, OCSP responder and CA
+// issuers URL of a certificate at the endpoints of the CA generation that
+// issues it, as configured in ca.urls. Unconfigured URLs leave the extension out.
+func (s *caService) setIssuerURLs(template *x509.Certificate, issuer model.CA) {
+	urls := s.cfg.CA.URLs.ForCA(issuer.ID, issuer.Generation)
+	if urls.CRL != "" {
+		template.CRLDistributionPoints = []string{urls.CRL}
+	}
+	if urls.OCSP != "" {
+		template.OCSPServer = []string{urls.OCSP}
+	}
+	if urls.CAIssuers != "" {
+		template.IssuingCertificateURL = []string{urls.CAIssuers}
+	}
+}
@@ -0,0 +1,96 @@
+// Command signerd is the signing daemon. It serves the keys of the token
+// configured under keymanagement to CA API instances on other hosts over
+// mutually authenticated TLS, so that the HSM can stay on an internal host
+// while the CA API runs in a DMZ with keymanagement.backend set to remote.
+//
+// Usage:
+//
+//	signerd -config /etc/core-ca/signerd.yaml
+package main
+
+import (
+	"context"
+	"core-ca/config"
+	keymodel "core-ca/keymanagement/model"
+	"core-ca/keymanagement/repository"
+	"core-ca/keymanagement/signer"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+func main() {
+	configFile := flag.String("config", "config.yaml", "configuration file")
+	flag.Parse()
+
+	cfg, err := config.LoadConfigFile(*configFile)
+	if err != nil {
+		log.Fatalf("signerd: %v", err)
+	}
+	if cfg.Signer.Cert == "" || cfg.Signer.Key == "" || cfg.Signer.ClientCA == "" {
+		log.Fatal("signerd: signer.cert, signer.key and signer.client_ca are required")
+	}
+	tlsConfig, err := signer.ServerTLSConfig(cfg.Signer.Cert, cfg.Signer.Key, cfg.Signer.ClientCA)
+	if err != nil {
+		log.Fatalf("signerd: %v", err)
+	}
+
+	repo, err := openRepository(cfg.KeyManagement)
+	if err != nil {
+		log.Fatalf("signerd: failed to open token: %v", err)
+	}
+	defer repo.Finalize()
+
+	server := &http.Server{
+		Addr: cfg.Signer.Listen,
+		Handler: signer.NewHandler(repo, signer.Options{
+			AllowGenerate:  cfg.Signer.AllowGenerate,
+			AllowedClients: cfg.Signer.AllowedClients,
+		}),
+		TLSConfig:         tlsConfig,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		log.Printf("signerd: serving %s token on %s", cfg.KeyManagement.Backend, cfg.Signer.Listen)
+		if err := server.ListenAndServeTLS("", ""); !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("signerd: %v", err)
+		}
+	}()
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	<-sigChan
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("signerd: shutdown: %v", err)
+	}
+}
+
+// openRepository opens the token configured under keymanagement. Key
+// ceremony PIN references are not supported: the daemon has no API to
+// submit shares on.
+func openRepository(cfg config.KeyManagementConfig) (repository.KeyPairRepository, error) {
+	switch cfg.Backend {
+	case keymodel.BackendPKCS11:
+		if _, ceremony, _ := keymodel.ParseCeremonyPinRef(cfg.SoftHSM.PinRef); ceremony {
+			return nil, errors.New("ceremony PIN references are not supported by signerd")
+		}
+		return repository.NewSoftHsmKeyPairRepository(cfg.SoftHSM.Module, cfg.SoftHSM.Slot, cfg.SoftHSM.PinRef, cfg.SoftHSM.PoolSize)
+	case keymodel.BackendSoftware:
+		if _, ceremony, _ := keymodel.ParseCeremonyPinRef(cfg.Software.PassphraseRef); ceremony {
+			return nil, errors.New("ceremony passphrase references are not supported by signerd")
+		}
+		return repository.NewSoftwareKeyPairRepository(cfg.Software.Dir, cfg.Software.PassphraseRef)
+	case keymodel.BackendMemory:
+		log.Printf("signerd: warning: keymanagement.backend is memory, keys are lost when the daemon stops")
+		return repository.NewMemoryKeyPairRepository(), nil
+	}
+	return nil, fmt.Errorf("signerd cannot serve a %s backend", cfg.Backend)
+}
@@ -1,6 +1,14 @@
 package config
 
 import (
+	"core-ca/ca/dn"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
 	"github.com/spf13/viper"
 )
 
@@ -8,25 +16,115 @@ import (
 type AppConfig struct {
 	CA            CAConfig            `yaml:"ca"`
 	KeyManagement KeyManagementConfig `yaml:"keymanagement"`
+	// Config của signing daemon (cmd/signerd), không dùng bởi CA API
+	Signer SignerConfig `yaml:"signer"`
 }
 
 // CAConfig chứa config cho CA service
 type CAConfig struct {
-	Issuer       string         `yaml:"issuer"`
+	Issuer       string         `yaml:"issuer"` // DN mặc định của CA mới (RFC 4514), CN được thay bằng tên CA
 	ValidityDays int            `yaml:"validity_days"`
 	Database     DatabaseConfig `yaml:"database"`
+	// URL CRL / OCSP / AIA ghi vào certificate do CA cấp; không khai báo thì bỏ các extension này
+	URLs CAURLConfig `yaml:"urls"`
+	// Chu kỳ đánh dấu CA và certificate hết hạn, ví dụ "1h" (0 = mặc định 1h, số âm = tắt)
+	ExpiryCheckInterval time.Duration `yaml:"expiry_check_interval"`
+}
+
+// CAURLs là các URL công khai của một CA. "{ca_id}" trong URL được thay bằng ID của CA,
+// "{generation}" bằng thế hệ (certificate và key) của CA đã ký certificate.
+// URL không khai báo được suy ra từ base_url: "{base_url}/ca/{ca_id}/crl/{generation}" (CRL dạng DER),
+// "{base_url}/ocsp?ca_id={ca_id}" và "{base_url}/ca/{ca_id}/cert/{generation}" (certificate CA dạng DER).
+type CAURLs struct {
+	BaseURL   string `yaml:"base_url"` // ví dụ "http://pki.example.com"
+	CRL       string `yaml:"crl"`
+	OCSP      string `yaml:"ocsp"`
+	CAIssuers string `yaml:"ca_issuers"`
+}
+
+// CAURLConfig chứa URL mặc định cho mọi CA và URL ghi đè theo ID của CA
+type CAURLConfig struct {
+	CAURLs `yaml:",inline"`
+	// Ghi đè theo ID của CA; khai báo base_url thì không dùng URL mặc định nào
+	CAs map[int]CAURLs `yaml:"cas"`
 }
 
 // KeyManagementConfig chứa config cho Key Management service
 type KeyManagementConfig struct {
-	SoftHSM SoftHSMConfig `yaml:"softhsm"`
+	// Backend của token mặc định: "pkcs11" (mặc định, dùng softhsm), "software", "memory"
+	// hoặc "remote" (ký qua signing daemon trên host khác)
+	Backend  string                 `yaml:"backend"`
+	SoftHSM  SoftHSMConfig          `yaml:"softhsm"`
+	Software SoftwareKeyStoreConfig `yaml:"software"`
+	Remote   RemoteSignerConfig     `yaml:"remote"`
+	// Ghi đè key policy theo mục đích của key: "ca", "ocsp", "end-entity"
+	KeyPolicies map[string]KeyPolicyConfig `yaml:"key_policies"`
+	Ceremony    CeremonyConfig             `yaml:"ceremony"`
+	// Nguồn ngẫu nhiên cho serial number và chữ ký của CA: "hsm" (mặc định, C_GenerateRandom của token
+	// giữ key CA trộn XOR với RNG của hệ điều hành) hoặc "os" (chỉ dùng crypto/rand)
+	RandomSource string `yaml:"random_source"`
+}
+
+// Các giá trị của keymanagement.random_source
+const (
+	RandomSourceHSM = "hsm"
+	RandomSourceOS  = "os"
+)
+
+// CeremonyConfig chứa config cho token mở khóa bằng M-of-N share (pin_ref "ceremony:M")
+type CeremonyConfig struct {
+	// Thời gian token giữ trạng thái đăng nhập sau khi đủ share, ví dụ "15m" (0 = mặc định 15 phút).
+	// Share đã nộp cũng bị hủy sau khoảng thời gian này nếu chưa đủ ngưỡng.
+	UnlockWindow time.Duration `yaml:"unlock_window"`
+}
+
+// KeyPolicyConfig ghi đè thuộc tính template của private key; trường không khai báo giữ giá trị mặc định
+type KeyPolicyConfig struct {
+	Extractable *bool `yaml:"extractable"` // CKA_EXTRACTABLE
+	Decrypt     *bool `yaml:"decrypt"`     // CKA_DECRYPT (chỉ áp dụng cho RSA)
 }
 
 // SoftHSMConfig chứa config cho SoftHSM
 type SoftHSMConfig struct {
 	Module string `yaml:"module"`
 	Slot   string `yaml:"slot"`
-	Pin    string `yaml:"pin"`
+	// Tham chiếu tới user PIN, ví dụ "env:SOFTHSM_PIN", "file:/run/secrets/softhsm-pin", "stdin:softhsm".
+	// PIN dạng plaintext trong config không còn được hỗ trợ.
+	PinRef   string `yaml:"pin_ref"`
+	PoolSize int    `yaml:"pool_size"` // Số session PKCS#11 mở đồng thời
+	// Chu kỳ kiểm tra trạng thái token, ví dụ "30s" (0 = tắt)
+	HealthCheckInterval time.Duration `yaml:"health_check_interval"`
+}
+
+// SoftwareKeyStoreConfig chứa config cho keystore phần mềm (backend "software"), dùng cho dev và CI
+type SoftwareKeyStoreConfig struct {
+	// Thư mục chứa key, mỗi key được mã hóa AES-256-GCM bằng key dẫn xuất từ passphrase (scrypt)
+	Dir string `yaml:"dir"`
+	// Tham chiếu tới passphrase, cùng cú pháp với pin_ref, ví dụ "env:CORE_CA_KEYSTORE_PASSPHRASE"
+	PassphraseRef string `yaml:"passphrase_ref"`
+}
+
+// RemoteSignerConfig chứa config kết nối tới signing daemon (backend "remote"), xác thực hai chiều bằng mTLS
+type RemoteSignerConfig struct {
+	URL        string        `yaml:"url"`         // ví dụ "https://signer.internal:8443"
+	CACert     string        `yaml:"ca_cert"`     // CA certificate dùng để xác thực certificate của daemon
+	ClientCert string        `yaml:"client_cert"` // certificate và key của CA API khi kết nối tới daemon
+	ClientKey  string        `yaml:"client_key"`
+	Timeout    time.Duration `yaml:"timeout"` // thời gian chờ mỗi request, 0 = mặc định 10s
+}
+
+// SignerConfig chứa config cho signing daemon (cmd/signerd). Daemon phục vụ token mặc định
+// khai báo trong keymanagement (backend pkcs11, software hoặc memory).
+type SignerConfig struct {
+	Listen string `yaml:"listen"` // địa chỉ lắng nghe, mặc định ":8443"
+	// Certificate và key của daemon; client phải có certificate do client_ca cấp
+	Cert     string `yaml:"cert"`
+	Key      string `yaml:"key"`
+	ClientCA string `yaml:"client_ca"`
+	// CN của client certificate được phép kết nối; rỗng = mọi certificate do client_ca cấp
+	AllowedClients []string `yaml:"allowed_clients"`
+	// Cho phép client sinh key pair (cần khi tạo CA qua daemon)
+	AllowGenerate bool `yaml:"allow_generate"`
 }
 
 // DatabaseConfig chứa config cho database
@@ -34,13 +132,22 @@ type DatabaseConfig struct {
 	DSN string `yaml:"dsn"` // Data Source Name for PostgreSQL
 }
 
-// LoadConfig load config chung từ file YAML
+// LoadConfig load config chung từ file config.yaml
 func LoadConfig() (*AppConfig, error) {
-	viper.SetConfigFile("config.yaml")
+	return LoadConfigFile("config.yaml")
+}
+
+// LoadConfigFile load config chung từ file YAML path
+func LoadConfigFile(path string) (*AppConfig, error) {
+	viper.SetConfigFile(path)
 	if err := viper.ReadInConfig(); err != nil {
 		return nil, err
 	}
 
+	if viper.IsSet("keymanagement.softhsm.pin") {
+		return nil, errors.New("keymanagement.softhsm.pin is not supported, set keymanagement.softhsm.pin_ref (e.g. env:SOFTHSM_PIN) instead")
+	}
+
 	config := &AppConfig{
 		CA: CAConfig{
 			Issuer:       viper.GetString("ca.issuer"),
@@ -48,19 +155,194 @@ func LoadConfig() (*AppConfig, error) {
 			Database: DatabaseConfig{
 				DSN: viper.GetString("ca.database.dsn"),
 			},
+			URLs: CAURLConfig{
+				CAURLs: loadCAURLs("ca.urls"),
+			},
+			ExpiryCheckInterval: viper.GetDuration("ca.expiry_check_interval"),
 		},
 		KeyManagement: KeyManagementConfig{
+			Backend: viper.GetString("keymanagement.backend"),
 			SoftHSM: SoftHSMConfig{
-				Module: viper.GetString("keymanagement.softhsm.module"),
-				Slot:   viper.GetString("keymanagement.softhsm.slot"),
-				Pin:    viper.GetString("keymanagement.softhsm.pin"),
+				Module:   viper.GetString("keymanagement.softhsm.module"),
+				Slot:     viper.GetString("keymanagement.softhsm.slot"),
+				PinRef:   viper.GetString("keymanagement.softhsm.pin_ref"),
+				PoolSize: viper.GetInt("keymanagement.softhsm.pool_size"),
+
+				HealthCheckInterval: viper.GetDuration("keymanagement.softhsm.health_check_interval"),
+			},
+			Software: SoftwareKeyStoreConfig{
+				Dir:           viper.GetString("keymanagement.software.dir"),
+				PassphraseRef: viper.GetString("keymanagement.software.passphrase_ref"),
+			},
+			Ceremony: CeremonyConfig{
+				UnlockWindow: viper.GetDuration("keymanagement.ceremony.unlock_window"),
+			},
+			Remote: RemoteSignerConfig{
+				URL:        viper.GetString("keymanagement.remote.url"),
+				CACert:     viper.GetString("keymanagement.remote.ca_cert"),
+				ClientCert: viper.GetString("keymanagement.remote.client_cert"),
+				ClientKey:  viper.GetString("keymanagement.remote.client_key"),
+				Timeout:    viper.GetDuration("keymanagement.remote.timeout"),
 			},
+			RandomSource: viper.GetString("keymanagement.random_source"),
 		},
+		Signer: SignerConfig{
+			Listen:         viper.GetString("signer.listen"),
+			Cert:           viper.GetString("signer.cert"),
+			Key:            viper.GetString("signer.key"),
+			ClientCA:       viper.GetString("signer.client_ca"),
+			AllowedClients: viper.GetStringSlice("signer.allowed_clients"),
+			AllowGenerate:  viper.GetBool("signer.allow_generate"),
+		},
+	}
+
+	config.KeyManagement.KeyPolicies = loadKeyPolicies("keymanagement.key_policies")
+
+	switch config.KeyManagement.Backend {
+	case "":
+		config.KeyManagement.Backend = "pkcs11"
+	case "pkcs11", "memory":
+	case "software":
+		if config.KeyManagement.Software.Dir == "" || config.KeyManagement.Software.PassphraseRef == "" {
+			return nil, errors.New("keymanagement.backend software requires keymanagement.software.dir and keymanagement.software.passphrase_ref")
+		}
+	case "remote":
+		remote := config.KeyManagement.Remote
+		if remote.URL == "" || remote.CACert == "" || remote.ClientCert == "" || remote.ClientKey == "" {
+			return nil, errors.New("keymanagement.backend remote requires keymanagement.remote.url, ca_cert, client_cert and client_key")
+		}
+	default:
+		return nil, errors.New("keymanagement.backend must be pkcs11, software, memory or remote")
+	}
+
+	if config.CA.Issuer != "" {
+		if _, err := dn.Parse(config.CA.Issuer); err != nil {
+			return nil, fmt.Errorf("ca.issuer: %w", err)
+		}
+	}
+
+	config.CA.URLs.CAs = make(map[int]CAURLs)
+	for key := range viper.GetStringMap("ca.urls.cas") {
+		caID, err := strconv.Atoi(key)
+		if err != nil || caID <= 0 {
+			return nil, fmt.Errorf("ca.urls.cas: %q is not a CA ID", key)
+		}
+		config.CA.URLs.CAs[caID] = loadCAURLs("ca.urls.cas." + key)
+	}
+	if err := config.CA.URLs.validate(); err != nil {
+		return nil, err
+	}
+
+	if config.Signer.Listen == "" {
+		config.Signer.Listen = ":8443"
+	}
+
+	switch config.KeyManagement.RandomSource {
+	case "":
+		config.KeyManagement.RandomSource = RandomSourceHSM
+	case RandomSourceHSM, RandomSourceOS:
+	default:
+		return nil, errors.New("keymanagement.random_source must be hsm or os")
 	}
 
 	return config, nil
 }
 
+// loadKeyPolicies đọc các key policy dưới key, chỉ lấy những thuộc tính được khai báo
+func loadKeyPolicies(key string) map[string]KeyPolicyConfig {
+	optionalBool := func(key string) *bool {
+		if !viper.IsSet(key) {
+			return nil
+		}
+		v := viper.GetBool(key)
+		return &v
+	}
+
+	policies := make(map[string]KeyPolicyConfig)
+	for purpose := range viper.GetStringMap(key) {
+		prefix := key + "." + purpose
+		policies[purpose] = KeyPolicyConfig{
+			Extractable: optionalBool(prefix + ".extractable"),
+			Decrypt:     optionalBool(prefix + ".decrypt"),
+		}
+	}
+	return policies
+}
+
+func loadCAURLs(key string) CAURLs {
+	return CAURLs{
+		BaseURL:   viper.GetString(key + ".base_url"),
+		CRL:       viper.GetString(key + ".crl"),
+		OCSP:      viper.GetString(key + ".ocsp"),
+		CAIssuers: viper.GetString(key + ".ca_issuers"),
+	}
+}
+
+// ForCA trả về URL của thế hệ generation của CA caID: URL ghi đè của CA nếu có, còn lại lấy
+// từ URL mặc định, với "{ca_id}" và "{generation}" đã được thay. URL rỗng nghĩa là không ghi
+// extension tương ứng.
+func (c CAURLConfig) ForCA(caID, generation int) CAURLs {
+	urls := c.CAURLs
+	if override, ok := c.CAs[caID]; ok {
+		if override.BaseURL != "" {
+			urls = CAURLs{BaseURL: override.BaseURL}
+		}
+		if override.CRL != "" {
+			urls.CRL = override.CRL
+		}
+		if override.OCSP != "" {
+			urls.OCSP = override.OCSP
+		}
+		if override.CAIssuers != "" {
+			urls.CAIssuers = override.CAIssuers
+		}
+	}
+
+	base := strings.TrimSuffix(urls.BaseURL, "/")
+	if base != "" {
+		if urls.CRL == "" {
+			urls.CRL = base + "/ca/{ca_id}/crl/{generation}"
+		}
+		if urls.OCSP == "" {
+			urls.OCSP = base + "/ocsp?ca_id={ca_id}"
+		}
+		if urls.CAIssuers == "" {
+			urls.CAIssuers = base + "/ca/{ca_id}/cert/{generation}"
+		}
+	}
+	placeholders := strings.NewReplacer("{ca_id}", strconv.Itoa(caID), "{generation}", strconv.Itoa(generation))
+	urls.CRL = placeholders.Replace(urls.CRL)
+	urls.OCSP = placeholders.Replace(urls.OCSP)
+	urls.CAIssuers = placeholders.Replace(urls.CAIssuers)
+	return urls
+}
+
+// validate kiểm tra mọi URL là URL http(s) tuyệt đối
+func (c CAURLConfig) validate() error {
+	placeholders := strings.NewReplacer("{ca_id}", "1", "{generation}", "1")
+	check := func(key string, urls CAURLs) error {
+		for name, value := range map[string]string{"base_url": urls.BaseURL, "crl": urls.CRL, "ocsp": urls.OCSP, "ca_issuers": urls.CAIssuers} {
+			if value == "" {
+				continue
+			}
+			u, err := url.Parse(placeholders.Replace(value))
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return fmt.Errorf("%s.%s must be an absolute http or https URL, got %q", key, name, value)
+			}
+		}
+		return nil
+	}
+	if err := check("ca.urls", c.CAURLs); err != nil {
+		return err
+	}
+	for caID, urls := range c.CAs {
+		if err := check(fmt.Sprintf("ca.urls.cas.%d", caID), urls); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // GetCAConfig trả về CA config từ app config
 func (c *AppConfig) GetCAConfig() *CAConfig {
 	return &c.CA
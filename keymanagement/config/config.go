@@ -7,7 +7,7 @@ import (
 type Config struct {
 	SoftHSMModule string // Path to libsofthsm2.so
 	SoftHSMSlot   string // Slot ID
-	SoftHSMPin    string // User PIN
+	SoftHSMPinRef string // Reference to the user PIN, e.g. "env:SOFTHSM_PIN"
 }
 
 func LoadConfig() (*Config, error) {
@@ -18,6 +18,6 @@ func LoadConfig() (*Config, error) {
 	return &Config{
 		SoftHSMModule: viper.GetString("keymanagement.softhsm.module"),
 		SoftHSMSlot:   viper.GetString("keymanagement.softhsm.slot"),
-		SoftHSMPin:    viper.GetString("keymanagement.softhsm.pin"),
+		SoftHSMPinRef: viper.GetString("keymanagement.softhsm.pin_ref"),
 	}, nil
 }
@@ -0,0 +1,67 @@
+// Package keyfile reads private keys and certificates exported by other
+// CAs: PKCS#12 files and PEM encoded PKCS#8, PKCS#1 and SEC 1 keys,
+// optionally encrypted with a password.
+package keyfile
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+)
+
+// ParsePrivateKeyPEM parses the first private key in PEM data. An
+// "ENCRYPTED PRIVATE KEY" block is decrypted with password.
+func ParsePrivateKeyPEM(data []byte, password string) (crypto.PrivateKey, error) {
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, errors.New("no private key found in PEM data")
+		}
+		if _, encrypted := block.Headers["DEK-Info"]; encrypted {
+			return nil, errors.New("legacy encrypted PEM keys are not supported, convert with openssl pkcs8 -topk8")
+		}
+
+		switch block.Type {
+		case "PRIVATE KEY":
+			return x509.ParsePKCS8PrivateKey(block.Bytes)
+		case "RSA PRIVATE KEY":
+			return x509.ParsePKCS1PrivateKey(block.Bytes)
+		case "EC PRIVATE KEY":
+			return x509.ParseECPrivateKey(block.Bytes)
+		case "ENCRYPTED PRIVATE KEY":
+			der, err := decryptPKCS8(block.Bytes, password)
+			if err != nil {
+				return nil, err
+			}
+			defer clear(der)
+			return x509.ParsePKCS8PrivateKey(der)
+		}
+	}
+}
+
+// ParseCertificatesPEM parses every CERTIFICATE block in PEM data.
+func ParseCertificatesPEM(data []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse certificate: %w", err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("no certificate found in PEM data")
+	}
+	return certs, nil
+}
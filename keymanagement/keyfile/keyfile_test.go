@@ -0,0 +1,138 @@
+package keyfile
+
+import (
+	"crypto"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The files in testdata were written by OpenSSL 3.0:
+//
+//	openssl pkcs8 -topk8 -in ec.pem -v2 aes-256-cbc -v2prf hmacWithSHA256 -passout pass:pbes2-password -out ec-pbes2-aes256.pem
+//	openssl pkcs12 -export -inkey rsa.pem -in rsa-cert.pem -keypbe PBE-SHA1-3DES -certpbe PBE-SHA1-3DES -macalg sha1 -passout pass:legacy-password -out rsa-3des.p12
+//	openssl pkcs12 -export -inkey rsa.pem -in rsa-cert.pem -passout pass:aes-password -out rsa-aes256.p12
+
+func readTestdata(t *testing.T, name string) []byte {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// plainKey parses an unencrypted key of testdata to compare with.
+func plainKey(t *testing.T, name string) crypto.PrivateKey {
+	t.Helper()
+	key, err := ParsePrivateKeyPEM(readTestdata(t, name), "")
+	if err != nil {
+		t.Fatalf("parse %s: %v", name, err)
+	}
+	return key
+}
+
+func sameKey(a, b crypto.PrivateKey) bool {
+	k, ok := a.(interface{ Equal(crypto.PrivateKey) bool })
+	return ok && k.Equal(b)
+}
+
+func TestParsePrivateKeyPEMPBES2(t *testing.T) {
+	data := readTestdata(t, "ec-pbes2-aes256.pem")
+
+	key, err := ParsePrivateKeyPEM(data, "pbes2-password")
+	if err != nil {
+		t.Fatalf("ParsePrivateKeyPEM: %v", err)
+	}
+	if !sameKey(key, plainKey(t, "ec.pem")) {
+		t.Fatal("decrypted key differs from the key OpenSSL encrypted")
+	}
+
+	if _, err := ParsePrivateKeyPEM(data, "wrong-password"); !errors.Is(err, ErrIncorrectPassword) {
+		t.Fatalf("wrong password: %v, want ErrIncorrectPassword", err)
+	}
+}
+
+func TestParsePKCS12(t *testing.T) {
+	want := plainKey(t, "rsa.pem")
+	for _, tc := range []struct{ file, password string }{
+		{"rsa-3des.p12", "legacy-password"},
+		{"rsa-aes256.p12", "aes-password"},
+	} {
+		t.Run(tc.file, func(t *testing.T) {
+			data := readTestdata(t, tc.file)
+
+			key, certs, err := ParsePKCS12(data, tc.password)
+			if err != nil {
+				t.Fatalf("ParsePKCS12: %v", err)
+			}
+			if !sameKey(key, want) {
+				t.Fatal("decrypted key differs from the key OpenSSL exported")
+			}
+			if len(certs) != 1 || certs[0].Subject.CommonName != "Legacy Issuing CA" {
+				t.Fatalf("got %d certificates, want the Legacy Issuing CA certificate", len(certs))
+			}
+
+			if _, _, err := ParsePKCS12(data, "wrong-password"); !errors.Is(err, ErrIncorrectPassword) {
+				t.Fatalf("wrong password: %v, want ErrIncorrectPassword", err)
+			}
+		})
+	}
+}
+
+func TestIterationCountBound(t *testing.T) {
+	for _, iterations := range []int{0, -1, maxIterations + 1, 1<<31 - 1} {
+		kdf, err := asn1.Marshal(pbkdf2Params{
+			Salt:       []byte("saltsalt"),
+			Iterations: iterations,
+			PRF:        pkix.AlgorithmIdentifier{Algorithm: oidHMACWithSHA256, Parameters: asn1.NullRawValue},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		iv, err := asn1.Marshal(make([]byte, 16))
+		if err != nil {
+			t.Fatal(err)
+		}
+		params, err := asn1.Marshal(pbes2Params{
+			KeyDerivationFunc: pkix.AlgorithmIdentifier{Algorithm: oidPBKDF2, Parameters: asn1.RawValue{FullBytes: kdf}},
+			EncryptionScheme:  pkix.AlgorithmIdentifier{Algorithm: oidAES256CBC, Parameters: asn1.RawValue{FullBytes: iv}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		der, err := asn1.Marshal(encryptedPrivateKeyInfo{
+			Algorithm:     pkix.AlgorithmIdentifier{Algorithm: oidPBES2, Parameters: asn1.RawValue{FullBytes: params}},
+			EncryptedData: make([]byte, 48),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		start := time.Now()
+		_, err = ParsePrivateKeyPEM(pem.EncodeToMemory(&pem.Block{Type: "ENCRYPTED PRIVATE KEY", Bytes: der}), "password")
+		if err == nil || !strings.Contains(err.Error(), "unsupported iteration count") {
+			t.Errorf("%d iterations: %v, want the iteration count refused", iterations, err)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("%d iterations: refused after %s", iterations, elapsed)
+		}
+	}
+
+	for _, iterations := range []int{0, maxIterations + 1} {
+		params, err := asn1.Marshal(pbeParams{Salt: []byte("saltsalt"), Iterations: iterations})
+		if err != nil {
+			t.Fatal(err)
+		}
+		algorithm := pkix.AlgorithmIdentifier{Algorithm: oidPBEWithSHAAnd3KeyTripleDESCBC, Parameters: asn1.RawValue{FullBytes: params}}
+		if _, err := decrypt(algorithm, make([]byte, 16), "password"); err == nil || !strings.Contains(err.Error(), "unsupported iteration count") {
+			t.Errorf("legacy PBE with %d iterations: %v, want the iteration count refused", iterations, err)
+		}
+	}
+}
@@ -0,0 +1,263 @@
+package keyfile
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/pbkdf2"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"hash"
+	"math/big"
+	"unicode/utf16"
+)
+
+var (
+	oidPBES2                         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2                        = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidPBEWithSHAAnd3KeyTripleDESCBC = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 1, 3}
+
+	oidHMACWithSHA1   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidHMACWithSHA384 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 10}
+	oidHMACWithSHA512 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 11}
+
+	oidAES128CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+	oidDESEDE3CBC = asn1.ObjectIdentifier{1, 2, 840, 113549, 3, 7}
+
+	oidSHA1   = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	oidSHA256 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidSHA384 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}
+	oidSHA512 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 3}
+)
+
+// ErrIncorrectPassword is returned when the password does not open a file.
+var ErrIncorrectPassword = errors.New("incorrect password")
+
+// maxIterations bounds the key derivation iteration count read from a file,
+// so that an uploaded file cannot tie up a CPU for hours. OpenSSL writes
+// 2048 and PKCS#12 writers rarely exceed a few hundred thousand.
+const maxIterations = 10_000_000
+
+// checkIterations refuses iteration counts outside 1..maxIterations.
+func checkIterations(iterations int) error {
+	if iterations <= 0 || iterations > maxIterations {
+		return fmt.Errorf("unsupported iteration count %d, must be between 1 and %d", iterations, maxIterations)
+	}
+	return nil
+}
+
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt       []byte
+	Iterations int
+	KeyLength  int                      `asn1:"optional"`
+	PRF        pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+type pbeParams struct {
+	Salt       []byte
+	Iterations int
+}
+
+// digest describes a hash for PKCS#12 key derivation: its constructor,
+// output size u and block size v (RFC 7292, appendix B.2).
+type digest struct {
+	new  func() hash.Hash
+	u, v int
+}
+
+var digestsByOID = []struct {
+	oid asn1.ObjectIdentifier
+	digest
+}{
+	{oidSHA1, digest{sha1.New, 20, 64}},
+	{oidSHA256, digest{sha256.New, 32, 64}},
+	{oidSHA384, digest{sha512.New384, 48, 128}},
+	{oidSHA512, digest{sha512.New, 64, 128}},
+}
+
+func digestFor(oid asn1.ObjectIdentifier) (digest, error) {
+	for _, d := range digestsByOID {
+		if d.oid.Equal(oid) {
+			return d.digest, nil
+		}
+	}
+	return digest{}, fmt.Errorf("unsupported digest algorithm %s", oid)
+}
+
+// bmpPassword encodes a password as a NUL-terminated BMPString, the form
+// PKCS#12 key derivation uses.
+func bmpPassword(password string) []byte {
+	units := utf16.Encode([]rune(password))
+	out := make([]byte, 0, 2*len(units)+2)
+	for _, u := range units {
+		out = append(out, byte(u>>8), byte(u))
+	}
+	return append(out, 0, 0)
+}
+
+// pkcs12KDF derives size bytes of key material for purpose id (1 key, 2 IV, 3 MAC).
+func pkcs12KDF(d digest, salt, password []byte, iterations int, id byte, size int) []byte {
+	fill := func(x []byte) []byte {
+		if len(x) == 0 {
+			return nil
+		}
+		out := make([]byte, d.v*((len(x)+d.v-1)/d.v))
+		for i := range out {
+			out[i] = x[i%len(x)]
+		}
+		return out
+	}
+
+	diversifier := bytes.Repeat([]byte{id}, d.v)
+	input := append(fill(salt), fill(password)...)
+	one := big.NewInt(1)
+	var out []byte
+	for len(out) < size {
+		h := d.new()
+		h.Write(diversifier)
+		h.Write(input)
+		a := h.Sum(nil)
+		for i := 1; i < iterations; i++ {
+			h.Reset()
+			h.Write(a)
+			a = h.Sum(a[:0])
+		}
+		out = append(out, a...)
+		if len(out) >= size {
+			break
+		}
+
+		// Each v-byte block of the input becomes (block + B + 1) mod 2^(8v).
+		b := new(big.Int).SetBytes(fill(a)[:d.v])
+		b.Add(b, one)
+		for j := 0; j < len(input); j += d.v {
+			block := new(big.Int).SetBytes(input[j : j+d.v])
+			sum := block.Add(block, b).Bytes()
+			if len(sum) > d.v {
+				sum = sum[len(sum)-d.v:]
+			}
+			clear(input[j : j+d.v])
+			copy(input[j+d.v-len(sum):j+d.v], sum)
+		}
+	}
+	return out[:size]
+}
+
+// decrypt decrypts data encrypted with a password-based scheme: PBES2 with
+// PBKDF2 and AES-CBC or 3DES-CBC, as written by current OpenSSL, or the
+// legacy PKCS#12 pbeWithSHAAnd3-KeyTripleDES-CBC.
+func decrypt(algorithm pkix.AlgorithmIdentifier, data []byte, password string) ([]byte, error) {
+	var (
+		block cipher.Block
+		iv    []byte
+		err   error
+	)
+	switch {
+	case algorithm.Algorithm.Equal(oidPBES2):
+		block, iv, err = pbes2Cipher(algorithm.Parameters.FullBytes, password)
+	case algorithm.Algorithm.Equal(oidPBEWithSHAAnd3KeyTripleDESCBC):
+		var params pbeParams
+		if _, err := asn1.Unmarshal(algorithm.Parameters.FullBytes, &params); err != nil {
+			return nil, fmt.Errorf("invalid PBE parameters: %w", err)
+		}
+		if err := checkIterations(params.Iterations); err != nil {
+			return nil, err
+		}
+		sha1Digest := digest{sha1.New, 20, 64}
+		key := pkcs12KDF(sha1Digest, params.Salt, bmpPassword(password), params.Iterations, 1, 24)
+		iv = pkcs12KDF(sha1Digest, params.Salt, bmpPassword(password), params.Iterations, 2, 8)
+		block, err = des.NewTripleDESCipher(key)
+	default:
+		return nil, fmt.Errorf("unsupported encryption algorithm %s, re-export with AES-256-CBC", algorithm.Algorithm)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	size := block.BlockSize()
+	if len(data) == 0 || len(data)%size != 0 || len(iv) != size {
+		return nil, errors.New("invalid encrypted data length")
+	}
+	plaintext := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plaintext, data)
+
+	pad := int(plaintext[len(plaintext)-1])
+	if pad == 0 || pad > size || !bytes.Equal(plaintext[len(plaintext)-pad:], bytes.Repeat([]byte{byte(pad)}, pad)) {
+		return nil, ErrIncorrectPassword
+	}
+	return plaintext[:len(plaintext)-pad], nil
+}
+
+// pbes2Cipher returns the cipher and IV of PBES2 parameters (RFC 8018, appendix A.4).
+func pbes2Cipher(der []byte, password string) (cipher.Block, []byte, error) {
+	var params pbes2Params
+	if _, err := asn1.Unmarshal(der, &params); err != nil {
+		return nil, nil, fmt.Errorf("invalid PBES2 parameters: %w", err)
+	}
+	if !params.KeyDerivationFunc.Algorithm.Equal(oidPBKDF2) {
+		return nil, nil, fmt.Errorf("unsupported key derivation function %s", params.KeyDerivationFunc.Algorithm)
+	}
+	var kdf pbkdf2Params
+	if _, err := asn1.Unmarshal(params.KeyDerivationFunc.Parameters.FullBytes, &kdf); err != nil {
+		return nil, nil, fmt.Errorf("invalid PBKDF2 parameters: %w", err)
+	}
+	if err := checkIterations(kdf.Iterations); err != nil {
+		return nil, nil, err
+	}
+	prf := sha1.New
+	switch {
+	case len(kdf.PRF.Algorithm) == 0 || kdf.PRF.Algorithm.Equal(oidHMACWithSHA1):
+	case kdf.PRF.Algorithm.Equal(oidHMACWithSHA256):
+		prf = sha256.New
+	case kdf.PRF.Algorithm.Equal(oidHMACWithSHA384):
+		prf = sha512.New384
+	case kdf.PRF.Algorithm.Equal(oidHMACWithSHA512):
+		prf = sha512.New
+	default:
+		return nil, nil, fmt.Errorf("unsupported PBKDF2 PRF %s", kdf.PRF.Algorithm)
+	}
+
+	var keySize int
+	newCipher := aes.NewCipher
+	switch scheme := params.EncryptionScheme.Algorithm; {
+	case scheme.Equal(oidAES128CBC):
+		keySize = 16
+	case scheme.Equal(oidAES192CBC):
+		keySize = 24
+	case scheme.Equal(oidAES256CBC):
+		keySize = 32
+	case scheme.Equal(oidDESEDE3CBC):
+		keySize, newCipher = 24, des.NewTripleDESCipher
+	default:
+		return nil, nil, fmt.Errorf("unsupported PBES2 encryption scheme %s", scheme)
+	}
+	if kdf.KeyLength != 0 && kdf.KeyLength != keySize {
+		return nil, nil, fmt.Errorf("PBKDF2 key length %d does not match the encryption scheme", kdf.KeyLength)
+	}
+	var iv []byte
+	if _, err := asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv); err != nil {
+		return nil, nil, fmt.Errorf("invalid IV: %w", err)
+	}
+
+	key, err := pbkdf2.Key(prf, password, kdf.Salt, kdf.Iterations, keySize)
+	if err != nil {
+		return nil, nil, err
+	}
+	block, err := newCipher(key)
+	clear(key)
+	return block, iv, err
+}
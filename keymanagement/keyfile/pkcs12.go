@@ -0,0 +1,221 @@
+package keyfile
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+)
+
+var (
+	oidDataContentType          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidEncryptedDataContentType = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 6}
+
+	oidKeyBag                  = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 1}
+	oidPKCS8ShroudedKeyBag     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 2}
+	oidCertBag                 = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 3}
+	oidCertTypeX509Certificate = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 22, 1}
+)
+
+type pfxPdu struct {
+	Version  int
+	AuthSafe contentInfo
+	MacData  macData `asn1:"optional"`
+}
+
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"tag:0,explicit,optional"`
+}
+
+type macData struct {
+	Mac        digestInfo
+	MacSalt    []byte
+	Iterations int `asn1:"optional,default:1"`
+}
+
+type digestInfo struct {
+	Algorithm pkix.AlgorithmIdentifier
+	Digest    []byte
+}
+
+type encryptedData struct {
+	Version              int
+	EncryptedContentInfo encryptedContentInfo
+}
+
+type encryptedContentInfo struct {
+	ContentType                asn1.ObjectIdentifier
+	ContentEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedContent           []byte `asn1:"tag:0,optional"`
+}
+
+type safeBag struct {
+	ID         asn1.ObjectIdentifier
+	Value      asn1.RawValue   `asn1:"tag:0,explicit"`
+	Attributes []asn1.RawValue `asn1:"set,optional"`
+}
+
+type certBag struct {
+	ID   asn1.ObjectIdentifier
+	Data []byte `asn1:"tag:0,explicit"`
+}
+
+type encryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+// ParsePKCS12 decodes a password-protected PKCS#12 file holding one private
+// key and any number of certificates. Files written by OpenSSL 3 (PBES2 with
+// AES and a SHA-256 MAC) and legacy 3DES files are supported.
+func ParsePKCS12(data []byte, password string) (crypto.PrivateKey, []*x509.Certificate, error) {
+	var pfx pfxPdu
+	if err := unmarshal(data, &pfx); err != nil {
+		return nil, nil, fmt.Errorf("failed to decode PKCS#12: %w", err)
+	}
+	if pfx.Version != 3 {
+		return nil, nil, fmt.Errorf("unsupported PKCS#12 version %d", pfx.Version)
+	}
+	if !pfx.AuthSafe.ContentType.Equal(oidDataContentType) {
+		return nil, nil, errors.New("only password-protected PKCS#12 files are supported")
+	}
+	var authSafe []byte
+	if err := unmarshal(pfx.AuthSafe.Content.Bytes, &authSafe); err != nil {
+		return nil, nil, fmt.Errorf("failed to decode PKCS#12 content: %w", err)
+	}
+	if err := verifyMac(pfx.MacData, authSafe, password); err != nil {
+		return nil, nil, err
+	}
+
+	var contents []contentInfo
+	if err := unmarshal(authSafe, &contents); err != nil {
+		return nil, nil, fmt.Errorf("failed to decode PKCS#12 safe contents: %w", err)
+	}
+	var (
+		key   crypto.PrivateKey
+		certs []*x509.Certificate
+	)
+	for _, ci := range contents {
+		var bagsDER []byte
+		switch {
+		case ci.ContentType.Equal(oidDataContentType):
+			if err := unmarshal(ci.Content.Bytes, &bagsDER); err != nil {
+				return nil, nil, fmt.Errorf("failed to decode PKCS#12 safe contents: %w", err)
+			}
+		case ci.ContentType.Equal(oidEncryptedDataContentType):
+			var ed encryptedData
+			if err := unmarshal(ci.Content.Bytes, &ed); err != nil {
+				return nil, nil, fmt.Errorf("failed to decode PKCS#12 encrypted data: %w", err)
+			}
+			var err error
+			bagsDER, err = decrypt(ed.EncryptedContentInfo.ContentEncryptionAlgorithm, ed.EncryptedContentInfo.EncryptedContent, password)
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to decrypt PKCS#12 certificates: %w", err)
+			}
+		default:
+			return nil, nil, fmt.Errorf("unsupported PKCS#12 content type %s", ci.ContentType)
+		}
+
+		var bags []safeBag
+		if err := unmarshal(bagsDER, &bags); err != nil {
+			return nil, nil, fmt.Errorf("failed to decode PKCS#12 safe bags: %w", err)
+		}
+		for _, bag := range bags {
+			switch {
+			case bag.ID.Equal(oidCertBag):
+				var cb certBag
+				if err := unmarshal(bag.Value.Bytes, &cb); err != nil {
+					return nil, nil, fmt.Errorf("failed to decode PKCS#12 certificate bag: %w", err)
+				}
+				if !cb.ID.Equal(oidCertTypeX509Certificate) {
+					continue
+				}
+				cert, err := x509.ParseCertificate(cb.Data)
+				if err != nil {
+					return nil, nil, fmt.Errorf("failed to parse certificate: %w", err)
+				}
+				certs = append(certs, cert)
+			case bag.ID.Equal(oidKeyBag), bag.ID.Equal(oidPKCS8ShroudedKeyBag):
+				if key != nil {
+					return nil, nil, errors.New("PKCS#12 file holds more than one private key")
+				}
+				der := bag.Value.Bytes
+				if bag.ID.Equal(oidPKCS8ShroudedKeyBag) {
+					var err error
+					der, err = decryptPKCS8(der, password)
+					if err != nil {
+						return nil, nil, err
+					}
+				}
+				var err error
+				key, err = x509.ParsePKCS8PrivateKey(der)
+				clear(der)
+				if err != nil {
+					return nil, nil, fmt.Errorf("failed to parse private key: %w", err)
+				}
+			}
+		}
+	}
+	if key == nil {
+		return nil, nil, errors.New("PKCS#12 file holds no private key")
+	}
+	return key, certs, nil
+}
+
+// verifyMac checks the integrity of the authenticated safe, which also
+// verifies the password (RFC 7292, appendix B).
+func verifyMac(mac macData, message []byte, password string) error {
+	if len(mac.Mac.Algorithm.Algorithm) == 0 {
+		return errors.New("PKCS#12 file has no MAC")
+	}
+	d, err := digestFor(mac.Mac.Algorithm.Algorithm)
+	if err != nil {
+		return fmt.Errorf("PKCS#12 MAC: %w", err)
+	}
+	if err := checkIterations(mac.Iterations); err != nil {
+		return fmt.Errorf("PKCS#12 MAC: %w", err)
+	}
+	passwords := [][]byte{bmpPassword(password)}
+	if password == "" {
+		// Some writers use an empty byte string for the empty password.
+		passwords = append(passwords, nil)
+	}
+	for _, p := range passwords {
+		key := pkcs12KDF(d, mac.MacSalt, p, mac.Iterations, 3, d.u)
+		h := hmac.New(d.new, key)
+		h.Write(message)
+		if hmac.Equal(h.Sum(nil), mac.Mac.Digest) {
+			return nil
+		}
+	}
+	return ErrIncorrectPassword
+}
+
+// decryptPKCS8 decrypts a DER EncryptedPrivateKeyInfo into PKCS#8 DER.
+func decryptPKCS8(der []byte, password string) ([]byte, error) {
+	var info encryptedPrivateKeyInfo
+	if err := unmarshal(der, &info); err != nil {
+		return nil, fmt.Errorf("failed to decode encrypted private key: %w", err)
+	}
+	key, err := decrypt(info.Algorithm, info.EncryptedData, password)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt private key: %w", err)
+	}
+	return key, nil
+}
+
+// unmarshal is asn1.Unmarshal refusing trailing data.
+func unmarshal(der []byte, out any) error {
+	rest, err := asn1.Unmarshal(der, out)
+	if err != nil {
+		return err
+	}
+	if len(rest) != 0 {
+		return errors.New("trailing data")
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package model
+
+import "time"
+
+// AttestationKeyLabel is the label of the EC P-256 key on the default token
+// that signs key attestations. It is generated, non-extractable and
+// sign-only, on first use.
+const AttestationKeyLabel = "core-ca-attestation"
+
+// KeyAttestationReport is the statement signed in a KeyAttestation. The
+// protection flags are read back from the token with C_GetAttributeValue.
+type KeyAttestationReport struct {
+	Token        string `json:"token"`
+	TokenLabel   string `json:"token_label"`
+	Manufacturer string `json:"manufacturer"`
+	Model        string `json:"model"`
+	SerialNumber string `json:"serial_number"`
+
+	Label     string       `json:"label"`
+	ID        string       `json:"id"` // hex CKA_ID
+	KeyType   string       `json:"key_type"`
+	Bits      int          `json:"bits"`
+	Algorithm KeyAlgorithm `json:"algorithm,omitempty"`
+	// PublicKeySHA256 is the hex SHA-256 of the DER SubjectPublicKeyInfo.
+	PublicKeySHA256 string `json:"public_key_sha256"`
+	PublicKey       string `json:"public_key"` // PEM
+
+	Sensitive        bool `json:"sensitive"`
+	Extractable      bool `json:"extractable"`
+	AlwaysSensitive  bool `json:"always_sensitive"`
+	NeverExtractable bool `json:"never_extractable"`
+	Local            bool `json:"local"`
+	// GeneratedOnToken is true when the key was generated on the token
+	// (CKA_LOCAL) and has never left it in plaintext (CKA_ALWAYS_SENSITIVE
+	// and CKA_NEVER_EXTRACTABLE).
+	GeneratedOnToken bool `json:"generated_on_token"`
+
+	AttestedAt time.Time `json:"attested_at"`
+}
+
+// KeyAttestation is a KeyAttestationReport signed with the attestation key.
+// The signature covers the bytes of Payload, not a re-encoding of Report.
+type KeyAttestation struct {
+	Report  KeyAttestationReport `json:"report"`
+	Payload string               `json:"payload"` // base64 of the signed JSON report
+
+	Signature          string `json:"signature"` // base64 DER ECDSA signature
+	SignatureAlgorithm string `json:"signature_algorithm"`
+	SignerToken        string `json:"signer_token"`
+	SignerLabel        string `json:"signer_label"`
+	SignerPublicKey    string `json:"signer_public_key"` // PEM
+}
@@ -0,0 +1,38 @@
+package model
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CeremonyPinScheme is the PIN reference scheme of tokens unlocked by an
+// M-of-N key ceremony: "ceremony:M" means the PIN is recombined from M
+// custodian shares instead of being read from anywhere.
+const CeremonyPinScheme = "ceremony"
+
+// ParseCeremonyPinRef reports whether ref is a ceremony PIN reference and
+// returns its threshold.
+func ParseCeremonyPinRef(ref string) (threshold int, ok bool, err error) {
+	scheme, value, found := strings.Cut(ref, ":")
+	if !found || scheme != CeremonyPinScheme {
+		return 0, false, nil
+	}
+	threshold, err = strconv.Atoi(value)
+	if err != nil || threshold < 2 || threshold > 255 {
+		return 0, true, fmt.Errorf("invalid ceremony PIN reference: threshold must be between 2 and 255, e.g. %s:3", CeremonyPinScheme)
+	}
+	return threshold, true, nil
+}
+
+// CeremonyStatus is the state of a key ceremony token.
+type CeremonyStatus struct {
+	Token          string     `json:"token"`
+	Locked         bool       `json:"locked"`
+	Threshold      int        `json:"threshold"`
+	SharesReceived int        `json:"shares_received"`
+	Custodians     []string   `json:"custodians"`                 // custodians whose shares are pending
+	SharesExpireAt *time.Time `json:"shares_expire_at,omitempty"` // pending shares are discarded after this
+	UnlockedUntil  *time.Time `json:"unlocked_until,omitempty"`
+}
@@ -0,0 +1,60 @@
+package model
+
+import "errors"
+
+// ErrHSMUnavailable is matched (with errors.Is) by every error returned when
+// the token cannot be reached, even after reconnecting and logging in again.
+var ErrHSMUnavailable = errors.New("HSM unavailable")
+
+// ErrTokenNotFound is returned when an operation names a token that is not loaded.
+var ErrTokenNotFound = errors.New("token not found")
+
+// HSMUnavailableError carries the PKCS#11 error that made the token unavailable.
+type HSMUnavailableError struct {
+	Err error
+}
+
+func (e *HSMUnavailableError) Error() string {
+	return "HSM unavailable: " + e.Err.Error()
+}
+
+func (e *HSMUnavailableError) Unwrap() error {
+	return e.Err
+}
+
+// Is makes errors.Is(err, ErrHSMUnavailable) report true.
+func (e *HSMUnavailableError) Is(target error) bool {
+	return target == ErrHSMUnavailable
+}
+
+// ErrTokenClosed is returned, wrapped in an HSMUnavailableError, for
+// operations on a repository after Finalize.
+var ErrTokenClosed = errors.New("token is closed")
+
+// ErrKeyNotFound is returned when no private key with the requested label exists on the token.
+var ErrKeyNotFound = errors.New("key not found")
+
+// ErrKeyDisabled is returned by GetSigner for keys that were disabled (CKA_SIGN is false).
+var ErrKeyDisabled = errors.New("key is disabled")
+
+// ErrKeyNotExtractable is returned when a key cannot be wrapped because its CKA_EXTRACTABLE is false.
+var ErrKeyNotExtractable = errors.New("key is not extractable")
+
+// ErrKeyExists is returned when a key would be created under a label already used on the token.
+var ErrKeyExists = errors.New("key already exists")
+
+// ErrInvalidKeyBackup is returned when a backup file cannot be restored as given.
+var ErrInvalidKeyBackup = errors.New("invalid key backup")
+
+// ErrTokenLocked is returned for a key ceremony token until enough custodian shares unlock it.
+var ErrTokenLocked = errors.New("token is locked")
+
+// ErrNotCeremonyToken is returned when shares are submitted for a token that does not use a key ceremony.
+var ErrNotCeremonyToken = errors.New("token does not use a key ceremony")
+
+// ErrShareRejected is returned when a custodian share cannot be accepted in the current ceremony state.
+var ErrShareRejected = errors.New("share rejected")
+
+// ErrNotSupported is returned for operations a token backend does not offer,
+// such as key management through a remote signer.
+var ErrNotSupported = errors.New("operation not supported")
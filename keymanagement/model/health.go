@@ -0,0 +1,18 @@
+package model
+
+// HSMHealth is the state of a token as reported by C_GetTokenInfo and C_GetSessionInfo.
+type HSMHealth struct {
+	Token        string `json:"token"`
+	Available    bool   `json:"available"`
+	Slot         uint   `json:"slot"`
+	TokenLabel   string `json:"token_label,omitempty"`
+	Manufacturer string `json:"manufacturer,omitempty"`
+	Model        string `json:"model,omitempty"`
+	SerialNumber string `json:"serial_number,omitempty"`
+	SessionState string `json:"session_state,omitempty"` // e.g. "rw-user"
+	SessionCount uint   `json:"session_count"`
+	PoolSize     int    `json:"pool_size"`
+	IdleSessions int    `json:"idle_sessions"`
+	Reconnects   uint64 `json:"reconnects"`
+	LastError    string `json:"last_error,omitempty"`
+}
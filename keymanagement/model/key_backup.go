@@ -0,0 +1,40 @@
+package model
+
+import "time"
+
+const (
+	// KeyBackupVersion is the format version of backups written by this service.
+	KeyBackupVersion = 1
+	// KeyBackupMechanism is the mechanism private keys are wrapped with.
+	KeyBackupMechanism = "CKM_AES_KEY_WRAP_PAD"
+)
+
+// KeyBackup is a private key wrapped with an AES key-encryption key (KEK)
+// resident on the token, together with what is needed to recreate the key
+// pair on another token holding the same KEK.
+type KeyBackup struct {
+	Version   int    `json:"version"`
+	Mechanism string `json:"mechanism"`
+	KEKLabel  string `json:"kek_label"`
+	Token     string `json:"token"` // token the key was backed up from
+
+	Label     string       `json:"label"`
+	ID        string       `json:"id"` // hex CKA_ID
+	Algorithm KeyAlgorithm `json:"algorithm"`
+	PublicKey string       `json:"public_key"` // PEM
+	// PublicKeySHA256 is the hex SHA-256 of the DER SubjectPublicKeyInfo.
+	PublicKeySHA256 string `json:"public_key_sha256"`
+	// WrappedKey is the base64 output of C_WrapKey, a wrapped PKCS#8 PrivateKeyInfo.
+	WrappedKey string              `json:"wrapped_key"`
+	Attributes KeyBackupAttributes `json:"attributes"`
+
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// KeyBackupAttributes are the private key attributes restored with the key.
+// Restored keys are always sensitive and private.
+type KeyBackupAttributes struct {
+	Sign        bool `json:"sign"`
+	Decrypt     bool `json:"decrypt"`
+	Extractable bool `json:"extractable"`
+}
@@ -0,0 +1,25 @@
+package model
+
+// KeyObject describes a key object on a token as reported by C_GetAttributeValue.
+type KeyObject struct {
+	Label     string       `json:"label"`
+	ID        string       `json:"id"`       // hex CKA_ID
+	Class     string       `json:"class"`    // "private" or "public"
+	KeyType   string       `json:"key_type"` // "RSA" or "EC"
+	Bits      int          `json:"bits"`
+	Algorithm KeyAlgorithm `json:"algorithm,omitempty"` // empty for sizes/curves this service does not generate
+
+	// Private key protection, nil for public keys.
+	Sensitive        *bool `json:"sensitive,omitempty"`
+	Extractable      *bool `json:"extractable,omitempty"`
+	AlwaysSensitive  *bool `json:"always_sensitive,omitempty"`
+	NeverExtractable *bool `json:"never_extractable,omitempty"`
+
+	// Local is true when the key was generated on the token rather than imported.
+	Local      bool   `json:"local"`
+	Modifiable bool   `json:"modifiable"`
+	StartDate  string `json:"start_date,omitempty"` // CKA_START_DATE, YYYY-MM-DD
+	EndDate    string `json:"end_date,omitempty"`   // CKA_END_DATE, YYYY-MM-DD
+	// Disabled is true for private keys whose CKA_SIGN was cleared.
+	Disabled bool `json:"disabled"`
+}
@@ -1,17 +1,59 @@
 package model
 
-import "crypto/rsa"
+import (
+	"crypto"
+	"fmt"
+)
+
+// KeyAlgorithm identifies the type and size of a key pair generated on the token.
+type KeyAlgorithm string
+
+const (
+	KeyAlgorithmRSA2048 KeyAlgorithm = "RSA-2048"
+	KeyAlgorithmRSA3072 KeyAlgorithm = "RSA-3072"
+	KeyAlgorithmRSA4096 KeyAlgorithm = "RSA-4096"
+	KeyAlgorithmECP256  KeyAlgorithm = "EC-P256"
+	KeyAlgorithmECP384  KeyAlgorithm = "EC-P384"
+
+	// DefaultKeyAlgorithm is used when no algorithm is requested.
+	DefaultKeyAlgorithm = KeyAlgorithmRSA2048
+)
+
+// ParseKeyAlgorithm validates a key algorithm name. An empty name selects DefaultKeyAlgorithm.
+func ParseKeyAlgorithm(s string) (KeyAlgorithm, error) {
+	if s == "" {
+		return DefaultKeyAlgorithm, nil
+	}
+	alg := KeyAlgorithm(s)
+	switch alg {
+	case KeyAlgorithmRSA2048, KeyAlgorithmRSA3072, KeyAlgorithmRSA4096, KeyAlgorithmECP256, KeyAlgorithmECP384:
+		return alg, nil
+	}
+	return "", fmt.Errorf("unsupported key algorithm: %s", s)
+}
+
+// IsRSA reports whether the algorithm produces an RSA key pair.
+func (a KeyAlgorithm) IsRSA() bool {
+	return a == KeyAlgorithmRSA2048 || a == KeyAlgorithmRSA3072 || a == KeyAlgorithmRSA4096
+}
+
+// IsEC reports whether the algorithm produces an elliptic curve key pair.
+func (a KeyAlgorithm) IsEC() bool {
+	return a == KeyAlgorithmECP256 || a == KeyAlgorithmECP384
+}
 
 // KeyPair represents a public/private key pair.
 type KeyPair struct {
 	ID         string
-	PrivateKey *rsa.PrivateKey
-	PublicKey  *rsa.PublicKey
+	Algorithm  KeyAlgorithm
+	PrivateKey crypto.PrivateKey
+	PublicKey  crypto.PublicKey
 }
 
 // KeyPairData for serializing metadata.
 type KeyPairData struct {
-	ID        string `json:"id"`
-	PublicKey string `json:"publicKey"`
-	KeyLabel  string `json:"keyLabel"`
+	ID        string       `json:"id"`
+	Algorithm KeyAlgorithm `json:"algorithm"`
+	PublicKey string       `json:"publicKey"` // PEM-encoded PKIX "PUBLIC KEY"
+	KeyLabel  string       `json:"keyLabel"`
 }
@@ -0,0 +1,49 @@
+package model
+
+import "fmt"
+
+// KeyPurpose selects the key policy a key pair is generated under.
+type KeyPurpose string
+
+const (
+	KeyPurposeCA        KeyPurpose = "ca"
+	KeyPurposeOCSP      KeyPurpose = "ocsp"
+	KeyPurposeEndEntity KeyPurpose = "end-entity"
+
+	// DefaultKeyPurpose is used when no purpose is requested.
+	DefaultKeyPurpose = KeyPurposeEndEntity
+)
+
+// ParseKeyPurpose validates a key purpose name. An empty name selects DefaultKeyPurpose.
+func ParseKeyPurpose(s string) (KeyPurpose, error) {
+	if s == "" {
+		return DefaultKeyPurpose, nil
+	}
+	purpose := KeyPurpose(s)
+	switch purpose {
+	case KeyPurposeCA, KeyPurposeOCSP, KeyPurposeEndEntity:
+		return purpose, nil
+	}
+	return "", fmt.Errorf("unsupported key purpose: %s", s)
+}
+
+// KeyPolicy controls the private key template attributes that differ between
+// purposes. Private keys are always sensitive and able to sign; the zero
+// value is a non-extractable, sign-only key.
+type KeyPolicy struct {
+	// Extractable sets CKA_EXTRACTABLE, allowing the key to be wrapped off the token.
+	Extractable bool `json:"extractable"`
+	// Decrypt sets CKA_DECRYPT on RSA private keys and CKA_ENCRYPT on their public keys.
+	Decrypt bool `json:"decrypt"`
+}
+
+// DefaultKeyPolicies returns the policy of every purpose: CA and OCSP keys
+// are non-extractable and sign-only, end-entity keys keep the extractable,
+// decrypt-capable template keys were generated with before policies existed.
+func DefaultKeyPolicies() map[KeyPurpose]KeyPolicy {
+	return map[KeyPurpose]KeyPolicy{
+		KeyPurposeCA:        {},
+		KeyPurposeOCSP:      {},
+		KeyPurposeEndEntity: {Extractable: true, Decrypt: true},
+	}
+}
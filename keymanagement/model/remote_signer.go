@@ -0,0 +1,101 @@
+package model
+
+import "errors"
+
+// Remote signer protocol. The signing daemon (cmd/signerd) serves the key
+// repository of its token as JSON requests POSTed to /v1/<operation> over
+// mutually authenticated TLS. The operations are sign, public-key, key-pair,
+// list, describe, generate, random and health; failures are answered with a
+// RemoteError.
+
+// RemoteKeyRequest names a key for the public-key, key-pair and describe operations.
+type RemoteKeyRequest struct {
+	Label string `json:"label"`
+}
+
+// RemoteSignRequest asks for a signature over a digest.
+type RemoteSignRequest struct {
+	Label  string `json:"label"`
+	Digest []byte `json:"digest"`
+	// Hash is the crypto.Hash name of the digest, e.g. "SHA-256". Empty signs
+	// the digest as given, with PKCS#1 v1.5 padding for RSA keys.
+	Hash string `json:"hash,omitempty"`
+	// PSS selects RSA-PSS with SaltLength as in rsa.PSSOptions.
+	PSS        bool `json:"pss,omitempty"`
+	SaltLength int  `json:"salt_length,omitempty"`
+}
+
+// RemoteSignResponse carries a signature in the form crypto.Signer returns it.
+type RemoteSignResponse struct {
+	Signature []byte `json:"signature"`
+}
+
+// RemotePublicKeyResponse carries the PEM encoded PKIX public key of a key
+// that may currently sign.
+type RemotePublicKeyResponse struct {
+	PublicKey string `json:"public_key"`
+}
+
+// RemoteDescribeResponse carries the attributes of a private key and its
+// PEM encoded PKIX public key.
+type RemoteDescribeResponse struct {
+	Key       KeyObject `json:"key"`
+	PublicKey string    `json:"public_key"`
+}
+
+// RemoteGenerateRequest asks for a new key pair. The daemon refuses it
+// unless it was started with key generation allowed.
+type RemoteGenerateRequest struct {
+	Label     string       `json:"label"`
+	Algorithm KeyAlgorithm `json:"algorithm"`
+	Policy    KeyPolicy    `json:"policy"`
+}
+
+// RemoteRandomRequest asks for bytes from the token's random number generator.
+type RemoteRandomRequest struct {
+	Length int `json:"length"`
+}
+
+// RemoteRandomResponse carries random bytes.
+type RemoteRandomResponse struct {
+	Random []byte `json:"random"`
+}
+
+// remoteErrorCodes are the errors that keep their identity across the protocol.
+var remoteErrorCodes = map[string]error{
+	"hsm_unavailable": ErrHSMUnavailable,
+	"token_locked":    ErrTokenLocked,
+	"key_not_found":   ErrKeyNotFound,
+	"key_disabled":    ErrKeyDisabled,
+	"key_exists":      ErrKeyExists,
+	"not_supported":   ErrNotSupported,
+}
+
+// RemoteError is an error response of the signing daemon. It matches the
+// error its code stands for with errors.Is.
+type RemoteError struct {
+	Message string `json:"error"`
+	Code    string `json:"code,omitempty"`
+}
+
+// NewRemoteError returns the error response for err.
+func NewRemoteError(err error) *RemoteError {
+	remoteErr := &RemoteError{Message: err.Error()}
+	for code, target := range remoteErrorCodes {
+		if errors.Is(err, target) {
+			remoteErr.Code = code
+			break
+		}
+	}
+	return remoteErr
+}
+
+func (e *RemoteError) Error() string {
+	return "remote signer: " + e.Message
+}
+
+// Is makes errors.Is match the error of the response code.
+func (e *RemoteError) Is(target error) bool {
+	err, ok := remoteErrorCodes[e.Code]
+	return ok && err == target
+}
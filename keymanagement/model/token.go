@@ -0,0 +1,24 @@
+package model
+
+const (
+	// DefaultToken is the name of the token configured in keymanagement.
+	// Keys requested without a token name live there.
+	DefaultToken = "default"
+
+	// BackendPKCS11 serves keys from a PKCS#11 slot.
+	BackendPKCS11 = "pkcs11"
+	// BackendSoftware serves keys from an encrypted keystore directory, named by Slot.
+	BackendSoftware = "software"
+	// BackendMemory serves keys held in process memory only, for tests.
+	BackendMemory = "memory"
+	// BackendRemote serves keys through the signing daemon at the URL in Slot.
+	BackendRemote = "remote"
+)
+
+// Token describes a key store the key management service routes operations to.
+type Token struct {
+	Name    string `json:"name"`
+	Backend string `json:"backend"`           // e.g. "pkcs11"
+	Slot    string `json:"slot"`              // PKCS#11 slot ID, keystore directory or signer URL
+	PinRef  string `json:"pin_ref,omitempty"` // e.g. "env:ROOT_CA_PIN"
+}
@@ -0,0 +1,116 @@
+package repository
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+)
+
+// kwpIV is the alternative initial value of AES key wrap with padding (RFC 5649, section 3).
+var kwpIV = [4]byte{0xa6, 0x59, 0x59, 0xa6}
+
+// wrapKeyPadded wraps plaintext with kek as CKM_AES_KEY_WRAP_PAD does, so
+// that software and PKCS#11 tokens read each other's backups.
+func wrapKeyPadded(kek, plaintext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	if len(plaintext) == 0 || uint64(len(plaintext)) > 0xffffffff {
+		return nil, errors.New("invalid key wrap input length")
+	}
+
+	n := (len(plaintext) + 7) / 8
+	a := make([]byte, 8, 8+8*n)
+	copy(a, kwpIV[:])
+	binary.BigEndian.PutUint32(a[4:], uint32(len(plaintext)))
+	padded := make([]byte, 8*n)
+	copy(padded, plaintext)
+
+	if n == 1 {
+		out := append(a, padded...)
+		block.Encrypt(out, out)
+		return out, nil
+	}
+
+	// RFC 3394 wrapping with the alternative initial value
+	return wrapBlocks(block, a, padded), nil
+}
+
+// wrapBlocks is the RFC 3394 wrapping process W of the n >= 2 64-bit blocks
+// in plaintext with the initial value iv. It overwrites plaintext and iv.
+func wrapBlocks(block cipher.Block, iv, plaintext []byte) []byte {
+	n := len(plaintext) / 8
+	buf := make([]byte, 16)
+	for j := 0; j < 6; j++ {
+		for i := 0; i < n; i++ {
+			copy(buf, iv)
+			copy(buf[8:], plaintext[8*i:8*i+8])
+			block.Encrypt(buf, buf)
+			t := uint64(n*j + i + 1)
+			binary.BigEndian.PutUint64(iv, binary.BigEndian.Uint64(buf[:8])^t)
+			copy(plaintext[8*i:], buf[8:])
+		}
+	}
+	return append(iv, plaintext...)
+}
+
+// unwrapKeyPadded reverses wrapKeyPadded and checks its integrity value.
+func unwrapKeyPadded(kek, ciphertext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < 16 || len(ciphertext)%8 != 0 {
+		return nil, errors.New("invalid wrapped key length")
+	}
+
+	n := len(ciphertext)/8 - 1
+	a := make([]byte, 8)
+	padded := make([]byte, 8*n)
+	if n == 1 {
+		buf := make([]byte, 16)
+		block.Decrypt(buf, ciphertext)
+		copy(a, buf[:8])
+		copy(padded, buf[8:])
+	} else {
+		a, padded = unwrapBlocks(block, ciphertext)
+	}
+
+	length := int(binary.BigEndian.Uint32(a[4:]))
+	valid := subtle.ConstantTimeCompare(a[:4], kwpIV[:]) == 1 && length > 8*(n-1) && length <= 8*n
+	if valid {
+		for _, b := range padded[length:] {
+			valid = valid && b == 0
+		}
+	}
+	if !valid {
+		return nil, errors.New("wrapped key integrity check failed, wrong wrapping key?")
+	}
+	return padded[:length], nil
+}
+
+// unwrapBlocks is the RFC 3394 unwrapping process W^-1 of a ciphertext of
+// n >= 2 blocks plus the integrity value. It returns the integrity value to
+// check and the plaintext.
+func unwrapBlocks(block cipher.Block, ciphertext []byte) (iv, plaintext []byte) {
+	n := len(ciphertext)/8 - 1
+	iv = make([]byte, 8)
+	plaintext = make([]byte, 8*n)
+	copy(iv, ciphertext[:8])
+	copy(plaintext, ciphertext[8:])
+	buf := make([]byte, 16)
+	for j := 5; j >= 0; j-- {
+		for i := n - 1; i >= 0; i-- {
+			t := uint64(n*j + i + 1)
+			binary.BigEndian.PutUint64(buf, binary.BigEndian.Uint64(iv)^t)
+			copy(buf[8:], plaintext[8*i:8*i+8])
+			block.Decrypt(buf, buf)
+			copy(iv, buf[:8])
+			copy(plaintext[8*i:], buf[8:])
+		}
+	}
+	return iv, plaintext
+}
@@ -0,0 +1,142 @@
+package repository
+
+import (
+	"bytes"
+	"crypto/aes"
+	"encoding/hex"
+	"testing"
+)
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatalf("bad hex %q: %v", s, err)
+	}
+	return b
+}
+
+// RFC 3394, section 4: wrapping with the default initial value.
+func TestWrapBlocksRFC3394(t *testing.T) {
+	tests := []struct {
+		name, kek, key, wrapped string
+	}{
+		{
+			name:    "4.1 128-bit key with 128-bit KEK",
+			kek:     "000102030405060708090A0B0C0D0E0F",
+			key:     "00112233445566778899AABBCCDDEEFF",
+			wrapped: "1FA68B0A8112B447AEF34BD8FB5A7B829D3E862371D2CFE5",
+		},
+		{
+			name:    "4.2 128-bit key with 192-bit KEK",
+			kek:     "000102030405060708090A0B0C0D0E0F1011121314151617",
+			key:     "00112233445566778899AABBCCDDEEFF",
+			wrapped: "96778B25AE6CA435F92B5B97C050AED2468AB8A17AD84E5D",
+		},
+		{
+			name:    "4.3 128-bit key with 256-bit KEK",
+			kek:     "000102030405060708090A0B0C0D0E0F101112131415161718191A1B1C1D1E1F",
+			key:     "00112233445566778899AABBCCDDEEFF",
+			wrapped: "64E8C3F9CE0F5BA263E9777905818A2A93C8191E7D6E8AE7",
+		},
+		{
+			name:    "4.6 256-bit key with 256-bit KEK",
+			kek:     "000102030405060708090A0B0C0D0E0F101112131415161718191A1B1C1D1E1F",
+			key:     "00112233445566778899AABBCCDDEEFF000102030405060708090A0B0C0D0E0F",
+			wrapped: "28C9F404C4B810F4CBCCB35CFB87F8263F5786E2D80ED326CBC7F0E71A99F43BFB988B9B7A02DD21",
+		},
+	}
+	defaultIV := mustHex(t, "A6A6A6A6A6A6A6A6")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			block, err := aes.NewCipher(mustHex(t, tt.kek))
+			if err != nil {
+				t.Fatal(err)
+			}
+			key := mustHex(t, tt.key)
+			want := mustHex(t, tt.wrapped)
+
+			iv := bytes.Clone(defaultIV)
+			if got := wrapBlocks(block, iv, bytes.Clone(key)); !bytes.Equal(got, want) {
+				t.Errorf("wrap = %X, want %X", got, want)
+			}
+			gotIV, got := unwrapBlocks(block, want)
+			if !bytes.Equal(gotIV, defaultIV) {
+				t.Errorf("unwrap integrity value = %X, want %X", gotIV, defaultIV)
+			}
+			if !bytes.Equal(got, key) {
+				t.Errorf("unwrap = %X, want %X", got, key)
+			}
+		})
+	}
+}
+
+// RFC 5649, section 6: wrapping with padding.
+func TestWrapKeyPaddedRFC5649(t *testing.T) {
+	kek := "5840df6e29b02af1ab493b705bf16ea1ae8338f4dcc176a8"
+	tests := []struct {
+		name, key, wrapped string
+	}{
+		{
+			name:    "20 octets",
+			key:     "c37b7e6492584340bed12207808941155068f738",
+			wrapped: "138bdeaa9b8fa7fc61f97742e72248ee5ae6ae5360d1ae6a5f54f373fa543b6a",
+		},
+		{
+			name:    "7 octets",
+			key:     "466f7250617369",
+			wrapped: "afbeb0f07dfbf5419200f2ccb50bb24f",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key := mustHex(t, tt.key)
+			want := mustHex(t, tt.wrapped)
+
+			got, err := wrapKeyPadded(mustHex(t, kek), key)
+			if err != nil {
+				t.Fatalf("wrapKeyPadded: %v", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("wrap = %x, want %x", got, want)
+			}
+			unwrapped, err := unwrapKeyPadded(mustHex(t, kek), want)
+			if err != nil {
+				t.Fatalf("unwrapKeyPadded: %v", err)
+			}
+			if !bytes.Equal(unwrapped, key) {
+				t.Errorf("unwrap = %x, want %x", unwrapped, key)
+			}
+		})
+	}
+}
+
+func TestUnwrapKeyPaddedIntegrityFailure(t *testing.T) {
+	kek := mustHex(t, "5840df6e29b02af1ab493b705bf16ea1ae8338f4dcc176a8")
+	otherKEK := mustHex(t, "000102030405060708090a0b0c0d0e0f1011121314151617")
+	for _, size := range []int{7, 20, 32} {
+		key := bytes.Repeat([]byte{0x5a}, size)
+		wrapped, err := wrapKeyPadded(kek, key)
+		if err != nil {
+			t.Fatalf("wrapKeyPadded(%d octets): %v", size, err)
+		}
+
+		if _, err := unwrapKeyPadded(otherKEK, wrapped); err == nil {
+			t.Errorf("%d octets: unwrap with the wrong KEK succeeded", size)
+		}
+		for i := range wrapped {
+			corrupted := bytes.Clone(wrapped)
+			corrupted[i] ^= 0x01
+			if _, err := unwrapKeyPadded(kek, corrupted); err == nil {
+				t.Errorf("%d octets: unwrap succeeded with byte %d flipped", size, i)
+			}
+		}
+	}
+
+	if _, err := unwrapKeyPadded(kek, make([]byte, 12)); err == nil {
+		t.Error("unwrap of a ciphertext that is not a multiple of 8 octets succeeded")
+	}
+	if _, err := wrapKeyPadded(kek, nil); err == nil {
+		t.Error("wrap of an empty key succeeded")
+	}
+}
@@ -0,0 +1,336 @@
+package repository
+
+import (
+	"core-ca/keymanagement/model"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/miekg/pkcs11"
+)
+
+// wrapMechanism wraps private keys as padded PKCS#8 (RFC 5649).
+var wrapMechanism = []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_AES_KEY_WRAP_PAD, nil)}
+
+// CreateWrappingKey creates an AES key-encryption key that can only wrap and
+// unwrap. A nil value generates a 256-bit key on the token; otherwise value
+// (16, 24 or 32 bytes) is imported so that several tokens share the KEK.
+func (r *softHSMKeyPairRepository) CreateWrappingKey(label string, value []byte) error {
+	template := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_SECRET_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_AES),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+		pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, false),
+		pkcs11.NewAttribute(pkcs11.CKA_WRAP, true),
+		pkcs11.NewAttribute(pkcs11.CKA_UNWRAP, true),
+		pkcs11.NewAttribute(pkcs11.CKA_ENCRYPT, false),
+		pkcs11.NewAttribute(pkcs11.CKA_DECRYPT, false),
+	}
+	switch len(value) {
+	case 0:
+		template = append(template, pkcs11.NewAttribute(pkcs11.CKA_VALUE_LEN, 32))
+	case 16, 24, 32:
+		template = append(template, pkcs11.NewAttribute(pkcs11.CKA_VALUE, value))
+	default:
+		return fmt.Errorf("invalid AES key length: %d bytes", len(value))
+	}
+
+	return r.withSession(func(session pkcs11.SessionHandle) error {
+		existing, err := r.findWrappingKey(session, label)
+		if err != nil {
+			return err
+		}
+		if existing != nil {
+			return fmt.Errorf("%w: %s", model.ErrKeyExists, label)
+		}
+
+		if value == nil {
+			_, err = r.ctx.GenerateKey(session,
+				[]*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_AES_KEY_GEN, nil)}, template)
+		} else {
+			_, err = r.ctx.CreateObject(session, template)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to create wrapping key: %w", err)
+		}
+		return nil
+	})
+}
+
+// WrapKey wraps the private key with the given label under the KEK kekLabel.
+// The Token and CreatedAt fields of the backup are left to the caller.
+func (r *softHSMKeyPairRepository) WrapKey(keyLabel, kekLabel string) (model.KeyBackup, error) {
+	key, err := r.lookupKey(keyLabel)
+	if err != nil {
+		return model.KeyBackup{}, err
+	}
+	pubPEM, fingerprint, err := EncodePublicKey(key.publicKey)
+	if err != nil {
+		return model.KeyBackup{}, err
+	}
+	algorithm, err := KeyAlgorithmOf(key.publicKey)
+	if err != nil {
+		return model.KeyBackup{}, err
+	}
+
+	backup := model.KeyBackup{
+		Version:         model.KeyBackupVersion,
+		Mechanism:       model.KeyBackupMechanism,
+		KEKLabel:        kekLabel,
+		Label:           keyLabel,
+		Algorithm:       algorithm,
+		PublicKey:       pubPEM,
+		PublicKeySHA256: fingerprint,
+	}
+	err = r.withSession(func(session pkcs11.SessionHandle) error {
+		kek, err := r.findWrappingKey(session, kekLabel)
+		if err != nil {
+			return err
+		}
+		if kek == nil {
+			return fmt.Errorf("%w: wrapping key %s", model.ErrKeyNotFound, kekLabel)
+		}
+
+		attrs, err := r.ctx.GetAttributeValue(session, key.privHandle, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_ID, nil),
+			pkcs11.NewAttribute(pkcs11.CKA_SIGN, nil),
+			pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, nil),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to read private key attributes: %w", err)
+		}
+		backup.ID = hex.EncodeToString(attrs[0].Value)
+		backup.Attributes.Sign = attributeBool(attrs[1].Value)
+		backup.Attributes.Extractable = attributeBool(attrs[2].Value)
+		if !backup.Attributes.Extractable {
+			return fmt.Errorf("%w: %s", model.ErrKeyNotExtractable, keyLabel)
+		}
+		if _, ok := key.publicKey.(*rsa.PublicKey); ok {
+			attrs, err = r.ctx.GetAttributeValue(session, key.privHandle, []*pkcs11.Attribute{
+				pkcs11.NewAttribute(pkcs11.CKA_DECRYPT, nil),
+			})
+			if err != nil {
+				return fmt.Errorf("failed to read private key attributes: %w", err)
+			}
+			backup.Attributes.Decrypt = attributeBool(attrs[0].Value)
+		}
+
+		wrapped, err := r.ctx.WrapKey(session, wrapMechanism, *kek, key.privHandle)
+		if err != nil {
+			var p11Err pkcs11.Error
+			if errors.As(err, &p11Err) && (p11Err == pkcs11.CKR_KEY_UNEXTRACTABLE || p11Err == pkcs11.CKR_KEY_NOT_WRAPPABLE) {
+				return fmt.Errorf("%w: %s: %v", model.ErrKeyNotExtractable, keyLabel, err)
+			}
+			return fmt.Errorf("failed to wrap private key: %w", err)
+		}
+		backup.WrappedKey = base64.StdEncoding.EncodeToString(wrapped)
+		return nil
+	})
+	if isHandleError(err) {
+		r.forgetKey(keyLabel)
+	}
+	if err != nil {
+		return model.KeyBackup{}, err
+	}
+	return backup, nil
+}
+
+// UnwrapKey recreates the key pair of backup on the token using the KEK
+// kekLabel, then signs a random digest with the unwrapped private key and
+// checks it against the backed-up public key. On a mismatch the new objects
+// are destroyed.
+func (r *softHSMKeyPairRepository) UnwrapKey(backup model.KeyBackup, kekLabel string) error {
+	block, _ := pem.Decode([]byte(backup.PublicKey))
+	if block == nil {
+		return errors.New("failed to decode public key PEM")
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return fmt.Errorf("failed to parse public key: %w", err)
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(backup.WrappedKey)
+	if err != nil {
+		return fmt.Errorf("failed to decode wrapped key: %w", err)
+	}
+	id, err := hex.DecodeString(backup.ID)
+	if err != nil {
+		return fmt.Errorf("failed to decode key ID: %w", err)
+	}
+	keyType, pubTemplate, err := publicKeyTemplate(pub)
+	if err != nil {
+		return err
+	}
+
+	pubTemplate = append(pubTemplate,
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PUBLIC_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, keyType),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_VERIFY, true),
+		pkcs11.NewAttribute(pkcs11.CKA_WRAP, false),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, backup.Label),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, id),
+	)
+	privTemplate := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, keyType),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_SIGN, backup.Attributes.Sign),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, backup.Label),
+		pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_UNWRAP, false),
+		pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, backup.Attributes.Extractable),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, id),
+	}
+	if keyType == pkcs11.CKK_RSA {
+		privTemplate = append(privTemplate, pkcs11.NewAttribute(pkcs11.CKA_DECRYPT, backup.Attributes.Decrypt))
+	}
+
+	var privHandle, pubHandle pkcs11.ObjectHandle
+	err = r.withSession(func(session pkcs11.SessionHandle) error {
+		existing, err := r.findObject(session, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+			pkcs11.NewAttribute(pkcs11.CKA_LABEL, backup.Label),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to search private key: %w", err)
+		}
+		if existing != nil {
+			return fmt.Errorf("%w: %s", model.ErrKeyExists, backup.Label)
+		}
+		kek, err := r.findWrappingKey(session, kekLabel)
+		if err != nil {
+			return err
+		}
+		if kek == nil {
+			return fmt.Errorf("%w: wrapping key %s", model.ErrKeyNotFound, kekLabel)
+		}
+
+		privHandle, err = r.ctx.UnwrapKey(session, wrapMechanism, *kek, wrapped, privTemplate)
+		if err != nil {
+			return fmt.Errorf("failed to unwrap private key: %w", err)
+		}
+		pubHandle, err = r.ctx.CreateObject(session, pubTemplate)
+		if err != nil {
+			r.ctx.DestroyObject(session, privHandle)
+			return fmt.Errorf("failed to create public key: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	r.forgetKey(backup.Label)
+
+	// A key restored disabled cannot sign, so its public key cannot be checked.
+	if !backup.Attributes.Sign {
+		return nil
+	}
+	if err := r.verifyKeyPair(backup.Label, privHandle, pub); err != nil {
+		r.withSession(func(session pkcs11.SessionHandle) error {
+			r.ctx.DestroyObject(session, privHandle)
+			r.ctx.DestroyObject(session, pubHandle)
+			return nil
+		})
+		return fmt.Errorf("restored key %s does not match the backed-up public key: %w", backup.Label, err)
+	}
+	return nil
+}
+
+// verifyKeyPair signs a random digest with privHandle and verifies the
+// signature with pub.
+func (r *softHSMKeyPairRepository) verifyKeyPair(keyLabel string, privHandle pkcs11.ObjectHandle, pub crypto.PublicKey) error {
+	digest := make([]byte, sha256.Size)
+	if _, err := rand.Read(digest); err != nil {
+		return err
+	}
+	signer := &softHSMSigner{repo: r, label: keyLabel, privHandle: privHandle, publicKey: pub}
+	signature, err := signer.Sign(rand.Reader, digest, crypto.SHA256)
+	if err != nil {
+		return err
+	}
+
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, digest, signature)
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(k, digest, signature) {
+			return errors.New("ECDSA signature verification failed")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported public key type: %T", pub)
+}
+
+// findWrappingKey returns the AES secret key with the given label, or nil if there is none.
+func (r *softHSMKeyPairRepository) findWrappingKey(session pkcs11.SessionHandle, label string) (*pkcs11.ObjectHandle, error) {
+	handle, err := r.findObject(session, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_SECRET_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to search wrapping key: %w", err)
+	}
+	return handle, nil
+}
+
+// publicKeyTemplate returns the key type and the attributes holding the key
+// material of a public key object for pub.
+func publicKeyTemplate(pub crypto.PublicKey) (uint, []*pkcs11.Attribute, error) {
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		return pkcs11.CKK_RSA, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_MODULUS, k.N.Bytes()),
+			pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, big.NewInt(int64(k.E)).Bytes()),
+		}, nil
+	case *ecdsa.PublicKey:
+		algorithm, err := KeyAlgorithmOf(k)
+		if err != nil {
+			return 0, nil, err
+		}
+		oid := oidNamedCurveP256
+		if algorithm == model.KeyAlgorithmECP384 {
+			oid = oidNamedCurveP384
+		}
+		ecParams, err := asn1.Marshal(oid)
+		if err != nil {
+			return 0, nil, fmt.Errorf("failed to encode EC params: %w", err)
+		}
+		ecdhKey, err := k.ECDH()
+		if err != nil {
+			return 0, nil, fmt.Errorf("invalid EC public key: %w", err)
+		}
+		ecPoint, err := asn1.Marshal(ecdhKey.Bytes())
+		if err != nil {
+			return 0, nil, fmt.Errorf("failed to encode EC point: %w", err)
+		}
+		return pkcs11.CKK_EC, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, ecParams),
+			pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, ecPoint),
+		}, nil
+	}
+	return 0, nil, fmt.Errorf("unsupported public key type: %T", pub)
+}
+
+// EncodePublicKey returns the PKIX PEM of pub and the hex SHA-256 of its DER.
+func EncodePublicKey(pub crypto.PublicKey) (string, string, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to marshal public key: %w", err)
+	}
+	sum := sha256.Sum256(der)
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})), hex.EncodeToString(sum[:]), nil
+}
@@ -0,0 +1,126 @@
+package repository
+
+import (
+	"core-ca/keymanagement/model"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/miekg/pkcs11"
+)
+
+// ImportKeyPair writes an existing private key and its public key to the
+// token with C_CreateObject. The private key is sensitive, its
+// CKA_EXTRACTABLE follows policy, and a test signature checks that the token
+// holds the key that was given; on failure the new objects are destroyed.
+func (r *softHSMKeyPairRepository) ImportKeyPair(label string, key crypto.Signer, policy model.KeyPolicy) (model.KeyPairData, error) {
+	pub := key.Public()
+	if _, err := KeyAlgorithmOf(pub); err != nil {
+		return model.KeyPairData{}, err
+	}
+	keyType, pubTemplate, err := publicKeyTemplate(pub)
+	if err != nil {
+		return model.KeyPairData{}, err
+	}
+
+	privTemplate := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, keyType),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_SIGN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+		pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_UNWRAP, false),
+		pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, policy.Extractable),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, []byte(label)),
+	}
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		if len(k.Primes) != 2 {
+			return model.KeyPairData{}, errors.New("multi-prime RSA keys are not supported")
+		}
+		k.Precompute()
+		privTemplate = append(privTemplate,
+			pkcs11.NewAttribute(pkcs11.CKA_MODULUS, k.N.Bytes()),
+			pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, big.NewInt(int64(k.E)).Bytes()),
+			pkcs11.NewAttribute(pkcs11.CKA_PRIVATE_EXPONENT, k.D.Bytes()),
+			pkcs11.NewAttribute(pkcs11.CKA_PRIME_1, k.Primes[0].Bytes()),
+			pkcs11.NewAttribute(pkcs11.CKA_PRIME_2, k.Primes[1].Bytes()),
+			pkcs11.NewAttribute(pkcs11.CKA_EXPONENT_1, k.Precomputed.Dp.Bytes()),
+			pkcs11.NewAttribute(pkcs11.CKA_EXPONENT_2, k.Precomputed.Dq.Bytes()),
+			pkcs11.NewAttribute(pkcs11.CKA_COEFFICIENT, k.Precomputed.Qinv.Bytes()),
+			pkcs11.NewAttribute(pkcs11.CKA_DECRYPT, policy.Decrypt),
+		)
+		pubTemplate = append(pubTemplate, pkcs11.NewAttribute(pkcs11.CKA_ENCRYPT, policy.Decrypt))
+	case *ecdsa.PrivateKey:
+		// The curve is shared with the public key template, CKA_VALUE is the
+		// private scalar padded to the curve size.
+		for _, attr := range pubTemplate {
+			if attr.Type == pkcs11.CKA_EC_PARAMS {
+				privTemplate = append(privTemplate, pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, attr.Value))
+			}
+		}
+		size := (k.Curve.Params().BitSize + 7) / 8
+		privTemplate = append(privTemplate, pkcs11.NewAttribute(pkcs11.CKA_VALUE, k.D.FillBytes(make([]byte, size))))
+	default:
+		return model.KeyPairData{}, fmt.Errorf("unsupported private key type: %T", key)
+	}
+	pubTemplate = append(pubTemplate,
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PUBLIC_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, keyType),
+		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+		pkcs11.NewAttribute(pkcs11.CKA_VERIFY, true),
+		pkcs11.NewAttribute(pkcs11.CKA_WRAP, false),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, []byte(label)),
+	)
+	defer func() {
+		// The templates hold the private key material until they are dropped.
+		for _, attr := range privTemplate {
+			clear(attr.Value)
+		}
+	}()
+
+	var privHandle, pubHandle pkcs11.ObjectHandle
+	err = r.withSession(func(session pkcs11.SessionHandle) error {
+		existing, err := r.findObject(session, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+			pkcs11.NewAttribute(pkcs11.CKA_LABEL, label),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to search private key: %w", err)
+		}
+		if existing != nil {
+			return fmt.Errorf("%w: %s", model.ErrKeyExists, label)
+		}
+
+		privHandle, err = r.ctx.CreateObject(session, privTemplate)
+		if err != nil {
+			return fmt.Errorf("failed to import private key: %w", err)
+		}
+		pubHandle, err = r.ctx.CreateObject(session, pubTemplate)
+		if err != nil {
+			r.ctx.DestroyObject(session, privHandle)
+			return fmt.Errorf("failed to create public key: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return model.KeyPairData{}, err
+	}
+	r.forgetKey(label)
+
+	if err := r.verifyKeyPair(label, privHandle, pub); err != nil {
+		r.withSession(func(session pkcs11.SessionHandle) error {
+			r.ctx.DestroyObject(session, privHandle)
+			r.ctx.DestroyObject(session, pubHandle)
+			return nil
+		})
+		return model.KeyPairData{}, fmt.Errorf("imported key %s does not match its public key: %w", label, err)
+	}
+	return newKeyPairData(label, pub)
+}
@@ -0,0 +1,282 @@
+package repository
+
+import (
+	"core-ca/keymanagement/model"
+	"crypto"
+	"encoding/asn1"
+	"encoding/hex"
+	"fmt"
+	"sort"
+
+	"github.com/miekg/pkcs11"
+)
+
+// findObjects returns every object matching template.
+func (r *softHSMKeyPairRepository) findObjects(session pkcs11.SessionHandle, template []*pkcs11.Attribute) ([]pkcs11.ObjectHandle, error) {
+	if err := r.ctx.FindObjectsInit(session, template); err != nil {
+		return nil, err
+	}
+	var handles []pkcs11.ObjectHandle
+	var err error
+	for {
+		var objs []pkcs11.ObjectHandle
+		objs, _, err = r.ctx.FindObjects(session, 64)
+		if err != nil || len(objs) == 0 {
+			break
+		}
+		handles = append(handles, objs...)
+	}
+	if finalErr := r.ctx.FindObjectsFinal(session); err == nil {
+		err = finalErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return handles, nil
+}
+
+// ListKeys describes every private and public key object on the token.
+func (r *softHSMKeyPairRepository) ListKeys() ([]model.KeyObject, error) {
+	var keys []model.KeyObject
+	err := r.withSession(func(session pkcs11.SessionHandle) error {
+		keys = keys[:0]
+		for _, class := range []uint{pkcs11.CKO_PRIVATE_KEY, pkcs11.CKO_PUBLIC_KEY} {
+			handles, err := r.findObjects(session, []*pkcs11.Attribute{
+				pkcs11.NewAttribute(pkcs11.CKA_CLASS, class),
+			})
+			if err != nil {
+				return fmt.Errorf("failed to search key objects: %w", err)
+			}
+			for _, handle := range handles {
+				key, err := r.describeKey(session, handle, class)
+				if err != nil {
+					return err
+				}
+				keys = append(keys, key)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Label != keys[j].Label {
+			return keys[i].Label < keys[j].Label
+		}
+		return keys[i].Class < keys[j].Class
+	})
+	return keys, nil
+}
+
+func (r *softHSMKeyPairRepository) DescribeKey(keyLabel string) (model.KeyObject, crypto.PublicKey, error) {
+	for attempt := 0; ; attempt++ {
+		key, err := r.lookupKey(keyLabel)
+		if err != nil {
+			return model.KeyObject{}, nil, err
+		}
+		var obj model.KeyObject
+		err = r.withSession(func(session pkcs11.SessionHandle) error {
+			obj, err = r.describeKey(session, key.privHandle, pkcs11.CKO_PRIVATE_KEY)
+			return err
+		})
+		if isHandleError(err) && attempt == 0 {
+			// The key was recreated since it was cached; look it up again.
+			r.forgetKey(keyLabel)
+			continue
+		}
+		if err != nil {
+			return model.KeyObject{}, nil, err
+		}
+		return obj, key.publicKey, nil
+	}
+}
+
+// describeKey reads the non-sensitive attributes of a key object. Attributes
+// that do not exist for the class are not requested, since a single invalid
+// or sensitive attribute fails the whole C_GetAttributeValue call.
+func (r *softHSMKeyPairRepository) describeKey(session pkcs11.SessionHandle, handle pkcs11.ObjectHandle, class uint) (model.KeyObject, error) {
+	template := []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_ID, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_LOCAL, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_MODIFIABLE, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_START_DATE, nil),
+		pkcs11.NewAttribute(pkcs11.CKA_END_DATE, nil),
+	}
+	if class == pkcs11.CKO_PRIVATE_KEY {
+		template = append(template,
+			pkcs11.NewAttribute(pkcs11.CKA_SIGN, nil),
+			pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, nil),
+			pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, nil),
+			pkcs11.NewAttribute(pkcs11.CKA_ALWAYS_SENSITIVE, nil),
+			pkcs11.NewAttribute(pkcs11.CKA_NEVER_EXTRACTABLE, nil),
+		)
+	}
+	attrs, err := r.ctx.GetAttributeValue(session, handle, template)
+	if err != nil {
+		return model.KeyObject{}, fmt.Errorf("failed to read key attributes: %w", err)
+	}
+
+	key := model.KeyObject{Class: "public"}
+	if class == pkcs11.CKO_PRIVATE_KEY {
+		key.Class = "private"
+	}
+	var keyType uint64
+	for _, attr := range attrs {
+		switch attr.Type {
+		case pkcs11.CKA_LABEL:
+			key.Label = string(attr.Value)
+		case pkcs11.CKA_ID:
+			key.ID = hex.EncodeToString(attr.Value)
+		case pkcs11.CKA_KEY_TYPE:
+			keyType = attributeUint(attr.Value)
+		case pkcs11.CKA_LOCAL:
+			key.Local = attributeBool(attr.Value)
+		case pkcs11.CKA_MODIFIABLE:
+			key.Modifiable = attributeBool(attr.Value)
+		case pkcs11.CKA_START_DATE:
+			key.StartDate = attributeDate(attr.Value)
+		case pkcs11.CKA_END_DATE:
+			key.EndDate = attributeDate(attr.Value)
+		case pkcs11.CKA_SIGN:
+			key.Disabled = !attributeBool(attr.Value)
+		case pkcs11.CKA_SENSITIVE:
+			key.Sensitive = boolPtr(attributeBool(attr.Value))
+		case pkcs11.CKA_EXTRACTABLE:
+			key.Extractable = boolPtr(attributeBool(attr.Value))
+		case pkcs11.CKA_ALWAYS_SENSITIVE:
+			key.AlwaysSensitive = boolPtr(attributeBool(attr.Value))
+		case pkcs11.CKA_NEVER_EXTRACTABLE:
+			key.NeverExtractable = boolPtr(attributeBool(attr.Value))
+		}
+	}
+
+	// The modulus and curve are public attributes of private keys too.
+	switch keyType {
+	case pkcs11.CKK_RSA:
+		key.KeyType = "RSA"
+		attrs, err = r.ctx.GetAttributeValue(session, handle, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_MODULUS, nil),
+		})
+		if err != nil {
+			return model.KeyObject{}, fmt.Errorf("failed to read RSA modulus: %w", err)
+		}
+		modulus := attrs[0].Value
+		for len(modulus) > 0 && modulus[0] == 0 {
+			modulus = modulus[1:]
+		}
+		key.Bits = len(modulus) * 8
+		key.Algorithm = map[int]model.KeyAlgorithm{
+			2048: model.KeyAlgorithmRSA2048,
+			3072: model.KeyAlgorithmRSA3072,
+			4096: model.KeyAlgorithmRSA4096,
+		}[key.Bits]
+	case pkcs11.CKK_EC:
+		key.KeyType = "EC"
+		attrs, err = r.ctx.GetAttributeValue(session, handle, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, nil),
+		})
+		if err != nil {
+			return model.KeyObject{}, fmt.Errorf("failed to read EC params: %w", err)
+		}
+		var oid asn1.ObjectIdentifier
+		if _, err := asn1.Unmarshal(attrs[0].Value, &oid); err == nil {
+			switch {
+			case oid.Equal(oidNamedCurveP256):
+				key.Bits, key.Algorithm = 256, model.KeyAlgorithmECP256
+			case oid.Equal(oidNamedCurveP384):
+				key.Bits, key.Algorithm = 384, model.KeyAlgorithmECP384
+			}
+		}
+	default:
+		key.KeyType = fmt.Sprintf("0x%x", keyType)
+	}
+	return key, nil
+}
+
+// SetKeyEnabled sets CKA_SIGN on the private key with the given label. A
+// disabled key is refused by GetSigner and by the token itself.
+func (r *softHSMKeyPairRepository) SetKeyEnabled(keyLabel string, enabled bool) error {
+	err := r.withSession(func(session pkcs11.SessionHandle) error {
+		privHandle, err := r.findObject(session, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+			pkcs11.NewAttribute(pkcs11.CKA_LABEL, keyLabel),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to search private key: %w", err)
+		}
+		if privHandle == nil {
+			return fmt.Errorf("%w: %s", model.ErrKeyNotFound, keyLabel)
+		}
+		err = r.ctx.SetAttributeValue(session, *privHandle, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_SIGN, enabled),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to set CKA_SIGN: %w", err)
+		}
+		return nil
+	})
+	r.forgetKey(keyLabel)
+	return err
+}
+
+// DestroyKeyPair destroys the private key with the given label and the public
+// key objects sharing its CKA_ID.
+func (r *softHSMKeyPairRepository) DestroyKeyPair(keyLabel string) error {
+	err := r.withSession(func(session pkcs11.SessionHandle) error {
+		privHandle, err := r.findObject(session, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+			pkcs11.NewAttribute(pkcs11.CKA_LABEL, keyLabel),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to search private key: %w", err)
+		}
+		if privHandle == nil {
+			return fmt.Errorf("%w: %s", model.ErrKeyNotFound, keyLabel)
+		}
+		attrs, err := r.ctx.GetAttributeValue(session, *privHandle, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_ID, nil),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to get private key ID: %w", err)
+		}
+		pubHandles, err := r.findObjects(session, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PUBLIC_KEY),
+			pkcs11.NewAttribute(pkcs11.CKA_ID, attrs[0].Value),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to search public key: %w", err)
+		}
+
+		if err := r.ctx.DestroyObject(session, *privHandle); err != nil {
+			return fmt.Errorf("failed to destroy private key: %w", err)
+		}
+		for _, handle := range pubHandles {
+			if err := r.ctx.DestroyObject(session, handle); err != nil {
+				return fmt.Errorf("failed to destroy public key: %w", err)
+			}
+		}
+		return nil
+	})
+	r.forgetKey(keyLabel)
+	return err
+}
+
+func attributeBool(b []byte) bool {
+	return len(b) > 0 && b[0] != 0
+}
+
+// attributeDate formats a CK_DATE ("YYYYMMDD"); unset dates are empty.
+func attributeDate(b []byte) string {
+	if len(b) != 8 || string(b) == "00000000" || b[0] == ' ' || b[0] == 0 {
+		return ""
+	}
+	return string(b[0:4]) + "-" + string(b[4:6]) + "-" + string(b[6:8])
+}
+
+func boolPtr(b bool) *bool {
+	return &b
+}
@@ -3,23 +3,52 @@ package repository
 import (
 	"core-ca/keymanagement/model"
 	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rsa"
 	"crypto/x509"
+	"encoding/asn1"
+	"encoding/binary"
 	"encoding/pem"
 	"errors"
 	"fmt"
 	"io"
 	"math/big"
 	"strconv"
+	"sync"
 
 	"github.com/miekg/pkcs11"
 )
 
 // KeyPairRepository interface for key storage.
 type KeyPairRepository interface {
-	GenerateKeyPair(id string) (model.KeyPairData, error)
+	// GenerateKeyPair creates a key pair whose private key template follows policy.
+	GenerateKeyPair(id string, algorithm model.KeyAlgorithm, policy model.KeyPolicy) (model.KeyPairData, error)
+	// ImportKeyPair stores an existing private key and its public key under
+	// label; the private key template follows policy.
+	ImportKeyPair(label string, key crypto.Signer, policy model.KeyPolicy) (model.KeyPairData, error)
 	FindByID(id string) (model.KeyPairData, error)
+	// GetSigner returns a signer for the private key with the given label,
+	// refusing keys disabled with SetKeyEnabled.
 	GetSigner(keyLabel string) (crypto.Signer, error)
+	// ListKeys describes every key object on the token.
+	ListKeys() ([]model.KeyObject, error)
+	// DescribeKey returns the attributes of the private key with the given
+	// label together with its public key.
+	DescribeKey(keyLabel string) (model.KeyObject, crypto.PublicKey, error)
+	SetKeyEnabled(keyLabel string, enabled bool) error
+	DestroyKeyPair(keyLabel string) error
+	// CreateWrappingKey creates an AES key-encryption key, generated on the
+	// token when value is nil.
+	CreateWrappingKey(label string, value []byte) error
+	// WrapKey wraps a private key with CKM_AES_KEY_WRAP_PAD under a KEK.
+	WrapKey(keyLabel, kekLabel string) (model.KeyBackup, error)
+	// UnwrapKey restores a wrapped key pair and checks it against the backed-up public key.
+	UnwrapKey(backup model.KeyBackup, kekLabel string) error
+	// GenerateRandom returns length bytes from the token's random number generator.
+	GenerateRandom(length int) ([]byte, error)
+	// Health exercises C_GetSessionInfo/C_GetTokenInfo, reconnecting if the session was lost.
+	Health() (model.HSMHealth, error)
 	Finalize()
 }
 
@@ -27,18 +56,66 @@ type Signer interface {
 	Sign(data []byte) ([]byte, error)
 }
 
+// Named curve OIDs used in CKA_EC_PARAMS.
+var (
+	oidNamedCurveP256 = asn1.ObjectIdentifier{1, 2, 840, 10045, 3, 1, 7}
+	oidNamedCurveP384 = asn1.ObjectIdentifier{1, 3, 132, 0, 34}
+)
+
+// DER-encoded DigestInfo prefixes for PKCS#1 v1.5 signatures (RFC 8017, section 9.2).
+var digestInfoPrefixes = map[crypto.Hash][]byte{
+	crypto.SHA1:   {0x30, 0x21, 0x30, 0x09, 0x06, 0x05, 0x2b, 0x0e, 0x03, 0x02, 0x1a, 0x05, 0x00, 0x04, 0x14},
+	crypto.SHA224: {0x30, 0x2d, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x04, 0x05, 0x00, 0x04, 0x1c},
+	crypto.SHA256: {0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x01, 0x05, 0x00, 0x04, 0x20},
+	crypto.SHA384: {0x30, 0x41, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x02, 0x05, 0x00, 0x04, 0x30},
+	crypto.SHA512: {0x30, 0x51, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x03, 0x05, 0x00, 0x04, 0x40},
+}
+
+// pssMechanismParams maps a hash to the CK_RSA_PKCS_PSS_PARAMS hash and MGF values.
+var pssMechanismParams = map[crypto.Hash]struct {
+	hashMech uint
+	mgf      uint
+}{
+	crypto.SHA256: {pkcs11.CKM_SHA256, pkcs11.CKG_MGF1_SHA256},
+	crypto.SHA384: {pkcs11.CKM_SHA384, pkcs11.CKG_MGF1_SHA384},
+	crypto.SHA512: {pkcs11.CKM_SHA512, pkcs11.CKG_MGF1_SHA512},
+}
+
 type softHSMKeyPairRepository struct {
-	ctx     *pkcs11.Ctx
-	slot    uint
-	pin     string
-	session pkcs11.SessionHandle
+	ctx        *pkcs11.Ctx
+	modulePath string
+	slot       uint
+	pin        string
+	poolSize   int
+
+	// poolMu guards the fields replaced when the repository reconnects.
+	poolMu     sync.RWMutex
+	pool       *sessionPool // nil while the token is unreachable
+	generation uint64
+	reconnects uint64
+	lastErr    error
+	closed     bool // set by Finalize; the sessions are never reopened
+	// reconnectMu serializes reconnect attempts and Finalize, which clears pin.
+	reconnectMu sync.Mutex
+
+	// keys caches the object handles of private keys by label so that
+	// GetSigner does not search the token on every request.
+	keysMu sync.RWMutex
+	keys   map[string]cachedKey
+}
+
+// cachedKey is a private key handle together with its public key.
+type cachedKey struct {
+	privHandle pkcs11.ObjectHandle
+	publicKey  crypto.PublicKey
+	disabled   bool // CKA_SIGN is false
 }
 
 type softHSMSigner struct {
-	ctx        *pkcs11.Ctx
-	session    pkcs11.SessionHandle
+	repo       *softHSMKeyPairRepository
+	label      string
 	privHandle pkcs11.ObjectHandle
-	publicKey  *rsa.PublicKey
+	publicKey  crypto.PublicKey
 }
 
 // Public returns the public key associated with the signer.
@@ -47,67 +124,136 @@ func (s *softHSMSigner) Public() crypto.PublicKey {
 }
 
 // Sign signs the given digest using the private key.
+// For RSA keys opts selects the padding: *rsa.PSSOptions uses CKM_RSA_PKCS_PSS,
+// anything else uses PKCS#1 v1.5 with the DigestInfo of opts.HashFunc().
 func (s *softHSMSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
-	// Always use CKM_RSA_PKCS but prepare the data correctly.
+	if _, ok := s.publicKey.(*ecdsa.PublicKey); ok {
+		return s.signECDSA(digest)
+	}
+
+	hash := crypto.Hash(0)
+	if opts != nil {
+		hash = opts.HashFunc()
+	}
+	if hash != 0 && len(digest) != hash.Size() {
+		return nil, fmt.Errorf("digest length %d does not match hash %s", len(digest), hash)
+	}
+
+	if pssOpts, ok := opts.(*rsa.PSSOptions); ok {
+		return s.signPSS(digest, hash, pssOpts)
+	}
+
 	mechanism := []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS, nil)}
 
-	// This is a pre-computed SHA256 hash from x509.CreateCertificate.
-	// We need to add the DigestInfo structure for PKCS#1 v1.5 padding.
-	// SHA256 DigestInfo: 30 31 30 0d 06 09 60 86 48 01 65 03 04 02 01 05 00 04 20 + hash.
-	if len(digest) == 32 {
-		// Prepend DigestInfo for SHA256
-		digestInfo := []byte{0x30, 0x31, 0x30, 0x0d, 0x06, 0x09, 0x60, 0x86, 0x48, 0x01, 0x65, 0x03, 0x04, 0x02, 0x01, 0x05, 0x00, 0x04, 0x20}
-		fullDigest := append(digestInfo, digest...)
-		digest = fullDigest
+	// CKM_RSA_PKCS only applies the PKCS#1 v1.5 padding, so the DigestInfo
+	// structure for the hash has to be prepended here.
+	// For raw data (hash == 0), use as-is.
+	if hash != 0 {
+		prefix, ok := digestInfoPrefixes[hash]
+		if !ok {
+			return nil, fmt.Errorf("unsupported hash function: %s", hash)
+		}
+		digest = append(append([]byte{}, prefix...), digest...)
 	}
-	// For raw data or other cases, use as-is.
 
-	err := s.ctx.SignInit(s.session, mechanism, s.privHandle)
-	if err != nil {
-		return nil, fmt.Errorf("failed to init sign: %v", err)
+	return s.sign(mechanism, digest)
+}
+
+// sign runs a single-part signature operation on a session from the pool.
+func (s *softHSMSigner) sign(mechanism []*pkcs11.Mechanism, data []byte) ([]byte, error) {
+	var signature []byte
+	err := s.repo.withSession(func(session pkcs11.SessionHandle) error {
+		err := s.repo.ctx.SignInit(session, mechanism, s.privHandle)
+		if err != nil {
+			return fmt.Errorf("failed to init sign: %w", err)
+		}
+		signature, err = s.repo.ctx.Sign(session, data)
+		if err != nil {
+			return fmt.Errorf("failed to sign data: %w", err)
+		}
+		return nil
+	})
+	if isHandleError(err) {
+		// The key was removed or recreated on the token; look it up again next time.
+		s.repo.forgetKey(s.label)
 	}
+	return signature, err
+}
 
-	signature, err := s.ctx.Sign(s.session, digest)
-	if err != nil {
-		return nil, fmt.Errorf("failed to sign data: %v", err)
+// signPSS signs a pre-computed digest with CKM_RSA_PKCS_PSS.
+func (s *softHSMSigner) signPSS(digest []byte, hash crypto.Hash, opts *rsa.PSSOptions) ([]byte, error) {
+	params, ok := pssMechanismParams[hash]
+	if !ok {
+		return nil, fmt.Errorf("unsupported hash function for RSA-PSS: %s", hash)
+	}
+
+	pub := s.publicKey.(*rsa.PublicKey)
+	saltLength := opts.SaltLength
+	switch saltLength {
+	case rsa.PSSSaltLengthEqualsHash:
+		saltLength = hash.Size()
+	case rsa.PSSSaltLengthAuto:
+		saltLength = (pub.N.BitLen()-1+7)/8 - 2 - hash.Size()
+	}
+	if saltLength < 0 {
+		return nil, fmt.Errorf("invalid RSA-PSS salt length: %d", saltLength)
 	}
 
-	return signature, nil
+	mechanism := []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS_PSS,
+		pkcs11.NewPSSParams(params.hashMech, params.mgf, uint(saltLength)))}
+	return s.sign(mechanism, digest)
 }
 
-func (s *softHSMSigner) SignRaw(data []byte) ([]byte, error) {
-	// Always use CKM_RSA_PKCS for direct signing
-	mechanism := []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS, nil)}
-	err := s.ctx.SignInit(s.session, mechanism, s.privHandle)
+// signECDSA signs a pre-computed digest with CKM_ECDSA and converts the raw
+// r||s output of the token into the DER form expected by crypto.Signer callers.
+func (s *softHSMSigner) signECDSA(digest []byte) ([]byte, error) {
+	mechanism := []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_ECDSA, nil)}
+	raw, err := s.sign(mechanism, digest)
 	if err != nil {
-		return nil, fmt.Errorf("failed to init sign: %v", err)
+		return nil, err
 	}
-	signature, err := s.ctx.Sign(s.session, data)
-	if err != nil {
-		return nil, fmt.Errorf("failed to sign data: %v", err)
+	if len(raw) == 0 || len(raw)%2 != 0 {
+		return nil, fmt.Errorf("invalid ECDSA signature length: %d", len(raw))
 	}
-	return signature, nil
+
+	half := len(raw) / 2
+	return asn1.Marshal(struct {
+		R, S *big.Int
+	}{
+		R: new(big.Int).SetBytes(raw[:half]),
+		S: new(big.Int).SetBytes(raw[half:]),
+	})
 }
 
-func NewSoftHsmKeyPairRepository(modulePath, slot, pin string) (KeyPairRepository, error) {
-	ctx := pkcs11.New(modulePath)
-	if ctx == nil {
-		return nil, pkcs11.Error(pkcs11.CKR_GENERAL_ERROR)
+// NewSoftHsmKeyPairRepository loads the PKCS#11 module, logs in to the token in
+// slot with the PIN pinRef resolves to (see ResolvePin) and keeps poolSize
+// sessions open for concurrent operations. Repositories for different slots of
+// the same module share one module context.
+func NewSoftHsmKeyPairRepository(modulePath, slot, pinRef string, poolSize int) (KeyPairRepository, error) {
+	pin, err := ResolvePin(pinRef)
+	if err != nil {
+		return nil, err
 	}
+	return NewSoftHsmKeyPairRepositoryWithPin(modulePath, slot, pin, poolSize)
+}
 
+// NewSoftHsmKeyPairRepositoryWithPin is NewSoftHsmKeyPairRepository for a PIN
+// that was not read through a reference, such as one recombined in a key ceremony.
+func NewSoftHsmKeyPairRepositoryWithPin(modulePath, slot, pin string, poolSize int) (KeyPairRepository, error) {
 	// Parse slot string to uint.
 	slotID, err := strconv.ParseUint(slot, 10, 32)
 	if err != nil {
 		return nil, err
 	}
 
-	err = ctx.Initialize()
+	ctx, err := openModule(modulePath)
 	if err != nil {
 		return nil, err
 	}
 
 	slots, err := ctx.GetSlotList(true)
 	if err != nil {
+		closeModule(modulePath)
 		return nil, err
 	}
 
@@ -121,90 +267,140 @@ func NewSoftHsmKeyPairRepository(modulePath, slot, pin string) (KeyPairRepositor
 		}
 	}
 	if !found {
+		closeModule(modulePath)
 		return nil, errors.New("slot not found")
 	}
 
-	session, err := ctx.OpenSession(targetSlot, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
-	if err != nil {
-		return nil, err
+	if poolSize <= 0 {
+		poolSize = DefaultSessionPoolSize
 	}
-
-	err = ctx.Login(session, pkcs11.CKU_USER, pin)
+	pool, err := newSessionPool(ctx, targetSlot, poolSize, pin)
 	if err != nil {
+		closeModule(modulePath)
 		return nil, err
 	}
 
 	return &softHSMKeyPairRepository{
-		ctx:     ctx,
-		slot:    uint(slotID),
-		pin:     pin,
-		session: session,
+		ctx:        ctx,
+		modulePath: modulePath,
+		slot:       targetSlot,
+		pin:        pin,
+		poolSize:   poolSize,
+		pool:       pool,
+		keys:       make(map[string]cachedKey),
 	}, nil
 }
 
-func (r *softHSMKeyPairRepository) GenerateKeyPair(id string) (model.KeyPairData, error) {
-	pubTemplate := []*pkcs11.Attribute{
+// keyPairTemplates returns the generation mechanism and the public/private key
+// templates for the requested algorithm and policy.
+func keyPairTemplates(id string, algorithm model.KeyAlgorithm, policy model.KeyPolicy) (*pkcs11.Mechanism, []*pkcs11.Attribute, []*pkcs11.Attribute, error) {
+	var (
+		mechanism   *pkcs11.Mechanism
+		keyType     uint
+		pubTemplate []*pkcs11.Attribute
+	)
+
+	switch algorithm {
+	case model.KeyAlgorithmRSA2048, model.KeyAlgorithmRSA3072, model.KeyAlgorithmRSA4096:
+		bits := map[model.KeyAlgorithm]int{
+			model.KeyAlgorithmRSA2048: 2048,
+			model.KeyAlgorithmRSA3072: 3072,
+			model.KeyAlgorithmRSA4096: 4096,
+		}[algorithm]
+		mechanism = pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS_KEY_PAIR_GEN, nil)
+		keyType = pkcs11.CKK_RSA
+		pubTemplate = []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_ENCRYPT, policy.Decrypt),
+			pkcs11.NewAttribute(pkcs11.CKA_MODULUS_BITS, bits),
+			pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, []byte{1, 0, 1}),
+		}
+	case model.KeyAlgorithmECP256, model.KeyAlgorithmECP384:
+		oid := oidNamedCurveP256
+		if algorithm == model.KeyAlgorithmECP384 {
+			oid = oidNamedCurveP384
+		}
+		ecParams, err := asn1.Marshal(oid)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("failed to encode EC params: %w", err)
+		}
+		mechanism = pkcs11.NewMechanism(pkcs11.CKM_EC_KEY_PAIR_GEN, nil)
+		keyType = pkcs11.CKK_EC
+		pubTemplate = []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, ecParams),
+		}
+	default:
+		return nil, nil, nil, fmt.Errorf("unsupported key algorithm: %s", algorithm)
+	}
+
+	pubTemplate = append(pubTemplate,
 		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PUBLIC_KEY),
-		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_RSA),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, keyType),
 		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
 		pkcs11.NewAttribute(pkcs11.CKA_VERIFY, true),
-		pkcs11.NewAttribute(pkcs11.CKA_ENCRYPT, true),
 		pkcs11.NewAttribute(pkcs11.CKA_WRAP, false),
-		pkcs11.NewAttribute(pkcs11.CKA_MODULUS_BITS, 2048),
-		pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, []byte{1, 0, 1}),
 		pkcs11.NewAttribute(pkcs11.CKA_LABEL, id),
 		pkcs11.NewAttribute(pkcs11.CKA_ID, []byte(id)),
-	}
+	)
 	privTemplate := []*pkcs11.Attribute{
 		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
-		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_RSA),
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, keyType),
 		pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
 		pkcs11.NewAttribute(pkcs11.CKA_SIGN, true),
-		pkcs11.NewAttribute(pkcs11.CKA_DECRYPT, true),
 		pkcs11.NewAttribute(pkcs11.CKA_LABEL, id),
 		pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, true),
 		pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
 		pkcs11.NewAttribute(pkcs11.CKA_WRAP_WITH_TRUSTED, false),
 		pkcs11.NewAttribute(pkcs11.CKA_UNWRAP, false),
-		pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, true),
+		pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, policy.Extractable),
 		pkcs11.NewAttribute(pkcs11.CKA_ID, []byte(id)),
 	}
-
-	pubHandle, _, err := r.ctx.GenerateKeyPair(r.session, 
-		[]*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_RSA_PKCS_KEY_PAIR_GEN, nil)}, 
-		pubTemplate, privTemplate)
-	if err != nil {
-		return model.KeyPairData{}, fmt.Errorf("failed to generate key pair: %v", err)
+	if keyType == pkcs11.CKK_RSA {
+		privTemplate = append(privTemplate, pkcs11.NewAttribute(pkcs11.CKA_DECRYPT, policy.Decrypt))
 	}
 
-	// Get public key components.
-	pubKeyAttr := []*pkcs11.Attribute{
-		pkcs11.NewAttribute(pkcs11.CKA_MODULUS, nil),
-		pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, nil),
-	}
+	return mechanism, pubTemplate, privTemplate, nil
+}
 
-	attrs, err := r.ctx.GetAttributeValue(r.session, pubHandle, pubKeyAttr)
+func (r *softHSMKeyPairRepository) GenerateKeyPair(id string, algorithm model.KeyAlgorithm, policy model.KeyPolicy) (model.KeyPairData, error) {
+	mechanism, pubTemplate, privTemplate, err := keyPairTemplates(id, algorithm, policy)
 	if err != nil {
-		return model.KeyPairData{}, fmt.Errorf("failed to get public key attributes: %v", err)
+		return model.KeyPairData{}, err
 	}
 
-	// Create RSA public key from modulus and exponent.
-	pubKey := &rsa.PublicKey{
-		N: new(big.Int).SetBytes(attrs[0].Value),
-		E: int(new(big.Int).SetBytes(attrs[1].Value).Int64()),
-	}
+	var pubKey crypto.PublicKey
+	err = r.withSession(func(session pkcs11.SessionHandle) error {
+		// A second key under the label would make lookups by label ambiguous
+		existing, err := r.findObject(session, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+			pkcs11.NewAttribute(pkcs11.CKA_LABEL, id),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to search private key: %w", err)
+		}
+		if existing != nil {
+			return fmt.Errorf("%w: %s", model.ErrKeyExists, id)
+		}
 
-	// Encode public key in PKCS1 format.
-	pubKeyPEM := pem.EncodeToMemory(&pem.Block{
-		Type:  "RSA PUBLIC KEY",
-		Bytes: x509.MarshalPKCS1PublicKey(pubKey),
+		pubHandle, _, err := r.ctx.GenerateKeyPair(session,
+			[]*pkcs11.Mechanism{mechanism},
+			pubTemplate, privTemplate)
+		if err != nil {
+			return fmt.Errorf("failed to generate key pair: %w", err)
+		}
+
+		pubKey, err = r.publicKeyFromHandle(session, pubHandle)
+		if err != nil {
+			return fmt.Errorf("failed to get public key attributes: %w", err)
+		}
+		return nil
 	})
+	if err != nil {
+		return model.KeyPairData{}, err
+	}
+	// A key with the same label may have been cached before.
+	r.forgetKey(id)
 
-	return model.KeyPairData{
-		ID:        id,
-		PublicKey: string(pubKeyPEM),
-		KeyLabel:  id,
-	}, nil
+	return newKeyPairData(id, pubKey)
 }
 
 func (r *softHSMKeyPairRepository) FindByID(id string) (model.KeyPairData, error) {
@@ -212,124 +408,283 @@ func (r *softHSMKeyPairRepository) FindByID(id string) (model.KeyPairData, error
 		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PUBLIC_KEY),
 		pkcs11.NewAttribute(pkcs11.CKA_ID, []byte(id)),
 	}
-	err := r.ctx.FindObjectsInit(r.session, template)
-	if err != nil {
-		return model.KeyPairData{}, err
-	}
-	objs, _, err := r.ctx.FindObjects(r.session, 1)
-	if err != nil || len(objs) == 0 {
-		return model.KeyPairData{}, errors.New("key not found")
-	}
-	err = r.ctx.FindObjectsFinal(r.session)
-	if err != nil {
-		return model.KeyPairData{}, err
-	}
+	var pubKey crypto.PublicKey
+	err := r.withSession(func(session pkcs11.SessionHandle) error {
+		handle, err := r.findObject(session, template)
+		if err != nil {
+			return err
+		}
+		if handle == nil {
+			return fmt.Errorf("%w: %s", model.ErrKeyNotFound, id)
+		}
 
-	// Get public key attributes.
-	pubKeyAttr := []*pkcs11.Attribute{
-		pkcs11.NewAttribute(pkcs11.CKA_MODULUS, nil),
-		pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, nil),
-	}
-	attrs, err := r.ctx.GetAttributeValue(r.session, objs[0], pubKeyAttr)
+		pubKey, err = r.publicKeyFromHandle(session, *handle)
+		return err
+	})
 	if err != nil {
 		return model.KeyPairData{}, err
 	}
 
-	// Create RSA public key from modulus and exponent.
-	pubKey := &rsa.PublicKey{
-		N: new(big.Int).SetBytes(attrs[0].Value),
-		E: int(new(big.Int).SetBytes(attrs[1].Value).Int64()),
-	}
-
-	pubKeyPEM := pem.EncodeToMemory(&pem.Block{
-		Type:  "RSA PUBLIC KEY",
-		Bytes: x509.MarshalPKCS1PublicKey(pubKey),
-	})
-
-	return model.KeyPairData{
-		ID:        id,
-		PublicKey: string(pubKeyPEM),
-		KeyLabel:  id,
-	}, nil
+	return newKeyPairData(id, pubKey)
 }
 
 func (r *softHSMKeyPairRepository) GetSigner(keyLabel string) (crypto.Signer, error) {
-	// Find private key.
-	privTemplate := []*pkcs11.Attribute{
-		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
-		pkcs11.NewAttribute(pkcs11.CKA_LABEL, keyLabel),
-	}
-	err := r.ctx.FindObjectsInit(r.session, privTemplate)
+	key, err := r.lookupKey(keyLabel)
 	if err != nil {
-		return nil, fmt.Errorf("failed to init private key search: %v", err)
+		return nil, err
 	}
-	privObjs, _, err := r.ctx.FindObjects(r.session, 1)
-	if err != nil || len(privObjs) == 0 {
-		r.ctx.FindObjectsFinal(r.session)
-		return nil, errors.New("private key not found")
+	if key.disabled {
+		return nil, fmt.Errorf("%w: %s", model.ErrKeyDisabled, keyLabel)
 	}
-	err = r.ctx.FindObjectsFinal(r.session)
+
+	return &softHSMSigner{
+		repo:       r,
+		label:      keyLabel,
+		privHandle: key.privHandle,
+		publicKey:  key.publicKey,
+	}, nil
+}
+
+// lookupKey returns the cached handles for a key label, searching the token on a miss.
+func (r *softHSMKeyPairRepository) lookupKey(keyLabel string) (cachedKey, error) {
+	r.keysMu.RLock()
+	key, ok := r.keys[keyLabel]
+	r.keysMu.RUnlock()
+	if ok {
+		return key, nil
+	}
+
+	err := r.withSession(func(session pkcs11.SessionHandle) error {
+		// Find private key.
+		privHandle, err := r.findObject(session, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PRIVATE_KEY),
+			pkcs11.NewAttribute(pkcs11.CKA_LABEL, keyLabel),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to search private key: %w", err)
+		}
+		if privHandle == nil {
+			return fmt.Errorf("%w: %s", model.ErrKeyNotFound, keyLabel)
+		}
+
+		// Get private key ID and whether it may sign.
+		attrs, err := r.ctx.GetAttributeValue(session, *privHandle, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_ID, nil),
+			pkcs11.NewAttribute(pkcs11.CKA_SIGN, nil),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to get private key ID: %w", err)
+		}
+
+		// Find corresponding public key using the same ID.
+		pubHandle, err := r.findObject(session, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PUBLIC_KEY),
+			pkcs11.NewAttribute(pkcs11.CKA_ID, attrs[0].Value),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to search public key: %w", err)
+		}
+		if pubHandle == nil {
+			return errors.New("matching public key not found")
+		}
+
+		publicKey, err := r.publicKeyFromHandle(session, *pubHandle)
+		if err != nil {
+			return fmt.Errorf("failed to get public key attributes: %w", err)
+		}
+
+		key = cachedKey{privHandle: *privHandle, publicKey: publicKey, disabled: !attributeBool(attrs[1].Value)}
+		return nil
+	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to finalize private key search: %v", err)
+		return cachedKey{}, err
 	}
-	privHandle := privObjs[0]
 
-	// Get private key ID.
-	privAttrs := []*pkcs11.Attribute{
-		pkcs11.NewAttribute(pkcs11.CKA_ID, nil),
+	r.keysMu.Lock()
+	r.keys[keyLabel] = key
+	r.keysMu.Unlock()
+	return key, nil
+}
+
+// forgetKey drops a label from the handle cache.
+func (r *softHSMKeyPairRepository) forgetKey(keyLabel string) {
+	r.keysMu.Lock()
+	delete(r.keys, keyLabel)
+	r.keysMu.Unlock()
+}
+
+// findObject returns the first object matching template, or nil if there is none.
+func (r *softHSMKeyPairRepository) findObject(session pkcs11.SessionHandle, template []*pkcs11.Attribute) (*pkcs11.ObjectHandle, error) {
+	if err := r.ctx.FindObjectsInit(session, template); err != nil {
+		return nil, err
+	}
+	objs, _, err := r.ctx.FindObjects(session, 1)
+	if finalErr := r.ctx.FindObjectsFinal(session); err == nil {
+		err = finalErr
 	}
-	attrs, err := r.ctx.GetAttributeValue(r.session, privHandle, privAttrs)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get private key ID: %v", err)
+		return nil, err
+	}
+	if len(objs) == 0 {
+		return nil, nil
 	}
-	keyID := attrs[0].Value
+	return &objs[0], nil
+}
 
-	// Find corresponding public key using the same ID.
-	pubTemplate := []*pkcs11.Attribute{
-		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_PUBLIC_KEY),
-		pkcs11.NewAttribute(pkcs11.CKA_ID, keyID),
+// isHandleError reports whether err means a cached object handle is no longer valid.
+func isHandleError(err error) bool {
+	var p11Err pkcs11.Error
+	if !errors.As(err, &p11Err) {
+		return false
 	}
-	err = r.ctx.FindObjectsInit(r.session, pubTemplate)
+	return p11Err == pkcs11.CKR_OBJECT_HANDLE_INVALID || p11Err == pkcs11.CKR_KEY_HANDLE_INVALID
+}
+
+// publicKeyFromHandle reads a public key object from the token and converts it
+// into an *rsa.PublicKey or *ecdsa.PublicKey depending on CKA_KEY_TYPE.
+func (r *softHSMKeyPairRepository) publicKeyFromHandle(session pkcs11.SessionHandle, handle pkcs11.ObjectHandle) (crypto.PublicKey, error) {
+	attrs, err := r.ctx.GetAttributeValue(session, handle, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, nil),
+	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to init public key search: %v", err)
+		return nil, err
 	}
-	pubObjs, _, err := r.ctx.FindObjects(r.session, 1)
-	if err != nil || len(pubObjs) == 0 {
-		r.ctx.FindObjectsFinal(r.session)
-		return nil, errors.New("matching public key not found")
+	keyType := attributeUint(attrs[0].Value)
+
+	switch keyType {
+	case pkcs11.CKK_RSA:
+		attrs, err = r.ctx.GetAttributeValue(session, handle, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_MODULUS, nil),
+			pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, nil),
+		})
+		if err != nil {
+			return nil, err
+		}
+		// Create RSA public key from modulus and exponent.
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(attrs[0].Value),
+			E: int(new(big.Int).SetBytes(attrs[1].Value).Int64()),
+		}, nil
+	case pkcs11.CKK_EC:
+		attrs, err = r.ctx.GetAttributeValue(session, handle, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_EC_PARAMS, nil),
+			pkcs11.NewAttribute(pkcs11.CKA_EC_POINT, nil),
+		})
+		if err != nil {
+			return nil, err
+		}
+		return ecPublicKey(attrs[0].Value, attrs[1].Value)
+	default:
+		return nil, fmt.Errorf("unsupported key type: %d", keyType)
 	}
-	err = r.ctx.FindObjectsFinal(r.session)
-	if err != nil {
-		return nil, fmt.Errorf("failed to finalize public key search: %v", err)
+}
+
+// ecPublicKey builds an ECDSA public key from CKA_EC_PARAMS and CKA_EC_POINT.
+func ecPublicKey(params, point []byte) (*ecdsa.PublicKey, error) {
+	var oid asn1.ObjectIdentifier
+	if _, err := asn1.Unmarshal(params, &oid); err != nil {
+		return nil, fmt.Errorf("failed to parse EC params: %w", err)
+	}
+	var curve elliptic.Curve
+	switch {
+	case oid.Equal(oidNamedCurveP256):
+		curve = elliptic.P256()
+	case oid.Equal(oidNamedCurveP384):
+		curve = elliptic.P384()
+	default:
+		return nil, fmt.Errorf("unsupported EC curve: %s", oid)
+	}
+
+	// CKA_EC_POINT is a DER OCTET STRING wrapping the uncompressed point,
+	// although some modules return the bare point.
+	var raw []byte
+	if rest, err := asn1.Unmarshal(point, &raw); err != nil || len(rest) != 0 {
+		raw = point
+	}
+	x, y := elliptic.Unmarshal(curve, raw)
+	if x == nil {
+		return nil, errors.New("invalid EC point")
+	}
+	return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+}
+
+// attributeUint decodes a CK_ULONG attribute value, which the token returns in native byte order.
+func attributeUint(b []byte) uint64 {
+	switch len(b) {
+	case 8:
+		return binary.NativeEndian.Uint64(b)
+	case 4:
+		return uint64(binary.NativeEndian.Uint32(b))
 	}
+	return 0
+}
 
-	// Get public key attributes.
-	pubKeyAttr := []*pkcs11.Attribute{
-		pkcs11.NewAttribute(pkcs11.CKA_MODULUS, nil),
-		pkcs11.NewAttribute(pkcs11.CKA_PUBLIC_EXPONENT, nil),
+// KeyAlgorithmOf returns the key algorithm matching a public key.
+func KeyAlgorithmOf(pub crypto.PublicKey) (model.KeyAlgorithm, error) {
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		switch k.N.BitLen() {
+		case 2048:
+			return model.KeyAlgorithmRSA2048, nil
+		case 3072:
+			return model.KeyAlgorithmRSA3072, nil
+		case 4096:
+			return model.KeyAlgorithmRSA4096, nil
+		}
+		return "", fmt.Errorf("unsupported RSA key size: %d", k.N.BitLen())
+	case *ecdsa.PublicKey:
+		switch k.Curve {
+		case elliptic.P256():
+			return model.KeyAlgorithmECP256, nil
+		case elliptic.P384():
+			return model.KeyAlgorithmECP384, nil
+		}
+		return "", fmt.Errorf("unsupported EC curve: %s", k.Curve.Params().Name)
 	}
-	attrs, err = r.ctx.GetAttributeValue(r.session, pubObjs[0], pubKeyAttr)
+	return "", fmt.Errorf("unsupported public key type: %T", pub)
+}
+
+// newKeyPairData encodes a public key as PKIX PEM together with its label.
+func newKeyPairData(id string, pub crypto.PublicKey) (model.KeyPairData, error) {
+	algorithm, err := KeyAlgorithmOf(pub)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get public key attributes: %v", err)
+		return model.KeyPairData{}, err
 	}
-
-	// Create RSA public key.
-	publicKey := &rsa.PublicKey{
-		N: new(big.Int).SetBytes(attrs[0].Value),
-		E: int(new(big.Int).SetBytes(attrs[1].Value).Int64()),
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return model.KeyPairData{}, fmt.Errorf("failed to marshal public key: %w", err)
 	}
+	pubKeyPEM := pem.EncodeToMemory(&pem.Block{
+		Type:  "PUBLIC KEY",
+		Bytes: der,
+	})
 
-	return &softHSMSigner{
-		ctx:        r.ctx,
-		session:    r.session,
-		privHandle: privHandle,
-		publicKey:  publicKey,
+	return model.KeyPairData{
+		ID:        id,
+		Algorithm: algorithm,
+		PublicKey: string(pubKeyPEM),
+		KeyLabel:  id,
 	}, nil
 }
 
+// Finalize closes the sessions and releases the module. Later operations
+// fail with model.ErrTokenClosed instead of logging in again.
 func (r *softHSMKeyPairRepository) Finalize() {
-	r.ctx.Logout(r.session)
-	r.ctx.CloseSession(r.session)
-	r.ctx.Finalize()
-	r.ctx.Destroy()
+	// Wait for a reconnect in progress so that no session is opened on a
+	// destroyed module.
+	r.reconnectMu.Lock()
+	defer r.reconnectMu.Unlock()
+	r.poolMu.Lock()
+	if r.closed {
+		r.poolMu.Unlock()
+		return
+	}
+	r.closed = true
+	r.pin = ""
+	if r.pool != nil {
+		r.pool.close()
+		r.pool = nil
+	}
+	r.poolMu.Unlock()
+	closeModule(r.modulePath)
 }
@@ -0,0 +1,63 @@
+package repository
+
+import (
+	"sync"
+
+	"github.com/miekg/pkcs11"
+)
+
+// A PKCS#11 module may only be initialized once per process, and C_Finalize
+// tears down every session opened through it. Tokens served by the same
+// module therefore share one context, which is finalized when the last
+// repository using it is closed.
+var modules = struct {
+	sync.Mutex
+	loaded map[string]*module
+}{loaded: make(map[string]*module)}
+
+type module struct {
+	ctx  *pkcs11.Ctx
+	refs int
+}
+
+// openModule returns the initialized context for modulePath, loading the
+// module on first use.
+func openModule(modulePath string) (*pkcs11.Ctx, error) {
+	modules.Lock()
+	defer modules.Unlock()
+
+	if m, ok := modules.loaded[modulePath]; ok {
+		m.refs++
+		return m.ctx, nil
+	}
+
+	ctx := pkcs11.New(modulePath)
+	if ctx == nil {
+		return nil, pkcs11.Error(pkcs11.CKR_GENERAL_ERROR)
+	}
+	if err := ctx.Initialize(); err != nil && err != pkcs11.Error(pkcs11.CKR_CRYPTOKI_ALREADY_INITIALIZED) {
+		ctx.Destroy()
+		return nil, err
+	}
+	modules.loaded[modulePath] = &module{ctx: ctx, refs: 1}
+	return ctx, nil
+}
+
+// closeModule releases one reference to modulePath and finalizes the module
+// once no repository uses it any more.
+func closeModule(modulePath string) {
+	modules.Lock()
+	defer modules.Unlock()
+
+	m, ok := modules.loaded[modulePath]
+	if !ok {
+		return
+	}
+	m.refs--
+	if m.refs > 0 {
+		return
+	}
+	delete(modules.loaded, modulePath)
+	m.ctx.Finalize()
+	m.ctx.Destroy()
+}
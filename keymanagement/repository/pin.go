@@ -0,0 +1,127 @@
+package repository
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// PinProvider resolves a PIN reference of the form "scheme:value". It is
+// called with the value part only.
+type PinProvider interface {
+	ResolvePin(value string) (string, error)
+}
+
+// PinProviderFunc adapts a function to PinProvider.
+type PinProviderFunc func(value string) (string, error)
+
+func (f PinProviderFunc) ResolvePin(value string) (string, error) {
+	return f(value)
+}
+
+var pinProviders = struct {
+	sync.RWMutex
+	byScheme map[string]PinProvider
+}{byScheme: map[string]PinProvider{
+	"env":   PinProviderFunc(envPin),
+	"file":  PinProviderFunc(filePin),
+	"stdin": PinProviderFunc(stdinPin),
+}}
+
+// RegisterPinProvider makes references with the given scheme (e.g. "vault")
+// resolve through provider. It replaces any provider registered for scheme.
+func RegisterPinProvider(scheme string, provider PinProvider) {
+	pinProviders.Lock()
+	defer pinProviders.Unlock()
+	pinProviders.byScheme[scheme] = provider
+}
+
+// ResolvePin returns the PIN a reference points to. Built-in schemes are
+//
+//	env:NAME    the environment variable NAME
+//	file:PATH   the first line of PATH, which must not be accessible by group or others
+//	stdin:LABEL a line read from standard input, prompting with LABEL
+func ResolvePin(ref string) (string, error) {
+	scheme, value, ok := strings.Cut(ref, ":")
+	if !ok || scheme == "" {
+		// Do not echo ref, it may be a PIN pasted in by mistake.
+		return "", errors.New("invalid PIN reference: expected scheme:value, e.g. env:SOFTHSM_PIN")
+	}
+
+	pinProviders.RLock()
+	provider, ok := pinProviders.byScheme[scheme]
+	pinProviders.RUnlock()
+	if !ok {
+		return "", fmt.Errorf("unsupported PIN reference scheme %q", scheme)
+	}
+
+	pin, err := provider.ResolvePin(value)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve %s PIN reference: %w", scheme, err)
+	}
+	if pin == "" {
+		return "", fmt.Errorf("PIN reference %s:%s resolved to an empty PIN", scheme, value)
+	}
+	return pin, nil
+}
+
+func envPin(name string) (string, error) {
+	if name == "" {
+		return "", errors.New("environment variable name is empty")
+	}
+	pin, ok := os.LookupEnv(name)
+	if !ok {
+		return "", fmt.Errorf("environment variable %s is not set", name)
+	}
+	return pin, nil
+}
+
+// filePin reads a PIN file, refusing files that other users could read or
+// replace.
+func filePin(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if !info.Mode().IsRegular() {
+		return "", fmt.Errorf("%s is not a regular file", path)
+	}
+	if perm := info.Mode().Perm(); perm&0o077 != 0 {
+		return "", fmt.Errorf("%s has permissions %#o, must not be accessible by group or others (chmod 600)", path, perm)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	pin, _, _ := strings.Cut(string(data), "\n")
+	return strings.TrimSuffix(pin, "\r"), nil
+}
+
+// stdin is shared by every stdin: reference so that buffered input for a
+// later token is not lost.
+var stdin = struct {
+	sync.Mutex
+	reader *bufio.Reader
+}{reader: bufio.NewReader(os.Stdin)}
+
+// stdinPin reads one line from standard input. It is meant for startup, with
+// the PIN typed by an operator or piped in by a service manager.
+func stdinPin(label string) (string, error) {
+	stdin.Lock()
+	defer stdin.Unlock()
+
+	if label == "" {
+		label = "token"
+	}
+	fmt.Fprintf(os.Stderr, "Enter PIN for %s: ", label)
+	line, err := stdin.reader.ReadString('\n')
+	if err != nil && (line == "" || !errors.Is(err, io.EOF)) {
+		return "", fmt.Errorf("failed to read PIN from stdin: %w", err)
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
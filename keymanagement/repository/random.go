@@ -0,0 +1,28 @@
+package repository
+
+import (
+	"fmt"
+
+	"github.com/miekg/pkcs11"
+)
+
+// GenerateRandom returns length bytes from the token's random number
+// generator (C_GenerateRandom).
+func (r *softHSMKeyPairRepository) GenerateRandom(length int) ([]byte, error) {
+	var random []byte
+	err := r.withSession(func(session pkcs11.SessionHandle) error {
+		var err error
+		random, err = r.ctx.GenerateRandom(session, length)
+		if err != nil {
+			return fmt.Errorf("C_GenerateRandom failed: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(random) != length {
+		return nil, fmt.Errorf("C_GenerateRandom returned %d bytes, want %d", len(random), length)
+	}
+	return random, nil
+}
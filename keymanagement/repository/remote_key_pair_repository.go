@@ -0,0 +1,265 @@
+package repository
+
+import (
+	"bytes"
+	"core-ca/keymanagement/model"
+	"crypto"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultRemoteTimeout bounds a request to the signing daemon when no timeout is configured.
+	DefaultRemoteTimeout = 10 * time.Second
+	// maxRemoteResponse bounds the size of a signing daemon response.
+	maxRemoteResponse = 1 << 20
+)
+
+// remoteKeyPairRepository serves the keys of a signing daemon (cmd/signerd)
+// on another host over the remote signer protocol, so that the HSM does not
+// have to be reachable from the host running the CA API. Keys are used and
+// inspected remotely; they are managed on the signer host.
+type remoteKeyPairRepository struct {
+	url    string
+	client *http.Client
+}
+
+// RemoteTLSConfig returns the client TLS configuration for a signing daemon
+// whose certificate chains to the CA certificates in caFile. The client
+// authenticates with the certificate and key in certFile and keyFile.
+func RemoteTLSConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	caPEM, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signer CA certificate: %w", err)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no certificate found in %s", caFile)
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load signer client certificate: %w", err)
+	}
+	return &tls.Config{
+		RootCAs:      roots,
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// NewRemoteKeyPairRepository connects to the signing daemon at url, e.g.
+// "https://signer.internal:8443", with tlsConfig (see RemoteTLSConfig) and
+// checks that the daemon's token is available. Requests time out after
+// timeout, DefaultRemoteTimeout when zero.
+func NewRemoteKeyPairRepository(url string, tlsConfig *tls.Config, timeout time.Duration) (KeyPairRepository, error) {
+	if !strings.HasPrefix(url, "https://") {
+		return nil, fmt.Errorf("signer URL %q must use https", url)
+	}
+	if timeout <= 0 {
+		timeout = DefaultRemoteTimeout
+	}
+	r := &remoteKeyPairRepository{
+		url: strings.TrimSuffix(url, "/"),
+		client: &http.Client{
+			Timeout:   timeout,
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		},
+	}
+	if _, err := r.Health(); err != nil {
+		r.Finalize()
+		return nil, err
+	}
+	return r, nil
+}
+
+// call POSTs request to a signing daemon operation and decodes the answer
+// into response. A daemon that cannot be reached makes the token unavailable.
+func (r *remoteKeyPairRepository) call(operation string, request, response any) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	resp, err := r.client.Post(r.url+"/v1/"+operation, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return &model.HSMUnavailableError{Err: err}
+	}
+	defer resp.Body.Close()
+
+	decoder := json.NewDecoder(io.LimitReader(resp.Body, maxRemoteResponse))
+	if resp.StatusCode != http.StatusOK {
+		var remoteErr model.RemoteError
+		if err := decoder.Decode(&remoteErr); err != nil || remoteErr.Message == "" {
+			return &model.HSMUnavailableError{Err: fmt.Errorf("signer answered %s to %s", resp.Status, operation)}
+		}
+		return &remoteErr
+	}
+	if err := decoder.Decode(response); err != nil {
+		return fmt.Errorf("invalid %s response from signer: %w", operation, err)
+	}
+	return nil
+}
+
+// errManagedOnSigner is returned for key management operations.
+func errManagedOnSigner(operation string) error {
+	return fmt.Errorf("%w: %s keys on the signer host", model.ErrNotSupported, operation)
+}
+
+// GenerateKeyPair generates a key pair on the signer's token. The daemon
+// refuses unless it allows key generation.
+func (r *remoteKeyPairRepository) GenerateKeyPair(id string, algorithm model.KeyAlgorithm, policy model.KeyPolicy) (model.KeyPairData, error) {
+	var keyPairData model.KeyPairData
+	err := r.call("generate", model.RemoteGenerateRequest{Label: id, Algorithm: algorithm, Policy: policy}, &keyPairData)
+	return keyPairData, err
+}
+
+// ImportKeyPair is not supported: private keys never cross the network.
+func (r *remoteKeyPairRepository) ImportKeyPair(label string, key crypto.Signer, policy model.KeyPolicy) (model.KeyPairData, error) {
+	return model.KeyPairData{}, errManagedOnSigner("import")
+}
+
+func (r *remoteKeyPairRepository) FindByID(id string) (model.KeyPairData, error) {
+	var keyPairData model.KeyPairData
+	err := r.call("key-pair", model.RemoteKeyRequest{Label: id}, &keyPairData)
+	return keyPairData, err
+}
+
+// GetSigner returns a signer for the key with the given label. The daemon
+// refuses keys that are disabled, both here and at every signature.
+func (r *remoteKeyPairRepository) GetSigner(keyLabel string) (crypto.Signer, error) {
+	var resp model.RemotePublicKeyResponse
+	if err := r.call("public-key", model.RemoteKeyRequest{Label: keyLabel}, &resp); err != nil {
+		return nil, err
+	}
+	publicKey, err := parseRemotePublicKey(resp.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	return &remoteSigner{repo: r, label: keyLabel, publicKey: publicKey}, nil
+}
+
+func (r *remoteKeyPairRepository) ListKeys() ([]model.KeyObject, error) {
+	var keys []model.KeyObject
+	err := r.call("list", struct{}{}, &keys)
+	return keys, err
+}
+
+func (r *remoteKeyPairRepository) DescribeKey(keyLabel string) (model.KeyObject, crypto.PublicKey, error) {
+	var resp model.RemoteDescribeResponse
+	if err := r.call("describe", model.RemoteKeyRequest{Label: keyLabel}, &resp); err != nil {
+		return model.KeyObject{}, nil, err
+	}
+	publicKey, err := parseRemotePublicKey(resp.PublicKey)
+	if err != nil {
+		return model.KeyObject{}, nil, err
+	}
+	return resp.Key, publicKey, nil
+}
+
+func (r *remoteKeyPairRepository) SetKeyEnabled(keyLabel string, enabled bool) error {
+	if enabled {
+		return errManagedOnSigner("enable")
+	}
+	return errManagedOnSigner("disable")
+}
+
+func (r *remoteKeyPairRepository) DestroyKeyPair(keyLabel string) error {
+	return errManagedOnSigner("destroy")
+}
+
+func (r *remoteKeyPairRepository) CreateWrappingKey(label string, value []byte) error {
+	return errManagedOnSigner("create wrapping")
+}
+
+func (r *remoteKeyPairRepository) WrapKey(keyLabel, kekLabel string) (model.KeyBackup, error) {
+	return model.KeyBackup{}, errManagedOnSigner("back up")
+}
+
+func (r *remoteKeyPairRepository) UnwrapKey(backup model.KeyBackup, kekLabel string) error {
+	return errManagedOnSigner("restore")
+}
+
+func (r *remoteKeyPairRepository) GenerateRandom(length int) ([]byte, error) {
+	var resp model.RemoteRandomResponse
+	if err := r.call("random", model.RemoteRandomRequest{Length: length}, &resp); err != nil {
+		return nil, err
+	}
+	if len(resp.Random) != length {
+		return nil, fmt.Errorf("signer returned %d random bytes, want %d", len(resp.Random), length)
+	}
+	return resp.Random, nil
+}
+
+// Health reports the state of the signer's token. An unreachable daemon is
+// reported like an unreachable token.
+func (r *remoteKeyPairRepository) Health() (model.HSMHealth, error) {
+	var health model.HSMHealth
+	if err := r.call("health", struct{}{}, &health); err != nil {
+		if !errors.Is(err, model.ErrHSMUnavailable) {
+			err = &model.HSMUnavailableError{Err: err}
+		}
+		return model.HSMHealth{Available: false, TokenLabel: r.url, LastError: err.Error()}, err
+	}
+	return health, nil
+}
+
+// Finalize closes the connections to the daemon.
+func (r *remoteKeyPairRepository) Finalize() {
+	r.client.CloseIdleConnections()
+}
+
+// remoteSigner signs through the signing daemon.
+type remoteSigner struct {
+	repo      *remoteKeyPairRepository
+	label     string
+	publicKey crypto.PublicKey
+}
+
+// Public returns the public key associated with the signer.
+func (s *remoteSigner) Public() crypto.PublicKey {
+	return s.publicKey
+}
+
+// Sign asks the daemon to sign digest. opts is passed on as for a local
+// token: *rsa.PSSOptions selects RSA-PSS and a zero hash signs the digest as
+// given. The daemon's token supplies the randomness; rand is not used.
+func (s *remoteSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	req := model.RemoteSignRequest{Label: s.label, Digest: digest}
+	if opts != nil && opts.HashFunc() != 0 {
+		req.Hash = opts.HashFunc().String()
+	}
+	if pssOpts, ok := opts.(*rsa.PSSOptions); ok {
+		req.PSS = true
+		req.SaltLength = pssOpts.SaltLength
+	}
+	var resp model.RemoteSignResponse
+	if err := s.repo.call("sign", req, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Signature, nil
+}
+
+// parseRemotePublicKey parses a PEM encoded PKIX public key sent by the daemon.
+func parseRemotePublicKey(publicKeyPEM string) (crypto.PublicKey, error) {
+	block, _ := pem.Decode([]byte(publicKeyPEM))
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, errors.New("signer sent no PEM public key")
+	}
+	publicKey, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("signer sent an invalid public key: %w", err)
+	}
+	if _, err := KeyAlgorithmOf(publicKey); err != nil {
+		return nil, err
+	}
+	return publicKey, nil
+}
@@ -0,0 +1,91 @@
+package repository
+
+import (
+	"fmt"
+
+	"github.com/miekg/pkcs11"
+)
+
+// DefaultSessionPoolSize is used when no pool size is configured.
+const DefaultSessionPoolSize = 4
+
+// sessionPool hands out PKCS#11 sessions so that concurrent operations never
+// share a session (SignInit/Sign and FindObjectsInit/FindObjectsFinal are
+// stateful per session). All sessions belong to the same token, so the pool
+// logs in once and every session shares that login state.
+type sessionPool struct {
+	ctx      *pkcs11.Ctx
+	slot     uint
+	sessions chan pkcs11.SessionHandle
+}
+
+// newSessionPool opens size read/write sessions on slot and logs in as CKU_USER.
+func newSessionPool(ctx *pkcs11.Ctx, slot uint, size int, pin string) (*sessionPool, error) {
+	if size <= 0 {
+		size = DefaultSessionPoolSize
+	}
+
+	p := &sessionPool{
+		ctx:      ctx,
+		slot:     slot,
+		sessions: make(chan pkcs11.SessionHandle, size),
+	}
+	for i := 0; i < size; i++ {
+		session, err := ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+		if err != nil {
+			p.close()
+			return nil, fmt.Errorf("failed to open session: %w", err)
+		}
+		p.sessions <- session
+	}
+
+	if err := p.login(pin); err != nil {
+		p.close()
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// login authenticates the token. Login state is per token, so one session is enough.
+func (p *sessionPool) login(pin string) error {
+	return p.withSession(func(session pkcs11.SessionHandle) error {
+		err := p.ctx.Login(session, pkcs11.CKU_USER, pin)
+		if err != nil && err != pkcs11.Error(pkcs11.CKR_USER_ALREADY_LOGGED_IN) {
+			return fmt.Errorf("failed to login: %w", err)
+		}
+		return nil
+	})
+}
+
+// get checks out a session, blocking until one is available.
+func (p *sessionPool) get() pkcs11.SessionHandle {
+	return <-p.sessions
+}
+
+// put returns a session to the pool.
+func (p *sessionPool) put(session pkcs11.SessionHandle) {
+	p.sessions <- session
+}
+
+// withSession runs fn with a session checked out for its whole duration.
+func (p *sessionPool) withSession(fn func(session pkcs11.SessionHandle) error) error {
+	session := p.get()
+	defer p.put(session)
+	return fn(session)
+}
+
+// idle returns the number of sessions not checked out.
+func (p *sessionPool) idle() int {
+	return len(p.sessions)
+}
+
+// close logs out and closes every session of the slot.
+func (p *sessionPool) close() {
+	select {
+	case session := <-p.sessions:
+		p.ctx.Logout(session)
+	default:
+	}
+	p.ctx.CloseAllSessions(p.slot)
+}
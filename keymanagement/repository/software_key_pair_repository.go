@@ -0,0 +1,794 @@
+package repository
+
+import (
+	"bytes"
+	"core-ca/keymanagement/model"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// Files of a software keystore directory: keystore.json holds the key
+// derivation parameters, each private key is stored in <hex label>.key and
+// each wrapping key in <hex label>.kek.
+const (
+	keystoreFile      = "keystore.json"
+	privateKeySuffix  = ".key"
+	wrappingKeySuffix = ".kek"
+	keystoreVersion   = 1
+)
+
+// scrypt parameters for new keystores.
+const (
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+// keystoreCheck is authenticated under the derived key so that a wrong
+// passphrase is reported when the keystore is opened.
+var keystoreCheck = []byte("core-ca keystore")
+
+// keystoreHeader is the content of keystore.json.
+type keystoreHeader struct {
+	Version int    `json:"version"`
+	KDF     string `json:"kdf"` // "scrypt"
+	N       int    `json:"n"`
+	R       int    `json:"r"`
+	P       int    `json:"p"`
+	Salt    []byte `json:"salt"`
+	Nonce   []byte `json:"nonce"`
+	Check   []byte `json:"check"` // AES-GCM tag over keystoreCheck
+}
+
+// softwareKeyMeta describes a stored key. It is authenticated together with
+// the encrypted key material, so its attributes cannot be changed on disk.
+type softwareKeyMeta struct {
+	Class       string `json:"class"` // "private" or "secret"
+	Label       string `json:"label"`
+	ID          string `json:"id,omitempty"` // hex, like CKA_ID
+	Sign        bool   `json:"sign"`
+	Decrypt     bool   `json:"decrypt"`
+	Extractable bool   `json:"extractable"`
+	Local       bool   `json:"local"` // generated rather than unwrapped
+}
+
+// softwareKeyFile is a stored key: PKCS#8 DER for private keys or the AES
+// value for wrapping keys, sealed with AES-256-GCM.
+type softwareKeyFile struct {
+	softwareKeyMeta
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+type softwareKey struct {
+	meta   softwareKeyMeta
+	signer crypto.Signer
+}
+
+// softwareKeyPairRepository keeps keys in process memory and, unless it is an
+// in-memory store, in a directory encrypted under a passphrase. It follows the
+// label semantics of the PKCS#11 repository so that the CA can run without an
+// HSM in development and CI.
+type softwareKeyPairRepository struct {
+	dir    string      // empty for an in-memory store
+	aead   cipher.AEAD // nil for an in-memory store
+	serial string
+
+	mu       sync.RWMutex
+	keys     map[string]*softwareKey // private keys by label
+	wrapping map[string][]byte       // AES wrapping keys by label
+}
+
+// NewMemoryKeyPairRepository returns a repository whose keys live only in
+// process memory and are lost when it is finalized. It is meant for tests.
+func NewMemoryKeyPairRepository() KeyPairRepository {
+	return &softwareKeyPairRepository{
+		keys:     make(map[string]*softwareKey),
+		wrapping: make(map[string][]byte),
+	}
+}
+
+// NewSoftwareKeyPairRepository opens the keystore directory dir with the
+// passphrase pinRef resolves to (see ResolvePin), creating the keystore if
+// dir holds none.
+func NewSoftwareKeyPairRepository(dir, pinRef string) (KeyPairRepository, error) {
+	passphrase, err := ResolvePin(pinRef)
+	if err != nil {
+		return nil, err
+	}
+	return NewSoftwareKeyPairRepositoryWithPassphrase(dir, passphrase)
+}
+
+// NewSoftwareKeyPairRepositoryWithPassphrase is NewSoftwareKeyPairRepository
+// for a passphrase that was not read through a reference, such as one
+// recombined in a key ceremony.
+func NewSoftwareKeyPairRepositoryWithPassphrase(dir, passphrase string) (KeyPairRepository, error) {
+	if dir == "" {
+		return nil, errors.New("keystore directory is empty")
+	}
+	if passphrase == "" {
+		return nil, errors.New("keystore passphrase is empty")
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create keystore directory: %w", err)
+	}
+
+	header, created, err := loadKeystoreHeader(dir)
+	if err != nil {
+		return nil, err
+	}
+	key, err := scrypt.Key([]byte(passphrase), header.Salt, header.N, header.R, header.P, 32)
+	if err != nil {
+		return nil, fmt.Errorf("failed to derive keystore key: %w", err)
+	}
+	block, err := aes.NewCipher(key)
+	clear(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &softwareKeyPairRepository{
+		dir:      dir,
+		aead:     aead,
+		serial:   hex.EncodeToString(header.Salt[:8]),
+		keys:     make(map[string]*softwareKey),
+		wrapping: make(map[string][]byte),
+	}
+	if created {
+		header.Nonce = make([]byte, aead.NonceSize())
+		if _, err := rand.Read(header.Nonce); err != nil {
+			return nil, fmt.Errorf("failed to generate nonce: %w", err)
+		}
+		header.Check = aead.Seal(nil, header.Nonce, nil, keystoreCheck)
+		data, err := json.MarshalIndent(header, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		if err := writeFileAtomic(filepath.Join(dir, keystoreFile), data); err != nil {
+			return nil, fmt.Errorf("failed to write %s: %w", keystoreFile, err)
+		}
+		return r, nil
+	}
+
+	if _, err := aead.Open(nil, header.Nonce, header.Check, keystoreCheck); err != nil {
+		return nil, errors.New("failed to open keystore: wrong passphrase")
+	}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// loadKeystoreHeader reads keystore.json. For a directory without keys it
+// returns the parameters of a new keystore with a random salt and created set.
+func loadKeystoreHeader(dir string) (keystoreHeader, bool, error) {
+	var header keystoreHeader
+	data, err := os.ReadFile(filepath.Join(dir, keystoreFile))
+	if err == nil {
+		if err := json.Unmarshal(data, &header); err != nil {
+			return keystoreHeader{}, false, fmt.Errorf("failed to parse %s: %w", keystoreFile, err)
+		}
+		if header.Version != keystoreVersion || header.KDF != "scrypt" || len(header.Salt) < 8 {
+			return keystoreHeader{}, false, fmt.Errorf("unsupported keystore version %d with KDF %q", header.Version, header.KDF)
+		}
+		return header, false, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return keystoreHeader{}, false, err
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return keystoreHeader{}, false, err
+	}
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), privateKeySuffix) || strings.HasSuffix(entry.Name(), wrappingKeySuffix) {
+			return keystoreHeader{}, false, fmt.Errorf("%s holds keys but no %s", dir, keystoreFile)
+		}
+	}
+
+	header = keystoreHeader{Version: keystoreVersion, KDF: "scrypt", N: scryptN, R: scryptR, P: scryptP, Salt: make([]byte, 16)}
+	if _, err := rand.Read(header.Salt); err != nil {
+		return keystoreHeader{}, false, fmt.Errorf("failed to generate salt: %w", err)
+	}
+	return header, true, nil
+}
+
+// load decrypts every key in the keystore directory.
+func (r *softwareKeyPairRepository) load() error {
+	entries, err := os.ReadDir(r.dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasSuffix(name, privateKeySuffix) && !strings.HasSuffix(name, wrappingKeySuffix) {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(r.dir, name))
+		if err != nil {
+			return err
+		}
+		var file softwareKeyFile
+		if err := json.Unmarshal(data, &file); err != nil {
+			return fmt.Errorf("failed to parse %s: %w", name, err)
+		}
+		aad, err := json.Marshal(file.softwareKeyMeta)
+		if err != nil {
+			return err
+		}
+		plaintext, err := r.aead.Open(nil, file.Nonce, file.Ciphertext, aad)
+		if err != nil {
+			return fmt.Errorf("failed to decrypt %s: %w", name, err)
+		}
+		if name != keyFileName(file.Class, file.Label) {
+			return fmt.Errorf("%s holds key %s, expected in %s", name, file.Label, keyFileName(file.Class, file.Label))
+		}
+
+		switch file.Class {
+		case "private":
+			signer, err := parsePrivateKey(plaintext)
+			clear(plaintext)
+			if err != nil {
+				return fmt.Errorf("failed to parse private key %s: %w", file.Label, err)
+			}
+			r.keys[file.Label] = &softwareKey{meta: file.softwareKeyMeta, signer: signer}
+		case "secret":
+			r.wrapping[file.Label] = plaintext
+		default:
+			return fmt.Errorf("unknown key class %q in %s", file.Class, name)
+		}
+	}
+	return nil
+}
+
+// keyFileName returns the file name of a key; labels are hex encoded since
+// they may contain any character.
+func keyFileName(class, label string) string {
+	if class == "secret" {
+		return hex.EncodeToString([]byte(label)) + wrappingKeySuffix
+	}
+	return hex.EncodeToString([]byte(label)) + privateKeySuffix
+}
+
+// parsePrivateKey parses PKCS#8 DER into an RSA or ECDSA key of a supported algorithm.
+func parsePrivateKey(der []byte) (crypto.Signer, error) {
+	priv, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+	var signer crypto.Signer
+	switch k := priv.(type) {
+	case *rsa.PrivateKey:
+		signer = k
+	case *ecdsa.PrivateKey:
+		signer = k
+	default:
+		return nil, fmt.Errorf("unsupported private key type: %T", priv)
+	}
+	if _, err := KeyAlgorithmOf(signer.Public()); err != nil {
+		return nil, err
+	}
+	return signer, nil
+}
+
+// store writes a key to the keystore directory. It is a no-op for an
+// in-memory store. The caller holds r.mu.
+func (r *softwareKeyPairRepository) store(meta softwareKeyMeta, plaintext []byte) error {
+	if r.aead == nil {
+		return nil
+	}
+	aad, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, r.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	data, err := json.MarshalIndent(softwareKeyFile{
+		softwareKeyMeta: meta,
+		Nonce:           nonce,
+		Ciphertext:      r.aead.Seal(nil, nonce, plaintext, aad),
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filepath.Join(r.dir, keyFileName(meta.Class, meta.Label)), data); err != nil {
+		return fmt.Errorf("failed to store key %s: %w", meta.Label, err)
+	}
+	return nil
+}
+
+// storePrivateKey writes a private key and its attributes. The caller holds r.mu.
+func (r *softwareKeyPairRepository) storePrivateKey(key *softwareKey) error {
+	der, err := x509.MarshalPKCS8PrivateKey(key.signer)
+	if err != nil {
+		return fmt.Errorf("failed to marshal private key: %w", err)
+	}
+	defer clear(der)
+	return r.store(key.meta, der)
+}
+
+// remove deletes a key file. The caller holds r.mu.
+func (r *softwareKeyPairRepository) remove(class, label string) error {
+	if r.aead == nil {
+		return nil
+	}
+	err := os.Remove(filepath.Join(r.dir, keyFileName(class, label)))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove key %s: %w", label, err)
+	}
+	return nil
+}
+
+// writeFileAtomic replaces path with data, readable by the owner only.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// GenerateKeyPair generates a key pair labelled id. Unlike a PKCS#11 token,
+// the keystore holds one key per label and refuses a label in use.
+func (r *softwareKeyPairRepository) GenerateKeyPair(id string, algorithm model.KeyAlgorithm, policy model.KeyPolicy) (model.KeyPairData, error) {
+	var (
+		signer crypto.Signer
+		err    error
+	)
+	switch algorithm {
+	case model.KeyAlgorithmRSA2048:
+		signer, err = rsa.GenerateKey(rand.Reader, 2048)
+	case model.KeyAlgorithmRSA3072:
+		signer, err = rsa.GenerateKey(rand.Reader, 3072)
+	case model.KeyAlgorithmRSA4096:
+		signer, err = rsa.GenerateKey(rand.Reader, 4096)
+	case model.KeyAlgorithmECP256:
+		signer, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case model.KeyAlgorithmECP384:
+		signer, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	default:
+		return model.KeyPairData{}, fmt.Errorf("unsupported key algorithm: %s", algorithm)
+	}
+	if err != nil {
+		return model.KeyPairData{}, fmt.Errorf("failed to generate key pair: %w", err)
+	}
+
+	key := &softwareKey{
+		meta: softwareKeyMeta{
+			Class:       "private",
+			Label:       id,
+			ID:          hex.EncodeToString([]byte(id)),
+			Sign:        true,
+			Decrypt:     policy.Decrypt && algorithm.IsRSA(),
+			Extractable: policy.Extractable,
+			Local:       true,
+		},
+		signer: signer,
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.keys[id]; ok {
+		return model.KeyPairData{}, fmt.Errorf("%w: %s", model.ErrKeyExists, id)
+	}
+	if err := r.storePrivateKey(key); err != nil {
+		return model.KeyPairData{}, err
+	}
+	r.keys[id] = key
+	return newKeyPairData(id, signer.Public())
+}
+
+// ImportKeyPair stores an existing private key under label. Imported keys
+// are reported as not generated locally, as on a token.
+func (r *softwareKeyPairRepository) ImportKeyPair(label string, key crypto.Signer, policy model.KeyPolicy) (model.KeyPairData, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return model.KeyPairData{}, fmt.Errorf("failed to marshal private key: %w", err)
+	}
+	defer clear(der)
+	// Keep a copy so that the caller's key is not shared with the keystore.
+	signer, err := parsePrivateKey(der)
+	if err != nil {
+		return model.KeyPairData{}, err
+	}
+	_, isRSA := signer.(*rsa.PrivateKey)
+	imported := &softwareKey{
+		meta: softwareKeyMeta{
+			Class:       "private",
+			Label:       label,
+			ID:          hex.EncodeToString([]byte(label)),
+			Sign:        true,
+			Decrypt:     policy.Decrypt && isRSA,
+			Extractable: policy.Extractable,
+		},
+		signer: signer,
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.keys[label]; ok {
+		return model.KeyPairData{}, fmt.Errorf("%w: %s", model.ErrKeyExists, label)
+	}
+	if err := r.store(imported.meta, der); err != nil {
+		return model.KeyPairData{}, err
+	}
+	r.keys[label] = imported
+	return newKeyPairData(label, signer.Public())
+}
+
+func (r *softwareKeyPairRepository) FindByID(id string) (model.KeyPairData, error) {
+	want := hex.EncodeToString([]byte(id))
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, key := range r.keys {
+		if key.meta.ID == want {
+			return newKeyPairData(id, key.signer.Public())
+		}
+	}
+	return model.KeyPairData{}, fmt.Errorf("%w: %s", model.ErrKeyNotFound, id)
+}
+
+func (r *softwareKeyPairRepository) GetSigner(keyLabel string) (crypto.Signer, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	key, ok := r.keys[keyLabel]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", model.ErrKeyNotFound, keyLabel)
+	}
+	if !key.meta.Sign {
+		return nil, fmt.Errorf("%w: %s", model.ErrKeyDisabled, keyLabel)
+	}
+	return &softwareSigner{repo: r, label: keyLabel, key: key}, nil
+}
+
+// softwareSigner signs with a keystore key as long as the key is neither
+// disabled nor destroyed, as a token would refuse the operation.
+type softwareSigner struct {
+	repo  *softwareKeyPairRepository
+	label string
+	key   *softwareKey
+}
+
+// Public returns the public key associated with the signer.
+func (s *softwareSigner) Public() crypto.PublicKey {
+	return s.key.signer.Public()
+}
+
+// Sign signs digest with the private key. As with the PKCS#11 signer, a nil
+// or zero hash signs the data as given with PKCS#1 v1.5 padding for RSA.
+func (s *softwareSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	s.repo.mu.RLock()
+	key, ok := s.repo.keys[s.label]
+	enabled := ok && key.meta.Sign
+	s.repo.mu.RUnlock()
+	if !ok || key != s.key {
+		return nil, fmt.Errorf("%w: %s", model.ErrKeyNotFound, s.label)
+	}
+	if !enabled {
+		return nil, fmt.Errorf("%w: %s", model.ErrKeyDisabled, s.label)
+	}
+
+	if opts == nil {
+		opts = crypto.Hash(0)
+	}
+	if hash := opts.HashFunc(); hash != 0 && len(digest) != hash.Size() {
+		return nil, fmt.Errorf("digest length %d does not match hash %s", len(digest), hash)
+	}
+	return s.key.signer.Sign(rand, digest, opts)
+}
+
+// ListKeys describes every private key and the public key stored with it.
+func (r *softwareKeyPairRepository) ListKeys() ([]model.KeyObject, error) {
+	r.mu.RLock()
+	keys := make([]model.KeyObject, 0, 2*len(r.keys))
+	for _, key := range r.keys {
+		private := describeSoftwareKey(key)
+		public := model.KeyObject{
+			Label:      private.Label,
+			ID:         private.ID,
+			Class:      "public",
+			KeyType:    private.KeyType,
+			Bits:       private.Bits,
+			Algorithm:  private.Algorithm,
+			Local:      private.Local,
+			Modifiable: true,
+		}
+		keys = append(keys, private, public)
+	}
+	r.mu.RUnlock()
+
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Label != keys[j].Label {
+			return keys[i].Label < keys[j].Label
+		}
+		return keys[i].Class < keys[j].Class
+	})
+	return keys, nil
+}
+
+func (r *softwareKeyPairRepository) DescribeKey(keyLabel string) (model.KeyObject, crypto.PublicKey, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	key, ok := r.keys[keyLabel]
+	if !ok {
+		return model.KeyObject{}, nil, fmt.Errorf("%w: %s", model.ErrKeyNotFound, keyLabel)
+	}
+	return describeSoftwareKey(key), key.signer.Public(), nil
+}
+
+// describeSoftwareKey reports a private key with the attributes a PKCS#11
+// token would give it: unwrapped keys were never always sensitive.
+func describeSoftwareKey(key *softwareKey) model.KeyObject {
+	obj := model.KeyObject{
+		Label:            key.meta.Label,
+		ID:               key.meta.ID,
+		Class:            "private",
+		Sensitive:        boolPtr(true),
+		Extractable:      boolPtr(key.meta.Extractable),
+		AlwaysSensitive:  boolPtr(key.meta.Local),
+		NeverExtractable: boolPtr(key.meta.Local && !key.meta.Extractable),
+		Local:            key.meta.Local,
+		Modifiable:       true,
+		Disabled:         !key.meta.Sign,
+	}
+	obj.Algorithm, _ = KeyAlgorithmOf(key.signer.Public())
+	switch k := key.signer.Public().(type) {
+	case *rsa.PublicKey:
+		obj.KeyType, obj.Bits = "RSA", k.N.BitLen()
+	case *ecdsa.PublicKey:
+		obj.KeyType, obj.Bits = "EC", k.Curve.Params().BitSize
+	}
+	return obj
+}
+
+// SetKeyEnabled sets whether the private key with the given label may sign.
+func (r *softwareKeyPairRepository) SetKeyEnabled(keyLabel string, enabled bool) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key, ok := r.keys[keyLabel]
+	if !ok {
+		return fmt.Errorf("%w: %s", model.ErrKeyNotFound, keyLabel)
+	}
+	updated := &softwareKey{meta: key.meta, signer: key.signer}
+	updated.meta.Sign = enabled
+	if err := r.storePrivateKey(updated); err != nil {
+		return err
+	}
+	// Signers hold the previous entry, so update it in place.
+	key.meta.Sign = enabled
+	return nil
+}
+
+// DestroyKeyPair deletes the key pair with the given label.
+func (r *softwareKeyPairRepository) DestroyKeyPair(keyLabel string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.keys[keyLabel]; !ok {
+		return fmt.Errorf("%w: %s", model.ErrKeyNotFound, keyLabel)
+	}
+	if err := r.remove("private", keyLabel); err != nil {
+		return err
+	}
+	delete(r.keys, keyLabel)
+	return nil
+}
+
+// CreateWrappingKey stores an AES key-encryption key, generating a 256-bit
+// key when value is nil.
+func (r *softwareKeyPairRepository) CreateWrappingKey(label string, value []byte) error {
+	switch len(value) {
+	case 0:
+		value = make([]byte, 32)
+		if _, err := rand.Read(value); err != nil {
+			return fmt.Errorf("failed to create wrapping key: %w", err)
+		}
+	case 16, 24, 32:
+		value = bytes.Clone(value)
+	default:
+		return fmt.Errorf("invalid AES key length: %d bytes", len(value))
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.wrapping[label]; ok {
+		return fmt.Errorf("%w: %s", model.ErrKeyExists, label)
+	}
+	if err := r.store(softwareKeyMeta{Class: "secret", Label: label}, value); err != nil {
+		return err
+	}
+	r.wrapping[label] = value
+	return nil
+}
+
+// WrapKey wraps the PKCS#8 encoding of a private key under the KEK kekLabel
+// with AES key wrap with padding, the format CKM_AES_KEY_WRAP_PAD produces.
+func (r *softwareKeyPairRepository) WrapKey(keyLabel, kekLabel string) (model.KeyBackup, error) {
+	r.mu.RLock()
+	key, ok := r.keys[keyLabel]
+	kek := r.wrapping[kekLabel]
+	var meta softwareKeyMeta
+	if ok {
+		meta = key.meta
+	}
+	r.mu.RUnlock()
+	if !ok {
+		return model.KeyBackup{}, fmt.Errorf("%w: %s", model.ErrKeyNotFound, keyLabel)
+	}
+	if kek == nil {
+		return model.KeyBackup{}, fmt.Errorf("%w: wrapping key %s", model.ErrKeyNotFound, kekLabel)
+	}
+	if !meta.Extractable {
+		return model.KeyBackup{}, fmt.Errorf("%w: %s", model.ErrKeyNotExtractable, keyLabel)
+	}
+
+	pub := key.signer.Public()
+	pubPEM, fingerprint, err := EncodePublicKey(pub)
+	if err != nil {
+		return model.KeyBackup{}, err
+	}
+	algorithm, err := KeyAlgorithmOf(pub)
+	if err != nil {
+		return model.KeyBackup{}, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key.signer)
+	if err != nil {
+		return model.KeyBackup{}, fmt.Errorf("failed to marshal private key: %w", err)
+	}
+	defer clear(der)
+	wrapped, err := wrapKeyPadded(kek, der)
+	if err != nil {
+		return model.KeyBackup{}, fmt.Errorf("failed to wrap private key: %w", err)
+	}
+
+	return model.KeyBackup{
+		Version:         model.KeyBackupVersion,
+		Mechanism:       model.KeyBackupMechanism,
+		KEKLabel:        kekLabel,
+		Label:           keyLabel,
+		ID:              meta.ID,
+		Algorithm:       algorithm,
+		PublicKey:       pubPEM,
+		PublicKeySHA256: fingerprint,
+		WrappedKey:      base64.StdEncoding.EncodeToString(wrapped),
+		Attributes: model.KeyBackupAttributes{
+			Sign:        meta.Sign,
+			Decrypt:     meta.Decrypt,
+			Extractable: meta.Extractable,
+		},
+	}, nil
+}
+
+// UnwrapKey restores the key pair of backup with the KEK kekLabel and checks
+// that the unwrapped private key matches the backed-up public key.
+func (r *softwareKeyPairRepository) UnwrapKey(backup model.KeyBackup, kekLabel string) error {
+	block, _ := pem.Decode([]byte(backup.PublicKey))
+	if block == nil {
+		return errors.New("failed to decode public key PEM")
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return fmt.Errorf("failed to parse public key: %w", err)
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(backup.WrappedKey)
+	if err != nil {
+		return fmt.Errorf("failed to decode wrapped key: %w", err)
+	}
+	if _, err := hex.DecodeString(backup.ID); err != nil {
+		return fmt.Errorf("failed to decode key ID: %w", err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.keys[backup.Label]; ok {
+		return fmt.Errorf("%w: %s", model.ErrKeyExists, backup.Label)
+	}
+	kek := r.wrapping[kekLabel]
+	if kek == nil {
+		return fmt.Errorf("%w: wrapping key %s", model.ErrKeyNotFound, kekLabel)
+	}
+
+	der, err := unwrapKeyPadded(kek, wrapped)
+	if err != nil {
+		return fmt.Errorf("failed to unwrap private key: %w", err)
+	}
+	defer clear(der)
+	signer, err := parsePrivateKey(der)
+	if err != nil {
+		return fmt.Errorf("failed to parse unwrapped private key: %w", err)
+	}
+	if k, ok := signer.Public().(interface{ Equal(crypto.PublicKey) bool }); !ok || !k.Equal(pub) {
+		return fmt.Errorf("restored key %s does not match the backed-up public key", backup.Label)
+	}
+
+	key := &softwareKey{
+		meta: softwareKeyMeta{
+			Class:       "private",
+			Label:       backup.Label,
+			ID:          strings.ToLower(backup.ID),
+			Sign:        backup.Attributes.Sign,
+			Decrypt:     backup.Attributes.Decrypt,
+			Extractable: backup.Attributes.Extractable,
+		},
+		signer: signer,
+	}
+	if err := r.store(key.meta, der); err != nil {
+		return err
+	}
+	r.keys[backup.Label] = key
+	return nil
+}
+
+// GenerateRandom reads the operating system RNG, which is all a software
+// keystore has.
+func (r *softwareKeyPairRepository) GenerateRandom(length int) ([]byte, error) {
+	random := make([]byte, length)
+	if _, err := rand.Read(random); err != nil {
+		return nil, err
+	}
+	return random, nil
+}
+
+// Health reports the keystore, which is available while it is open.
+func (r *softwareKeyPairRepository) Health() (model.HSMHealth, error) {
+	health := model.HSMHealth{
+		Available:    true,
+		TokenLabel:   "memory",
+		Manufacturer: "core-ca",
+		Model:        "software",
+		SerialNumber: r.serial,
+	}
+	if r.dir != "" {
+		health.TokenLabel = r.dir
+	}
+	return health, nil
+}
+
+// Finalize drops the keys from memory; stored keys stay in the directory.
+func (r *softwareKeyPairRepository) Finalize() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	clear(r.keys)
+	for label, value := range r.wrapping {
+		clear(value)
+		delete(r.wrapping, label)
+	}
+}
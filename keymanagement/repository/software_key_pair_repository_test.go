@@ -0,0 +1,179 @@
+package repository
+
+import (
+	"bytes"
+	"core-ca/keymanagement/model"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testPassphrase = "correct horse battery staple"
+
+func openKeystore(t *testing.T, dir, passphrase string) KeyPairRepository {
+	t.Helper()
+	repo, err := NewSoftwareKeyPairRepositoryWithPassphrase(dir, passphrase)
+	if err != nil {
+		t.Fatalf("open keystore: %v", err)
+	}
+	t.Cleanup(repo.Finalize)
+	return repo
+}
+
+// privateScalar returns the secret part of a key, to look for on disk.
+func privateScalar(t *testing.T, signer crypto.Signer) []byte {
+	t.Helper()
+	switch k := signer.(*softwareSigner).key.signer.(type) {
+	case *rsa.PrivateKey:
+		return k.D.Bytes()
+	case *ecdsa.PrivateKey:
+		return k.D.Bytes()
+	}
+	t.Fatalf("unexpected signer %T", signer)
+	return nil
+}
+
+func TestSoftwareKeystoreRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	repo := openKeystore(t, dir, testPassphrase)
+
+	caPolicy := model.DefaultKeyPolicies()[model.KeyPurposeCA]
+	keys := map[string]model.KeyAlgorithm{
+		"root-key":   model.KeyAlgorithmECP384,
+		"issuer-key": model.KeyAlgorithmRSA2048,
+	}
+	public := map[string]crypto.PublicKey{}
+	var secrets [][]byte
+	for label, algorithm := range keys {
+		keyPair, err := repo.GenerateKeyPair(label, algorithm, caPolicy)
+		if err != nil {
+			t.Fatalf("GenerateKeyPair %s: %v", label, err)
+		}
+		signer, err := repo.GetSigner(label)
+		if err != nil {
+			t.Fatalf("GetSigner %s: %v", label, err)
+		}
+		public[label] = signer.Public()
+		secrets = append(secrets, privateScalar(t, signer))
+		if keyPair.PublicKey == "" {
+			t.Fatalf("no public key for %s", label)
+		}
+	}
+	if _, err := repo.GenerateKeyPair("root-key", model.KeyAlgorithmECP256, caPolicy); !errors.Is(err, model.ErrKeyExists) {
+		t.Fatalf("GenerateKeyPair of an existing label: %v, want ErrKeyExists", err)
+	}
+	kek := bytes.Repeat([]byte{0x42}, 32)
+	if err := repo.CreateWrappingKey("backup-kek", kek); err != nil {
+		t.Fatalf("CreateWrappingKey: %v", err)
+	}
+	if err := repo.SetKeyEnabled("issuer-key", false); err != nil {
+		t.Fatalf("SetKeyEnabled: %v", err)
+	}
+
+	// Nothing secret is stored in the clear
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, secret := range append(secrets, kek, []byte(testPassphrase)) {
+			if bytes.Contains(data, secret) {
+				t.Fatalf("%s holds key material in the clear", entry.Name())
+			}
+		}
+		if info, err := entry.Info(); err != nil || info.Mode().Perm()&0o077 != 0 {
+			t.Errorf("%s is readable by others: %v", entry.Name(), info.Mode())
+		}
+	}
+	repo.Finalize()
+
+	// Reopening decrypts the same keys with their attributes
+	reloaded := openKeystore(t, dir, testPassphrase)
+	digest := sha256.Sum256([]byte("tbsCertificate"))
+	signer, err := reloaded.GetSigner("root-key")
+	if err != nil {
+		t.Fatalf("GetSigner after reload: %v", err)
+	}
+	if !signer.Public().(*ecdsa.PublicKey).Equal(public["root-key"]) {
+		t.Fatal("root-key changed across reload")
+	}
+	signature, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	if !ecdsa.VerifyASN1(public["root-key"].(*ecdsa.PublicKey), digest[:], signature) {
+		t.Fatal("signature of the reloaded key does not verify")
+	}
+	if _, err := reloaded.GetSigner("issuer-key"); !errors.Is(err, model.ErrKeyDisabled) {
+		t.Fatalf("GetSigner of a disabled key after reload: %v, want ErrKeyDisabled", err)
+	}
+	object, publicKey, err := reloaded.DescribeKey("issuer-key")
+	if err != nil {
+		t.Fatalf("DescribeKey: %v", err)
+	}
+	if !publicKey.(*rsa.PublicKey).Equal(public["issuer-key"]) {
+		t.Fatal("issuer-key changed across reload")
+	}
+	if object.Extractable == nil || *object.Extractable || !object.Local {
+		t.Fatalf("issuer-key attributes changed across reload: %+v", object)
+	}
+
+	// The wrapping key is reloaded and the CA key is still refused for backup
+	if _, err := reloaded.WrapKey("root-key", "backup-kek"); !errors.Is(err, model.ErrKeyNotExtractable) {
+		t.Fatalf("WrapKey of a CA key after reload: %v, want ErrKeyNotExtractable", err)
+	}
+}
+
+func TestSoftwareKeystoreWrongPassphrase(t *testing.T) {
+	dir := t.TempDir()
+	repo := openKeystore(t, dir, testPassphrase)
+	if _, err := repo.GenerateKeyPair("root-key", model.KeyAlgorithmECP256, model.DefaultKeyPolicies()[model.KeyPurposeCA]); err != nil {
+		t.Fatalf("GenerateKeyPair: %v", err)
+	}
+	repo.Finalize()
+
+	_, err := NewSoftwareKeyPairRepositoryWithPassphrase(dir, "wrong "+testPassphrase)
+	if err == nil || !strings.Contains(err.Error(), "wrong passphrase") {
+		t.Fatalf("open with a wrong passphrase: %v, want it refused", err)
+	}
+	if _, err := NewSoftwareKeyPairRepositoryWithPassphrase(dir, ""); err == nil {
+		t.Fatal("open with an empty passphrase succeeded")
+	}
+}
+
+func TestSoftwareKeystoreTamperedKey(t *testing.T) {
+	dir := t.TempDir()
+	repo := openKeystore(t, dir, testPassphrase)
+	if _, err := repo.GenerateKeyPair("root-key", model.KeyAlgorithmECP256, model.DefaultKeyPolicies()[model.KeyPurposeCA]); err != nil {
+		t.Fatalf("GenerateKeyPair: %v", err)
+	}
+	repo.Finalize()
+
+	// The attributes are authenticated with the key: making it extractable breaks decryption
+	path := filepath.Join(dir, keyFileName("private", "root-key"))
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := bytes.Replace(data, []byte(`"extractable": false`), []byte(`"extractable": true`), 1)
+	if bytes.Equal(tampered, data) {
+		t.Fatal("extractable attribute not found in the key file")
+	}
+	if err := os.WriteFile(path, tampered, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewSoftwareKeyPairRepositoryWithPassphrase(dir, testPassphrase); err == nil {
+		t.Fatal("a key file with changed attributes was loaded")
+	}
+}
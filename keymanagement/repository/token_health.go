@@ -0,0 +1,231 @@
+package repository
+
+import (
+	"core-ca/keymanagement/model"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/miekg/pkcs11"
+)
+
+// Reconnect backoff: 250ms, 500ms, 1s, 2s between five attempts.
+const (
+	reconnectAttempts       = 5
+	reconnectInitialBackoff = 250 * time.Millisecond
+	reconnectMaxBackoff     = 4 * time.Second
+)
+
+// isSessionLost reports whether err means the pooled sessions or the login are
+// gone and the repository has to reconnect before retrying.
+func isSessionLost(err error) bool {
+	var p11Err pkcs11.Error
+	if !errors.As(err, &p11Err) {
+		return false
+	}
+	switch p11Err {
+	case pkcs11.CKR_SESSION_HANDLE_INVALID,
+		pkcs11.CKR_SESSION_CLOSED,
+		pkcs11.CKR_USER_NOT_LOGGED_IN,
+		pkcs11.CKR_DEVICE_REMOVED,
+		pkcs11.CKR_DEVICE_ERROR,
+		pkcs11.CKR_TOKEN_NOT_PRESENT,
+		pkcs11.CKR_CRYPTOKI_NOT_INITIALIZED:
+		return true
+	}
+	return false
+}
+
+// currentPool returns the active session pool and its generation. It fails
+// once the repository has been finalized.
+func (r *softHSMKeyPairRepository) currentPool() (*sessionPool, uint64, error) {
+	r.poolMu.RLock()
+	defer r.poolMu.RUnlock()
+	if r.closed {
+		return nil, 0, &model.HSMUnavailableError{Err: model.ErrTokenClosed}
+	}
+	return r.pool, r.generation, nil
+}
+
+// withSession runs fn on a pooled session. If the token reports that the
+// session or the login was lost, it reconnects and runs fn once more.
+func (r *softHSMKeyPairRepository) withSession(fn func(session pkcs11.SessionHandle) error) error {
+	pool, generation, err := r.currentPool()
+	if err != nil {
+		return err
+	}
+	if pool != nil {
+		err := pool.withSession(fn)
+		if !isSessionLost(err) {
+			return err
+		}
+		log.Printf("keymanagement: lost PKCS#11 session on slot %d: %v", r.slot, err)
+	}
+
+	pool, err = r.reconnect(generation)
+	if err != nil {
+		return err
+	}
+
+	err = pool.withSession(fn)
+	if isSessionLost(err) {
+		r.setLastError(err)
+		return &model.HSMUnavailableError{Err: err}
+	}
+	return err
+}
+
+// reconnect closes the sessions of the given pool generation, then reopens
+// the pool and logs in again with exponential backoff, and returns the new
+// pool. Callers that observed an older generation get the pool another caller
+// reconnected. A finalized repository never reopens its sessions.
+func (r *softHSMKeyPairRepository) reconnect(generation uint64) (*sessionPool, error) {
+	r.reconnectMu.Lock()
+	defer r.reconnectMu.Unlock()
+
+	r.poolMu.Lock()
+	if r.closed {
+		r.poolMu.Unlock()
+		return nil, &model.HSMUnavailableError{Err: model.ErrTokenClosed}
+	}
+	if r.pool != nil && r.generation != generation {
+		pool := r.pool
+		r.poolMu.Unlock()
+		return pool, nil
+	}
+	if r.pool != nil {
+		r.pool.close()
+		r.pool = nil
+	}
+	r.poolMu.Unlock()
+
+	backoff := reconnectInitialBackoff
+	var err error
+	for attempt := 1; attempt <= reconnectAttempts; attempt++ {
+		var pool *sessionPool
+		pool, err = r.openPool()
+		if err == nil {
+			r.poolMu.Lock()
+			if r.closed {
+				// Finalized while logging in: drop the new sessions.
+				r.poolMu.Unlock()
+				pool.close()
+				return nil, &model.HSMUnavailableError{Err: model.ErrTokenClosed}
+			}
+			r.pool = pool
+			r.generation++
+			r.reconnects++
+			r.lastErr = nil
+			r.poolMu.Unlock()
+
+			// Object handles are not guaranteed to survive a new login.
+			r.forgetAllKeys()
+			log.Printf("keymanagement: reconnected to slot %d after %d attempt(s)", r.slot, attempt)
+			return pool, nil
+		}
+
+		log.Printf("keymanagement: reconnect attempt %d/%d to slot %d failed: %v", attempt, reconnectAttempts, r.slot, err)
+		if attempt < reconnectAttempts {
+			time.Sleep(backoff)
+			backoff = min(backoff*2, reconnectMaxBackoff)
+		}
+	}
+
+	r.setLastError(err)
+	return nil, &model.HSMUnavailableError{Err: err}
+}
+
+// openPool opens a fresh session pool, re-initializing the module first if it
+// was finalized underneath us (e.g. after CKR_DEVICE_REMOVED).
+func (r *softHSMKeyPairRepository) openPool() (*sessionPool, error) {
+	pool, err := newSessionPool(r.ctx, r.slot, r.poolSize, r.pin)
+	var p11Err pkcs11.Error
+	if errors.As(err, &p11Err) && p11Err == pkcs11.CKR_CRYPTOKI_NOT_INITIALIZED {
+		if err := r.ctx.Initialize(); err != nil && err != pkcs11.Error(pkcs11.CKR_CRYPTOKI_ALREADY_INITIALIZED) {
+			return nil, err
+		}
+		pool, err = newSessionPool(r.ctx, r.slot, r.poolSize, r.pin)
+	}
+	return pool, err
+}
+
+func (r *softHSMKeyPairRepository) setLastError(err error) {
+	r.poolMu.Lock()
+	r.lastErr = err
+	r.poolMu.Unlock()
+}
+
+// forgetAllKeys empties the handle cache.
+func (r *softHSMKeyPairRepository) forgetAllKeys() {
+	r.keysMu.Lock()
+	r.keys = make(map[string]cachedKey)
+	r.keysMu.Unlock()
+}
+
+// Health checks the login state of a pooled session and reads the token info.
+// A session that is no longer logged in triggers a reconnect.
+func (r *softHSMKeyPairRepository) Health() (model.HSMHealth, error) {
+	health := model.HSMHealth{Slot: r.slot, PoolSize: r.poolSize}
+
+	err := r.withSession(func(session pkcs11.SessionHandle) error {
+		info, err := r.ctx.GetSessionInfo(session)
+		if err != nil {
+			return err
+		}
+		if info.State != pkcs11.CKS_RW_USER_FUNCTIONS && info.State != pkcs11.CKS_RO_USER_FUNCTIONS {
+			// The session survived but the login did not.
+			return pkcs11.Error(pkcs11.CKR_USER_NOT_LOGGED_IN)
+		}
+		health.SessionState = sessionStateName(info.State)
+		return nil
+	})
+	if err == nil {
+		var tokenInfo pkcs11.TokenInfo
+		tokenInfo, err = r.ctx.GetTokenInfo(r.slot)
+		if err == nil {
+			health.TokenLabel = strings.TrimSpace(tokenInfo.Label)
+			health.Manufacturer = strings.TrimSpace(tokenInfo.ManufacturerID)
+			health.Model = strings.TrimSpace(tokenInfo.Model)
+			health.SerialNumber = strings.TrimSpace(tokenInfo.SerialNumber)
+			health.SessionCount = tokenInfo.SessionCount
+		}
+	}
+
+	r.poolMu.RLock()
+	if r.pool != nil {
+		health.IdleSessions = r.pool.idle()
+	}
+	health.Reconnects = r.reconnects
+	lastErr := r.lastErr
+	r.poolMu.RUnlock()
+
+	if err != nil {
+		if !errors.Is(err, model.ErrHSMUnavailable) {
+			err = &model.HSMUnavailableError{Err: err}
+		}
+		health.LastError = err.Error()
+		return health, err
+	}
+	if lastErr != nil {
+		health.LastError = lastErr.Error()
+	}
+	health.Available = true
+	return health, nil
+}
+
+func sessionStateName(state uint) string {
+	switch state {
+	case pkcs11.CKS_RO_PUBLIC_SESSION:
+		return "ro-public"
+	case pkcs11.CKS_RO_USER_FUNCTIONS:
+		return "ro-user"
+	case pkcs11.CKS_RW_PUBLIC_SESSION:
+		return "rw-public"
+	case pkcs11.CKS_RW_USER_FUNCTIONS:
+		return "rw-user"
+	case pkcs11.CKS_RW_SO_FUNCTIONS:
+		return "rw-so"
+	}
+	return "unknown"
+}
@@ -0,0 +1,110 @@
+package service
+
+import (
+	"core-ca/keymanagement/model"
+	"core-ca/keymanagement/repository"
+	"crypto"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+func (s *keyManagementService) AttestKey(token, keyLabel string) (model.KeyAttestation, error) {
+	if token == "" {
+		token = model.DefaultToken
+	}
+	repo, err := s.repo(token)
+	if err != nil {
+		return model.KeyAttestation{}, err
+	}
+	key, pub, err := repo.DescribeKey(keyLabel)
+	if err != nil {
+		return model.KeyAttestation{}, err
+	}
+	health, err := repo.Health()
+	if err != nil {
+		return model.KeyAttestation{}, err
+	}
+	pubPEM, fingerprint, err := repository.EncodePublicKey(pub)
+	if err != nil {
+		return model.KeyAttestation{}, err
+	}
+
+	report := model.KeyAttestationReport{
+		Token:            token,
+		TokenLabel:       health.TokenLabel,
+		Manufacturer:     health.Manufacturer,
+		Model:            health.Model,
+		SerialNumber:     health.SerialNumber,
+		Label:            key.Label,
+		ID:               key.ID,
+		KeyType:          key.KeyType,
+		Bits:             key.Bits,
+		Algorithm:        key.Algorithm,
+		PublicKeySHA256:  fingerprint,
+		PublicKey:        pubPEM,
+		Sensitive:        key.Sensitive != nil && *key.Sensitive,
+		Extractable:      key.Extractable == nil || *key.Extractable,
+		AlwaysSensitive:  key.AlwaysSensitive != nil && *key.AlwaysSensitive,
+		NeverExtractable: key.NeverExtractable != nil && *key.NeverExtractable,
+		Local:            key.Local,
+		AttestedAt:       time.Now().UTC(),
+	}
+	report.GeneratedOnToken = report.Local && report.AlwaysSensitive && report.NeverExtractable
+
+	payload, err := json.Marshal(report)
+	if err != nil {
+		return model.KeyAttestation{}, fmt.Errorf("failed to encode attestation report: %w", err)
+	}
+	signer, err := s.attestationSigner()
+	if err != nil {
+		return model.KeyAttestation{}, fmt.Errorf("failed to get attestation key: %w", err)
+	}
+	digest := sha256.Sum256(payload)
+	signature, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		return model.KeyAttestation{}, fmt.Errorf("failed to sign attestation report: %w", err)
+	}
+	signerPEM, _, err := repository.EncodePublicKey(signer.Public())
+	if err != nil {
+		return model.KeyAttestation{}, err
+	}
+
+	return model.KeyAttestation{
+		Report:             report,
+		Payload:            base64.StdEncoding.EncodeToString(payload),
+		Signature:          base64.StdEncoding.EncodeToString(signature),
+		SignatureAlgorithm: "ECDSA-SHA256",
+		SignerToken:        model.DefaultToken,
+		SignerLabel:        model.AttestationKeyLabel,
+		SignerPublicKey:    signerPEM,
+	}, nil
+}
+
+// attestationSigner returns the attestation key of the default token,
+// generating it on first use.
+func (s *keyManagementService) attestationSigner() (crypto.Signer, error) {
+	s.attestMu.Lock()
+	defer s.attestMu.Unlock()
+
+	repo, err := s.repo(model.DefaultToken)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := repo.GetSigner(model.AttestationKeyLabel)
+	if !errors.Is(err, model.ErrKeyNotFound) {
+		return signer, err
+	}
+
+	// The zero policy is non-extractable and sign-only, whatever is configured.
+	if _, err := repo.GenerateKeyPair(model.AttestationKeyLabel, model.KeyAlgorithmECP256, model.KeyPolicy{}); err != nil {
+		return nil, err
+	}
+	log.Printf("keymanagement: generated attestation key %s on token %s", model.AttestationKeyLabel, model.DefaultToken)
+	return repo.GetSigner(model.AttestationKeyLabel)
+}
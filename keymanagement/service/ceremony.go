@@ -0,0 +1,245 @@
+package service
+
+import (
+	"core-ca/keymanagement/model"
+	"core-ca/keymanagement/repository"
+	"core-ca/keymanagement/shamir"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+)
+
+// DefaultUnlockWindow is how long a key ceremony token stays logged in, and
+// how long submitted shares are kept, when no window is configured.
+const DefaultUnlockWindow = 15 * time.Minute
+
+// ceremonyState collects the custodian shares of a token PIN. It is guarded
+// by keyManagementService.mu.
+type ceremonyState struct {
+	threshold  int
+	shares     map[byte][]byte // by share index
+	shareSize  int
+	custodians []string
+	expires    time.Time // pending shares are discarded after this
+	unlocking  bool
+
+	unlockedUntil time.Time
+	timer         *time.Timer // locks the token when the window expires
+}
+
+func newCeremonyState(threshold int) *ceremonyState {
+	return &ceremonyState{threshold: threshold, shares: make(map[byte][]byte)}
+}
+
+// discardShares zeroes and drops the pending shares.
+func (c *ceremonyState) discardShares() {
+	for index, share := range c.shares {
+		clear(share)
+		delete(c.shares, index)
+	}
+	c.custodians = nil
+	c.shareSize = 0
+	c.expires = time.Time{}
+}
+
+// reset discards the pending shares and stops the lock timer.
+func (c *ceremonyState) reset() {
+	c.discardShares()
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	c.unlockedUntil = time.Time{}
+}
+
+// ceremonyEntry returns the entry of a key ceremony token. The caller holds s.mu.
+func (s *keyManagementService) ceremonyEntry(token string) (string, tokenEntry, error) {
+	if token == "" {
+		token = model.DefaultToken
+	}
+	entry, ok := s.tokens[token]
+	if !ok {
+		return "", tokenEntry{}, fmt.Errorf("%w: %s", model.ErrTokenNotFound, token)
+	}
+	if entry.ceremony == nil {
+		return "", tokenEntry{}, fmt.Errorf("%w: %s", model.ErrNotCeremonyToken, token)
+	}
+	if !entry.ceremony.expires.IsZero() && time.Now().After(entry.ceremony.expires) {
+		log.Printf("keymanagement: discarded %d expired shares for token %s", len(entry.ceremony.shares), token)
+		entry.ceremony.discardShares()
+	}
+	return token, entry, nil
+}
+
+func ceremonyStatus(name string, entry tokenEntry) model.CeremonyStatus {
+	c := entry.ceremony
+	status := model.CeremonyStatus{
+		Token:          name,
+		Locked:         entry.repo == nil,
+		Threshold:      c.threshold,
+		SharesReceived: len(c.shares),
+		Custodians:     slices.Clone(c.custodians),
+	}
+	if !c.expires.IsZero() {
+		expires := c.expires
+		status.SharesExpireAt = &expires
+	}
+	if entry.repo != nil {
+		until := c.unlockedUntil
+		status.UnlockedUntil = &until
+	}
+	return status
+}
+
+func (s *keyManagementService) CeremonyStatus(token string) (model.CeremonyStatus, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	name, entry, err := s.ceremonyEntry(token)
+	if err != nil {
+		return model.CeremonyStatus{}, err
+	}
+	return ceremonyStatus(name, entry), nil
+}
+
+func (s *keyManagementService) SubmitShare(token, custodian string, share []byte) (model.CeremonyStatus, error) {
+	if custodian == "" {
+		return model.CeremonyStatus{}, fmt.Errorf("%w: custodian is required", model.ErrShareRejected)
+	}
+	if len(share) < 2 || share[0] == 0 {
+		return model.CeremonyStatus{}, fmt.Errorf("%w: invalid share", model.ErrShareRejected)
+	}
+
+	s.mu.Lock()
+	name, entry, err := s.ceremonyEntry(token)
+	if err != nil {
+		s.mu.Unlock()
+		return model.CeremonyStatus{}, err
+	}
+	c := entry.ceremony
+	switch {
+	case entry.repo != nil:
+		err = fmt.Errorf("%w: token %s is already unlocked", model.ErrShareRejected, name)
+	case c.unlocking:
+		err = fmt.Errorf("%w: token %s is being unlocked", model.ErrShareRejected, name)
+	case slices.Contains(c.custodians, custodian):
+		err = fmt.Errorf("%w: custodian %s already submitted a share", model.ErrShareRejected, custodian)
+	case c.shares[share[0]] != nil:
+		err = fmt.Errorf("%w: share %d was already submitted", model.ErrShareRejected, share[0])
+	case len(c.shares) > 0 && len(share) != c.shareSize:
+		err = fmt.Errorf("%w: share length does not match the shares already submitted", model.ErrShareRejected)
+	}
+	if err != nil {
+		status := ceremonyStatus(name, entry)
+		s.mu.Unlock()
+		return status, err
+	}
+
+	if len(c.shares) == 0 {
+		c.shareSize = len(share)
+		c.expires = time.Now().Add(s.unlockWindow)
+	}
+	c.shares[share[0]] = slices.Clone(share)
+	c.custodians = append(c.custodians, custodian)
+	log.Printf("keymanagement: custodian %s submitted share %d of %d for token %s", custodian, len(c.shares), c.threshold, name)
+	if len(c.shares) < c.threshold {
+		status := ceremonyStatus(name, entry)
+		s.mu.Unlock()
+		return status, nil
+	}
+
+	// Log in without holding the lock; the shares are handed over so that a
+	// failed attempt starts a new collection.
+	shares := make([][]byte, 0, len(c.shares))
+	for index, share := range c.shares {
+		shares = append(shares, share)
+		delete(c.shares, index)
+	}
+	custodians := c.custodians
+	c.discardShares()
+	c.unlocking = true
+	s.mu.Unlock()
+
+	repo, err := s.unlock(entry.token, shares)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c.unlocking = false
+	current, ok := s.tokens[name]
+	if !ok || current.ceremony != c {
+		// The token was closed meanwhile.
+		if repo != nil {
+			repo.Finalize()
+		}
+		return model.CeremonyStatus{}, fmt.Errorf("%w: %s", model.ErrTokenNotFound, name)
+	}
+	if err != nil {
+		log.Printf("keymanagement: failed to unlock token %s with the shares of %s: %v", name, strings.Join(custodians, ", "), err)
+		return ceremonyStatus(name, current), fmt.Errorf("failed to unlock token %s: %w", name, err)
+	}
+
+	current.repo = newCeremonyRepository(name, repo)
+	s.tokens[name] = current
+	c.unlockedUntil = time.Now().Add(s.unlockWindow)
+	c.timer = time.AfterFunc(s.unlockWindow, func() { s.lockExpired(name, c) })
+	log.Printf("keymanagement: token %s unlocked by %s until %s", name, strings.Join(custodians, ", "), c.unlockedUntil.Format(time.RFC3339))
+	return ceremonyStatus(name, current), nil
+}
+
+// unlock recombines the PIN from shares and logs in to the token.
+func (s *keyManagementService) unlock(token model.Token, shares [][]byte) (repository.KeyPairRepository, error) {
+	defer func() {
+		for _, share := range shares {
+			clear(share)
+		}
+	}()
+	pin, err := shamir.Combine(shares)
+	if err != nil {
+		return nil, err
+	}
+	defer clear(pin)
+	return s.open(token, string(pin))
+}
+
+func (s *keyManagementService) LockToken(token string) error {
+	s.mu.Lock()
+	name, entry, err := s.ceremonyEntry(token)
+	if err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	repo := s.lock(name, entry)
+	s.mu.Unlock()
+
+	if repo != nil {
+		repo.Finalize()
+		log.Printf("keymanagement: token %s locked", name)
+	}
+	return nil
+}
+
+// lockExpired locks the token when the unlock window of c has passed.
+func (s *keyManagementService) lockExpired(name string, c *ceremonyState) {
+	s.mu.Lock()
+	entry, ok := s.tokens[name]
+	if !ok || entry.ceremony != c || entry.repo == nil || time.Now().Before(c.unlockedUntil) {
+		s.mu.Unlock()
+		return
+	}
+	repo := s.lock(name, entry)
+	s.mu.Unlock()
+
+	repo.Finalize()
+	log.Printf("keymanagement: token %s locked, unlock window expired", name)
+}
+
+// lock detaches the repository of a ceremony token and returns it for the
+// caller to finalize outside s.mu. The caller holds s.mu.
+func (s *keyManagementService) lock(name string, entry tokenEntry) repository.KeyPairRepository {
+	repo := entry.repo
+	entry.repo = nil
+	entry.ceremony.reset()
+	s.tokens[name] = entry
+	return repo
+}
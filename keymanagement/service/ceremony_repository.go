@@ -0,0 +1,168 @@
+package service
+
+import (
+	"core-ca/keymanagement/model"
+	"core-ca/keymanagement/repository"
+	"crypto"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// ceremonyRepository serves an unlocked key ceremony token. Every operation,
+// including signatures of signers handed out before, is counted in inflight,
+// so Finalize waits for the operations in progress before it logs out. Later
+// operations fail with model.ErrTokenLocked and never reach the finalized
+// repository, which could otherwise log in again on its own.
+type ceremonyRepository struct {
+	name string
+	repo repository.KeyPairRepository
+
+	// A counter rather than a read lock: a signature may read the token RNG,
+	// which must fail instead of blocking once Finalize waits.
+	mu       sync.Mutex
+	locked   bool
+	inflight sync.WaitGroup
+}
+
+func newCeremonyRepository(name string, repo repository.KeyPairRepository) *ceremonyRepository {
+	return &ceremonyRepository{name: name, repo: repo}
+}
+
+// do runs fn on the repository unless the token was locked.
+func do[T any](r *ceremonyRepository, fn func(repo repository.KeyPairRepository) (T, error)) (T, error) {
+	r.mu.Lock()
+	if r.locked {
+		r.mu.Unlock()
+		var zero T
+		return zero, fmt.Errorf("%w: %s was locked", model.ErrTokenLocked, r.name)
+	}
+	r.inflight.Add(1)
+	r.mu.Unlock()
+	defer r.inflight.Done()
+	return fn(r.repo)
+}
+
+// run is do for operations without a result.
+func (r *ceremonyRepository) run(fn func(repo repository.KeyPairRepository) error) error {
+	_, err := do(r, func(repo repository.KeyPairRepository) (struct{}, error) {
+		return struct{}{}, fn(repo)
+	})
+	return err
+}
+
+func (r *ceremonyRepository) GenerateKeyPair(id string, algorithm model.KeyAlgorithm, policy model.KeyPolicy) (model.KeyPairData, error) {
+	return do(r, func(repo repository.KeyPairRepository) (model.KeyPairData, error) {
+		return repo.GenerateKeyPair(id, algorithm, policy)
+	})
+}
+
+func (r *ceremonyRepository) ImportKeyPair(label string, key crypto.Signer, policy model.KeyPolicy) (model.KeyPairData, error) {
+	return do(r, func(repo repository.KeyPairRepository) (model.KeyPairData, error) {
+		return repo.ImportKeyPair(label, key, policy)
+	})
+}
+
+func (r *ceremonyRepository) FindByID(id string) (model.KeyPairData, error) {
+	return do(r, func(repo repository.KeyPairRepository) (model.KeyPairData, error) {
+		return repo.FindByID(id)
+	})
+}
+
+func (r *ceremonyRepository) GetSigner(keyLabel string) (crypto.Signer, error) {
+	return do(r, func(repo repository.KeyPairRepository) (crypto.Signer, error) {
+		signer, err := repo.GetSigner(keyLabel)
+		if err != nil {
+			return nil, err
+		}
+		return ceremonySigner{r: r, signer: signer}, nil
+	})
+}
+
+func (r *ceremonyRepository) ListKeys() ([]model.KeyObject, error) {
+	return do(r, func(repo repository.KeyPairRepository) ([]model.KeyObject, error) {
+		return repo.ListKeys()
+	})
+}
+
+func (r *ceremonyRepository) DescribeKey(keyLabel string) (model.KeyObject, crypto.PublicKey, error) {
+	var pub crypto.PublicKey
+	object, err := do(r, func(repo repository.KeyPairRepository) (model.KeyObject, error) {
+		object, p, err := repo.DescribeKey(keyLabel)
+		pub = p
+		return object, err
+	})
+	return object, pub, err
+}
+
+func (r *ceremonyRepository) SetKeyEnabled(keyLabel string, enabled bool) error {
+	return r.run(func(repo repository.KeyPairRepository) error {
+		return repo.SetKeyEnabled(keyLabel, enabled)
+	})
+}
+
+func (r *ceremonyRepository) DestroyKeyPair(keyLabel string) error {
+	return r.run(func(repo repository.KeyPairRepository) error {
+		return repo.DestroyKeyPair(keyLabel)
+	})
+}
+
+func (r *ceremonyRepository) CreateWrappingKey(label string, value []byte) error {
+	return r.run(func(repo repository.KeyPairRepository) error {
+		return repo.CreateWrappingKey(label, value)
+	})
+}
+
+func (r *ceremonyRepository) WrapKey(keyLabel, kekLabel string) (model.KeyBackup, error) {
+	return do(r, func(repo repository.KeyPairRepository) (model.KeyBackup, error) {
+		return repo.WrapKey(keyLabel, kekLabel)
+	})
+}
+
+func (r *ceremonyRepository) UnwrapKey(backup model.KeyBackup, kekLabel string) error {
+	return r.run(func(repo repository.KeyPairRepository) error {
+		return repo.UnwrapKey(backup, kekLabel)
+	})
+}
+
+func (r *ceremonyRepository) GenerateRandom(length int) ([]byte, error) {
+	return do(r, func(repo repository.KeyPairRepository) ([]byte, error) {
+		return repo.GenerateRandom(length)
+	})
+}
+
+func (r *ceremonyRepository) Health() (model.HSMHealth, error) {
+	return do(r, func(repo repository.KeyPairRepository) (model.HSMHealth, error) {
+		return repo.Health()
+	})
+}
+
+// Finalize waits for the operations in flight, then logs out of the token.
+func (r *ceremonyRepository) Finalize() {
+	r.mu.Lock()
+	if r.locked {
+		r.mu.Unlock()
+		return
+	}
+	r.locked = true
+	r.mu.Unlock()
+	r.inflight.Wait()
+	r.repo.Finalize()
+}
+
+// ceremonySigner signs through its ceremonyRepository so that a signature in
+// progress holds off the lock.
+type ceremonySigner struct {
+	r      *ceremonyRepository
+	signer crypto.Signer
+}
+
+func (s ceremonySigner) Public() crypto.PublicKey {
+	return s.signer.Public()
+}
+
+func (s ceremonySigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	return do(s.r, func(repository.KeyPairRepository) ([]byte, error) {
+		return s.signer.Sign(rand, digest, opts)
+	})
+}
@@ -0,0 +1,365 @@
+package service
+
+import (
+	"bytes"
+	"core-ca/keymanagement/model"
+	"core-ca/keymanagement/repository"
+	"core-ca/keymanagement/shamir"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+const ceremonyPin = "1234-5678"
+
+// newCeremonyService returns a service whose default token needs threshold
+// of the returned shares of ceremonyPin, and counts the logins.
+func newCeremonyService(t *testing.T, parts, threshold int, window time.Duration) (*keyManagementService, [][]byte, *int) {
+	t.Helper()
+	shares, err := shamir.Split([]byte(ceremonyPin), parts, threshold)
+	if err != nil {
+		t.Fatalf("Split: %v", err)
+	}
+	logins := 0
+	open := func(token model.Token, pin string) (repository.KeyPairRepository, error) {
+		if pin != ceremonyPin {
+			return nil, errors.New("CKR_PIN_INCORRECT")
+		}
+		logins++
+		return repository.NewMemoryKeyPairRepository(), nil
+	}
+	token := model.Token{Backend: model.BackendMemory, PinRef: fmt.Sprintf("%s:%d", model.CeremonyPinScheme, threshold)}
+	s, err := NewKeyManagementService(token, nil, open, nil, window)
+	if err != nil {
+		t.Fatalf("NewKeyManagementService: %v", err)
+	}
+	t.Cleanup(s.Close)
+	return s.(*keyManagementService), shares, &logins
+}
+
+func TestCeremonyUnlock(t *testing.T) {
+	for _, tc := range []struct{ parts, threshold int }{{2, 2}, {3, 2}, {5, 3}} {
+		t.Run(fmt.Sprintf("%d-of-%d", tc.threshold, tc.parts), func(t *testing.T) {
+			s, shares, logins := newCeremonyService(t, tc.parts, tc.threshold, time.Minute)
+
+			for i := 0; i < tc.threshold-1; i++ {
+				status, err := s.SubmitShare("", fmt.Sprintf("custodian-%d", i), shares[i])
+				if err != nil {
+					t.Fatalf("SubmitShare %d: %v", i, err)
+				}
+				if !status.Locked || status.SharesReceived != i+1 {
+					t.Fatalf("after %d shares: locked %v with %d shares", i+1, status.Locked, status.SharesReceived)
+				}
+			}
+			// Fewer than threshold shares leave the token locked
+			if _, err := s.GetKeyPair("", "k"); !errors.Is(err, model.ErrTokenLocked) {
+				t.Fatalf("GetKeyPair before the threshold: %v, want ErrTokenLocked", err)
+			}
+
+			status, err := s.SubmitShare("", "last", shares[tc.parts-1])
+			if err != nil {
+				t.Fatalf("SubmitShare: %v", err)
+			}
+			if status.Locked || status.UnlockedUntil == nil || status.SharesReceived != 0 {
+				t.Fatalf("after the threshold: %+v", status)
+			}
+			if *logins != 1 {
+				t.Fatalf("logged in %d times, want 1", *logins)
+			}
+			if _, err := s.GenerateKeyPair("", "k", model.KeyAlgorithmECP256, model.KeyPurposeCA); err != nil {
+				t.Fatalf("GenerateKeyPair on the unlocked token: %v", err)
+			}
+
+			if err := s.LockToken(""); err != nil {
+				t.Fatalf("LockToken: %v", err)
+			}
+			if _, err := s.GetKeyPair("", "k"); !errors.Is(err, model.ErrTokenLocked) {
+				t.Fatalf("GetKeyPair after LockToken: %v, want ErrTokenLocked", err)
+			}
+		})
+	}
+}
+
+func TestCeremonyRejectsShares(t *testing.T) {
+	s, shares, _ := newCeremonyService(t, 5, 3, time.Minute)
+
+	if _, err := s.SubmitShare("", "alice", shares[0]); err != nil {
+		t.Fatalf("SubmitShare: %v", err)
+	}
+	for _, tc := range []struct {
+		name, custodian string
+		share           []byte
+	}{
+		{"same custodian", "alice", shares[1]},
+		{"duplicate share", "bob", shares[0]},
+		{"different length", "bob", shares[1][:len(shares[1])-1]},
+		{"index 0", "bob", append([]byte{0}, shares[1][1:]...)},
+		{"no data", "bob", shares[1][:1]},
+		{"no custodian", "", shares[1]},
+	} {
+		status, err := s.SubmitShare("", tc.custodian, tc.share)
+		if !errors.Is(err, model.ErrShareRejected) {
+			t.Errorf("%s: %v, want ErrShareRejected", tc.name, err)
+		}
+		if status.SharesReceived > 1 {
+			t.Errorf("%s: %d shares pending after a rejected share", tc.name, status.SharesReceived)
+		}
+	}
+
+	if _, err := s.CeremonyStatus("missing"); !errors.Is(err, model.ErrTokenNotFound) {
+		t.Errorf("CeremonyStatus of an unknown token: %v, want ErrTokenNotFound", err)
+	}
+}
+
+func TestCeremonyCorruptedShare(t *testing.T) {
+	s, shares, logins := newCeremonyService(t, 3, 2, time.Minute)
+
+	corrupted := bytes.Clone(shares[1])
+	corrupted[1] ^= 0xff
+	if _, err := s.SubmitShare("", "alice", shares[0]); err != nil {
+		t.Fatalf("SubmitShare: %v", err)
+	}
+	status, err := s.SubmitShare("", "bob", corrupted)
+	if err == nil {
+		t.Fatal("a corrupted share unlocked the token")
+	}
+	if !status.Locked || status.SharesReceived != 0 || *logins != 0 {
+		t.Fatalf("after a failed unlock: %+v, %d logins", status, *logins)
+	}
+
+	// The failed attempt starts a new collection
+	for i, custodian := range []string{"alice", "bob"} {
+		if status, err = s.SubmitShare("", custodian, shares[i]); err != nil {
+			t.Fatalf("SubmitShare %s: %v", custodian, err)
+		}
+	}
+	if status.Locked {
+		t.Fatal("token still locked after valid shares")
+	}
+}
+
+func TestCeremonyUnlockWindowExpiry(t *testing.T) {
+	const window = 100 * time.Millisecond
+	s, shares, _ := newCeremonyService(t, 3, 2, window)
+
+	// Pending shares are discarded once the window has passed
+	if _, err := s.SubmitShare("", "alice", shares[0]); err != nil {
+		t.Fatalf("SubmitShare: %v", err)
+	}
+	time.Sleep(2 * window)
+	status, err := s.CeremonyStatus("")
+	if err != nil {
+		t.Fatalf("CeremonyStatus: %v", err)
+	}
+	if status.SharesReceived != 0 || len(status.Custodians) != 0 {
+		t.Fatalf("expired shares kept: %+v", status)
+	}
+
+	// An unlocked token locks itself when the window expires
+	for i, custodian := range []string{"alice", "bob"} {
+		if status, err = s.SubmitShare("", custodian, shares[i]); err != nil {
+			t.Fatalf("SubmitShare %s: %v", custodian, err)
+		}
+	}
+	if status.Locked {
+		t.Fatal("token locked right after unlocking")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		status, err = s.CeremonyStatus("")
+		if err != nil {
+			t.Fatalf("CeremonyStatus: %v", err)
+		}
+		if status.Locked {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("token still unlocked after the unlock window")
+		}
+		time.Sleep(window / 4)
+	}
+	if status.UnlockedUntil != nil {
+		t.Errorf("locked token reports unlocked until %s", status.UnlockedUntil)
+	}
+	if _, err := s.GetKeyPair("", "k"); !errors.Is(err, model.ErrTokenLocked) {
+		t.Fatalf("GetKeyPair after the window: %v, want ErrTokenLocked", err)
+	}
+}
+
+// blockingRepository holds signatures until release is closed and counts the
+// operations that reach it after Finalize.
+type blockingRepository struct {
+	repository.KeyPairRepository
+	signing chan struct{}
+	release chan struct{}
+
+	mu             sync.Mutex
+	finalized      bool
+	afterFinalize  int
+	signingStarted sync.Once
+}
+
+func (r *blockingRepository) check() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.finalized {
+		r.afterFinalize++
+	}
+}
+
+func (r *blockingRepository) GetSigner(keyLabel string) (crypto.Signer, error) {
+	r.check()
+	signer, err := r.KeyPairRepository.GetSigner(keyLabel)
+	if err != nil {
+		return nil, err
+	}
+	return blockingSigner{r: r, Signer: signer}, nil
+}
+
+func (r *blockingRepository) GenerateRandom(length int) ([]byte, error) {
+	r.check()
+	return r.KeyPairRepository.GenerateRandom(length)
+}
+
+func (r *blockingRepository) Finalize() {
+	r.mu.Lock()
+	r.finalized = true
+	r.mu.Unlock()
+	r.KeyPairRepository.Finalize()
+}
+
+func (r *blockingRepository) isFinalized() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.finalized
+}
+
+type blockingSigner struct {
+	crypto.Signer
+	r *blockingRepository
+}
+
+func (s blockingSigner) Sign(random io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	s.r.check()
+	s.r.signingStarted.Do(func() { close(s.r.signing) })
+	<-s.r.release
+	s.r.check()
+	return s.Signer.Sign(random, digest, opts)
+}
+
+func TestCeremonyLockDrainsSignatures(t *testing.T) {
+	shares, err := shamir.Split([]byte(ceremonyPin), 3, 2)
+	if err != nil {
+		t.Fatalf("Split: %v", err)
+	}
+	backend := &blockingRepository{
+		KeyPairRepository: repository.NewMemoryKeyPairRepository(),
+		signing:           make(chan struct{}),
+		release:           make(chan struct{}),
+	}
+	logins := 0
+	open := func(token model.Token, pin string) (repository.KeyPairRepository, error) {
+		if pin != ceremonyPin {
+			return nil, errors.New("CKR_PIN_INCORRECT")
+		}
+		logins++
+		return backend, nil
+	}
+	token := model.Token{Backend: model.BackendMemory, PinRef: model.CeremonyPinScheme + ":2"}
+	svc, err := NewKeyManagementService(token, nil, open, nil, time.Minute)
+	if err != nil {
+		t.Fatalf("NewKeyManagementService: %v", err)
+	}
+	t.Cleanup(svc.Close)
+	s := svc.(*keyManagementService)
+
+	for i, custodian := range []string{"alice", "bob"} {
+		if _, err := s.SubmitShare("", custodian, shares[i]); err != nil {
+			t.Fatalf("SubmitShare %s: %v", custodian, err)
+		}
+	}
+	keyPair, err := s.GenerateKeyPair("", "root", model.KeyAlgorithmECP256, model.KeyPurposeCA)
+	if err != nil {
+		t.Fatalf("GenerateKeyPair: %v", err)
+	}
+	signer, err := s.GetSigner("", "root")
+	if err != nil {
+		t.Fatalf("GetSigner: %v", err)
+	}
+
+	digest := sha256.Sum256([]byte("tbsCertificate"))
+	type result struct {
+		signature []byte
+		err       error
+	}
+	signed := make(chan result, 1)
+	go func() {
+		signature, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+		signed <- result{signature, err}
+	}()
+	<-backend.signing
+
+	locked := make(chan error, 1)
+	go func() { locked <- s.LockToken("") }()
+
+	// The lock takes effect for new operations but waits for the signature
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, err := s.GetSigner("", "root"); errors.Is(err, model.ErrTokenLocked) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("token still serving new operations while locking")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if backend.isFinalized() {
+		t.Fatal("token logged out while a signature was in progress")
+	}
+	select {
+	case err := <-locked:
+		t.Fatalf("LockToken returned during a signature: %v", err)
+	default:
+	}
+
+	close(backend.release)
+	res := <-signed
+	if res.err != nil {
+		t.Fatalf("Sign in progress: %v", res.err)
+	}
+	if !ecdsa.VerifyASN1(keyPair.PublicKey.(*ecdsa.PublicKey), digest[:], res.signature) {
+		t.Fatal("signature in progress does not verify")
+	}
+	if err := <-locked; err != nil {
+		t.Fatalf("LockToken: %v", err)
+	}
+	if !backend.isFinalized() {
+		t.Fatal("token not logged out after the signature")
+	}
+
+	// Signers and readers handed out before the lock do not log in again
+	if _, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256); !errors.Is(err, model.ErrTokenLocked) {
+		t.Fatalf("Sign after LockToken: %v, want ErrTokenLocked", err)
+	}
+	if _, err := io.ReadFull(s.Random(""), make([]byte, 32)); !errors.Is(err, model.ErrTokenLocked) {
+		t.Fatalf("Random after LockToken: %v, want ErrTokenLocked", err)
+	}
+	status, err := s.CeremonyStatus("")
+	if err != nil {
+		t.Fatalf("CeremonyStatus: %v", err)
+	}
+	backend.mu.Lock()
+	afterFinalize := backend.afterFinalize
+	backend.mu.Unlock()
+	if !status.Locked || logins != 1 || afterFinalize != 0 {
+		t.Fatalf("after LockToken: locked %v, %d logins, %d operations on the finalized token", status.Locked, logins, afterFinalize)
+	}
+}
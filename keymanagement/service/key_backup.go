@@ -0,0 +1,86 @@
+package service
+
+import (
+	"core-ca/keymanagement/model"
+	"core-ca/keymanagement/repository"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+func (s *keyManagementService) CreateWrappingKey(token, label string, value []byte) error {
+	if label == "" {
+		return errors.New("wrapping key label is required")
+	}
+	repo, err := s.repo(token)
+	if err != nil {
+		return err
+	}
+	return repo.CreateWrappingKey(label, value)
+}
+
+func (s *keyManagementService) BackupKey(token, keyLabel, kekLabel string) (model.KeyBackup, error) {
+	if token == "" {
+		token = model.DefaultToken
+	}
+	repo, err := s.repo(token)
+	if err != nil {
+		return model.KeyBackup{}, err
+	}
+	backup, err := repo.WrapKey(keyLabel, kekLabel)
+	if err != nil {
+		return model.KeyBackup{}, err
+	}
+	backup.Token = token
+	backup.CreatedAt = time.Now().UTC()
+	log.Printf("keymanagement: backed up key %s on token %s under wrapping key %s", keyLabel, token, kekLabel)
+	return backup, nil
+}
+
+func (s *keyManagementService) RestoreKey(token string, backup model.KeyBackup, kekLabel string) error {
+	if token == "" {
+		token = model.DefaultToken
+	}
+	if backup.Version != model.KeyBackupVersion {
+		return fmt.Errorf("%w: unsupported version %d", model.ErrInvalidKeyBackup, backup.Version)
+	}
+	if backup.Mechanism != model.KeyBackupMechanism {
+		return fmt.Errorf("%w: unsupported mechanism %s", model.ErrInvalidKeyBackup, backup.Mechanism)
+	}
+	if backup.Label == "" || backup.Label == model.AttestationKeyLabel {
+		return fmt.Errorf("%w: invalid label %q", model.ErrInvalidKeyBackup, backup.Label)
+	}
+	if kekLabel == "" {
+		kekLabel = backup.KEKLabel
+	}
+
+	// The recorded fingerprint catches a public key edited in the file.
+	block, _ := pem.Decode([]byte(backup.PublicKey))
+	if block == nil {
+		return fmt.Errorf("%w: failed to decode public key PEM", model.ErrInvalidKeyBackup)
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return fmt.Errorf("%w: failed to parse public key: %v", model.ErrInvalidKeyBackup, err)
+	}
+	_, fingerprint, err := repository.EncodePublicKey(pub)
+	if err != nil {
+		return err
+	}
+	if fingerprint != backup.PublicKeySHA256 {
+		return fmt.Errorf("%w: public key of %s does not match its fingerprint %s", model.ErrInvalidKeyBackup, backup.Label, backup.PublicKeySHA256)
+	}
+
+	repo, err := s.repo(token)
+	if err != nil {
+		return err
+	}
+	if err := repo.UnwrapKey(backup, kekLabel); err != nil {
+		return err
+	}
+	log.Printf("keymanagement: restored key %s (backed up from token %s) on token %s", backup.Label, backup.Token, token)
+	return nil
+}
@@ -1,30 +1,257 @@
 package service
 
 import (
+	"context"
 	"core-ca/keymanagement/model"
 	"core-ca/keymanagement/repository"
 	"crypto"
 	"crypto/x509"
 	"encoding/pem"
+	"errors"
 	"fmt"
+	"io"
+	"log"
+	"sort"
+	"sync"
+	"time"
 )
 
+// KeyManagementService routes key operations to named tokens. An empty token
+// name selects model.DefaultToken.
 type KeyManagementService interface {
-	GenerateKeyPair(id string) (model.KeyPair, error)
-	GetKeyPair(id string) (model.KeyPair, error)
-	GetSigner(keyLabel string) (crypto.Signer, error)
+	// GenerateKeyPair creates a key pair under the key policy of purpose.
+	GenerateKeyPair(token, id string, algorithm model.KeyAlgorithm, purpose model.KeyPurpose) (model.KeyPair, error)
+	// ImportKeyPair stores an existing private key on the token under the key
+	// policy of purpose, for keys migrated from another CA.
+	ImportKeyPair(token, label string, key crypto.Signer, purpose model.KeyPurpose) (model.KeyPair, error)
+	// KeyPolicies returns the policy applied to each key purpose.
+	KeyPolicies() map[model.KeyPurpose]model.KeyPolicy
+	GetKeyPair(token, id string) (model.KeyPair, error)
+	GetSigner(token, keyLabel string) (crypto.Signer, error)
+	// ListKeys describes every key object on the token.
+	ListKeys(token string) ([]model.KeyObject, error)
+	// DisableKey clears CKA_SIGN so that GetSigner and the token refuse the key; EnableKey sets it again.
+	DisableKey(token, keyLabel string) error
+	EnableKey(token, keyLabel string) error
+	// DestroyKeyPair permanently removes the key pair from the token. Callers
+	// are responsible for checking that nothing still uses the key.
+	DestroyKeyPair(token, keyLabel string) error
+	// AttestKey reads back the protection attributes of a private key and
+	// signs them with the attestation key of the default token.
+	AttestKey(token, keyLabel string) (model.KeyAttestation, error)
+	// CreateWrappingKey creates an AES key-encryption key on the token. A nil
+	// value generates it on the token; otherwise the given key is imported.
+	CreateWrappingKey(token, label string, value []byte) error
+	// BackupKey wraps a private key under the token-resident KEK kekLabel.
+	BackupKey(token, keyLabel, kekLabel string) (model.KeyBackup, error)
+	// RestoreKey unwraps a backup onto the token with the KEK kekLabel (the
+	// backup's KEK label when empty) and verifies the restored key pair.
+	RestoreKey(token string, backup model.KeyBackup, kekLabel string) error
+	// Random returns a reader of the token's random number generator
+	// (C_GenerateRandom) mixed with the operating system RNG. Reads fail while
+	// the token is unavailable.
+	Random(token string) io.Reader
+	// OpenToken logs in to the token and makes it available under its name.
+	// Tokens with a ceremony PIN reference are added locked instead.
+	OpenToken(token model.Token) error
+	// CloseToken finalizes a token opened with OpenToken.
+	CloseToken(name string) error
+	// Tokens lists the loaded tokens, default first.
+	Tokens() []model.Token
+	// Health reports the token state. The error matches model.ErrHSMUnavailable when the token is down.
+	Health(token string) (model.HSMHealth, error)
+	// MonitorHealth checks every token each interval until ctx is done, logging state changes.
+	MonitorHealth(ctx context.Context, interval time.Duration)
+	// CeremonyStatus reports the unlock state of a key ceremony token.
+	CeremonyStatus(token string) (model.CeremonyStatus, error)
+	// SubmitShare adds a custodian's PIN share. When the threshold is reached
+	// the PIN is recombined and the token is logged in until the unlock window expires.
+	SubmitShare(token, custodian string, share []byte) (model.CeremonyStatus, error)
+	// LockToken logs out of a key ceremony token before its unlock window
+	// expires, once the operations in progress have finished. Signers handed
+	// out before fail with model.ErrTokenLocked afterwards.
+	LockToken(token string) error
+	// Close finalizes every loaded token.
+	Close()
+}
+
+// TokenOpener opens the key repository of a token. pin is the PIN recombined
+// in a key ceremony; when it is empty token.PinRef is resolved.
+type TokenOpener func(token model.Token, pin string) (repository.KeyPairRepository, error)
+
+type tokenEntry struct {
+	token model.Token
+	repo  repository.KeyPairRepository // nil while a ceremony token is locked
+	// ceremony is set for tokens unlocked by custodian shares.
+	ceremony *ceremonyState
 }
 
 type keyManagementService struct {
-	repo repository.KeyPairRepository
+	open         TokenOpener
+	policies     map[model.KeyPurpose]model.KeyPolicy
+	unlockWindow time.Duration
+
+	// attestMu serializes creation of the attestation key.
+	attestMu sync.Mutex
+
+	mu     sync.RWMutex
+	tokens map[string]tokenEntry
+}
+
+// NewKeyManagementService serves defaultToken from repo and opens further
+// tokens with open. policies overrides model.DefaultKeyPolicies for the
+// purposes it contains. Key ceremony tokens stay unlocked for unlockWindow
+// (DefaultUnlockWindow when zero); repo is nil when defaultToken is one.
+func NewKeyManagementService(defaultToken model.Token, repo repository.KeyPairRepository, open TokenOpener, policies map[model.KeyPurpose]model.KeyPolicy, unlockWindow time.Duration) (KeyManagementService, error) {
+	defaultToken.Name = model.DefaultToken
+	merged := model.DefaultKeyPolicies()
+	for purpose, policy := range policies {
+		merged[purpose] = policy
+	}
+	if unlockWindow <= 0 {
+		unlockWindow = DefaultUnlockWindow
+	}
+
+	entry := tokenEntry{token: defaultToken, repo: repo}
+	threshold, ceremony, err := model.ParseCeremonyPinRef(defaultToken.PinRef)
+	if err != nil {
+		return nil, err
+	}
+	if ceremony {
+		entry.repo = nil
+		entry.ceremony = newCeremonyState(threshold)
+	}
+	return &keyManagementService{
+		open:         open,
+		policies:     merged,
+		unlockWindow: unlockWindow,
+		tokens: map[string]tokenEntry{
+			model.DefaultToken: entry,
+		},
+	}, nil
+}
+
+func (s *keyManagementService) repo(token string) (repository.KeyPairRepository, error) {
+	if token == "" {
+		token = model.DefaultToken
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	entry, ok := s.tokens[token]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", model.ErrTokenNotFound, token)
+	}
+	if entry.repo == nil {
+		return nil, fmt.Errorf("%w: %s needs %d custodian shares", model.ErrTokenLocked, token, entry.ceremony.threshold)
+	}
+	return entry.repo, nil
+}
+
+func (s *keyManagementService) OpenToken(token model.Token) error {
+	if token.Name == "" {
+		return fmt.Errorf("token name is required")
+	}
+	if token.Backend != model.BackendPKCS11 {
+		return fmt.Errorf("unsupported token backend %q: only pkcs11 slots can be opened as further tokens", token.Backend)
+	}
+
+	s.mu.RLock()
+	for name, entry := range s.tokens {
+		if name == token.Name {
+			s.mu.RUnlock()
+			return fmt.Errorf("token %s is already loaded", token.Name)
+		}
+		// Two repositories on one slot would share (and log out) the same login.
+		if entry.token.Backend == token.Backend && entry.token.Slot == token.Slot {
+			s.mu.RUnlock()
+			return fmt.Errorf("slot %s is already served by token %s", token.Slot, name)
+		}
+	}
+	s.mu.RUnlock()
+
+	entry := tokenEntry{token: token}
+	threshold, ceremony, err := model.ParseCeremonyPinRef(token.PinRef)
+	if err != nil {
+		return err
+	}
+	if ceremony {
+		entry.ceremony = newCeremonyState(threshold)
+	} else {
+		entry.repo, err = s.open(token, "")
+		if err != nil {
+			return fmt.Errorf("failed to open token %s: %w", token.Name, err)
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.tokens[token.Name]; ok {
+		if entry.repo != nil {
+			entry.repo.Finalize()
+		}
+		return fmt.Errorf("token %s is already loaded", token.Name)
+	}
+	s.tokens[token.Name] = entry
+	return nil
 }
 
-func NewKeyManagementService(repo repository.KeyPairRepository) KeyManagementService {
-	return &keyManagementService{repo: repo}
+func (s *keyManagementService) CloseToken(name string) error {
+	if name == model.DefaultToken {
+		return fmt.Errorf("the default token cannot be closed")
+	}
+	s.mu.Lock()
+	entry, ok := s.tokens[name]
+	delete(s.tokens, name)
+	if ok && entry.ceremony != nil {
+		entry.ceremony.reset()
+	}
+	s.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("%w: %s", model.ErrTokenNotFound, name)
+	}
+	if entry.repo != nil {
+		entry.repo.Finalize()
+	}
+	return nil
 }
 
-func (s *keyManagementService) GenerateKeyPair(id string) (model.KeyPair, error) {
-	keyPairData, err := s.repo.GenerateKeyPair(id)
+func (s *keyManagementService) Tokens() []model.Token {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	tokens := make([]model.Token, 0, len(s.tokens))
+	for _, entry := range s.tokens {
+		tokens = append(tokens, entry.token)
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		if tokens[i].Name == model.DefaultToken || tokens[j].Name == model.DefaultToken {
+			return tokens[i].Name == model.DefaultToken
+		}
+		return tokens[i].Name < tokens[j].Name
+	})
+	return tokens
+}
+
+func (s *keyManagementService) KeyPolicies() map[model.KeyPurpose]model.KeyPolicy {
+	policies := make(map[model.KeyPurpose]model.KeyPolicy, len(s.policies))
+	for purpose, policy := range s.policies {
+		policies[purpose] = policy
+	}
+	return policies
+}
+
+func (s *keyManagementService) GenerateKeyPair(token, id string, algorithm model.KeyAlgorithm, purpose model.KeyPurpose) (model.KeyPair, error) {
+	if id == model.AttestationKeyLabel {
+		return model.KeyPair{}, fmt.Errorf("key label %s is reserved for the attestation key", id)
+	}
+	policy, ok := s.policies[purpose]
+	if !ok {
+		return model.KeyPair{}, fmt.Errorf("unsupported key purpose: %s", purpose)
+	}
+	repo, err := s.repo(token)
+	if err != nil {
+		return model.KeyPair{}, err
+	}
+	keyPairData, err := repo.GenerateKeyPair(id, algorithm, policy)
 	if err != nil {
 		return model.KeyPair{}, err
 	}
@@ -33,19 +260,51 @@ func (s *keyManagementService) GenerateKeyPair(id string) (model.KeyPair, error)
 	if block == nil {
 		return model.KeyPair{}, fmt.Errorf("failed to decode PEM block")
 	}
-	pubKey, err := x509.ParsePKCS1PublicKey(block.Bytes)
+	pubKey, err := x509.ParsePKIXPublicKey(block.Bytes)
 	if err != nil {
 		return model.KeyPair{}, fmt.Errorf("failed to parse public key: %v", err)
 	}
 
 	return model.KeyPair{
 		ID:        id,
+		Algorithm: keyPairData.Algorithm,
 		PublicKey: pubKey,
 	}, nil
 }
 
-func (s *keyManagementService) GetKeyPair(id string) (model.KeyPair, error) {
-	keyPairData, err := s.repo.FindByID(id)
+func (s *keyManagementService) ImportKeyPair(token, label string, key crypto.Signer, purpose model.KeyPurpose) (model.KeyPair, error) {
+	if label == "" || label == model.AttestationKeyLabel {
+		return model.KeyPair{}, fmt.Errorf("invalid key label %q", label)
+	}
+	policy, ok := s.policies[purpose]
+	if !ok {
+		return model.KeyPair{}, fmt.Errorf("unsupported key purpose: %s", purpose)
+	}
+	if token == "" {
+		token = model.DefaultToken
+	}
+	repo, err := s.repo(token)
+	if err != nil {
+		return model.KeyPair{}, err
+	}
+	keyPairData, err := repo.ImportKeyPair(label, key, policy)
+	if err != nil {
+		return model.KeyPair{}, err
+	}
+	log.Printf("keymanagement: imported %s key pair %s on token %s", purpose, label, token)
+	return model.KeyPair{
+		ID:        label,
+		Algorithm: keyPairData.Algorithm,
+		PublicKey: key.Public(),
+	}, nil
+}
+
+func (s *keyManagementService) GetKeyPair(token, id string) (model.KeyPair, error) {
+	repo, err := s.repo(token)
+	if err != nil {
+		return model.KeyPair{}, err
+	}
+	keyPairData, err := repo.FindByID(id)
 	if err != nil {
 		return model.KeyPair{}, err
 	}
@@ -55,7 +314,7 @@ func (s *keyManagementService) GetKeyPair(id string) (model.KeyPair, error) {
 	if block == nil {
 		return model.KeyPair{}, fmt.Errorf("failed to decode PEM block")
 	}
-	pubKey, err := x509.ParsePKCS1PublicKey(block.Bytes)
+	pubKey, err := x509.ParsePKIXPublicKey(block.Bytes)
 	if err != nil {
 		return model.KeyPair{}, fmt.Errorf("failed to parse public key: %v", err)
 	}
@@ -63,15 +322,119 @@ func (s *keyManagementService) GetKeyPair(id string) (model.KeyPair, error) {
 	// PrivateKey is managed by SoftHSM.
 	return model.KeyPair{
 		ID:         id,
+		Algorithm:  keyPairData.Algorithm,
 		PublicKey:  pubKey,
 		PrivateKey: nil, // PrivateKey is managed by SoftHSM
 	}, nil
 }
 
-func (s *keyManagementService) GetSigner(keyLabel string) (crypto.Signer, error) {
-	signer, err := s.repo.GetSigner(keyLabel)
+func (s *keyManagementService) GetSigner(token, keyLabel string) (crypto.Signer, error) {
+	repo, err := s.repo(token)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := repo.GetSigner(keyLabel)
 	if err != nil {
 		return nil, err
 	}
 	return signer, nil
 }
+
+func (s *keyManagementService) ListKeys(token string) ([]model.KeyObject, error) {
+	repo, err := s.repo(token)
+	if err != nil {
+		return nil, err
+	}
+	return repo.ListKeys()
+}
+
+func (s *keyManagementService) DisableKey(token, keyLabel string) error {
+	repo, err := s.repo(token)
+	if err != nil {
+		return err
+	}
+	return repo.SetKeyEnabled(keyLabel, false)
+}
+
+func (s *keyManagementService) EnableKey(token, keyLabel string) error {
+	repo, err := s.repo(token)
+	if err != nil {
+		return err
+	}
+	return repo.SetKeyEnabled(keyLabel, true)
+}
+
+func (s *keyManagementService) DestroyKeyPair(token, keyLabel string) error {
+	if token == "" {
+		token = model.DefaultToken
+	}
+	repo, err := s.repo(token)
+	if err != nil {
+		return err
+	}
+	if err := repo.DestroyKeyPair(keyLabel); err != nil {
+		return err
+	}
+	log.Printf("keymanagement: destroyed key pair %s on token %s", keyLabel, token)
+	return nil
+}
+
+func (s *keyManagementService) Health(token string) (model.HSMHealth, error) {
+	if token == "" {
+		token = model.DefaultToken
+	}
+	repo, err := s.repo(token)
+	if err != nil {
+		return model.HSMHealth{Token: token, LastError: err.Error()}, err
+	}
+	health, err := repo.Health()
+	health.Token = token
+	return health, err
+}
+
+func (s *keyManagementService) MonitorHealth(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	available := make(map[string]bool)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for _, token := range s.Tokens() {
+			wasAvailable, seen := available[token.Name]
+			health, err := s.Health(token.Name)
+			if errors.Is(err, model.ErrTokenLocked) {
+				// Locking and unlocking are logged by the ceremony.
+				delete(available, token.Name)
+				continue
+			}
+			if err != nil && (wasAvailable || !seen) {
+				log.Printf("keymanagement: token %s (slot %d) became unavailable: %v", token.Name, health.Slot, err)
+			} else if err == nil && seen && !wasAvailable {
+				log.Printf("keymanagement: token %s (slot %d, %s) is available again", token.Name, health.Slot, health.TokenLabel)
+			}
+			available[token.Name] = err == nil
+		}
+	}
+}
+
+func (s *keyManagementService) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for name, entry := range s.tokens {
+		if entry.ceremony != nil {
+			entry.ceremony.reset()
+		}
+		if entry.repo != nil {
+			entry.repo.Finalize()
+		}
+		delete(s.tokens, name)
+	}
+}
@@ -0,0 +1,48 @@
+package service
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"io"
+)
+
+// maxRandomRequest bounds a single C_GenerateRandom call.
+const maxRandomRequest = 1024
+
+// tokenRandom reads the random number generator of a token mixed with the
+// operating system RNG.
+type tokenRandom struct {
+	s     *keyManagementService
+	token string
+}
+
+// Random returns a reader of the token's random number generator mixed with
+// the operating system RNG.
+func (s *keyManagementService) Random(token string) io.Reader {
+	return tokenRandom{s: s, token: token}
+}
+
+// Read fills p with token random bytes XORed with operating system random
+// bytes, so the output is as unpredictable as the better of the two sources.
+// It fails rather than fall back to the operating system alone when the
+// token is unavailable.
+func (r tokenRandom) Read(p []byte) (int, error) {
+	repo, err := r.s.repo(r.token)
+	if err != nil {
+		return 0, err
+	}
+	for n := 0; n < len(p); {
+		chunk := p[n:min(len(p), n+maxRandomRequest)]
+		random, err := repo.GenerateRandom(len(chunk))
+		if err != nil {
+			return n, err
+		}
+		if _, err := rand.Read(chunk); err != nil {
+			return n, err
+		}
+		subtle.XORBytes(chunk, chunk, random)
+		clear(random)
+		n += len(chunk)
+	}
+	return len(p), nil
+}
@@ -0,0 +1,120 @@
+// Package shamir implements Shamir's secret sharing over GF(2^8).
+//
+// Each share is one byte holding its x coordinate followed by one byte per
+// secret byte, the values at x of random polynomials whose constant terms are
+// the secret bytes.
+package shamir
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+)
+
+// exp and log tables of GF(2^8) with the AES polynomial x^8+x^4+x^3+x+1 and generator 3.
+var expTable, logTable = func() ([510]byte, [256]byte) {
+	var exp [510]byte
+	var log [256]byte
+	x := byte(1)
+	for i := 0; i < 255; i++ {
+		exp[i] = x
+		exp[i+255] = x
+		log[x] = byte(i)
+		// x *= 3
+		hi := x & 0x80
+		x ^= x << 1
+		if hi != 0 {
+			x ^= 0x1b
+		}
+	}
+	return exp, log
+}()
+
+func mul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return expTable[int(logTable[a])+int(logTable[b])]
+}
+
+func div(a, b byte) byte {
+	if a == 0 {
+		return 0
+	}
+	return expTable[int(logTable[a])+255-int(logTable[b])]
+}
+
+// Split divides secret into parts shares, any threshold of which recover it.
+func Split(secret []byte, parts, threshold int) ([][]byte, error) {
+	switch {
+	case len(secret) == 0:
+		return nil, errors.New("secret is empty")
+	case threshold < 2:
+		return nil, errors.New("threshold must be at least 2")
+	case parts < threshold:
+		return nil, errors.New("parts must not be less than threshold")
+	case parts > 255:
+		return nil, errors.New("parts must not exceed 255")
+	}
+
+	shares := make([][]byte, parts)
+	for i := range shares {
+		shares[i] = make([]byte, len(secret)+1)
+		shares[i][0] = byte(i + 1)
+	}
+
+	coefficients := make([]byte, threshold)
+	for j, s := range secret {
+		coefficients[0] = s
+		if _, err := rand.Read(coefficients[1:]); err != nil {
+			return nil, fmt.Errorf("failed to generate coefficients: %w", err)
+		}
+		for _, share := range shares {
+			// Horner's rule
+			x, y := share[0], byte(0)
+			for k := threshold - 1; k >= 0; k-- {
+				y = mul(y, x) ^ coefficients[k]
+			}
+			share[j+1] = y
+		}
+	}
+	clear(coefficients)
+	return shares, nil
+}
+
+// Combine recovers the secret from shares produced by Split. Fewer shares
+// than the threshold yield a wrong secret rather than an error.
+func Combine(shares [][]byte) ([]byte, error) {
+	if len(shares) < 2 {
+		return nil, errors.New("at least 2 shares are required")
+	}
+	size := len(shares[0])
+	if size < 2 {
+		return nil, errors.New("share is too short")
+	}
+	seen := make(map[byte]bool, len(shares))
+	for _, share := range shares {
+		if len(share) != size {
+			return nil, errors.New("shares have different lengths")
+		}
+		if share[0] == 0 || seen[share[0]] {
+			return nil, fmt.Errorf("invalid or duplicate share index %d", share[0])
+		}
+		seen[share[0]] = true
+	}
+
+	secret := make([]byte, size-1)
+	for i, si := range shares {
+		// Lagrange basis polynomial of share i evaluated at x = 0
+		basis := byte(1)
+		for j, sj := range shares {
+			if i != j {
+				basis = mul(basis, div(sj[0], sj[0]^si[0]))
+			}
+		}
+		for k := range secret {
+			secret[k] ^= mul(basis, si[k+1])
+		}
+	}
+	return secret, nil
+}
@@ -0,0 +1,123 @@
+package shamir
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand/v2"
+	"testing"
+)
+
+var secret = []byte("correct horse battery staple")
+
+func TestSplitCombine(t *testing.T) {
+	for _, tc := range []struct{ parts, threshold int }{
+		{2, 2}, {3, 2}, {3, 3}, {5, 3}, {7, 4}, {10, 10}, {255, 5},
+	} {
+		t.Run(fmt.Sprintf("%d-of-%d", tc.threshold, tc.parts), func(t *testing.T) {
+			shares, err := Split(secret, tc.parts, tc.threshold)
+			if err != nil {
+				t.Fatalf("Split: %v", err)
+			}
+			if len(shares) != tc.parts {
+				t.Fatalf("got %d shares, want %d", len(shares), tc.parts)
+			}
+
+			// Any threshold shares, in any order, and more than threshold recover the secret
+			for range 10 {
+				perm := rand.Perm(tc.parts)
+				for _, n := range []int{tc.threshold, tc.parts} {
+					subset := make([][]byte, n)
+					for i := range subset {
+						subset[i] = shares[perm[i]]
+					}
+					got, err := Combine(subset)
+					if err != nil {
+						t.Fatalf("Combine(%d shares): %v", n, err)
+					}
+					if !bytes.Equal(got, secret) {
+						t.Fatalf("Combine(%d shares) = %q, want %q", n, got, secret)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestCombineFewerThanThreshold(t *testing.T) {
+	shares, err := Split(secret, 5, 3)
+	if err != nil {
+		t.Fatalf("Split: %v", err)
+	}
+	got, err := Combine(shares[:2])
+	if err != nil {
+		t.Fatalf("Combine: %v", err)
+	}
+	if bytes.Equal(got, secret) {
+		t.Error("2 shares of a 3-of-5 split recovered the secret")
+	}
+	if _, err := Combine(shares[:1]); err == nil {
+		t.Error("Combine of a single share succeeded")
+	}
+}
+
+func TestCombineRejectsMalformedShares(t *testing.T) {
+	shares, err := Split(secret, 5, 3)
+	if err != nil {
+		t.Fatalf("Split: %v", err)
+	}
+
+	duplicate := [][]byte{shares[0], shares[1], shares[0]}
+	if _, err := Combine(duplicate); err == nil {
+		t.Error("Combine accepted a duplicate share")
+	}
+	zeroIndex := bytes.Clone(shares[2])
+	zeroIndex[0] = 0
+	if _, err := Combine([][]byte{shares[0], shares[1], zeroIndex}); err == nil {
+		t.Error("Combine accepted a share with index 0")
+	}
+	if _, err := Combine([][]byte{shares[0], shares[1], shares[2][:len(shares[2])-1]}); err == nil {
+		t.Error("Combine accepted shares of different lengths")
+	}
+	if _, err := Combine([][]byte{{1}, {2}}); err == nil {
+		t.Error("Combine accepted shares without data")
+	}
+}
+
+func TestCombineCorruptedShare(t *testing.T) {
+	shares, err := Split(secret, 5, 3)
+	if err != nil {
+		t.Fatalf("Split: %v", err)
+	}
+	corrupted := bytes.Clone(shares[1])
+	corrupted[5] ^= 0x80
+	got, err := Combine([][]byte{shares[0], corrupted, shares[2]})
+	if err != nil {
+		t.Fatalf("Combine: %v", err)
+	}
+	if bytes.Equal(got, secret) {
+		t.Error("a corrupted share still recovered the secret")
+	}
+	// Only the corrupted byte position differs
+	for i := range secret {
+		if (got[i] != secret[i]) != (i == 4) {
+			t.Errorf("byte %d: got %#x, secret %#x", i, got[i], secret[i])
+		}
+	}
+}
+
+func TestSplitRejectsInvalidParameters(t *testing.T) {
+	for _, tc := range []struct {
+		name             string
+		secret           []byte
+		parts, threshold int
+	}{
+		{"empty secret", nil, 3, 2},
+		{"threshold 1", secret, 3, 1},
+		{"fewer parts than threshold", secret, 2, 3},
+		{"too many parts", secret, 256, 2},
+	} {
+		if _, err := Split(tc.secret, tc.parts, tc.threshold); err == nil {
+			t.Errorf("%s: Split succeeded", tc.name)
+		}
+	}
+}
@@ -0,0 +1,283 @@
+// Package signer serves the keys of a token to CA instances on other hosts
+// over the remote signer protocol (see model.RemoteSignRequest), so that the
+// network-facing CA API and the HSM do not have to share a host. The CA side
+// of the protocol is repository.NewRemoteKeyPairRepository.
+package signer
+
+import (
+	"core-ca/keymanagement/model"
+	"core-ca/keymanagement/repository"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+)
+
+const (
+	// maxRequest bounds the size of a request body.
+	maxRequest = 64 << 10
+	// maxRandom bounds a single random request.
+	maxRandom = 1024
+)
+
+// errInvalidRequest is returned for requests that cannot be served as sent.
+var errInvalidRequest = errors.New("invalid request")
+
+// hashes are the digests a signature may be requested for, by crypto.Hash name.
+var hashes = map[string]crypto.Hash{
+	crypto.SHA1.String():   crypto.SHA1,
+	crypto.SHA224.String(): crypto.SHA224,
+	crypto.SHA256.String(): crypto.SHA256,
+	crypto.SHA384.String(): crypto.SHA384,
+	crypto.SHA512.String(): crypto.SHA512,
+}
+
+// Options controls what clients of the signing daemon may do.
+type Options struct {
+	// AllowGenerate lets clients generate key pairs, which creating a CA
+	// through the daemon needs. Other key management is only done on the
+	// signer host.
+	AllowGenerate bool
+	// AllowedClients restricts clients to certificates with these subject
+	// common names. Empty allows every certificate the TLS configuration
+	// accepts.
+	AllowedClients []string
+}
+
+type server struct {
+	repo repository.KeyPairRepository
+	opts Options
+}
+
+// ServerTLSConfig returns the TLS configuration of the signing daemon: it
+// presents the certificate in certFile and requires client certificates
+// issued by the CA certificates in clientCAFile.
+func ServerTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load signer certificate: %w", err)
+	}
+	caPEM, err := os.ReadFile(clientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client CA certificate: %w", err)
+	}
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no certificate found in %s", clientCAFile)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// NewHandler returns the remote signer protocol handler for repo. It must be
+// served over TLS with verified client certificates (see ServerTLSConfig);
+// requests without one are refused.
+func NewHandler(repo repository.KeyPairRepository, opts Options) http.Handler {
+	s := &server{repo: repo, opts: opts}
+	mux := http.NewServeMux()
+	mux.Handle("POST /v1/sign", operation(s.sign))
+	mux.Handle("POST /v1/public-key", operation(s.publicKey))
+	mux.Handle("POST /v1/key-pair", operation(s.keyPair))
+	mux.Handle("POST /v1/list", operation(s.list))
+	mux.Handle("POST /v1/describe", operation(s.describe))
+	mux.Handle("POST /v1/generate", operation(s.generate))
+	mux.Handle("POST /v1/random", operation(s.random))
+	mux.Handle("POST /v1/health", operation(s.health))
+	return s.authorize(mux)
+}
+
+// authorize refuses clients without a certificate or with one whose common
+// name is not allowed.
+func (s *server) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+			writeJSON(w, http.StatusUnauthorized, &model.RemoteError{Message: "client certificate required"})
+			return
+		}
+		client := r.TLS.PeerCertificates[0].Subject.CommonName
+		if len(s.opts.AllowedClients) > 0 && !slices.Contains(s.opts.AllowedClients, client) {
+			log.Printf("signer: refused client %q from %s", client, r.RemoteAddr)
+			writeJSON(w, http.StatusForbidden, &model.RemoteError{Message: fmt.Sprintf("client %q is not allowed", client)})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// operation adapts a protocol operation to an HTTP handler: it decodes the
+// JSON request, runs fn for the client named by its certificate and writes
+// the result or a model.RemoteError.
+func operation[Req any](fn func(client string, req Req) (any, error)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req Req
+		if err := json.NewDecoder(io.LimitReader(r.Body, maxRequest)).Decode(&req); err != nil {
+			writeJSON(w, http.StatusBadRequest, &model.RemoteError{Message: "invalid request: " + err.Error()})
+			return
+		}
+		resp, err := fn(r.TLS.PeerCertificates[0].Subject.CommonName, req)
+		if err != nil {
+			status := errorStatus(err)
+			if status >= http.StatusInternalServerError {
+				log.Printf("signer: %s: %v", r.URL.Path, err)
+			}
+			writeJSON(w, status, model.NewRemoteError(err))
+			return
+		}
+		writeJSON(w, http.StatusOK, resp)
+	})
+}
+
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, errInvalidRequest):
+		return http.StatusBadRequest
+	case errors.Is(err, model.ErrKeyNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, model.ErrKeyDisabled):
+		return http.StatusForbidden
+	case errors.Is(err, model.ErrKeyExists):
+		return http.StatusConflict
+	case errors.Is(err, model.ErrTokenLocked):
+		return http.StatusLocked
+	case errors.Is(err, model.ErrNotSupported):
+		return http.StatusNotImplemented
+	case errors.Is(err, model.ErrHSMUnavailable):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("signer: failed to write response: %v", err)
+	}
+}
+
+func (s *server) sign(client string, req model.RemoteSignRequest) (any, error) {
+	var hash crypto.Hash
+	if req.Hash != "" {
+		var ok bool
+		if hash, ok = hashes[req.Hash]; !ok {
+			return nil, fmt.Errorf("%w: unsupported hash %s", errInvalidRequest, req.Hash)
+		}
+		if len(req.Digest) != hash.Size() {
+			return nil, fmt.Errorf("%w: digest length %d does not match hash %s", errInvalidRequest, len(req.Digest), hash)
+		}
+	}
+	var opts crypto.SignerOpts = hash
+	if req.PSS {
+		opts = &rsa.PSSOptions{SaltLength: req.SaltLength, Hash: hash}
+	}
+
+	signer, err := s.repo.GetSigner(req.Label)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := signer.Sign(rand.Reader, req.Digest, opts)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("signer: %s signed with key %s", client, req.Label)
+	return model.RemoteSignResponse{Signature: signature}, nil
+}
+
+func (s *server) publicKey(client string, req model.RemoteKeyRequest) (any, error) {
+	signer, err := s.repo.GetSigner(req.Label)
+	if err != nil {
+		return nil, err
+	}
+	publicKeyPEM, err := encodePublicKey(signer.Public())
+	if err != nil {
+		return nil, err
+	}
+	return model.RemotePublicKeyResponse{PublicKey: publicKeyPEM}, nil
+}
+
+func (s *server) keyPair(client string, req model.RemoteKeyRequest) (any, error) {
+	return s.repo.FindByID(req.Label)
+}
+
+func (s *server) list(client string, _ struct{}) (any, error) {
+	keys, err := s.repo.ListKeys()
+	if err != nil {
+		return nil, err
+	}
+	if keys == nil {
+		keys = []model.KeyObject{}
+	}
+	return keys, nil
+}
+
+func (s *server) describe(client string, req model.RemoteKeyRequest) (any, error) {
+	key, publicKey, err := s.repo.DescribeKey(req.Label)
+	if err != nil {
+		return nil, err
+	}
+	publicKeyPEM, err := encodePublicKey(publicKey)
+	if err != nil {
+		return nil, err
+	}
+	return model.RemoteDescribeResponse{Key: key, PublicKey: publicKeyPEM}, nil
+}
+
+func (s *server) generate(client string, req model.RemoteGenerateRequest) (any, error) {
+	if !s.opts.AllowGenerate {
+		return nil, fmt.Errorf("%w: key generation is disabled on this signer", model.ErrNotSupported)
+	}
+	if req.Label == "" {
+		return nil, fmt.Errorf("%w: label is required", errInvalidRequest)
+	}
+	if _, err := model.ParseKeyAlgorithm(string(req.Algorithm)); err != nil || req.Algorithm == "" {
+		return nil, fmt.Errorf("%w: unsupported key algorithm %q", errInvalidRequest, req.Algorithm)
+	}
+	keyPairData, err := s.repo.GenerateKeyPair(req.Label, req.Algorithm, req.Policy)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("signer: %s generated %s key pair %s", client, req.Algorithm, req.Label)
+	return keyPairData, nil
+}
+
+func (s *server) random(client string, req model.RemoteRandomRequest) (any, error) {
+	if req.Length <= 0 || req.Length > maxRandom {
+		return nil, fmt.Errorf("%w: random length must be 1 to %d", errInvalidRequest, maxRandom)
+	}
+	random, err := s.repo.GenerateRandom(req.Length)
+	if err != nil {
+		return nil, err
+	}
+	return model.RemoteRandomResponse{Random: random}, nil
+}
+
+func (s *server) health(client string, _ struct{}) (any, error) {
+	health, err := s.repo.Health()
+	if err != nil {
+		return nil, err
+	}
+	return health, nil
+}
+
+// encodePublicKey encodes a public key as PKIX PEM.
+func encodePublicKey(publicKey crypto.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(publicKey)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal public key: %w", err)
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})), nil
+}
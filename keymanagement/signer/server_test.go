@@ -0,0 +1,267 @@
+package signer
+
+import (
+	"core-ca/keymanagement/model"
+	"core-ca/keymanagement/repository"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testPKI issues the certificates of a signing daemon and its clients under
+// one CA and writes them as PEM files.
+type testPKI struct {
+	dir    string
+	caCert *x509.Certificate
+	caKey  *ecdsa.PrivateKey
+	serial int64
+}
+
+func newTestPKI(t *testing.T) *testPKI {
+	t.Helper()
+	p := &testPKI{dir: t.TempDir()}
+	p.caKey, p.caCert = p.issue(t, "ca", "Test Signer CA", nil, nil)
+	return p
+}
+
+// issue creates a certificate for cn, signed by the test CA or self-signed
+// when the CA does not exist yet, and writes name.pem and name-key.pem.
+func (p *testPKI) issue(t *testing.T, name, cn string, ips []net.IP, usage []x509.ExtKeyUsage) (*ecdsa.PrivateKey, *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.serial++
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(p.serial),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  ips,
+		ExtKeyUsage:  usage,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	parent, signer := template, crypto.Signer(key)
+	if p.caCert == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		parent, signer = p.caCert, p.caKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.write(t, name+".pem", "CERTIFICATE", der)
+	p.write(t, name+"-key.pem", "PRIVATE KEY", keyDER)
+	return key, cert
+}
+
+func (p *testPKI) write(t *testing.T, name, blockType string, der []byte) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(p.dir, name), pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (p *testPKI) path(name string) string {
+	return filepath.Join(p.dir, name)
+}
+
+// startSigner serves backend over mutually authenticated TLS and returns its URL.
+func startSigner(t *testing.T, p *testPKI, backend repository.KeyPairRepository, opts Options) string {
+	t.Helper()
+	p.issue(t, "server", "signer.test", []net.IP{net.IPv4(127, 0, 0, 1)}, []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth})
+	tlsConfig, err := ServerTLSConfig(p.path("server.pem"), p.path("server-key.pem"), p.path("ca.pem"))
+	if err != nil {
+		t.Fatalf("ServerTLSConfig: %v", err)
+	}
+	srv := httptest.NewUnstartedServer(NewHandler(backend, opts))
+	srv.TLS = tlsConfig
+	srv.StartTLS()
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+// connect opens the remote repository as the client whose certificate has cn.
+func connect(t *testing.T, p *testPKI, url, cn string) (repository.KeyPairRepository, error) {
+	t.Helper()
+	p.issue(t, cn, cn, nil, []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth})
+	tlsConfig, err := repository.RemoteTLSConfig(p.path("ca.pem"), p.path(cn+".pem"), p.path(cn+"-key.pem"))
+	if err != nil {
+		t.Fatalf("RemoteTLSConfig: %v", err)
+	}
+	return repository.NewRemoteKeyPairRepository(url, tlsConfig, 5*time.Second)
+}
+
+func TestRemoteRejectsClientNotAllowed(t *testing.T) {
+	p := newTestPKI(t)
+	url := startSigner(t, p, repository.NewMemoryKeyPairRepository(), Options{AllowedClients: []string{"ca-api"}})
+
+	_, err := connect(t, p, url, "intruder")
+	if err == nil || !strings.Contains(err.Error(), `client "intruder" is not allowed`) {
+		t.Fatalf("client not in allowed_clients: %v, want it refused", err)
+	}
+
+	repo, err := connect(t, p, url, "ca-api")
+	if err != nil {
+		t.Fatalf("allowed client: %v", err)
+	}
+	repo.Finalize()
+}
+
+func TestRemoteRejectsUntrustedClientCertificate(t *testing.T) {
+	p := newTestPKI(t)
+	url := startSigner(t, p, repository.NewMemoryKeyPairRepository(), Options{AllowedClients: []string{"ca-api"}})
+
+	// A client certificate with an allowed name from another CA fails the handshake
+	other := newTestPKI(t)
+	other.issue(t, "ca-api", "ca-api", nil, []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth})
+	tlsConfig, err := repository.RemoteTLSConfig(p.path("ca.pem"), other.path("ca-api.pem"), other.path("ca-api-key.pem"))
+	if err != nil {
+		t.Fatalf("RemoteTLSConfig: %v", err)
+	}
+	_, err = repository.NewRemoteKeyPairRepository(url, tlsConfig, 5*time.Second)
+	if !errors.Is(err, model.ErrHSMUnavailable) {
+		t.Fatalf("untrusted client certificate: %v, want ErrHSMUnavailable", err)
+	}
+}
+
+func TestRemoteGenerate(t *testing.T) {
+	p := newTestPKI(t)
+	backend := repository.NewMemoryKeyPairRepository()
+	policy := model.DefaultKeyPolicies()[model.KeyPurposeCA]
+
+	denied, err := connect(t, p, startSigner(t, p, backend, Options{}), "ca-api")
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	defer denied.Finalize()
+	if _, err := denied.GenerateKeyPair("ca-key", model.KeyAlgorithmECP256, policy); !errors.Is(err, model.ErrNotSupported) {
+		t.Fatalf("GenerateKeyPair with allow_generate=false: %v, want ErrNotSupported", err)
+	}
+	if _, err := backend.FindByID("ca-key"); !errors.Is(err, model.ErrKeyNotFound) {
+		t.Fatalf("key generated although refused: %v", err)
+	}
+
+	allowed, err := connect(t, p, startSigner(t, p, backend, Options{AllowGenerate: true}), "ca-api")
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	defer allowed.Finalize()
+	if _, err := allowed.GenerateKeyPair("ca-key", model.KeyAlgorithmECP256, policy); err != nil {
+		t.Fatalf("GenerateKeyPair with allow_generate=true: %v", err)
+	}
+	if _, err := allowed.GenerateKeyPair("ca-key", model.KeyAlgorithmECP256, policy); !errors.Is(err, model.ErrKeyExists) {
+		t.Fatalf("GenerateKeyPair of an existing label: %v, want ErrKeyExists", err)
+	}
+}
+
+func TestRemoteSignVerify(t *testing.T) {
+	p := newTestPKI(t)
+	backend := repository.NewMemoryKeyPairRepository()
+	policy := model.DefaultKeyPolicies()[model.KeyPurposeCA]
+	for _, algorithm := range []model.KeyAlgorithm{model.KeyAlgorithmRSA2048, model.KeyAlgorithmECP256, model.KeyAlgorithmECP384} {
+		if _, err := backend.GenerateKeyPair(string(algorithm), algorithm, policy); err != nil {
+			t.Fatalf("GenerateKeyPair %s: %v", algorithm, err)
+		}
+	}
+	repo, err := connect(t, p, startSigner(t, p, backend, Options{AllowedClients: []string{"ca-api"}}), "ca-api")
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	defer repo.Finalize()
+
+	message := []byte("tbsCertificate")
+	sha256Digest := sha256.Sum256(message)
+	sha384Digest := sha512.Sum384(message)
+
+	t.Run("RSA PKCS#1 v1.5", func(t *testing.T) {
+		signer := remoteSigner(t, repo, backend, string(model.KeyAlgorithmRSA2048))
+		signature, err := signer.Sign(rand.Reader, sha256Digest[:], crypto.SHA256)
+		if err != nil {
+			t.Fatalf("Sign: %v", err)
+		}
+		if err := rsa.VerifyPKCS1v15(signer.Public().(*rsa.PublicKey), crypto.SHA256, sha256Digest[:], signature); err != nil {
+			t.Fatalf("verify: %v", err)
+		}
+	})
+	t.Run("RSA PSS", func(t *testing.T) {
+		signer := remoteSigner(t, repo, backend, string(model.KeyAlgorithmRSA2048))
+		opts := &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash, Hash: crypto.SHA256}
+		signature, err := signer.Sign(rand.Reader, sha256Digest[:], opts)
+		if err != nil {
+			t.Fatalf("Sign: %v", err)
+		}
+		if err := rsa.VerifyPSS(signer.Public().(*rsa.PublicKey), crypto.SHA256, sha256Digest[:], signature, opts); err != nil {
+			t.Fatalf("verify: %v", err)
+		}
+	})
+	for _, tc := range []struct {
+		label  model.KeyAlgorithm
+		hash   crypto.Hash
+		digest []byte
+	}{
+		{model.KeyAlgorithmECP256, crypto.SHA256, sha256Digest[:]},
+		{model.KeyAlgorithmECP384, crypto.SHA384, sha384Digest[:]},
+	} {
+		t.Run("ECDSA "+string(tc.label), func(t *testing.T) {
+			signer := remoteSigner(t, repo, backend, string(tc.label))
+			signature, err := signer.Sign(rand.Reader, tc.digest, tc.hash)
+			if err != nil {
+				t.Fatalf("Sign: %v", err)
+			}
+			if !ecdsa.VerifyASN1(signer.Public().(*ecdsa.PublicKey), tc.digest, signature) {
+				t.Fatal("signature does not verify")
+			}
+		})
+	}
+
+	if _, err := repo.GetSigner("missing"); !errors.Is(err, model.ErrKeyNotFound) {
+		t.Errorf("GetSigner of a missing key: %v, want ErrKeyNotFound", err)
+	}
+}
+
+// remoteSigner returns the remote signer of label after checking that it
+// presents the backend's public key.
+func remoteSigner(t *testing.T, repo, backend repository.KeyPairRepository, label string) crypto.Signer {
+	t.Helper()
+	signer, err := repo.GetSigner(label)
+	if err != nil {
+		t.Fatalf("GetSigner %s: %v", label, err)
+	}
+	local, err := backend.GetSigner(label)
+	if err != nil {
+		t.Fatalf("backend GetSigner %s: %v", label, err)
+	}
+	if !local.Public().(interface{ Equal(crypto.PublicKey) bool }).Equal(signer.Public()) {
+		t.Fatalf("remote public key of %s differs from the backend's", label)
+	}
+	return signer
+}